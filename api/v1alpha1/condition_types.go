@@ -16,10 +16,6 @@ limitations under the License.
 
 package v1alpha1
 
-import (
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-)
-
 // ConditionType specifies the available conditions for the resource
 type ConditionType string
 
@@ -30,20 +26,9 @@ const (
 	// ConditionActive specifies that the resource has finished.
 	// For resource which run to completion.
 	ConditionActive ConditionType = "Active"
+	// ConditionDestinationRulesReady specifies that all the overriding destination rules are ready.
+	ConditionDestinationRulesReady ConditionType = "DestinationRulesReady"
+	// ConditionExpired specifies that the TTL of the resource was exceeded (and its resources were
+	// cleaned up).
+	ConditionExpired ConditionType = "Expired"
 )
-
-// Condition describes the state of a DynamicEnv at a certain point.
-type Condition struct {
-	// Type of condition
-	Type ConditionType `json:"type"`
-	// Status of the condition, one of True, False, Unknown.
-	Status metav1.ConditionStatus `json:"status"`
-	// The last time this condition was updated.
-	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
-	// Last time the condition transitioned from one status to another.
-	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
-	// The reason for the condition's last transition.
-	Reason string `json:"reason,omitempty"`
-	// A human-readable message indicating details about the transition.
-	Message string `json:"message,omitempty"`
-}
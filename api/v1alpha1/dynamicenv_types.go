@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -27,6 +28,7 @@ import (
 
 type LifeCycleStatus string
 type GlobalReadyStatus string
+type DynamicEnvPhase string
 type SubsetOrConsumer int
 
 const (
@@ -39,12 +41,34 @@ const (
 	Updating         LifeCycleStatus = "updating"
 	IgnoredMissingDR LifeCycleStatus = "ignored-missing-destination-rule"
 	IgnoredMissingVS LifeCycleStatus = "ignored-missing-virtual-service"
+	AmbiguousBaseDR  LifeCycleStatus = "ambiguous-base-destination-rule"
+	Conflicting      LifeCycleStatus = "conflicting" // The resource already exists but belongs to another owner
+	// The base DestinationRule exists but has no subset with the default version (so it's ignored)
+	MissingDefaultSubset LifeCycleStatus = "missing-default-subset"
+	// The controller is not allowed to create resources in the target namespace
+	NamespaceNotAllowed LifeCycleStatus = "namespace-not-allowed"
+	// The resource is being deleted (e.g. while the DynamicEnv is cleaned up)
+	Terminating LifeCycleStatus = "terminating"
+	// The base DestinationRule opted out of being overridden (so it's ignored)
+	OptedOut LifeCycleStatus = "opted-out"
+	// The service host was excluded from the subset (see `Subset.ExcludedHosts`)
+	Excluded LifeCycleStatus = "excluded"
 
 	// Statuses for the global readiness (argocd ready check)
 	Degraded   GlobalReadyStatus = "degraded"
 	Ready      GlobalReadyStatus = "ready"
 	Processing GlobalReadyStatus = "processing"
 
+	// The overall phase of the DynamicEnv, derived from the statuses of all its resources (see
+	// `handlers.ComputeDynamicEnvPhase` for the precedence rules).
+	PhaseProcessing DynamicEnvPhase = "Processing"
+	PhaseReady      DynamicEnvPhase = "Ready"
+	PhaseDegraded   DynamicEnvPhase = "Degraded"
+	PhaseMissing    DynamicEnvPhase = "Missing"
+	// The TTL of the DynamicEnv was exceeded and its resources were cleaned up (see
+	// `DynamicEnvSpec.TTLSecondsAfterCreation`)
+	PhaseExpired DynamicEnvPhase = "Expired"
+
 	// Whether it's consumer or subset.
 	SUBSET   SubsetOrConsumer = iota
 	CONSUMER SubsetOrConsumer = iota
@@ -69,6 +93,20 @@ func (s LifeCycleStatus) String() string {
 		return string(IgnoredMissingDR)
 	case IgnoredMissingVS:
 		return string(IgnoredMissingVS)
+	case AmbiguousBaseDR:
+		return string(AmbiguousBaseDR)
+	case Conflicting:
+		return string(Conflicting)
+	case MissingDefaultSubset:
+		return string(MissingDefaultSubset)
+	case NamespaceNotAllowed:
+		return string(NamespaceNotAllowed)
+	case Terminating:
+		return string(Terminating)
+	case OptedOut:
+		return string(OptedOut)
+	case Excluded:
+		return string(Excluded)
 	}
 	return defaultResult
 }
@@ -89,6 +127,20 @@ func ParseLifeCycleStatus(s string) LifeCycleStatus {
 		return IgnoredMissingDR
 	case string(IgnoredMissingVS):
 		return IgnoredMissingVS
+	case string(AmbiguousBaseDR):
+		return AmbiguousBaseDR
+	case string(Conflicting):
+		return Conflicting
+	case string(MissingDefaultSubset):
+		return MissingDefaultSubset
+	case string(NamespaceNotAllowed):
+		return NamespaceNotAllowed
+	case string(Terminating):
+		return Terminating
+	case string(OptedOut):
+		return OptedOut
+	case string(Excluded):
+		return Excluded
 	}
 	return Unknown
 }
@@ -107,7 +159,7 @@ func (s *LifeCycleStatus) UnmarshalJSON(data []byte) error {
 }
 
 func (s *LifeCycleStatus) IsFailedStatus() bool {
-	return *s == Missing || *s == Failed
+	return *s == Missing || *s == Failed || *s == AmbiguousBaseDR || *s == Conflicting || *s == NamespaceNotAllowed
 }
 
 func (s *GlobalReadyStatus) String() string {
@@ -149,6 +201,7 @@ func (s *GlobalReadyStatus) UnmarshalJSON(data []byte) error {
 //+kubebuilder:subresource:status
 //+kubebuilder:resource:path=dynamicenvs,scope=Namespaced,shortName=de
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.state",description="Status of the DynamicEnv"
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase",description="The overall phase of the DynamicEnv resources"
 // +kubebuilder:printcolumn:name="Desired",type="integer",JSONPath=".status.totalCount",description="displays desired subsets and consumers count"
 // +kubebuilder:printcolumn:name="Current",type="integer",JSONPath=".status.totalReady",description="displays how many subsets and consumers are available"
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
@@ -176,6 +229,14 @@ type DynamicEnvSpec struct {
 	// deployments with custom image and/or settings. However, since they are only consumers no virtual service or
 	// destination route will be pointing to them.
 	Consumers []Subset `json:"consumers,omitempty"`
+
+	// Expire the dynamic environment this many seconds after its creation (e.g. for forgotten
+	// preview environments): its deployments, destination rules and virtual service routes are
+	// cleaned up and its phase is set to Expired, while the DynamicEnv itself is kept. Never expires
+	// if not set.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TTLSecondsAfterCreation *int64 `json:"ttlSecondsAfterCreation,omitempty"`
 }
 
 // specifies a set of criterion to be met in order for the rule to be applied to the HTTP request
@@ -212,6 +273,20 @@ type Subset struct {
 	// conjunction with 'SourceLabels' in the `IstioMatches`.
 	PodLabels map[string]string `json:"podLabels,omitempty"`
 
+	// Additional labels selecting the pods of this subset in the generated DestinationRule subset
+	// (e.g. a `track` label), for services whose subsets are distinguished by more than the version
+	// label. They are added to the pods as well. The version label always selects the unique version
+	// (so the preview pods are still uniquely identified) and can not be overridden.
+	// +optional
+	SubsetSelector map[string]string `json:"subsetSelector,omitempty"`
+
+	// Service hosts of the subset (short or fully qualified) that should not be overridden in this
+	// environment. No DestinationRules or routes are generated for them and they are reported as
+	// excluded. Not applicable to consumers, and not part of the deployment hash as it does not
+	// affect the deployment.
+	// +optional
+	ExcludedHosts []string `json:"excludedHosts,omitempty" hash:"ignore"`
+
 	// Number of deployment replicas. Default is 1. Note: 0 is *invalid*.
 	Replicas *int32 `json:"replicas,omitempty"`
 
@@ -224,6 +299,168 @@ type Subset struct {
 	// Default version for this subset (if different then the global default version). This is the
 	// version that will get the default route.
 	DefaultVersion string `json:"defaultVersion,omitempty"`
+
+	// Traffic policy overrides applied to the generated subset (merged with the policy inherited
+	// from the base subset). Not part of the deployment hash as it does not affect the deployment.
+	// +optional
+	TrafficPolicy *SubsetTrafficPolicy `json:"trafficPolicy,omitempty" hash:"ignore"`
+
+	// The percentage (1-100) of the matching traffic routed to this subset, the rest is routed to
+	// the default version (e.g. 10 for a gradual rollout). Defaults to 100. Not applicable to
+	// consumers, and not part of the deployment hash as it does not affect the deployment.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	Weight *int32 `json:"weight,omitempty" hash:"ignore"`
+}
+
+// Traffic policy settings that could be overridden per subset
+type SubsetTrafficPolicy struct {
+	// Connection pool overrides (only the specified values override the inherited ones)
+	// +optional
+	ConnectionPool *ConnectionPoolSettings `json:"connectionPool,omitempty"`
+
+	// Load balancer settings (replacing the inherited ones), e.g. consistent hashing for sticky
+	// sessions
+	// +optional
+	LoadBalancer *LoadBalancerSettings `json:"loadBalancer,omitempty"`
+
+	// TLS origination settings (replacing the inherited ones), e.g. for external HTTPS hosts
+	// +optional
+	TLS *ClientTLSSettings `json:"tls,omitempty"`
+
+	// Overrides of the settings of specific ports, merged by port number into the port level
+	// settings inherited from the base subset (e.g. mTLS on one port and plaintext on another)
+	// +optional
+	PortLevelSettings []PortTrafficPolicy `json:"portLevelSettings,omitempty"`
+}
+
+// Traffic policy settings that could be overridden per port of the generated subset
+type PortTrafficPolicy struct {
+	// The number of the port the settings apply to
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port uint32 `json:"port"`
+
+	// Connection pool overrides of the port (only the specified values override the inherited ones)
+	// +optional
+	ConnectionPool *ConnectionPoolSettings `json:"connectionPool,omitempty"`
+
+	// Load balancer settings of the port (replacing the inherited ones)
+	// +optional
+	LoadBalancer *LoadBalancerSettings `json:"loadBalancer,omitempty"`
+
+	// TLS settings of the port (replacing the inherited ones)
+	// +optional
+	TLS *ClientTLSSettings `json:"tls,omitempty"`
+}
+
+// A subset of the Istio client TLS settings, used to originate TLS connections to the upstream
+// hosts
+type ClientTLSSettings struct {
+	// The TLS mode (one of DISABLE, SIMPLE, MUTUAL or ISTIO_MUTUAL).
+	Mode string `json:"mode"`
+
+	// The SNI presented to the server during the TLS handshake (required for SIMPLE and MUTUAL).
+	// +optional
+	SNI string `json:"sni,omitempty"`
+
+	// The name of the secret holding the client certificate, key and CA certificates.
+	// +optional
+	CredentialName string `json:"credentialName,omitempty"`
+
+	// The path of the file holding the CA certificates used to verify the server certificate.
+	// +optional
+	CaCertificates string `json:"caCertificates,omitempty"`
+
+	// Alternate names used to verify the subject identity of the server certificate.
+	// +optional
+	SubjectAltNames []string `json:"subjectAltNames,omitempty"`
+}
+
+// A subset of the Istio load balancer settings. Exactly one of `simple` and `consistentHash` should
+// be specified.
+type LoadBalancerSettings struct {
+	// Standard load balancing algorithm (one of ROUND_ROBIN, LEAST_CONN, LEAST_REQUEST, RANDOM or
+	// PASSTHROUGH).
+	// +optional
+	Simple string `json:"simple,omitempty"`
+
+	// Soft session affinity based on a hash key.
+	// +optional
+	ConsistentHash *ConsistentHashLB `json:"consistentHash,omitempty"`
+}
+
+// The hash key of consistent hash load balancing. Exactly one of the keys should be specified.
+type ConsistentHashLB struct {
+	// Hash based on a specific HTTP header.
+	// +optional
+	HTTPHeaderName string `json:"httpHeaderName,omitempty"`
+
+	// Hash based on HTTP cookie.
+	// +optional
+	HTTPCookie *HTTPCookie `json:"httpCookie,omitempty"`
+
+	// Hash based on the source IP address.
+	// +optional
+	UseSourceIP bool `json:"useSourceIp,omitempty"`
+
+	// Hash based on a specific HTTP query parameter.
+	// +optional
+	HTTPQueryParameterName string `json:"httpQueryParameterName,omitempty"`
+}
+
+// Describes an HTTP cookie that will be used as the hash key for consistent hash load balancing.
+type HTTPCookie struct {
+	// Name of the cookie.
+	Name string `json:"name"`
+
+	// Path to set for the cookie.
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// Lifetime of the cookie (e.g. 1h). A generated cookie is a session cookie if 0.
+	TTL metav1.Duration `json:"ttl"`
+}
+
+// A subset of the Istio connection pool settings
+type ConnectionPoolSettings struct {
+	// TCP connection pool settings
+	// +optional
+	TCP *TCPConnectionPool `json:"tcp,omitempty"`
+
+	// HTTP connection pool settings
+	// +optional
+	HTTP *HTTPConnectionPool `json:"http,omitempty"`
+}
+
+type TCPConnectionPool struct {
+	// Maximum number of HTTP1 /TCP connections to a destination host.
+	// +optional
+	MaxConnections int32 `json:"maxConnections,omitempty"`
+
+	// TCP connection timeout (e.g. 30ms).
+	// +optional
+	ConnectTimeout *metav1.Duration `json:"connectTimeout,omitempty"`
+}
+
+type HTTPConnectionPool struct {
+	// Maximum number of requests that will be queued while waiting for a ready connection pool
+	// connection.
+	// +optional
+	HTTP1MaxPendingRequests int32 `json:"http1MaxPendingRequests,omitempty"`
+
+	// Maximum number of active requests to a destination.
+	// +optional
+	HTTP2MaxRequests int32 `json:"http2MaxRequests,omitempty"`
+
+	// Maximum number of requests per connection to a backend.
+	// +optional
+	MaxRequestsPerConnection int32 `json:"maxRequestsPerConnection,omitempty"`
+
+	// Maximum number of retries that can be outstanding to all hosts in a cluster at a given time.
+	// +optional
+	MaxRetries int32 `json:"maxRetries,omitempty"`
 }
 
 // Defines the details of the container on which changes need to be made
@@ -251,14 +488,19 @@ type ContainerOverrides struct {
 // DynamicEnvStatus defines the observed state of DynamicEnv
 type DynamicEnvStatus struct {
 	// Represents the latest available observations of a deployment's current state.
-	Conditions      []Condition               `json:"conditions,omitempty"`
+	Conditions      []metav1.Condition        `json:"conditions,omitempty"`
 	SubsetsStatus   map[string]SubsetStatus   `json:"subsetsStatus"`
 	ConsumersStatus map[string]ConsumerStatus `json:"consumersStatus,omitempty"`
 	State           GlobalReadyStatus         `json:"state,omitempty"`
+	// The overall phase of all the resources (one of Processing, Ready, Degraded, Missing, Expired)
+	Phase DynamicEnvPhase `json:"phase,omitempty"`
 	// desired subsets and consumers count
 	TotalCount int `json:"totalCount,omitempty"`
 	// number of available subsets and consumers
 	TotalReady int `json:"totalReady"`
+	// The generation of the DynamicEnv the status was last written for
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -310,12 +552,32 @@ type ResourceStatus struct {
 	Name string `json:"name"`
 	// The namespace where the resource is created
 	Namespace string `json:"namespace"`
+	// The service host the resource was generated for (DestinationRules and VirtualServices)
+	ServiceHost string `json:"serviceHost,omitempty"`
 	// The life cycle status of the resource
 	Status LifeCycleStatus `json:"status"`
+	// When the base resource was first found missing (DestinationRules waiting for, or ignored
+	// without, their base DestinationRule)
+	MissingSince *metav1.Time `json:"missingSince,omitempty"`
+	// The latest transitions of the life cycle status, oldest first (only recorded when enabled, see
+	// `--status-transition-history`)
+	// +optional
+	Transitions []StatusTransition `json:"transitions,omitempty"`
+}
+
+// StatusTransition records a change of the life cycle status of a resource
+type StatusTransition struct {
+	// The previous status
+	From LifeCycleStatus `json:"from"`
+	// The new status
+	To LifeCycleStatus `json:"to"`
+	// When the change was recorded
+	At metav1.Time `json:"at"`
 }
 
 func (rs ResourceStatus) IsEqual(other ResourceStatus) bool {
-	return rs.Name == other.Name && rs.Namespace == other.Namespace && rs.Status == other.Status
+	return rs.Name == other.Name && rs.Namespace == other.Namespace && rs.ServiceHost == other.ServiceHost &&
+		rs.Status == other.Status
 }
 
 // StatusError shows an error we want to display in the status with the last time it happened. This
@@ -344,6 +606,38 @@ func NewStatusError(error string) StatusError {
 	}
 }
 
+// UniqueVersion returns the version (label value) of the resources we launch for this DynamicEnv
+// (the namespace and name, truncated if required).
+func (de *DynamicEnv) UniqueVersion() string {
+	name := de.Name
+	ns := de.Namespace
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	if len(ns) > 20 {
+		ns = ns[:20]
+	}
+	return fmt.Sprintf("%s-%s", ns, name)
+}
+
+// ExpiresAt returns when the DynamicEnv expires according to its TTLSecondsAfterCreation (false if
+// it never expires).
+func (de *DynamicEnv) ExpiresAt() (time.Time, bool) {
+	if de.Spec.TTLSecondsAfterCreation == nil {
+		return time.Time{}, false
+	}
+	return de.CreationTimestamp.Add(time.Duration(*de.Spec.TTLSecondsAfterCreation) * time.Second), true
+}
+
+// HashInclude omits an empty subset selector from the subset hash, so the hashes of subsets that
+// don't use it (and the deployments already launched for them) are not affected by it.
+func (s Subset) HashInclude(field string, _ interface{}) (bool, error) {
+	if field == "SubsetSelector" {
+		return len(s.SubsetSelector) > 0, nil
+	}
+	return true, nil
+}
+
 func (co ContainerOverrides) IsEmpty() bool {
 	return reflect.DeepEqual(co, ContainerOverrides{})
 }
@@ -18,9 +18,12 @@ package v1alpha1_test
 
 import (
 	"encoding/json"
+	"time"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var _ = Describe("Life Cycle Status", func() {
@@ -38,6 +41,13 @@ var _ = Describe("Life Cycle Status", func() {
 		Entry("updating status", riskifiedv1alpha1.Updating, "updating"),
 		Entry("ignored missing destination rule", riskifiedv1alpha1.IgnoredMissingDR, "ignored-missing-destination-rule"),
 		Entry("ignored missing virtual service", riskifiedv1alpha1.IgnoredMissingVS, "ignored-missing-virtual-service"),
+		Entry("ambiguous base destination rule", riskifiedv1alpha1.AmbiguousBaseDR, "ambiguous-base-destination-rule"),
+		Entry("conflicting", riskifiedv1alpha1.Conflicting, "conflicting"),
+		Entry("missing default subset", riskifiedv1alpha1.MissingDefaultSubset, "missing-default-subset"),
+		Entry("namespace not allowed", riskifiedv1alpha1.NamespaceNotAllowed, "namespace-not-allowed"),
+		Entry("terminating", riskifiedv1alpha1.Terminating, "terminating"),
+		Entry("opted out", riskifiedv1alpha1.OptedOut, "opted-out"),
+		Entry("excluded", riskifiedv1alpha1.Excluded, "excluded"),
 	)
 
 	It("invalid status produces unknown", func() {
@@ -125,7 +135,33 @@ var _ = Describe("Global Ready Status", func() {
 		Entry("unknown is not failed", riskifiedv1alpha1.Unknown, false),
 		Entry("ignored missing DR is not failed", riskifiedv1alpha1.IgnoredMissingDR, false),
 		Entry("ignored missing VS is not failed", riskifiedv1alpha1.IgnoredMissingVS, false),
+		Entry("ambiguous base DR is failed", riskifiedv1alpha1.AmbiguousBaseDR, true),
+		Entry("conflicting is failed", riskifiedv1alpha1.Conflicting, true),
+		Entry("missing default subset is not failed", riskifiedv1alpha1.MissingDefaultSubset, false),
+		Entry("namespace not allowed is failed", riskifiedv1alpha1.NamespaceNotAllowed, true),
+		Entry("terminating is not failed", riskifiedv1alpha1.Terminating, false),
 		Entry("missing is failed", riskifiedv1alpha1.Missing, true),
 		Entry("failed is failed", riskifiedv1alpha1.Failed, true),
 	)
 })
+
+var _ = Describe("DynamicEnv expiry", func() {
+	created := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	It("never expires without a TTL", func() {
+		de := riskifiedv1alpha1.DynamicEnv{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(created)}}
+		_, ok := de.ExpiresAt()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("expires the TTL seconds after its creation", func() {
+		ttl := int64(3600)
+		de := riskifiedv1alpha1.DynamicEnv{
+			ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(created)},
+			Spec:       riskifiedv1alpha1.DynamicEnvSpec{TTLSecondsAfterCreation: &ttl},
+		}
+		expiresAt, ok := de.ExpiresAt()
+		Expect(ok).To(BeTrue())
+		Expect(expiresAt).To(Equal(created.Add(time.Hour)))
+	})
+})
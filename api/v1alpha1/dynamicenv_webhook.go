@@ -17,31 +17,145 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"reflect"
+	"strings"
 
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
 // log is for logging in this package.
 var dynamicenvlog = logf.Log.WithName("dynamicenv-resource")
 
+// DefaultSubsetVersion is set as the DefaultVersion of new subsets that do not specify one (see
+// defaultSubsetVersions). Nothing is defaulted if empty.
+var DefaultSubsetVersion string
+
+// The path of the mutating webhook (must match its kubebuilder marker below)
+const mutatingWebhookPath = "/mutate-riskified-com-v1alpha1-dynamicenv"
+
 func (de *DynamicEnv) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return fmt.Errorf("creating the admission decoder: %w", err)
+	}
+	mgr.GetWebhookServer().Register(mutatingWebhookPath, &webhook.Admission{Handler: &dynamicEnvDefaulter{decoder: decoder}})
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(de).
+		WithValidator(&dynamicEnvValidator{client: mgr.GetClient()}).
 		Complete()
 }
 
+//+kubebuilder:webhook:path=/mutate-riskified-com-v1alpha1-dynamicenv,mutating=true,failurePolicy=fail,sideEffects=None,groups=riskified.com,resources=dynamicenvs,verbs=create;update,versions=v1alpha1,name=mdynamicenv.kb.io,admissionReviewVersions=v1
+
+// Defaults the DynamicEnvs (see defaultSubsetVersions) and returns the warnings about the defaulted
+// subsets to the user along with the patch. The defaulting webhook of the builder can't return
+// admission warnings.
+type dynamicEnvDefaulter struct {
+	decoder *admission.Decoder
+}
+
+var _ admission.Handler = &dynamicEnvDefaulter{}
+
+func (d *dynamicEnvDefaulter) Handle(_ context.Context, req admission.Request) admission.Response {
+	de := &DynamicEnv{}
+	if err := d.decoder.Decode(req, de); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	var old *DynamicEnv
+	if len(req.OldObject.Raw) > 0 {
+		old = &DynamicEnv{}
+		if err := d.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+	warnings := de.defaultSubsetVersions(old)
+	marshalled, err := json.Marshal(de)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshalled).WithWarnings(warnings...)
+}
+
+// Sets the DefaultVersion of the subsets that omit it. On updates (`old` is the DynamicEnv before
+// the update, nil on creation) only the added subsets are defaulted, as the default version of the
+// existing subsets is immutable. Returns a warning for each defaulted subset.
+func (de *DynamicEnv) defaultSubsetVersions(old *DynamicEnv) (warnings []string) {
+	if DefaultSubsetVersion == "" {
+		return nil
+	}
+	for i := range de.Spec.Subsets {
+		s := &de.Spec.Subsets[i]
+		if s.DefaultVersion == "" && (old == nil || !containsSubset(old.Spec.Subsets, *s)) {
+			dynamicenvlog.Info("Subset has no default version, using the operator default",
+				"name", de.Name, "subset", s.Namespace+"/"+s.Name, "default-version", DefaultSubsetVersion)
+			warnings = append(warnings, fmt.Sprintf("subset %s/%s has no defaultVersion, using the operator default %q",
+				s.Namespace, s.Name, DefaultSubsetVersion))
+			s.DefaultVersion = DefaultSubsetVersion
+		}
+	}
+	return warnings
+}
+
+// Whether the provided subsets contain a subset with the name and namespace of `subset`
+func containsSubset(subsets []Subset, subset Subset) bool {
+	for _, s := range subsets {
+		if s.Name == subset.Name && s.Namespace == subset.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
 //+kubebuilder:webhook:path=/validate-riskified-com-v1alpha1-dynamicenv,mutating=false,failurePolicy=fail,sideEffects=None,groups=riskified.com,resources=dynamicenvs,verbs=create;update,versions=v1alpha1,name=vdynamicenv.kb.io,admissionReviewVersions=v1
 
 var _ webhook.Validator = &DynamicEnv{}
 
+// Validates the DynamicEnvs (see `DynamicEnv.ValidateCreate` and `DynamicEnv.ValidateUpdate`) and
+// also verifies them against the existing resources with the context of the admission request
+// (see validateUniqueVersion).
+type dynamicEnvValidator struct {
+	client client.Reader
+}
+
+var _ webhook.CustomValidator = &dynamicEnvValidator{}
+
+func (v *dynamicEnvValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	de := obj.(*DynamicEnv)
+	if err := de.ValidateCreate(); err != nil {
+		return err
+	}
+	return de.validateUniqueVersion(ctx, v.client)
+}
+
+func (v *dynamicEnvValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	de := newObj.(*DynamicEnv)
+	if err := de.ValidateUpdate(oldObj); err != nil {
+		return err
+	}
+	return de.validateUniqueVersion(ctx, v.client)
+}
+
+func (v *dynamicEnvValidator) ValidateDelete(_ context.Context, obj runtime.Object) error {
+	return obj.(*DynamicEnv).ValidateDelete()
+}
+
 // ValidateCreate implements webhook.Validator so a webhook will be registered for the type
 func (de *DynamicEnv) ValidateCreate() error {
 	dynamicenvlog.Info("validate create", "name", de.Name)
@@ -123,6 +237,16 @@ func (de *DynamicEnv) validateIstioMatchAnyOf() error {
 
 // Validates certain aspects of the subset. Should be used both on create and update.
 func (de *DynamicEnv) validateSubsetsProperties() error {
+	for _, c := range de.Spec.Consumers {
+		if c.Weight != nil {
+			msg := "weight is only applicable to subsets (consumers are not routed to)"
+			return field.Invalid(field.NewPath("spec").Child("Consumers").Key(c.Name).Child("weight"), *c.Weight, msg)
+		}
+		if len(c.SubsetSelector) > 0 {
+			msg := "subsetSelector is only applicable to subsets (consumers are not routed to)"
+			return field.Invalid(field.NewPath("spec").Child("Consumers").Key(c.Name).Child("subsetSelector"), c.SubsetSelector, msg)
+		}
+	}
 	subsets := append(de.Spec.Subsets, de.Spec.Consumers...)
 	for _, s := range subsets {
 		if s.Replicas != nil && *s.Replicas == 0 {
@@ -141,6 +265,231 @@ func (de *DynamicEnv) validateSubsetsProperties() error {
 			msg := "It seems that not all container names are unique"
 			return field.Invalid(field.NewPath("spec").Child("Subsets").Key(s.Name).Child("initContainers"), s.InitContainers, msg)
 		}
+		selectorPath := field.NewPath("spec").Child("Subsets").Key(s.Name).Child("subsetSelector")
+		if errs := metav1validation.ValidateLabels(s.SubsetSelector, selectorPath); len(errs) > 0 {
+			return errs[0]
+		}
+		if s.Weight != nil && (*s.Weight < 1 || *s.Weight > 100) {
+			path := field.NewPath("spec").Child("Subsets").Key(s.Name).Child("weight")
+			return field.Invalid(path, *s.Weight, "weight must be between 1 and 100")
+		}
+		if s.TrafficPolicy != nil {
+			if err := s.TrafficPolicy.ConnectionPool.Validate(); err != nil {
+				path := field.NewPath("spec").Child("Subsets").Key(s.Name).Child("trafficPolicy").Child("connectionPool")
+				return field.Invalid(path, s.TrafficPolicy.ConnectionPool, err.Error())
+			}
+			if err := s.TrafficPolicy.LoadBalancer.Validate(); err != nil {
+				path := field.NewPath("spec").Child("Subsets").Key(s.Name).Child("trafficPolicy").Child("loadBalancer")
+				return field.Invalid(path, s.TrafficPolicy.LoadBalancer, err.Error())
+			}
+			if err := s.TrafficPolicy.TLS.Validate(); err != nil {
+				path := field.NewPath("spec").Child("Subsets").Key(s.Name).Child("trafficPolicy").Child("tls")
+				return field.Invalid(path, s.TrafficPolicy.TLS, err.Error())
+			}
+			ports := map[uint32]bool{}
+			for i, p := range s.TrafficPolicy.PortLevelSettings {
+				path := field.NewPath("spec").Child("Subsets").Key(s.Name).Child("trafficPolicy").Child("portLevelSettings").Index(i)
+				if err := p.Validate(); err != nil {
+					return field.Invalid(path, p, err.Error())
+				}
+				if ports[p.Port] {
+					return field.Duplicate(path.Child("port"), p.Port)
+				}
+				ports[p.Port] = true
+			}
+		}
+	}
+	return nil
+}
+
+// Verifies that no other DynamicEnv uses our unique version (which is truncated, so it may collide)
+// for any of the service hosts of our subsets: they would share the subset names and version labels
+// of the same hosts and route each other's traffic.
+func (de *DynamicEnv) validateUniqueVersion(ctx context.Context, c client.Reader) error {
+	existing := &DynamicEnvList{}
+	if err := c.List(ctx, existing); err != nil {
+		return errors.NewInternalError(fmt.Errorf("listing existing dynamic environments: %w", err))
+	}
+	version := de.UniqueVersion()
+	var colliding []DynamicEnv
+	for _, other := range existing.Items {
+		if (other.Namespace != de.Namespace || other.Name != de.Name) && other.UniqueVersion() == version {
+			colliding = append(colliding, other)
+		}
+	}
+	if len(colliding) == 0 {
+		return nil
+	}
+	ours := map[string]Subset{}
+	for _, s := range de.Spec.Subsets {
+		hosts, err := subsetHosts(ctx, c, s)
+		if err != nil {
+			return errors.NewInternalError(fmt.Errorf("locating the hosts of subset %s/%s: %w", s.Namespace, s.Name, err))
+		}
+		for _, host := range hosts {
+			ours[host] = s
+		}
+	}
+	for _, other := range colliding {
+		for _, otherSubset := range other.Spec.Subsets {
+			hosts, err := subsetHosts(ctx, c, otherSubset)
+			if err != nil {
+				return errors.NewInternalError(fmt.Errorf("locating the hosts of subset %s/%s: %w", otherSubset.Namespace, otherSubset.Name, err))
+			}
+			for _, host := range hosts {
+				if s, ok := ours[host]; ok {
+					msg := fmt.Sprintf("version %q of subset %s/%s collides with DynamicEnv %s/%s on host %s",
+						version, s.Namespace, s.Name, other.Namespace, other.Name, host)
+					return field.Invalid(field.NewPath("metadata").Child("name"), de.Name, msg)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the hosts (`name.namespace`) of the Services selecting the pods of the subset's deployment
+// (none if the deployment does not exist).
+func subsetHosts(ctx context.Context, c client.Reader, s Subset) ([]string, error) {
+	deployment := &appsv1.Deployment{}
+	if err := c.Get(ctx, types.NamespacedName{Name: s.Name, Namespace: s.Namespace}, deployment); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("fetching deployment: %w", err)
+	}
+	services := &corev1.ServiceList{}
+	if err := c.List(ctx, services, client.InNamespace(s.Namespace)); err != nil {
+		return nil, fmt.Errorf("listing services: %w", err)
+	}
+	var hosts []string
+	for _, service := range services.Items {
+		selector := service.Spec.Selector
+		if len(selector) > 0 && labels.SelectorFromSet(selector).Matches(labels.Set(deployment.Spec.Template.Labels)) {
+			hosts = append(hosts, service.Name+"."+service.Namespace)
+		}
+	}
+	return hosts, nil
+}
+
+// Validate verifies that the connection pool settings are within range. A nil receiver is valid.
+func (c *ConnectionPoolSettings) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.TCP != nil {
+		if c.TCP.MaxConnections < 0 {
+			return fmt.Errorf("tcp.maxConnections must not be negative (got %d)", c.TCP.MaxConnections)
+		}
+		if c.TCP.ConnectTimeout != nil && c.TCP.ConnectTimeout.Duration <= 0 {
+			return fmt.Errorf("tcp.connectTimeout must be positive (got %s)", c.TCP.ConnectTimeout.Duration)
+		}
+	}
+	if c.HTTP != nil {
+		values := map[string]int32{
+			"http1MaxPendingRequests":  c.HTTP.HTTP1MaxPendingRequests,
+			"http2MaxRequests":         c.HTTP.HTTP2MaxRequests,
+			"maxRequestsPerConnection": c.HTTP.MaxRequestsPerConnection,
+			"maxRetries":               c.HTTP.MaxRetries,
+		}
+		for _, name := range []string{"http1MaxPendingRequests", "http2MaxRequests", "maxRequestsPerConnection", "maxRetries"} {
+			if values[name] < 0 {
+				return fmt.Errorf("http.%s must not be negative (got %d)", name, values[name])
+			}
+		}
+	}
+	return nil
+}
+
+// Validate verifies that the port is within range, along with its settings. A nil receiver is valid.
+func (p *PortTrafficPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.Port < 1 || p.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535 (got %d)", p.Port)
+	}
+	if err := p.ConnectionPool.Validate(); err != nil {
+		return fmt.Errorf("port %d: %w", p.Port, err)
+	}
+	if err := p.LoadBalancer.Validate(); err != nil {
+		return fmt.Errorf("port %d: %w", p.Port, err)
+	}
+	if err := p.TLS.Validate(); err != nil {
+		return fmt.Errorf("port %d: %w", p.Port, err)
+	}
+	return nil
+}
+
+// The supported TLS modes of the traffic to the subset hosts
+var tlsModes = []string{"DISABLE", "SIMPLE", "MUTUAL", "ISTIO_MUTUAL"}
+
+// Validate verifies that the TLS mode is known and that an SNI is specified for the modes that
+// originate TLS to (external) hosts. A nil receiver is valid.
+func (t *ClientTLSSettings) Validate() error {
+	if t == nil {
+		return nil
+	}
+	known := false
+	for _, mode := range tlsModes {
+		if t.Mode == mode {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown TLS mode %q (expected one of: %s)", t.Mode, strings.Join(tlsModes, ", "))
+	}
+	if (t.Mode == "SIMPLE" || t.Mode == "MUTUAL") && t.SNI == "" {
+		return fmt.Errorf("tls.sni must be specified for %s mode", t.Mode)
+	}
+	return nil
+}
+
+// The supported simple load balancing algorithms
+var simpleLoadBalancers = []string{"ROUND_ROBIN", "LEAST_CONN", "LEAST_REQUEST", "RANDOM", "PASSTHROUGH"}
+
+// Validate verifies that exactly one load balancing policy (and exactly one hash key for consistent
+// hashing) is specified. A nil receiver is valid.
+func (l *LoadBalancerSettings) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if (l.Simple == "") == (l.ConsistentHash == nil) {
+		return fmt.Errorf("exactly one of simple and consistentHash must be specified")
+	}
+	if l.Simple != "" {
+		for _, lb := range simpleLoadBalancers {
+			if l.Simple == lb {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown simple load balancer %q (expected one of: %s)", l.Simple, strings.Join(simpleLoadBalancers, ", "))
+	}
+	hash := l.ConsistentHash
+	var keys []string
+	if hash.HTTPHeaderName != "" {
+		keys = append(keys, "httpHeaderName")
+	}
+	if hash.HTTPCookie != nil {
+		keys = append(keys, "httpCookie")
+	}
+	if hash.UseSourceIP {
+		keys = append(keys, "useSourceIp")
+	}
+	if hash.HTTPQueryParameterName != "" {
+		keys = append(keys, "httpQueryParameterName")
+	}
+	if len(keys) != 1 {
+		return fmt.Errorf("exactly one consistentHash key must be specified (got: %s)", strings.Join(keys, ", "))
+	}
+	if hash.HTTPCookie != nil {
+		if hash.HTTPCookie.Name == "" {
+			return fmt.Errorf("consistentHash.httpCookie.name must not be empty")
+		}
+		if hash.HTTPCookie.TTL.Duration < 0 {
+			return fmt.Errorf("consistentHash.httpCookie.ttl must not be negative (got %s)", hash.HTTPCookie.TTL.Duration)
+		}
 	}
 	return nil
 }
@@ -17,17 +17,30 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"io"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"os"
+	"strings"
+
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 	"sigs.k8s.io/yaml"
 )
 
 var zeroReplicas int32 = 0
+var excessiveWeight int32 = 110
+var partialWeight int32 = 10
 
 func mkDynamicEnvFromYamlFile(fileName string) (de DynamicEnv, err error) {
 	sourceFile, err := os.Open(fileName)
@@ -354,6 +367,323 @@ var _ = Describe("Validating Webhook", func() {
 				},
 				"0 replicas",
 			),
+			Entry(
+				"negative connection pool values",
+				&DynamicEnv{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "my-de",
+						Namespace: "default",
+					},
+					Spec: DynamicEnvSpec{
+						IstioMatches: []IstioMatch{
+							{
+								Headers: map[string]StringMatch{
+									"name": {
+										Exact: "my_name",
+									},
+								},
+							},
+						},
+						Subsets: []Subset{
+							{
+								Name:       "somename",
+								Namespace:  "ns",
+								Containers: []ContainerOverrides{{ContainerName: "container"}},
+								TrafficPolicy: &SubsetTrafficPolicy{
+									ConnectionPool: &ConnectionPoolSettings{
+										TCP: &TCPConnectionPool{MaxConnections: -1},
+									},
+								},
+							},
+						},
+					},
+				},
+				"tcp.maxConnections must not be negative",
+			),
+			Entry(
+				"multiple consistent hash keys",
+				&DynamicEnv{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "my-de",
+						Namespace: "default",
+					},
+					Spec: DynamicEnvSpec{
+						IstioMatches: []IstioMatch{
+							{
+								Headers: map[string]StringMatch{
+									"name": {
+										Exact: "my_name",
+									},
+								},
+							},
+						},
+						Subsets: []Subset{
+							{
+								Name:       "somename",
+								Namespace:  "ns",
+								Containers: []ContainerOverrides{{ContainerName: "container"}},
+								TrafficPolicy: &SubsetTrafficPolicy{
+									LoadBalancer: &LoadBalancerSettings{
+										ConsistentHash: &ConsistentHashLB{HTTPHeaderName: "x-user", UseSourceIP: true},
+									},
+								},
+							},
+						},
+					},
+				},
+				"exactly one consistentHash key must be specified (got: httpHeaderName, useSourceIp)",
+			),
+			Entry(
+				"port level TLS without SNI",
+				&DynamicEnv{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "my-de",
+						Namespace: "default",
+					},
+					Spec: DynamicEnvSpec{
+						IstioMatches: []IstioMatch{
+							{
+								Headers: map[string]StringMatch{
+									"name": {
+										Exact: "my_name",
+									},
+								},
+							},
+						},
+						Subsets: []Subset{
+							{
+								Name:       "somename",
+								Namespace:  "ns",
+								Containers: []ContainerOverrides{{ContainerName: "container"}},
+								TrafficPolicy: &SubsetTrafficPolicy{
+									PortLevelSettings: []PortTrafficPolicy{
+										{Port: 9080, TLS: &ClientTLSSettings{Mode: "ISTIO_MUTUAL"}},
+										{Port: 8443, TLS: &ClientTLSSettings{Mode: "SIMPLE"}},
+									},
+								},
+							},
+						},
+					},
+				},
+				"port 8443: tls.sni must be specified for SIMPLE mode",
+			),
+			Entry(
+				"duplicate port level settings",
+				&DynamicEnv{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "my-de",
+						Namespace: "default",
+					},
+					Spec: DynamicEnvSpec{
+						IstioMatches: []IstioMatch{
+							{
+								Headers: map[string]StringMatch{
+									"name": {
+										Exact: "my_name",
+									},
+								},
+							},
+						},
+						Subsets: []Subset{
+							{
+								Name:       "somename",
+								Namespace:  "ns",
+								Containers: []ContainerOverrides{{ContainerName: "container"}},
+								TrafficPolicy: &SubsetTrafficPolicy{
+									PortLevelSettings: []PortTrafficPolicy{
+										{Port: 9080, TLS: &ClientTLSSettings{Mode: "ISTIO_MUTUAL"}},
+										{Port: 9080, TLS: &ClientTLSSettings{Mode: "DISABLE"}},
+									},
+								},
+							},
+						},
+					},
+				},
+				"trafficPolicy.portLevelSettings[1].port: Duplicate value",
+			),
+			Entry(
+				"weight above 100",
+				&DynamicEnv{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "my-de",
+						Namespace: "default",
+					},
+					Spec: DynamicEnvSpec{
+						IstioMatches: []IstioMatch{
+							{
+								Headers: map[string]StringMatch{
+									"name": {
+										Exact: "my_name",
+									},
+								},
+							},
+						},
+						Subsets: []Subset{
+							{
+								Name:       "somename",
+								Namespace:  "ns",
+								Containers: []ContainerOverrides{{ContainerName: "container"}},
+								Weight:     &excessiveWeight,
+							},
+						},
+					},
+				},
+				"weight must be between 1 and 100",
+			),
+			Entry(
+				"zero weight",
+				&DynamicEnv{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "my-de",
+						Namespace: "default",
+					},
+					Spec: DynamicEnvSpec{
+						IstioMatches: []IstioMatch{
+							{
+								Headers: map[string]StringMatch{
+									"name": {
+										Exact: "my_name",
+									},
+								},
+							},
+						},
+						Subsets: []Subset{
+							{
+								Name:       "somename",
+								Namespace:  "ns",
+								Containers: []ContainerOverrides{{ContainerName: "container"}},
+								Weight:     &zeroReplicas,
+							},
+						},
+					},
+				},
+				"weight must be between 1 and 100",
+			),
+			Entry(
+				"weight on a consumer",
+				&DynamicEnv{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "my-de",
+						Namespace: "default",
+					},
+					Spec: DynamicEnvSpec{
+						IstioMatches: []IstioMatch{
+							{
+								Headers: map[string]StringMatch{
+									"name": {
+										Exact: "my_name",
+									},
+								},
+							},
+						},
+						Consumers: []Subset{
+							{
+								Name:       "somename",
+								Namespace:  "ns",
+								Containers: []ContainerOverrides{{ContainerName: "container"}},
+								Weight:     &partialWeight,
+							},
+						},
+					},
+				},
+				"weight is only applicable to subsets",
+			),
+			Entry(
+				"invalid subset selector label value",
+				&DynamicEnv{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "my-de",
+						Namespace: "default",
+					},
+					Spec: DynamicEnvSpec{
+						IstioMatches: []IstioMatch{
+							{
+								Headers: map[string]StringMatch{
+									"name": {
+										Exact: "my_name",
+									},
+								},
+							},
+						},
+						Subsets: []Subset{
+							{
+								Name:           "somename",
+								Namespace:      "ns",
+								Containers:     []ContainerOverrides{{ContainerName: "container"}},
+								SubsetSelector: map[string]string{"track": "not a valid value"},
+							},
+						},
+					},
+				},
+				"subsetSelector",
+			),
+			Entry(
+				"subset selector on a consumer",
+				&DynamicEnv{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "my-de",
+						Namespace: "default",
+					},
+					Spec: DynamicEnvSpec{
+						IstioMatches: []IstioMatch{
+							{
+								Headers: map[string]StringMatch{
+									"name": {
+										Exact: "my_name",
+									},
+								},
+							},
+						},
+						Consumers: []Subset{
+							{
+								Name:           "somename",
+								Namespace:      "ns",
+								Containers:     []ContainerOverrides{{ContainerName: "container"}},
+								SubsetSelector: map[string]string{"track": "canary"},
+							},
+						},
+					},
+				},
+				"subsetSelector is only applicable to subsets",
+			),
+		)
+
+		DescribeTable(
+			"Validating load balancer settings",
+			func(lb *LoadBalancerSettings, partialError string) {
+				err := lb.Validate()
+				if partialError == "" {
+					Expect(err).To(BeNil())
+				} else {
+					Expect(err).To(MatchError(ContainSubstring(partialError)))
+				}
+			},
+			Entry("no settings", nil, ""),
+			Entry("simple", &LoadBalancerSettings{Simple: "LEAST_REQUEST"}, ""),
+			Entry("consistent hash by header", &LoadBalancerSettings{ConsistentHash: &ConsistentHashLB{HTTPHeaderName: "x-user"}}, ""),
+			Entry("unknown simple", &LoadBalancerSettings{Simple: "FASTEST"}, `unknown simple load balancer "FASTEST"`),
+			Entry("neither simple nor consistent hash", &LoadBalancerSettings{}, "exactly one of simple and consistentHash"),
+			Entry("consistent hash without a key", &LoadBalancerSettings{ConsistentHash: &ConsistentHashLB{}}, "exactly one consistentHash key"),
+			Entry("cookie without a name",
+				&LoadBalancerSettings{ConsistentHash: &ConsistentHashLB{HTTPCookie: &HTTPCookie{}}}, "httpCookie.name must not be empty"),
+		)
+
+		DescribeTable(
+			"Validating TLS settings",
+			func(tls *ClientTLSSettings, partialError string) {
+				err := tls.Validate()
+				if partialError == "" {
+					Expect(err).To(BeNil())
+				} else {
+					Expect(err).To(MatchError(ContainSubstring(partialError)))
+				}
+			},
+			Entry("no settings", nil, ""),
+			Entry("simple with SNI", &ClientTLSSettings{Mode: "SIMPLE", SNI: "api.example.com"}, ""),
+			Entry("istio mutual without SNI", &ClientTLSSettings{Mode: "ISTIO_MUTUAL"}, ""),
+			Entry("unknown mode", &ClientTLSSettings{Mode: "STRICT"}, `unknown TLS mode "STRICT"`),
+			Entry("simple without SNI", &ClientTLSSettings{Mode: "SIMPLE"}, "tls.sni must be specified for SIMPLE mode"),
+			Entry("mutual without SNI", &ClientTLSSettings{Mode: "MUTUAL", CredentialName: "certs"}, "tls.sni must be specified for MUTUAL mode"),
 		)
 
 		DescribeTable(
@@ -463,4 +793,245 @@ var _ = Describe("Validating Webhook", func() {
 			),
 		)
 	})
+
+	Context("Defaulting the subsets default version", func() {
+		var previousDefault string
+		mkDE := func() *DynamicEnv {
+			return &DynamicEnv{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-de", Namespace: "default"},
+				Spec: DynamicEnvSpec{
+					Subsets: []Subset{
+						{Name: "details", Namespace: "services"},
+						{Name: "reviews", Namespace: "services", DefaultVersion: "custom"},
+					},
+					Consumers: []Subset{{Name: "worker", Namespace: "services"}},
+				},
+			}
+		}
+		BeforeEach(func() {
+			previousDefault = DefaultSubsetVersion
+			DefaultSubsetVersion = "stable"
+		})
+		AfterEach(func() {
+			DefaultSubsetVersion = previousDefault
+		})
+
+		It("sets the operator default on subsets without a default version", func() {
+			de := mkDE()
+			de.defaultSubsetVersions(nil)
+			Expect(de.Spec.Subsets[0].DefaultVersion).To(Equal("stable"))
+		})
+
+		It("respects explicit default versions", func() {
+			de := mkDE()
+			de.defaultSubsetVersions(nil)
+			Expect(de.Spec.Subsets[1].DefaultVersion).To(Equal("custom"))
+		})
+
+		It("does not default consumers (they are not routed to)", func() {
+			de := mkDE()
+			de.defaultSubsetVersions(nil)
+			Expect(de.Spec.Consumers[0].DefaultVersion).To(BeEmpty())
+		})
+
+		It("does not default existing subsets on update (it would modify their default version)", func() {
+			old := mkDE()
+			de := mkDE()
+			de.ResourceVersion = "1"
+			Expect(de.defaultSubsetVersions(old)).To(BeEmpty())
+			Expect(de.Spec.Subsets[0].DefaultVersion).To(BeEmpty())
+		})
+
+		It("defaults the subsets added by an update", func() {
+			old := mkDE()
+			de := mkDE()
+			de.ResourceVersion = "1"
+			de.Spec.Subsets = append(de.Spec.Subsets, Subset{Name: "ratings", Namespace: "services"})
+			Expect(de.defaultSubsetVersions(old)).To(Equal([]string{
+				`subset services/ratings has no defaultVersion, using the operator default "stable"`,
+			}))
+			Expect(de.Spec.Subsets[0].DefaultVersion).To(BeEmpty())
+			Expect(de.Spec.Subsets[2].DefaultVersion).To(Equal("stable"))
+		})
+
+		It("does nothing without an operator default", func() {
+			DefaultSubsetVersion = ""
+			de := mkDE()
+			de.defaultSubsetVersions(nil)
+			Expect(de.Spec.Subsets[0].DefaultVersion).To(BeEmpty())
+		})
+
+		It("warns about the defaulted subsets", func() {
+			de := mkDE()
+			Expect(de.defaultSubsetVersions(nil)).To(Equal([]string{
+				`subset services/details has no defaultVersion, using the operator default "stable"`,
+			}))
+		})
+
+		It("returns the warnings in the admission response along with the patch", func() {
+			s := runtime.NewScheme()
+			Expect(AddToScheme(s)).To(Succeed())
+			decoder, err := admission.NewDecoder(s)
+			Expect(err).NotTo(HaveOccurred())
+			raw, err := json.Marshal(mkDE())
+			Expect(err).NotTo(HaveOccurred())
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			}}
+
+			resp := (&dynamicEnvDefaulter{decoder: decoder}).Handle(context.Background(), req)
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Warnings).To(ConsistOf(ContainSubstring("subset services/details has no defaultVersion")))
+			Expect(resp.Patches).To(HaveLen(1))
+			Expect(resp.Patches[0].Operation).To(Equal("add"))
+			Expect(resp.Patches[0].Path).To(Equal("/spec/subsets/0/defaultVersion"))
+			Expect(resp.Patches[0].Value).To(Equal("stable"))
+		})
+
+		It("only defaults the subsets added by an update request", func() {
+			s := runtime.NewScheme()
+			Expect(AddToScheme(s)).To(Succeed())
+			decoder, err := admission.NewDecoder(s)
+			Expect(err).NotTo(HaveOccurred())
+			old := mkDE()
+			old.ResourceVersion = "1"
+			oldRaw, err := json.Marshal(old)
+			Expect(err).NotTo(HaveOccurred())
+			de := old.DeepCopy()
+			de.Spec.Subsets = append(de.Spec.Subsets, Subset{Name: "ratings", Namespace: "services"})
+			raw, err := json.Marshal(de)
+			Expect(err).NotTo(HaveOccurred())
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Update,
+				Object:    runtime.RawExtension{Raw: raw},
+				OldObject: runtime.RawExtension{Raw: oldRaw},
+			}}
+
+			resp := (&dynamicEnvDefaulter{decoder: decoder}).Handle(context.Background(), req)
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Warnings).To(ConsistOf(ContainSubstring("subset services/ratings has no defaultVersion")))
+			Expect(resp.Patches).To(HaveLen(1))
+			Expect(resp.Patches[0].Path).To(Equal("/spec/subsets/2/defaultVersion"))
+			Expect(resp.Patches[0].Value).To(Equal("stable"))
+		})
+
+		It("does not warn when nothing is defaulted", func() {
+			s := runtime.NewScheme()
+			Expect(AddToScheme(s)).To(Succeed())
+			decoder, err := admission.NewDecoder(s)
+			Expect(err).NotTo(HaveOccurred())
+			de := mkDE()
+			de.Spec.Subsets[0].DefaultVersion = "custom"
+			raw, err := json.Marshal(de)
+			Expect(err).NotTo(HaveOccurred())
+			req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			}}
+
+			resp := (&dynamicEnvDefaulter{decoder: decoder}).Handle(context.Background(), req)
+			Expect(resp.Allowed).To(BeTrue())
+			Expect(resp.Warnings).To(BeEmpty())
+			Expect(resp.Patches).To(BeEmpty())
+		})
+	})
+
+	Context("Colliding unique versions", func() {
+		mkDE := func(namespace, name string, subsets ...string) *DynamicEnv {
+			de := &DynamicEnv{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Spec: DynamicEnvSpec{
+					IstioMatches: []IstioMatch{{Headers: map[string]StringMatch{"end-user": {Exact: "jason"}}}},
+				},
+			}
+			for _, s := range subsets {
+				de.Spec.Subsets = append(de.Spec.Subsets, Subset{
+					Name:       s,
+					Namespace:  "services",
+					Containers: []ContainerOverrides{{ContainerName: s, Image: "image"}},
+				})
+			}
+			return de
+		}
+		mkDeployment := func(name, app string) client.Object {
+			return &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "services"},
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": app}}},
+				},
+			}
+		}
+		mkService := func(name, app string) client.Object {
+			return &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "services"},
+				Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": app}},
+			}
+		}
+		var validator *dynamicEnvValidator
+		withExisting := func(existing ...*DynamicEnv) {
+			s := runtime.NewScheme()
+			Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+			Expect(AddToScheme(s)).To(Succeed())
+			objects := []client.Object{
+				mkDeployment("details", "details"),
+				mkDeployment("details-canary", "details"),
+				mkDeployment("reviews", "reviews"),
+				mkService("details", "details"),
+				mkService("reviews", "reviews"),
+			}
+			for _, de := range existing {
+				objects = append(objects, de)
+			}
+			validator = &dynamicEnvValidator{
+				client: fake.NewClientBuilder().WithScheme(s).WithObjects(objects...).Build(),
+			}
+		}
+
+		It("rejects a version that collides with another DynamicEnv on the same subset", func() {
+			// Both are truncated to the same unique version
+			name := strings.Repeat("a", 40)
+			withExisting(mkDE("team", name+"-first", "details"))
+			err := validator.ValidateCreate(context.Background(), mkDE("team", name+"-second", "details", "reviews"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("of subset services/details collides with DynamicEnv team/" + name + "-first on host details.services"))
+		})
+
+		It("rejects a version that collides on a host shared by different subsets", func() {
+			name := strings.Repeat("a", 40)
+			withExisting(mkDE("team", name+"-first", "details"))
+			err := validator.ValidateCreate(context.Background(), mkDE("team", name+"-second", "details-canary"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("of subset services/details-canary collides with DynamicEnv team/" + name + "-first on host details.services"))
+		})
+
+		It("rejects ambiguous namespace and name combinations", func() {
+			withExisting(mkDE("team-a", "env", "details"))
+			Expect(validator.ValidateCreate(context.Background(), mkDE("team", "a-env", "details"))).NotTo(Succeed())
+		})
+
+		It("accepts colliding versions of unrelated subsets", func() {
+			name := strings.Repeat("a", 40)
+			withExisting(mkDE("team", name+"-first", "details"))
+			Expect(validator.ValidateCreate(context.Background(), mkDE("team", name+"-second", "reviews"))).To(Succeed())
+		})
+
+		It("accepts distinct versions of the same subset", func() {
+			withExisting(mkDE("team", "first", "details"))
+			Expect(validator.ValidateCreate(context.Background(), mkDE("team", "second", "details"))).To(Succeed())
+		})
+
+		It("does not collide with itself on update", func() {
+			existing := mkDE("team", "first", "details")
+			withExisting(existing)
+			Expect(validator.ValidateUpdate(context.Background(), existing, mkDE("team", "first", "details", "reviews"))).To(Succeed())
+		})
+
+		It("fails on invalid dynamic environments before looking up the existing ones", func() {
+			withExisting()
+			de := mkDE("team", "first", "details")
+			de.Spec.IstioMatches = nil
+			Expect(validator.ValidateCreate(context.Background(), de)).NotTo(Succeed())
+		})
+	})
 })
@@ -23,22 +23,71 @@ package v1alpha1
 
 import (
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *Condition) DeepCopyInto(out *Condition) {
+func (in *ClientTLSSettings) DeepCopyInto(out *ClientTLSSettings) {
 	*out = *in
-	in.LastUpdateTime.DeepCopyInto(&out.LastUpdateTime)
-	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	if in.SubjectAltNames != nil {
+		in, out := &in.SubjectAltNames, &out.SubjectAltNames
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClientTLSSettings.
+func (in *ClientTLSSettings) DeepCopy() *ClientTLSSettings {
+	if in == nil {
+		return nil
+	}
+	out := new(ClientTLSSettings)
+	in.DeepCopyInto(out)
+	return out
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Condition.
-func (in *Condition) DeepCopy() *Condition {
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConnectionPoolSettings) DeepCopyInto(out *ConnectionPoolSettings) {
+	*out = *in
+	if in.TCP != nil {
+		in, out := &in.TCP, &out.TCP
+		*out = new(TCPConnectionPool)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HTTP != nil {
+		in, out := &in.HTTP, &out.HTTP
+		*out = new(HTTPConnectionPool)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConnectionPoolSettings.
+func (in *ConnectionPoolSettings) DeepCopy() *ConnectionPoolSettings {
 	if in == nil {
 		return nil
 	}
-	out := new(Condition)
+	out := new(ConnectionPoolSettings)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsistentHashLB) DeepCopyInto(out *ConsistentHashLB) {
+	*out = *in
+	if in.HTTPCookie != nil {
+		in, out := &in.HTTPCookie, &out.HTTPCookie
+		*out = new(HTTPCookie)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsistentHashLB.
+func (in *ConsistentHashLB) DeepCopy() *ConsistentHashLB {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsistentHashLB)
 	in.DeepCopyInto(out)
 	return out
 }
@@ -46,7 +95,7 @@ func (in *Condition) DeepCopy() *Condition {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ConsumerStatus) DeepCopyInto(out *ConsumerStatus) {
 	*out = *in
-	out.ResourceStatus = in.ResourceStatus
+	in.ResourceStatus.DeepCopyInto(&out.ResourceStatus)
 	if in.Errors != nil {
 		in, out := &in.Errors, &out.Errors
 		*out = make([]StatusError, len(*in))
@@ -176,6 +225,11 @@ func (in *DynamicEnvSpec) DeepCopyInto(out *DynamicEnvSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.TTLSecondsAfterCreation != nil {
+		in, out := &in.TTLSecondsAfterCreation, &out.TTLSecondsAfterCreation
+		*out = new(int64)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DynamicEnvSpec.
@@ -193,7 +247,7 @@ func (in *DynamicEnvStatus) DeepCopyInto(out *DynamicEnvStatus) {
 	*out = *in
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
-		*out = make([]Condition, len(*in))
+		*out = make([]metav1.Condition, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
@@ -224,6 +278,37 @@ func (in *DynamicEnvStatus) DeepCopy() *DynamicEnvStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HTTPCookie) DeepCopyInto(out *HTTPCookie) {
+	*out = *in
+	out.TTL = in.TTL
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HTTPCookie.
+func (in *HTTPCookie) DeepCopy() *HTTPCookie {
+	if in == nil {
+		return nil
+	}
+	out := new(HTTPCookie)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HTTPConnectionPool) DeepCopyInto(out *HTTPConnectionPool) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HTTPConnectionPool.
+func (in *HTTPConnectionPool) DeepCopy() *HTTPConnectionPool {
+	if in == nil {
+		return nil
+	}
+	out := new(HTTPConnectionPool)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IstioMatch) DeepCopyInto(out *IstioMatch) {
 	*out = *in
@@ -253,9 +338,70 @@ func (in *IstioMatch) DeepCopy() *IstioMatch {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LoadBalancerSettings) DeepCopyInto(out *LoadBalancerSettings) {
+	*out = *in
+	if in.ConsistentHash != nil {
+		in, out := &in.ConsistentHash, &out.ConsistentHash
+		*out = new(ConsistentHashLB)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LoadBalancerSettings.
+func (in *LoadBalancerSettings) DeepCopy() *LoadBalancerSettings {
+	if in == nil {
+		return nil
+	}
+	out := new(LoadBalancerSettings)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PortTrafficPolicy) DeepCopyInto(out *PortTrafficPolicy) {
+	*out = *in
+	if in.ConnectionPool != nil {
+		in, out := &in.ConnectionPool, &out.ConnectionPool
+		*out = new(ConnectionPoolSettings)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LoadBalancer != nil {
+		in, out := &in.LoadBalancer, &out.LoadBalancer
+		*out = new(LoadBalancerSettings)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(ClientTLSSettings)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PortTrafficPolicy.
+func (in *PortTrafficPolicy) DeepCopy() *PortTrafficPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(PortTrafficPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ResourceStatus) DeepCopyInto(out *ResourceStatus) {
 	*out = *in
+	if in.MissingSince != nil {
+		in, out := &in.MissingSince, &out.MissingSince
+		*out = (*in).DeepCopy()
+	}
+	if in.Transitions != nil {
+		in, out := &in.Transitions, &out.Transitions
+		*out = make([]StatusTransition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ResourceStatus.
@@ -284,6 +430,22 @@ func (in *StatusError) DeepCopy() *StatusError {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StatusTransition) DeepCopyInto(out *StatusTransition) {
+	*out = *in
+	in.At.DeepCopyInto(&out.At)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StatusTransition.
+func (in *StatusTransition) DeepCopy() *StatusTransition {
+	if in == nil {
+		return nil
+	}
+	out := new(StatusTransition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *StringMatch) DeepCopyInto(out *StringMatch) {
 	*out = *in
@@ -309,6 +471,18 @@ func (in *Subset) DeepCopyInto(out *Subset) {
 			(*out)[key] = val
 		}
 	}
+	if in.SubsetSelector != nil {
+		in, out := &in.SubsetSelector, &out.SubsetSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ExcludedHosts != nil {
+		in, out := &in.ExcludedHosts, &out.ExcludedHosts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.Replicas != nil {
 		in, out := &in.Replicas, &out.Replicas
 		*out = new(int32)
@@ -328,6 +502,16 @@ func (in *Subset) DeepCopyInto(out *Subset) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.TrafficPolicy != nil {
+		in, out := &in.TrafficPolicy, &out.TrafficPolicy
+		*out = new(SubsetTrafficPolicy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Weight != nil {
+		in, out := &in.Weight, &out.Weight
+		*out = new(int32)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Subset.
@@ -421,16 +605,20 @@ func (in *SubsetMessages) DeepCopy() *SubsetMessages {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SubsetStatus) DeepCopyInto(out *SubsetStatus) {
 	*out = *in
-	out.Deployment = in.Deployment
+	in.Deployment.DeepCopyInto(&out.Deployment)
 	if in.DestinationRules != nil {
 		in, out := &in.DestinationRules, &out.DestinationRules
 		*out = make([]ResourceStatus, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 	if in.VirtualServices != nil {
 		in, out := &in.VirtualServices, &out.VirtualServices
 		*out = make([]ResourceStatus, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 	if in.Errors != nil {
 		in, out := &in.Errors, &out.Errors
@@ -448,3 +636,60 @@ func (in *SubsetStatus) DeepCopy() *SubsetStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SubsetTrafficPolicy) DeepCopyInto(out *SubsetTrafficPolicy) {
+	*out = *in
+	if in.ConnectionPool != nil {
+		in, out := &in.ConnectionPool, &out.ConnectionPool
+		*out = new(ConnectionPoolSettings)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LoadBalancer != nil {
+		in, out := &in.LoadBalancer, &out.LoadBalancer
+		*out = new(LoadBalancerSettings)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(ClientTLSSettings)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PortLevelSettings != nil {
+		in, out := &in.PortLevelSettings, &out.PortLevelSettings
+		*out = make([]PortTrafficPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SubsetTrafficPolicy.
+func (in *SubsetTrafficPolicy) DeepCopy() *SubsetTrafficPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(SubsetTrafficPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TCPConnectionPool) DeepCopyInto(out *TCPConnectionPool) {
+	*out = *in
+	if in.ConnectTimeout != nil {
+		in, out := &in.ConnectTimeout, &out.ConnectTimeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TCPConnectionPool.
+func (in *TCPConnectionPool) DeepCopy() *TCPConnectionPool {
+	if in == nil {
+		return nil
+	}
+	out := new(TCPConnectionPool)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command render prints the resources a DynamicEnv would generate, without a cluster (see
+// `render.Render`):
+//
+//	render [flags] FILE...
+//
+// The files (YAML or JSON, "-" for stdin) should contain a single DynamicEnv along with the base
+// resources it would override: the deployments, the services, the DestinationRules and the
+// VirtualServices.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/riskified/dynamic-environment/pkg/names"
+	"github.com/riskified/dynamic-environment/pkg/render"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func main() {
+	var opts render.Options
+	var labelsToRemove string
+	var output string
+	flag.StringVar(&opts.VersionLabel, "version-label", names.DefaultVersionLabel,
+		"The label we use to determine the version of the subsets.")
+	flag.StringVar(&opts.DefaultVersion, "default-version", names.DefaultVersion,
+		"The version to route to by default (unless overridden by the subsets).")
+	flag.StringVar(&labelsToRemove, "remove-labels", "",
+		"A comma-separated list of labels to remove from the overriding deployments.")
+	flag.BoolVar(&opts.SharedDestinationRules, "shared-destination-rules", false,
+		"Render a single DestinationRule per service host (shared by all the dynamic environments).")
+	flag.StringVar(&opts.ClusterDomain, "cluster-domain", names.DefaultClusterDomain,
+		"The cluster domain used to fully qualify service hosts.")
+	flag.StringVar(&output, "output", "yaml", "The output format (yaml or json).")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] FILE...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if labelsToRemove != "" {
+		opts.LabelsToRemove = strings.Split(labelsToRemove, ",")
+	}
+	if output != "yaml" && output != "json" {
+		fail(fmt.Errorf("unsupported output format: %s", output))
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var objects []client.Object
+	for _, path := range flag.Args() {
+		decoded, err := decodeFile(path)
+		if err != nil {
+			fail(fmt.Errorf("reading %s: %w", path, err))
+		}
+		objects = append(objects, decoded...)
+	}
+	de, base, err := render.SplitDynamicEnv(objects)
+	if err != nil {
+		fail(err)
+	}
+	rendered, err := render.Render(de, base, opts)
+	if err != nil {
+		fail(err)
+	}
+	if err := render.Encode(os.Stdout, rendered, output == "json"); err != nil {
+		fail(err)
+	}
+}
+
+func decodeFile(path string) ([]client.Object, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return render.Decode(r)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
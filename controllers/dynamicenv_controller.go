@@ -18,26 +18,35 @@ package controllers
 
 import (
 	"context"
+	goerrors "errors"
 	"fmt"
+	"golang.org/x/time/rate"
 	istioapi "istio.io/api/networking/v1alpha3"
 	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	appsv1 "k8s.io/api/apps/v1"
-	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 	"sort"
 	"strings"
+	"time"
 
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"github.com/riskified/dynamic-environment/pkg/features"
 	"github.com/riskified/dynamic-environment/pkg/handlers"
+	"github.com/riskified/dynamic-environment/pkg/health"
 	"github.com/riskified/dynamic-environment/pkg/helpers"
+	"github.com/riskified/dynamic-environment/pkg/metrics"
 	"github.com/riskified/dynamic-environment/pkg/names"
 	"github.com/riskified/dynamic-environment/pkg/watches"
 )
@@ -45,10 +54,111 @@ import (
 // DynamicEnvReconciler reconciles a DynamicEnv object
 type DynamicEnvReconciler struct {
 	client.Client
-	Scheme         *runtime.Scheme
-	VersionLabel   string
-	DefaultVersion string
-	LabelsToRemove []string
+	// A direct (uncached) reader for status reads that miss the cache (see
+	// `handlers.DestinationRuleHandler`). Optional.
+	APIReader    client.Reader
+	Scheme       *runtime.Scheme
+	VersionLabel string
+	// Version label keys for specific service hosts (see `handlers.DestinationRuleHandler`)
+	VersionLabelsByHost map[string]string
+	DefaultVersion      string
+	// Default versions for specific service hosts, describing their base DestinationRules (so they
+	// take precedence over the default versions of the subsets).
+	DefaultVersionsByHost map[string]string
+	LabelsToRemove        []string
+	// Share a single DestinationRule per service host between all dynamic environments (see
+	// `handlers.DestinationRuleHandler`).
+	SharedDestinationRules bool
+	// The cluster domain used to fully qualify service hosts
+	ClusterDomain string
+	Recorder      record.EventRecorder
+	// A template for the names of the generated subsets (see `handlers.DestinationRuleHandler`)
+	SubsetNameTemplate string
+	// Computes the names of the generated DestinationRules (optional, see `handlers.NameStrategy`)
+	NameStrategy handlers.NameStrategy
+	// The maximum number of dynamic environments sharing a single resource (0 for no limit)
+	MaxAnnotationOwners int
+	// The annotation recording the owners of the shared resources (defaults to
+	// `names.NamespacedNameAnnotation`, see `watches.Ownership`)
+	OwnerAnnotation string
+	// Overrides the TLS settings of the generated subsets (optional, see `handlers.DestinationRuleHandler`)
+	SubsetTLS *istioapi.ClientTLSSettings
+	// Records the outcomes of handling the DestinationRules (optional)
+	DestinationRuleMetrics *metrics.DestinationRuleMetrics
+	// Only route to a subset once its deployment is running (see `handlers.DestinationRuleHandler`)
+	WaitForDeployment bool
+	// How long to wait (checking every BaseDestinationRuleBackoff) for missing base
+	// DestinationRules before ignoring them (see `handlers.DestinationRuleHandler`).
+	BaseDestinationRuleGracePeriod time.Duration
+	BaseDestinationRuleBackoff     time.Duration
+	// The namespace of the base and generated DestinationRules if not the subset namespace
+	DestinationRuleNamespace string
+	// The namespaces of the base DestinationRules of specific service hosts (see
+	// `handlers.DestinationRuleHandler`)
+	DestinationRuleNamespacesByHost map[string]string
+	// The reader for discovering the base DestinationRules, e.g. of another cluster (see
+	// `handlers.DestinationRuleHandler`). Defaults to Client.
+	BaseLookupReader client.Reader
+	// Do not adopt existing DestinationRules owned by others (see `handlers.DestinationRuleHandler`)
+	StrictDestinationRuleOwnership bool
+	// Report hosts without a base DestinationRule as errors instead of ignoring them (see
+	// `handlers.DestinationRuleHandler`)
+	StrictHosts bool
+	// Write the generated DestinationRules using server-side apply (see
+	// `handlers.DestinationRuleHandler`)
+	DestinationRuleServerSideApply bool
+	// The annotation marking base DestinationRules that should never be overridden (see
+	// `handlers.DestinationRuleHandler`)
+	NoOverrideAnnotation string
+	// The interval between relists of the owned resources (see `watches.AnnotationResync`). Defaults
+	// to `watches.DefaultResyncPeriod`.
+	ResyncPeriod time.Duration
+	// Also route to the hosts of ServiceEntries selecting the subset workloads (see
+	// `handlers.DestinationRuleHandler`).
+	ServiceEntryHosts bool
+	// Also match base DestinationRules whose hosts resolve to the same Service as the subset hosts
+	// (see `handlers.DestinationRuleHandler`).
+	MatchDestinationRulesByService bool
+	// Also consider the base DestinationRules of other namespaces that are exported to the subset
+	// namespace (see `handlers.DestinationRuleHandler`).
+	ExportedBaseDestinationRules bool
+	// Resolve the short hosts of base DestinationRules of other namespaces relative to the subset
+	// namespace (see `handlers.DestinationRuleHandler`).
+	ShortHostsInServiceNamespace bool
+	// Bounds the individual client calls of the DestinationRule handler (0 for no timeout).
+	OperationTimeout time.Duration
+	// Throttles the DestinationRule writes of all the dynamic environments (optional, see
+	// `handlers.DestinationRuleHandler`).
+	DestinationRuleWriteLimiter *rate.Limiter
+	// The maximum number of service hosts of a subset whose DestinationRules are handled
+	// concurrently (sequentially if 1 or less, see `handlers.DestinationRuleHandler`).
+	DestinationRuleHostConcurrency int
+	// The states of the feature gates (see the `features` package)
+	FeatureGates features.Gates
+	// Bounds a single reconcile (0 for no timeout). The DestinationRule handlers persist the status
+	// of the hosts handled so far (every StatusFlushInterval) so a timed out reconcile leaves an
+	// accurate partial status.
+	ReconcileTimeout    time.Duration
+	StatusFlushInterval time.Duration
+	// The number of the latest status transitions recorded per resource (0 to not record them, see
+	// `handlers.DynamicEnvStatusHandler`)
+	StatusTransitionHistory int
+	// The namespaces DestinationRules may (or may not) be created in (see
+	// `handlers.DestinationRuleHandler`).
+	AllowedNamespaces []string
+	DeniedNamespaces  []string
+	// The keys of the DynamicEnv labels and annotations to propagate onto the generated
+	// DestinationRules.
+	PropagatedLabels      []string
+	PropagatedAnnotations []string
+	// Tracks the outcomes of the reconciles for the readiness check (optional)
+	ReconcileHealth *health.ReconcileHealth
+	// Backs off the requeues of DynamicEnvs whose resources did not converge yet (optional, they
+	// are requeued through the rate limiter of the controller otherwise)
+	RequeueBackoff *handlers.RequeueBackoff
+	// Triggers reconciles on demand, e.g. from the debug endpoint (optional, see
+	// `watches.ReconcileTrigger`)
+	Trigger *watches.ReconcileTrigger
 }
 
 type ReconcileLoopStatus struct {
@@ -85,6 +195,7 @@ func (rls *ReconcileLoopStatus) addDeploymentMessage(subset string, tpe riskifie
 //+kubebuilder:rbac:groups=riskified.com,resources=dynamicenvs/finalizers,verbs=update
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 //+kubebuilder:rbac:groups=networking.istio.io,resources=*,verbs=*
 //+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch
 // TODO: shrink istio permissions if possible.
@@ -99,6 +210,27 @@ func (rls *ReconcileLoopStatus) addDeploymentMessage(subset string, tpe riskifie
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
 func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	if r.ReconcileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.ReconcileTimeout)
+		defer cancel()
+	}
+	result, err := r.reconcile(ctx, req)
+	if r.ReconcileHealth != nil {
+		r.ReconcileHealth.Record(err)
+	}
+	if r.RequeueBackoff != nil && err == nil && result == (ctrl.Result{}) {
+		r.RequeueBackoff.Reset(req.NamespacedName)
+	}
+	if r.Trigger != nil {
+		r.Trigger.Done(req.NamespacedName)
+	}
+	return result, err
+}
+
+func (r *DynamicEnvReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	// Correlates the handlers logs of this reconcile (see `helpers.CorrelatedLogger`)
+	ctx, _ = helpers.WithCorrelationID(ctx)
 	log := ctrllog.FromContext(ctx)
 	log.V(1).Info("Entered Reconcile Loop")
 	rls := ReconcileLoopStatus{
@@ -129,17 +261,29 @@ func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, err
 	}
 
+	// The time left until the DynamicEnv expires (0 if it never does)
+	var expiresIn time.Duration
+	if expiresAt, ok := dynamicEnv.ExpiresAt(); ok {
+		if expiresIn = time.Until(expiresAt); expiresIn <= 0 {
+			return r.expireDynamicEnv(ctx, dynamicEnv, expiresAt)
+		}
+	}
+
 	owner := types.NamespacedName{Name: dynamicEnv.Name, Namespace: dynamicEnv.Namespace}
 	var deploymentHandlers []handlers.SRHandler
 	var mrHandlers []handlers.MRHandler
 	nonReadyExists := false
 	degradedExists := false
+	// The shortest delay requested by the handlers (0 for the default requeue)
+	var requeueAfter time.Duration
 
 	statusHandler := handlers.DynamicEnvStatusHandler{
-		Client:     r.Client,
-		Ctx:        ctx,
-		DynamicEnv: dynamicEnv,
+		Client:                 r.Client,
+		Ctx:                    ctx,
+		DynamicEnv:             dynamicEnv,
+		TransitionHistoryLimit: r.StatusTransitionHistory,
 	}
+	statusHandler.ClearExpired()
 
 	subsetsAndConsumers := mergeSubsetsAndConsumers(dynamicEnv.Spec.Subsets, dynamicEnv.Spec.Consumers)
 
@@ -167,19 +311,21 @@ func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		}
 
 		deploymentHandler := handlers.DeploymentHandler{
-			Client:         r.Client,
-			UniqueName:     uniqueName,
-			UniqueVersion:  uniqueVersion,
-			Owner:          owner,
-			BaseDeployment: baseDeployment,
-			DeploymentType: st.Type,
-			LabelsToRemove: r.LabelsToRemove,
-			VersionLabel:   r.VersionLabel,
-			StatusHandler:  &statusHandler,
-			Matches:        dynamicEnv.Spec.IstioMatches,
-			Subset:         s,
-			Log:            log,
-			Ctx:            ctx,
+			Client:             r.Client,
+			UniqueName:         uniqueName,
+			UniqueVersion:      uniqueVersion,
+			Owner:              owner,
+			BaseDeployment:     baseDeployment,
+			DeploymentType:     st.Type,
+			LabelsToRemove:     r.LabelsToRemove,
+			VersionLabel:       r.VersionLabel,
+			ExtraVersionLabels: r.extraVersionLabels(),
+			OwnerAnnotation:    r.OwnerAnnotation,
+			StatusHandler:      &statusHandler,
+			Matches:            dynamicEnv.Spec.IstioMatches,
+			Subset:             s,
+			Log:                log,
+			Ctx:                ctx,
 		}
 		deploymentHandlers = append(deploymentHandlers, &deploymentHandler)
 		if err := deploymentHandler.Handle(); err != nil {
@@ -197,38 +343,131 @@ func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				break
 			}
 
-			destinationRuleHandler := handlers.DestinationRuleHandler{
-				Client:         r.Client,
-				UniqueName:     uniqueName,
-				UniqueVersion:  uniqueVersion,
-				Namespace:      s.Namespace,
-				VersionLabel:   r.VersionLabel,
-				DefaultVersion: defaultVersionForSubset,
-				StatusHandler:  &statusHandler,
-				ServiceHosts:   serviceHosts,
-				Owner:          owner,
-				Log:            log,
-				Ctx:            ctx,
+			var connectionPool *riskifiedv1alpha1.ConnectionPoolSettings
+			var loadBalancer *riskifiedv1alpha1.LoadBalancerSettings
+			var tls *riskifiedv1alpha1.ClientTLSSettings
+			var portLevelSettings []riskifiedv1alpha1.PortTrafficPolicy
+			if s.TrafficPolicy != nil {
+				connectionPool = s.TrafficPolicy.ConnectionPool
+				loadBalancer = s.TrafficPolicy.LoadBalancer
+				tls = s.TrafficPolicy.TLS
+				portLevelSettings = s.TrafficPolicy.PortLevelSettings
+			}
+			destinationRuleHandler, err := handlers.NewDestinationRuleHandler(handlers.DestinationRuleHandler{
+				Client:                          r.Client,
+				APIReader:                       r.APIReader,
+				BaseLookupReader:                r.BaseLookupReader,
+				UniqueName:                      uniqueName,
+				UniqueVersion:                   uniqueVersion,
+				Namespace:                       s.Namespace,
+				VersionLabel:                    r.VersionLabel,
+				VersionLabelsByHost:             r.VersionLabelsByHost,
+				DefaultVersion:                  defaultVersionForSubset,
+				DefaultVersionsByHost:           r.DefaultVersionsByHost,
+				StatusHandler:                   &statusHandler,
+				ServiceHosts:                    serviceHosts,
+				ExcludedHosts:                   s.ExcludedHosts,
+				Owner:                           owner,
+				OwnerUID:                        dynamicEnv.UID,
+				SharedDestinationRules:          r.SharedDestinationRules,
+				ClusterDomain:                   r.ClusterDomain,
+				Recorder:                        r.Recorder,
+				SubsetNameTemplate:              r.SubsetNameTemplate,
+				NameStrategy:                    r.NameStrategy,
+				MaxAnnotationOwners:             r.MaxAnnotationOwners,
+				OwnerAnnotation:                 r.OwnerAnnotation,
+				SubsetTLS:                       r.SubsetTLS,
+				ConnectionPool:                  connectionPool,
+				LoadBalancer:                    loadBalancer,
+				TLS:                             tls,
+				PortLevelSettings:               portLevelSettings,
+				SubsetSelector:                  s.SubsetSelector,
+				Metrics:                         r.DestinationRuleMetrics,
+				WaitForDeployment:               r.WaitForDeployment,
+				BaseDestinationRuleGracePeriod:  r.BaseDestinationRuleGracePeriod,
+				BaseDestinationRuleBackoff:      r.BaseDestinationRuleBackoff,
+				DestinationRuleNamespace:        r.DestinationRuleNamespace,
+				DestinationRuleNamespacesByHost: r.DestinationRuleNamespacesByHost,
+				StrictOwnership:                 r.StrictDestinationRuleOwnership,
+				StrictHosts:                     r.StrictHosts,
+				ServerSideApply:                 r.DestinationRuleServerSideApply,
+				NoOverrideAnnotation:            r.NoOverrideAnnotation,
+				ServiceEntryHosts:               r.ServiceEntryHosts,
+				MatchByService:                  r.MatchDestinationRulesByService,
+				ExportedBaseDestinationRules:    r.ExportedBaseDestinationRules,
+				ShortHostsInServiceNamespace:    r.ShortHostsInServiceNamespace,
+				OperationTimeout:                r.OperationTimeout,
+				WriteLimiter:                    r.DestinationRuleWriteLimiter,
+				HostConcurrency:                 r.DestinationRuleHostConcurrency,
+				FeatureGates:                    r.FeatureGates,
+				StatusFlushInterval:             r.StatusFlushInterval,
+				AllowedNamespaces:               r.AllowedNamespaces,
+				DeniedNamespaces:                r.DeniedNamespaces,
+				Labels:                          helpers.PickKeys(dynamicEnv.Labels, r.PropagatedLabels),
+				Annotations:                     helpers.PickKeys(dynamicEnv.Annotations, r.PropagatedAnnotations),
+				Log:                             log,
+				Ctx:                             ctx,
+			})
+			if err != nil {
+				rls.returnError = err
+				rls.subsetMessages[uniqueName] = rls.subsetMessages[uniqueName].AppendDestinationRuleMsg(err.Error())
+				break
 			}
-			mrHandlers = append(mrHandlers, &destinationRuleHandler)
+			mrHandlers = append(mrHandlers, destinationRuleHandler)
 			if err := destinationRuleHandler.Handle(); err != nil {
+				var superseded handlers.SupersededGeneration
+				if goerrors.As(err, &superseded) {
+					// The newer generation is reconciled by its own loop, writing anything would
+					// override its changes.
+					log.Info("Skipping superseded reconcile", "generation", superseded.Generation, "latest", superseded.Latest)
+					return ctrl.Result{}, nil
+				}
 				rls.returnError = err
 				rls.subsetMessages[uniqueName] = rls.subsetMessages[uniqueName].AppendDestinationRuleMsg(err.Error())
 				break
 			}
+			if after := destinationRuleHandler.RequeueAfter(); after > 0 {
+				// Check again for the base destination rules that were not applied yet (or the
+				// statuses of the created ones that failed to be persisted)
+				nonReadyExists = true
+				rls.nonReadyCS[uniqueName] = true
+				if requeueAfter == 0 || after < requeueAfter {
+					requeueAfter = after
+				}
+			}
+			if len(destinationRuleHandler.GetExcludedHosts()) > 0 {
+				// Do not route to the hosts that were excluded from the subset
+				serviceHosts = destinationRuleHandler.IncludedHosts()
+			}
+			if len(destinationRuleHandler.GetPendingHosts()) > 0 {
+				// Do not route to hosts without a subset yet
+				nonReadyExists = true
+				rls.nonReadyCS[uniqueName] = true
+				serviceHosts = destinationRuleHandler.GetHosts()
+				if len(serviceHosts) == 0 {
+					log.Info("Waiting for subset deployment before routing", "subset", uniqueName)
+					continue
+				}
+			}
 
 			virtualServiceHandler := handlers.VirtualServiceHandler{
-				Client:         r.Client,
-				UniqueName:     uniqueName,
-				UniqueVersion:  uniqueVersion,
-				RoutePrefix:    helpers.CalculateVirtualServicePrefix(uniqueVersion, s.Name),
-				Namespace:      s.Namespace,
-				ServiceHosts:   serviceHosts,
-				DefaultVersion: defaultVersionForSubset,
-				DynamicEnv:     dynamicEnv,
-				StatusHandler:  &statusHandler,
-				Log:            log,
-				Ctx:            ctx,
+				Client:                r.Client,
+				UniqueName:            uniqueName,
+				UniqueVersion:         uniqueVersion,
+				RoutePrefix:           helpers.CalculateVirtualServicePrefix(uniqueVersion, s.Name),
+				Namespace:             s.Namespace,
+				ServiceHosts:          serviceHosts,
+				DefaultVersion:        defaultVersionForSubset,
+				DefaultVersionsByHost: r.DefaultVersionsByHost,
+				DynamicEnv:            dynamicEnv,
+				StatusHandler:         &statusHandler,
+				SubsetNames:           destinationRuleHandler.GetSubsetNames(),
+				ClusterDomain:         r.ClusterDomain,
+				Weight:                subsetWeight(s),
+				MaxAnnotationOwners:   r.MaxAnnotationOwners,
+				OwnerAnnotation:       r.OwnerAnnotation,
+				Log:                   log,
+				Ctx:                   ctx,
 			}
 
 			mrHandlers = append(mrHandlers, &virtualServiceHandler)
@@ -258,6 +497,7 @@ func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		rls.setErrorIfNotMasking(rls.returnError)
 	}
 
+	var allStatuses []riskifiedv1alpha1.LifeCycleStatus
 	for _, handler := range deploymentHandlers {
 		newStatus, err := handler.GetStatus()
 		if err != nil {
@@ -266,6 +506,7 @@ func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			continue
 		}
 		log.Info("Handler returned status", "status", newStatus)
+		allStatuses = append(allStatuses, newStatus.Status)
 		if err = handler.ApplyStatus(newStatus); err != nil {
 			log.Error(err, "error updating status", "status", newStatus)
 			rls.setErrorIfNotMasking(err)
@@ -279,6 +520,7 @@ func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			degradedExists = true
 		}
 	}
+	var drStatuses []riskifiedv1alpha1.ResourceStatus
 	for _, handler := range mrHandlers {
 		statuses, err := handler.GetStatus()
 		if err != nil {
@@ -286,7 +528,18 @@ func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			rls.subsetMessages[handler.GetSubset()] = rls.subsetMessages[handler.GetSubset()].AppendGlobalMsg("error fetching status: %s", err)
 			continue
 		}
+		if _, ok := handler.(*handlers.DestinationRuleHandler); ok {
+			drStatuses = append(drStatuses, statuses...)
+		}
+		if handlers.RequiresRequeue(statuses) {
+			// Nothing else may trigger a reconcile once these resources are ready
+			nonReadyExists = true
+			rls.nonReadyCS[handler.GetSubset()] = true
+		}
 		log.Info("MRHandler returned statuses", "statuses", statuses)
+		for _, s := range statuses {
+			allStatuses = append(allStatuses, s.Status)
+		}
 		if err = handler.ApplyStatus(statuses); err != nil {
 			log.Error(err, "error updating status", "statuses", statuses)
 			rls.setErrorIfNotMasking(err)
@@ -300,6 +553,26 @@ func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		}
 	}
 
+	if r.DestinationRuleMetrics != nil {
+		namespaces := r.destinationRuleNamespaces(dynamicEnv)
+		if err := handlers.RecordOwnedDestinationRules(ctx, r.Client, r.ownership(), r.DestinationRuleMetrics, namespaces, dynamicEnv, drStatuses); err != nil {
+			// Only the metrics are affected
+			log.Error(err, "error recording owned destination rules")
+		}
+	}
+
+	if len(drStatuses) > 0 {
+		if err := statusHandler.SetDestinationRulesCondition(handlers.AggregateDestinationRuleStatuses(drStatuses)); err != nil {
+			log.Error(err, "error setting destination rules condition")
+			rls.setErrorIfNotMasking(err)
+		}
+	}
+
+	if err := statusHandler.SetPhase(handlers.ComputeDynamicEnvPhase(allStatuses)); err != nil {
+		log.Error(err, "error setting phase")
+		rls.setErrorIfNotMasking(err)
+	}
+
 	globalState := riskifiedv1alpha1.Processing
 	if !nonReadyExists {
 		globalState = riskifiedv1alpha1.Ready
@@ -314,8 +587,8 @@ func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	statusHandler.SyncSubsetMessagesToStatus(rls.subsetMessages)
 	statusHandler.SyncConsumerMessagesToStatus(rls.consumerMessages)
 	if err := statusHandler.SetGlobalState(globalState, len(subsetsAndConsumers), len(rls.nonReadyCS)); err != nil {
-		if errors.IsConflict(err) {
-			log.Info("Ignoring global status update error due to conflict")
+		if errors.IsConflict(err) || goerrors.As(err, &handlers.SupersededGeneration{}) {
+			log.Info("Ignoring global status update error due to conflict", "error", err)
 		} else {
 			log.Error(err, "error setting global state", "global-state", globalState, "subsetMessages", rls.subsetMessages)
 			rls.setErrorIfNotMasking(err)
@@ -324,9 +597,26 @@ func (r *DynamicEnvReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 	if nonReadyExists && rls.returnError == nil {
 		// Currently we don't get updates on resource's status changes, so we need to requeue.
+		if requeueAfter > 0 {
+			log.V(1).Info("Requeue because of missing base destination rules or unrecorded statuses", "after", requeueAfter)
+			return ctrl.Result{RequeueAfter: requeueAfter}, nil
+		}
+		if r.RequeueBackoff != nil {
+			after := r.RequeueBackoff.Next(owner)
+			log.V(1).Info("Requeue because of non running status", "after", after)
+			return ctrl.Result{RequeueAfter: after}, nil
+		}
 		log.V(1).Info("Requeue because of non running status")
 		return ctrl.Result{Requeue: true}, nil
 	}
+	if expiresIn > 0 && rls.returnError == nil {
+		// Converged, but nothing else may trigger a reconcile once the TTL is exceeded
+		if r.RequeueBackoff != nil {
+			r.RequeueBackoff.Reset(owner)
+		}
+		log.V(1).Info("Requeue for the expiry of the dynamic environment", "after", expiresIn)
+		return ctrl.Result{RequeueAfter: expiresIn}, nil
+	}
 	return ctrl.Result{}, rls.returnError
 }
 
@@ -352,36 +642,10 @@ func findDeletedSC(de *riskifiedv1alpha1.DynamicEnv, allSC map[string]riskifiedv
 	return removed
 }
 
-func (r *DynamicEnvReconciler) locateMatchingServiceHostnames(ctx context.Context, namespace string, ls labels.Set) (serviceHosts []string, err error) {
-
-	services := v1.ServiceList{}
-	var matchingServices []v1.Service
-	if err := r.List(ctx, &services, client.InNamespace(namespace)); err != nil {
-		return serviceHosts, fmt.Errorf("error fetching services list for namespace %s: %w", namespace, err)
-	}
-	for _, service := range services.Items {
-		var matcher labels.Set = service.Spec.Selector
-		selector, err := matcher.AsValidatedSelector()
-		if err != nil {
-			return serviceHosts, fmt.Errorf("error converting service selector (from: %v): %w", matcher, err)
-		}
-		if selector.Matches(ls) {
-			matchingServices = append(matchingServices, service)
-		}
-	}
-
-	switch len(matchingServices) {
-	case 0:
-		return serviceHosts, fmt.Errorf("couldn't find service with matching labels: (%v) in namespace: %s", ls, namespace)
-	default:
-		for _, sh := range matchingServices {
-			serviceHosts = append(serviceHosts, sh.Name)
-		}
-		// This is mainly to be able to test multiple services in Kuttl, but since I'm not expecting more than a few
-		// elements the effect is eligible.
-		sort.Strings(serviceHosts)
-		return serviceHosts, nil
-	}
+// Returns the hosts of the Services (and ServiceEntries, see `ServiceEntryHosts`) selecting the
+// provided pod labels (see `handlers.LocateMatchingServiceHosts`).
+func (r *DynamicEnvReconciler) locateMatchingServiceHostnames(ctx context.Context, namespace string, ls labels.Set) ([]string, error) {
+	return handlers.LocateMatchingServiceHosts(ctx, r.Client, namespace, ls, r.ServiceEntryHosts)
 }
 
 func (r *DynamicEnvReconciler) addFinalizersIfRequired(ctx context.Context, de *riskifiedv1alpha1.DynamicEnv) error {
@@ -430,10 +694,39 @@ func (r *DynamicEnvReconciler) cleanDynamicEnvResources(ctx context.Context, de
 			return ctrl.Result{}, err
 		}
 	}
+	if r.DestinationRuleMetrics != nil && len(de.Finalizers) == 0 {
+		r.DestinationRuleMetrics.ForgetOwner(types.NamespacedName{Name: de.Name, Namespace: de.Namespace})
+	}
 
 	return ctrl.Result{}, nil
 }
 
+// Cleans up the resources of a DynamicEnv whose TTL was exceeded, like on deletion (see
+// cleanDynamicEnvResources) but keeping the finalizers, and marks it as expired. It's done on every
+// reconcile of an expired DynamicEnv (until the TTL is extended), so the resources are not launched
+// again.
+func (r *DynamicEnvReconciler) expireDynamicEnv(ctx context.Context, de *riskifiedv1alpha1.DynamicEnv, expiredAt time.Time) (ctrl.Result, error) {
+	log := ctrllog.FromContext(ctx)
+	log.Info("Dynamic Env expired, cleaning up ...", "expiredAt", expiredAt)
+	if _, err := r.cleanupDeployments(ctx, de); err != nil {
+		log.Error(err, "error cleaning up the deployments of an expired dynamic env")
+		return ctrl.Result{}, err
+	}
+	if _, err := r.cleanupDestinationRules(ctx, de); err != nil {
+		log.Error(err, "error cleaning up the destination rules of an expired dynamic env")
+		return ctrl.Result{}, err
+	}
+	if err := r.cleanupVirtualServices(ctx, de); err != nil {
+		log.Error(err, "error cleaning up the virtual services of an expired dynamic env")
+		return ctrl.Result{}, err
+	}
+	statusHandler := handlers.DynamicEnvStatusHandler{Client: r.Client, Ctx: ctx, DynamicEnv: de}
+	if err := statusHandler.SetExpired(expiredAt); err != nil {
+		return ctrl.Result{}, fmt.Errorf("error marking the dynamic env as expired: %w", err)
+	}
+	return ctrl.Result{}, nil
+}
+
 // Deletes created deployments on controller deletion and deletes the finalizer once all the deployments are deleted.
 // Returns the number of identified resources that are not yet deleted (and error if happened).
 func (r *DynamicEnvReconciler) cleanupDeployments(ctx context.Context, de *riskifiedv1alpha1.DynamicEnv) (int, error) {
@@ -465,28 +758,75 @@ func (r *DynamicEnvReconciler) cleanupDeployments(ctx context.Context, de *riski
 // Deletes created destination rules on controller deletion. Deletes the finalizer once all DRs are deleted. Returns the
 // number of running DRs and error.
 func (r *DynamicEnvReconciler) cleanupDestinationRules(ctx context.Context, de *riskifiedv1alpha1.DynamicEnv) (int, error) {
-	var drs []riskifiedv1alpha1.ResourceStatus
 	var runningCount int
-	for _, s := range de.Status.SubsetsStatus {
-		drs = append(drs, s.DestinationRules...)
+	var subsets []string
+	for subset := range de.Status.SubsetsStatus {
+		subsets = append(subsets, subset)
 	}
-	for _, item := range drs {
-		ctrl.Log.Info("Cleaning up destination rule ...", "destinationRule", item)
-		found := istionetwork.DestinationRule{}
-		if err := r.Get(ctx, types.NamespacedName{Name: item.Name, Namespace: item.Namespace}, &found); err != nil {
-			if errors.IsNotFound(err) { // if not found assume deleted
-				continue
+	sort.Strings(subsets)
+	statusHandler := handlers.DynamicEnvStatusHandler{Client: r.Client, Ctx: ctx, DynamicEnv: de}
+	for _, subset := range subsets {
+		// The rules that still exist are reported as terminating, the ones that are gone are dropped
+		var remaining []riskifiedv1alpha1.ResourceStatus
+		for _, item := range de.Status.SubsetsStatus[subset].DestinationRules {
+			ctrl.Log.Info("Cleaning up destination rule ...", "destinationRule", item)
+			found, err := r.deleteDestinationRule(ctx, item, de)
+			if found {
+				runningCount += 1
+				item.Status = riskifiedv1alpha1.Terminating
+				remaining = append(remaining, item)
+			}
+			if err != nil {
+				return runningCount, fmt.Errorf("error cleaning up destination rule (%v): %w", item, err)
 			}
-			return runningCount, fmt.Errorf("error searching for destination rule (%v): %w", item, err)
 		}
-		runningCount += 1
-		if err := r.Delete(ctx, &found); err != nil {
-			return runningCount, fmt.Errorf("error deleting destination rule %v: %w", &found, err)
+		if err := statusHandler.SetDestinationRuleStatuses(subset, remaining); err != nil {
+			return runningCount, fmt.Errorf("error updating the status of terminating destination rules: %w", err)
+		}
+	}
+	// Catch owned destination rules which are not (or no longer) in the status
+	owner := types.NamespacedName{Name: de.Name, Namespace: de.Namespace}
+	for _, ns := range r.destinationRuleNamespaces(de) {
+		handler := handlers.DestinationRuleHandler{
+			Client:              r.Client,
+			UniqueVersion:       helpers.UniqueDynamicEnvName(de),
+			VersionLabel:        r.VersionLabel,
+			VersionLabelsByHost: r.VersionLabelsByHost,
+			ClusterDomain:       r.ClusterDomain,
+			Namespace:           ns,
+			Owner:               owner,
+			OwnerUID:            de.UID,
+			OwnerAnnotation:     r.OwnerAnnotation,
+			Log:                 ctrl.Log,
+			Ctx:                 ctx,
+		}
+		if err := handler.Cleanup(); err != nil {
+			return runningCount, fmt.Errorf("error cleaning up owned destination rules in namespace %s: %w", ns, err)
 		}
 	}
 	return runningCount, nil
 }
 
+// Returns the (sorted) namespaces the DestinationRules of the provided DynamicEnv may reside in.
+func (r *DynamicEnvReconciler) destinationRuleNamespaces(de *riskifiedv1alpha1.DynamicEnv) []string {
+	var namespaces []string
+	for _, s := range de.Spec.Subsets {
+		if !helpers.StringSliceContains(s.Namespace, namespaces) {
+			namespaces = append(namespaces, s.Namespace)
+		}
+	}
+	if r.DestinationRuleNamespace != "" {
+		namespaces = []string{r.DestinationRuleNamespace}
+	}
+	for _, ns := range r.DestinationRuleNamespacesByHost {
+		if !helpers.StringSliceContains(ns, namespaces) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
 func (r *DynamicEnvReconciler) cleanupVirtualServices(ctx context.Context, de *riskifiedv1alpha1.DynamicEnv) error {
 	vss := collectVirtualServices(de)
 	for _, item := range vss {
@@ -511,13 +851,42 @@ func (r *DynamicEnvReconciler) deleteFinalizer(ctx context.Context, finalizer st
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *DynamicEnvReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	// Re-enqueue the owners of all the owned resources periodically in case watch events were lost
+	// (relisted from the API server, as the cache misses the same events)
+	resync := watches.NewAnnotationResync(mgr.GetAPIReader(), r.ResyncPeriod,
+		func() client.ObjectList { return &appsv1.DeploymentList{} },
+		func() client.ObjectList { return &istionetwork.DestinationRuleList{} },
+		func() client.ObjectList { return &istionetwork.VirtualServiceList{} },
+	)
+	resync.AnnotationKey = r.OwnerAnnotation
+	if err := mgr.Add(resync); err != nil {
+		return fmt.Errorf("adding owned resources resync: %w", err)
+	}
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&riskifiedv1alpha1.DynamicEnv{}).
-		Watches(&source.Kind{Type: &appsv1.Deployment{}}, &watches.EnqueueRequestForAnnotation{}).
-		Watches(&source.Kind{Type: &istionetwork.DestinationRule{}}, &watches.EnqueueRequestForAnnotation{}).
-		Watches(&source.Kind{Type: &istionetwork.VirtualService{}}, &watches.EnqueueRequestForAnnotation{}).
-		WithEventFilter(predicate.GenerationChangedPredicate{}).
-		Complete(r)
+		Watches(&source.Kind{Type: &appsv1.Deployment{}}, &watches.EnqueueRequestForAnnotation{AnnotationKey: r.OwnerAnnotation},
+			builder.WithPredicates(watches.OwnedResourceChangedPredicate{AnnotationKey: r.OwnerAnnotation})).
+		Watches(&source.Kind{Type: &istionetwork.DestinationRule{}}, &watches.EnqueueRequestForAnnotation{AnnotationKey: r.OwnerAnnotation},
+			builder.WithPredicates(watches.OwnedResourceChangedPredicate{AnnotationKey: r.OwnerAnnotation})).
+		Watches(&source.Kind{Type: &istionetwork.VirtualService{}}, &watches.EnqueueRequestForAnnotation{AnnotationKey: r.OwnerAnnotation},
+			builder.WithPredicates(watches.OwnedResourceChangedPredicate{AnnotationKey: r.OwnerAnnotation})).
+		Watches(resync.Source(), &watches.EnqueueRequestForAnnotation{AnnotationKey: r.OwnerAnnotation})
+	if r.Trigger != nil {
+		b = b.Watches(r.Trigger.Source(), &handler.EnqueueRequestForObject{})
+	}
+	return b.WithEventFilter(predicate.GenerationChangedPredicate{}).Complete(r)
+}
+
+// DynamicEnvStatus returns the status of the requested DynamicEnv (e.g. for the debug endpoint, see
+// `watches.ReconcileTrigger`).
+func DynamicEnvStatus(c client.Reader) watches.StatusFunc {
+	return func(ctx context.Context, key types.NamespacedName) (interface{}, error) {
+		de := &riskifiedv1alpha1.DynamicEnv{}
+		if err := c.Get(ctx, key, de); err != nil {
+			return nil, err
+		}
+		return de.Status, nil
+	}
 }
 
 // Cleanup subsets and consumers that are removed from the dynamic environment CRD.
@@ -573,6 +942,23 @@ func (r *DynamicEnvReconciler) cleanupConsumer(ctx context.Context, name string,
 	return nil
 }
 
+// Returns the per-host version labels that are different from the global version label (so the
+// overriding deployments could be selected by all of them).
+func (r *DynamicEnvReconciler) extraVersionLabels() (result []string) {
+	for _, l := range r.VersionLabelsByHost {
+		if l != r.VersionLabel && !helpers.StringSliceContains(l, result) {
+			result = append(result, l)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Returns the ownership annotations of the shared resources (see OwnerAnnotation).
+func (r *DynamicEnvReconciler) ownership() watches.Ownership {
+	return watches.Ownership{Key: r.OwnerAnnotation}
+}
+
 // searches for `name` in the subsetsStatus and delete it. If not found deletes from status
 func (r *DynamicEnvReconciler) cleanupSubset(ctx context.Context, name string, de *riskifiedv1alpha1.DynamicEnv) error {
 	st, ok := de.Status.SubsetsStatus[name]
@@ -586,7 +972,7 @@ func (r *DynamicEnvReconciler) cleanupSubset(ctx context.Context, name string, d
 			exists = found
 		}
 		for _, dr := range st.DestinationRules {
-			found, err := r.deleteDestinationRule(ctx, dr)
+			found, err := r.deleteDestinationRule(ctx, dr, de)
 			if err != nil {
 				return fmt.Errorf("deleting destination rule from removed subset: %w", err)
 			}
@@ -624,18 +1010,43 @@ func (r *DynamicEnvReconciler) deleteDeployment(ctx context.Context, deployment
 	return true, nil
 }
 
-func (r *DynamicEnvReconciler) deleteDestinationRule(ctx context.Context, dr riskifiedv1alpha1.ResourceStatus) (found bool, err error) {
-	toDelete := istionetwork.DestinationRule{}
-	if err := r.Get(ctx, types.NamespacedName{Name: dr.Name, Namespace: dr.Namespace}, &toDelete); err != nil {
-		if errors.IsNotFound(err) {
-			return false, nil
+// Deletes the destination rule if we're its only owner. Otherwise (e.g. shared destination rule)
+// only removes our subset and ownership from it. Returns whether the destination rule was still
+// owned by us.
+func (r *DynamicEnvReconciler) deleteDestinationRule(ctx context.Context, dr riskifiedv1alpha1.ResourceStatus, de *riskifiedv1alpha1.DynamicEnv) (found bool, err error) {
+	owner := types.NamespacedName{Name: de.Name, Namespace: de.Namespace}
+	ownership := r.ownership()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		toDelete := istionetwork.DestinationRule{}
+		if err := r.Get(ctx, types.NamespacedName{Name: dr.Name, Namespace: dr.Namespace}, &toDelete); err != nil {
+			if errors.IsNotFound(err) {
+				found = false
+				return nil
+			}
+			return fmt.Errorf("fetching destination rule for deletion: %w", err)
 		}
-		return false, fmt.Errorf("fetching destination rule for deletion: %w", err)
-	}
-	if err := r.Delete(ctx, &toDelete); err != nil {
-		return true, fmt.Errorf("deleting destination rule: %w", err)
-	}
-	return true, nil
+		if len(ownership.OwnersOf(&toDelete)) > 0 && !ownership.ContainsOwner(owner, de.UID, &toDelete) {
+			// Already released by us (or owned by a previous DynamicEnv with the same name)
+			found = false
+			return nil
+		}
+		versionLabel := helpers.VersionLabelFor(toDelete.Spec.Host, toDelete.Namespace, r.ClusterDomain, r.VersionLabel, r.VersionLabelsByHost)
+		if len(ownership.OwnersOf(&toDelete)) == 0 && !handlers.ContainsVersionSubset(&toDelete, versionLabel, helpers.UniqueDynamicEnvName(de)) {
+			// Already released by us, but kept for the subsets of others
+			found = false
+			return nil
+		}
+		found = true
+		if handlers.ReleaseDestinationRule(ownership, &toDelete, owner, versionLabel, helpers.UniqueDynamicEnvName(de)) {
+			if err := r.Delete(ctx, &toDelete); err != nil {
+				return fmt.Errorf("deleting destination rule: %w", err)
+			}
+			return nil
+		}
+		ctrl.Log.Info("Removing our subset from shared destination rule", "destinationRule", dr)
+		return r.Update(ctx, &toDelete)
+	})
+	return found, err
 }
 
 func (r *DynamicEnvReconciler) cleanupVirtualService(ctx context.Context, vs riskifiedv1alpha1.ResourceStatus, de *riskifiedv1alpha1.DynamicEnv) error {
@@ -660,7 +1071,7 @@ func (r *DynamicEnvReconciler) cleanupVirtualService(ctx context.Context, vs ris
 		newRoutes = append(newRoutes, route)
 	}
 	found.Spec.Http = newRoutes
-	watches.RemoveFromAnnotation(types.NamespacedName{Name: de.Name, Namespace: de.Namespace}, &found)
+	r.ownership().RemoveFromAnnotation(types.NamespacedName{Name: de.Name, Namespace: de.Namespace}, &found)
 	if err := r.Update(ctx, &found); err != nil {
 		ctrl.Log.Error(err, "error updating virtual service after cleanup", "virtual-service", found.Name)
 		return err
@@ -702,3 +1113,11 @@ func markedForDeletion(de *riskifiedv1alpha1.DynamicEnv) bool {
 func mkSubsetUniqueName(name, version string) string {
 	return name + "-" + version
 }
+
+// The percentage of the matching traffic routed to the subset (all of it unless configured)
+func subsetWeight(s riskifiedv1alpha1.Subset) int32 {
+	if s.Weight == nil {
+		return 100
+	}
+	return *s.Weight
+}
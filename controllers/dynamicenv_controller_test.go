@@ -0,0 +1,294 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	goerrors "errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	istioapi "istio.io/api/networking/v1alpha3"
+	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"github.com/riskified/dynamic-environment/pkg/handlers"
+	"github.com/riskified/dynamic-environment/pkg/names"
+	"github.com/riskified/dynamic-environment/pkg/watches"
+)
+
+var _ = Describe("DynamicEnvReconciler", func() {
+	owner := types.NamespacedName{Name: "de", Namespace: "team"}
+	request := ctrl.Request{NamespacedName: owner}
+
+	mkDynamicEnv := func() *riskifiedv1alpha1.DynamicEnv {
+		return &riskifiedv1alpha1.DynamicEnv{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              owner.Name,
+				Namespace:         owner.Namespace,
+				UID:               "uid",
+				CreationTimestamp: metav1.Now(),
+				Finalizers:        []string{names.DeleteDeployments, names.DeleteDestinationRules, names.CleanupVirtualServices},
+			},
+			Spec: riskifiedv1alpha1.DynamicEnvSpec{
+				IstioMatches: []riskifiedv1alpha1.IstioMatch{{Headers: map[string]riskifiedv1alpha1.StringMatch{"end-user": {Exact: "jason"}}}},
+				Subsets: []riskifiedv1alpha1.Subset{{
+					Name:       "details",
+					Namespace:  "services",
+					Containers: []riskifiedv1alpha1.ContainerOverrides{{ContainerName: "details", Image: "details:new"}},
+				}},
+			},
+		}
+	}
+	mkBaseDeployment := func() *appsv1.Deployment {
+		podLabels := map[string]string{"app": "details", "version": "shared"}
+		var replicas int32 = 1
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "details", Namespace: "services", Labels: map[string]string{"app": "details"}},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: podLabels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: podLabels},
+					Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "details", Image: "details:shared"}}},
+				},
+			},
+		}
+	}
+	mkService := func() *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "details", Namespace: "services"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "details"}},
+		}
+	}
+	mkVirtualService := func() *istionetwork.VirtualService {
+		return &istionetwork.VirtualService{
+			ObjectMeta: metav1.ObjectMeta{Name: "details", Namespace: "services"},
+			Spec: istioapi.VirtualService{
+				Hosts: []string{"details"},
+				Http: []*istioapi.HTTPRoute{{
+					Route: []*istioapi.HTTPRouteDestination{{Destination: &istioapi.Destination{Host: "details", Subset: "shared"}}},
+				}},
+			},
+		}
+	}
+	mkBaseDestinationRule := func() *istionetwork.DestinationRule {
+		return &istionetwork.DestinationRule{
+			ObjectMeta: metav1.ObjectMeta{Name: "details", Namespace: "services"},
+			Spec: istioapi.DestinationRule{
+				Host:    "details",
+				Subsets: []*istioapi.Subset{{Name: "shared", Labels: map[string]string{"version": "shared"}}},
+			},
+		}
+	}
+	mkReconciler := func(objects ...client.Object) *DynamicEnvReconciler {
+		s := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(s)).To(Succeed())
+		Expect(riskifiedv1alpha1.AddToScheme(s)).To(Succeed())
+		Expect(istionetwork.AddToScheme(s)).To(Succeed())
+		return &DynamicEnvReconciler{
+			Client:         fake.NewClientBuilder().WithScheme(s).WithObjects(objects...).Build(),
+			Scheme:         s,
+			VersionLabel:   "version",
+			DefaultVersion: "shared",
+			ClusterDomain:  "cluster.local",
+			Recorder:       record.NewFakeRecorder(100),
+		}
+	}
+	fetch := func(r *DynamicEnvReconciler) *riskifiedv1alpha1.DynamicEnv {
+		de := &riskifiedv1alpha1.DynamicEnv{}
+		Expect(r.Get(context.Background(), owner, de)).To(Succeed())
+		return de
+	}
+
+	Context("missing base destination rules", func() {
+		It("checks again for missing base destination rules within the grace period", func() {
+			r := mkReconciler(mkDynamicEnv(), mkBaseDeployment(), mkService(), mkVirtualService())
+			r.BaseDestinationRuleGracePeriod = 10 * time.Minute
+			r.BaseDestinationRuleBackoff = 30 * time.Second
+			result, err := r.Reconcile(context.Background(), request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(30 * time.Second))
+
+			// Still waiting for the base destination rule
+			statuses := fetch(r).Status.SubsetsStatus["details-team-de"].DestinationRules
+			Expect(statuses).To(HaveLen(1))
+			Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Initializing))
+		})
+
+		It("stops checking for missing base destination rules once the grace period is over", func() {
+			de := mkDynamicEnv()
+			missingSince := metav1.NewTime(time.Now().Add(-time.Hour))
+			de.Status.SubsetsStatus = map[string]riskifiedv1alpha1.SubsetStatus{
+				"details-team-de": {
+					DestinationRules: []riskifiedv1alpha1.ResourceStatus{{
+						Name:         "details-team-de-details",
+						Namespace:    "services",
+						ServiceHost:  "details",
+						Status:       riskifiedv1alpha1.Initializing,
+						MissingSince: &missingSince,
+					}},
+				},
+			}
+			r := mkReconciler(de, mkBaseDeployment(), mkService(), mkVirtualService())
+			r.BaseDestinationRuleGracePeriod = 10 * time.Minute
+			r.BaseDestinationRuleBackoff = 30 * time.Second
+			result, err := r.Reconcile(context.Background(), request)
+			// The subset has no other hosts, so it is retried as an error (with the rate limiter)
+			Expect(goerrors.As(err, &handlers.NoBaseDestinationRules{})).To(BeTrue())
+			Expect(result.RequeueAfter).To(BeZero())
+
+			statuses := fetch(r).Status.SubsetsStatus["details-team-de"].DestinationRules
+			Expect(statuses).To(HaveLen(1))
+			Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.IgnoredMissingDR))
+		})
+	})
+
+	Context("initializing subsets", func() {
+		It("backs off while the subset deployments are initializing", func() {
+			r := mkReconciler(mkDynamicEnv(), mkBaseDeployment(), mkService(), mkVirtualService(), mkBaseDestinationRule())
+			r.RequeueBackoff = handlers.NewRequeueBackoff(time.Second, time.Minute)
+			result, err := r.Reconcile(context.Background(), request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(time.Second))
+
+			Expect(fetch(r).Status.State).To(Equal(riskifiedv1alpha1.Processing))
+
+			result, err = r.Reconcile(context.Background(), request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(2 * time.Second))
+		})
+
+		It("requeues through the rate limiter without a backoff", func() {
+			r := mkReconciler(mkDynamicEnv(), mkBaseDeployment(), mkService(), mkVirtualService(), mkBaseDestinationRule())
+			result, err := r.Reconcile(context.Background(), request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(ctrl.Result{Requeue: true}))
+		})
+	})
+
+	Context("an expired dynamic environment", func() {
+		var ttl int64 = 60
+		mkExpired := func() *riskifiedv1alpha1.DynamicEnv {
+			de := mkDynamicEnv()
+			de.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+			de.Spec.TTLSecondsAfterCreation = &ttl
+			de.Status.SubsetsStatus = map[string]riskifiedv1alpha1.SubsetStatus{
+				"details-team-de": {
+					DestinationRules: []riskifiedv1alpha1.ResourceStatus{
+						{Name: "details-team-de", Namespace: "services", ServiceHost: "details", Status: riskifiedv1alpha1.Running},
+					},
+				},
+			}
+			return de
+		}
+		mkOwnedDestinationRule := func() *istionetwork.DestinationRule {
+			dr := &istionetwork.DestinationRule{
+				ObjectMeta: metav1.ObjectMeta{Name: "details-team-de", Namespace: "services"},
+				Spec: istioapi.DestinationRule{
+					Host: "details",
+					Subsets: []*istioapi.Subset{{
+						Name:   "details-team-de",
+						Labels: map[string]string{"version": "team-de"},
+					}},
+				},
+			}
+			watches.AddToAnnotation(owner, dr)
+			watches.AddOwnerUID(owner, "uid", dr)
+			return dr
+		}
+
+		It("deletes its destination rules and does not requeue", func() {
+			r := mkReconciler(mkExpired(), mkOwnedDestinationRule())
+			result, err := r.Reconcile(context.Background(), request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(ctrl.Result{}))
+
+			err = r.Get(context.Background(), types.NamespacedName{Name: "details-team-de", Namespace: "services"}, &istionetwork.DestinationRule{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+			de := fetch(r)
+			statuses := de.Status.SubsetsStatus["details-team-de"].DestinationRules
+			Expect(statuses).To(HaveLen(1))
+			Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Terminating))
+			Expect(meta.IsStatusConditionTrue(de.Status.Conditions, "Expired")).To(BeTrue())
+			Expect(de.Finalizers).To(HaveLen(3))
+		})
+
+		It("keeps the destination rules shared with other dynamic environments", func() {
+			other := types.NamespacedName{Name: "other", Namespace: "team"}
+			dr := mkOwnedDestinationRule()
+			dr.Spec.Subsets = append(dr.Spec.Subsets, &istioapi.Subset{Name: "details-team-other", Labels: map[string]string{"version": "team-other"}})
+			watches.AddToAnnotation(other, dr)
+			watches.AddOwnerUID(other, "other-uid", dr)
+			r := mkReconciler(mkExpired(), dr)
+			_, err := r.Reconcile(context.Background(), request)
+			Expect(err).NotTo(HaveOccurred())
+
+			found := &istionetwork.DestinationRule{}
+			Expect(r.Get(context.Background(), types.NamespacedName{Name: "details-team-de", Namespace: "services"}, found)).To(Succeed())
+			Expect(found.Spec.Subsets).To(HaveLen(1))
+			Expect(found.Spec.Subsets[0].Name).To(Equal("details-team-other"))
+			Expect(watches.OwnersOf(found)).To(Equal([]types.NamespacedName{other}))
+		})
+
+		It("does not launch the subsets", func() {
+			r := mkReconciler(mkExpired(), mkBaseDeployment(), mkService())
+			_, err := r.Reconcile(context.Background(), request)
+			Expect(err).NotTo(HaveOccurred())
+
+			deployments := &appsv1.DeploymentList{}
+			Expect(r.List(context.Background(), deployments)).To(Succeed())
+			Expect(deployments.Items).To(HaveLen(1))
+			Expect(deployments.Items[0].Name).To(Equal("details"))
+		})
+
+		It("requeues for the expiry once converged", func() {
+			var ttl int64 = 3600
+			de := mkDynamicEnv()
+			de.Spec.TTLSecondsAfterCreation = &ttl
+			r := mkReconciler(de, mkBaseDeployment(), mkService(), mkVirtualService(), mkBaseDestinationRule())
+			_, err := r.Reconcile(context.Background(), request)
+			Expect(err).NotTo(HaveOccurred())
+			deployment := &appsv1.Deployment{}
+			Expect(r.Get(context.Background(), types.NamespacedName{Name: "details-team-de", Namespace: "services"}, deployment)).To(Succeed())
+			deployment.Status.Conditions = []appsv1.DeploymentCondition{{
+				Type:   appsv1.DeploymentProgressing,
+				Status: corev1.ConditionTrue,
+				Reason: "NewReplicaSetAvailable",
+			}}
+			Expect(r.Status().Update(context.Background(), deployment)).To(Succeed())
+
+			result, err := r.Reconcile(context.Background(), request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fetch(r).Status.State).To(Equal(riskifiedv1alpha1.Ready))
+			Expect(result.RequeueAfter).To(BeNumerically("~", time.Hour, time.Minute))
+		})
+	})
+})
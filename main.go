@@ -19,22 +19,34 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/riskified/dynamic-environment/pkg/features"
+	"github.com/riskified/dynamic-environment/pkg/handlers"
+	"github.com/riskified/dynamic-environment/pkg/health"
 	"github.com/riskified/dynamic-environment/pkg/metrics"
 	"github.com/riskified/dynamic-environment/pkg/names"
+	"github.com/riskified/dynamic-environment/pkg/watches"
 	"os"
 	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
+	"golang.org/x/time/rate"
+	istioapi "istio.io/api/networking/v1alpha3"
 	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	k8smetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
 	"github.com/riskified/dynamic-environment/controllers"
@@ -81,6 +93,41 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
+// Parses a list of <service-host>=<value> pairs
+func parseHostPairs(pairs []string) (map[string]string, error) {
+	byHost := map[string]string{}
+	for _, pair := range pairs {
+		host, value, ok := strings.Cut(pair, "=")
+		if !ok || host == "" || value == "" {
+			return nil, fmt.Errorf("expected <service-host>=<value>, got %q", pair)
+		}
+		byHost[host] = value
+	}
+	return byHost, nil
+}
+
+// Returns the value of the environment variable, or the provided default if it's not set
+func envOrDefault(name, defaultValue string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// Returns the zap option selecting the encoding of the log lines (json or console). Keeps the
+// encoder selected by the zap flags if the format is empty.
+func logEncoder(format string) (zap.Opts, error) {
+	switch format {
+	case "":
+		return func(*zap.Options) {}, nil
+	case "json":
+		return zap.JSONEncoder(), nil
+	case "console":
+		return zap.ConsoleEncoder(), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q (expected json or console)", format)
+}
+
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
@@ -88,6 +135,47 @@ func main() {
 	var versionLabel string
 	var defaultVersion string
 	var labelsToRemove arrayFlags
+	var sharedDestinationRules bool
+	var clusterDomain string
+	var subsetNameTemplate string
+	var maxAnnotationOwners int
+	var subsetTLSMode string
+	var versionLabelsByHost arrayFlags
+	var defaultVersionsByHost arrayFlags
+	var waitForDeployment bool
+	var baseDestinationRuleGracePeriod time.Duration
+	var baseDestinationRuleBackoff time.Duration
+	var destinationRuleNamespace string
+	var destinationRuleNamespacesByHost arrayFlags
+	var baseLookupKubeconfig string
+	var strictDestinationRuleOwnership bool
+	var strictHosts bool
+	var destinationRuleServerSideApply bool
+	var noOverrideAnnotation string
+	var resyncPeriod time.Duration
+	var serviceEntryHosts bool
+	var matchDestinationRulesByService bool
+	var exportedBaseDestinationRules bool
+	var shortHostsInServiceNamespace bool
+	var operationTimeout time.Duration
+	var destinationRuleWriteQPS float64
+	var destinationRuleWriteBurst int
+	var destinationRuleHostConcurrency int
+	var featureGates features.Gates
+	var reconcileTimeout time.Duration
+	var statusFlushInterval time.Duration
+	var statusTransitionHistory int
+	var allowedNamespaces arrayFlags
+	var deniedNamespaces arrayFlags
+	var propagatedLabels arrayFlags
+	var propagatedAnnotations arrayFlags
+	var logFormat string
+	var ownerAnnotation string
+	var enableDebugEndpoints bool
+	var readyzErrorThreshold float64
+	var readyzErrorWindow time.Duration
+	var requeueBackoff time.Duration
+	var maxRequeueBackoff time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -97,14 +185,148 @@ func main() {
 		"This is the name of the label used to differentiate versions (default vs overriding).")
 	flag.StringVar(&defaultVersion, "default-version", names.DefaultVersion,
 		"The global default version - this version is the one that gets the default route. Could be overridden per subset.")
+	flag.Var(&versionLabelsByHost, "version-label-per-host",
+		"A comma separated list of <service-host>=<label> pairs for services that use a different version label.")
+	flag.Var(&defaultVersionsByHost, "default-version-per-host",
+		"A comma separated list of <service-host>=<version> pairs for services whose base DestinationRules use a different default version.")
 	flag.Var(&labelsToRemove, "remove-labels", "A comma separated list of labels to remove when duplicating deployment.")
+	flag.StringVar(&clusterDomain, "cluster-domain", names.DefaultClusterDomain,
+		"The cluster domain used to fully qualify service hosts.")
+	flag.StringVar(&subsetNameTemplate, "subset-name-template", "",
+		"A Go template for the names of generated subsets (with .UniqueVersion and .BaseSubsetName). Defaults to the unique version.")
+	flag.BoolVar(&sharedDestinationRules, "shared-destination-rules", false,
+		"Share a single DestinationRule per service host between all dynamic environments (each adding its own subset).")
+	flag.IntVar(&maxAnnotationOwners, "max-annotation-owners", 0,
+		"The maximum number of dynamic environments that may share a single resource (0 for no limit).")
+	flag.StringVar(&subsetTLSMode, "subset-tls-mode", "",
+		"Override the TLS mode of the generated subsets (e.g. ISTIO_MUTUAL, DISABLE). Defaults to the TLS settings of the base subset.")
+	flag.BoolVar(&waitForDeployment, "wait-for-deployment", false,
+		"Only create the DestinationRules (and routes) of a subset once its deployment is running.")
+	flag.DurationVar(&baseDestinationRuleGracePeriod, "base-destination-rule-grace-period", 0,
+		"How long since a base DestinationRule was first found missing to keep checking for it before ignoring it (0 to ignore them right away).")
+	flag.DurationVar(&baseDestinationRuleBackoff, "base-destination-rule-backoff", handlers.DefaultBaseDestinationRuleBackoff,
+		"The interval between checks for missing base DestinationRules (during base-destination-rule-grace-period).")
+	flag.StringVar(&destinationRuleNamespace, "destination-rule-namespace", "",
+		"The namespace of the base (and generated) DestinationRules. Defaults to the namespace of each subset.")
+	flag.Var(&destinationRuleNamespacesByHost, "destination-rule-namespace-per-host",
+		"A comma separated list of <service-host>=<namespace> pairs for services whose base DestinationRules are in another namespace.")
+	flag.StringVar(&baseLookupKubeconfig, "base-lookup-kubeconfig", "",
+		"A kubeconfig of the (config) cluster to discover the base DestinationRules in. Defaults to the cluster we run in.")
+	flag.DurationVar(&resyncPeriod, "resync-period", watches.DefaultResyncPeriod,
+		"The interval between relists of the owned resources (re-enqueueing their dynamic environments).")
+	flag.BoolVar(&strictDestinationRuleOwnership, "strict-destination-rule-ownership", false,
+		"Do not modify existing DestinationRules that are owned by others (they are reported as conflicting instead of being adopted).")
+	flag.BoolVar(&strictHosts, "strict-hosts", false,
+		"Report hosts without a base DestinationRule (after the grace period) as errors, degrading the dynamic environment, instead of ignoring them.")
+	flag.BoolVar(&destinationRuleServerSideApply, "destination-rule-server-side-apply", false,
+		"Write the generated DestinationRules using server-side apply (as the \""+names.DestinationRuleFieldManager+"\" field manager) instead of create / update.")
+	flag.StringVar(&noOverrideAnnotation, "no-override-annotation", names.DefaultNoOverrideAnnotation,
+		"Base DestinationRules with this annotation set to \"true\" are never overridden (their hosts are reported as opted out).")
+	flag.BoolVar(&serviceEntryHosts, "service-entry-hosts", false,
+		"Also route to the hosts of ServiceEntries selecting the subset workloads (even without a base DestinationRule).")
+	flag.BoolVar(&matchDestinationRulesByService, "match-destination-rules-by-service", false,
+		"Fall back to matching base DestinationRules whose hosts resolve to the same Kubernetes Service as the subset hosts (e.g. using another cluster domain or an ExternalName alias).")
+	flag.BoolVar(&exportedBaseDestinationRules, "exported-base-destination-rules", false,
+		"Also consider the base DestinationRules of other namespaces (e.g. of an ingress gateway) that are exported to the subset namespace, when none of the ones in the subset namespace match.")
+	flag.BoolVar(&shortHostsInServiceNamespace, "short-hosts-in-service-namespace", false,
+		"Resolve the short hosts (bare service names) of base DestinationRules of other namespaces than the subset one (exported or in the destination rule namespace) relative to the subset namespace.")
+	flag.DurationVar(&operationTimeout, "operation-timeout", 0,
+		"The timeout of individual DestinationRule API calls (get/list/create/update/patch/delete, 0 for no timeout).")
+	flag.Float64Var(&destinationRuleWriteQPS, "destination-rule-write-qps", 0,
+		"The maximum rate (per second) of DestinationRule creates / updates, smoothing the bursts of dynamic environments with many hosts (0 for no limit).")
+	flag.IntVar(&destinationRuleWriteBurst, "destination-rule-write-burst", 10,
+		"The number of DestinationRule writes allowed at once beyond destination-rule-write-qps.")
+	flag.IntVar(&destinationRuleHostConcurrency, "destination-rule-host-concurrency", 1,
+		"The maximum number of service hosts of a subset whose DestinationRules are handled concurrently (sequentially if 1). Requires the ConcurrentHosts feature gate.")
+	flag.Var(&featureGates, "feature-gates",
+		"A comma-separated list of name=bool pairs enabling experimental behaviors (e.g. ConcurrentHosts=true). All the gates are off by default.")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", 0,
+		"The timeout of a single reconcile (0 for no timeout).")
+	flag.DurationVar(&statusFlushInterval, "status-flush-interval", 0,
+		"How often the statuses of the DestinationRules handled so far are persisted during a reconcile (after each host if 0).")
+	flag.IntVar(&statusTransitionHistory, "status-transition-history", 0,
+		"The number of the latest status transitions recorded per resource in the status (0 to not record them).")
+	flag.Var(&allowedNamespaces, "allowed-namespaces",
+		"A comma separated list of the namespaces DestinationRules may be created in. Defaults to all namespaces.")
+	flag.Var(&deniedNamespaces, "denied-namespaces",
+		"A comma separated list of the namespaces DestinationRules may not be created in (takes precedence over allowed-namespaces).")
+	flag.Var(&propagatedLabels, "propagate-labels",
+		"A comma separated list of DynamicEnv labels to copy onto the generated DestinationRules (the version label always wins).")
+	flag.Var(&propagatedAnnotations, "propagate-annotations",
+		"A comma separated list of DynamicEnv annotations to copy onto the generated DestinationRules.")
+	flag.Float64Var(&readyzErrorThreshold, "readyz-error-threshold", 0,
+		"Fail the readiness check when more than this fraction (0-1) of the recent reconciles failed (0 to disable).")
+	flag.DurationVar(&readyzErrorWindow, "readyz-error-window", health.DefaultWindow,
+		"The period of the reconciles taken into account by readyz-error-threshold.")
+	flag.StringVar(&ownerAnnotation, "owner-annotation", envOrDefault("OWNER_ANNOTATION", names.NamespacedNameAnnotation),
+		"The annotation key recording the dynamic environments owning a resource (could also be set with OWNER_ANNOTATION). "+
+			"Operator instances running side by side should use different keys.")
+	flag.DurationVar(&requeueBackoff, "requeue-backoff", handlers.DefaultRequeueBackoff,
+		"The initial delay before reconciling again a dynamic environment whose resources are not ready yet (doubled on every attempt).")
+	flag.DurationVar(&maxRequeueBackoff, "max-requeue-backoff", handlers.DefaultMaxRequeueBackoff,
+		"The maximum delay before reconciling again a dynamic environment whose resources are not ready yet.")
+	flag.BoolVar(&enableDebugEndpoints, "enable-debug-endpoints", false,
+		"Serve the debug endpoints (e.g. "+watches.ReconcileTriggerPath+" to trigger reconciles) on the metrics address.")
+	flag.StringVar(&logFormat, "log-format", "",
+		"The encoding of the log lines: json or console. Defaults to the encoding selected by the zap flags.")
 	opts := zap.Options{
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	encoder, err := logEncoder(logFormat)
+	if err != nil {
+		ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+		setupLog.Error(err, "invalid log-format")
+		os.Exit(1)
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts), encoder))
+
+	if _, err := watches.NewOwnership(ownerAnnotation); err != nil {
+		setupLog.Error(err, "invalid owner-annotation")
+		os.Exit(1)
+	}
+
+	if errs := validation.IsQualifiedName(noOverrideAnnotation); len(errs) > 0 {
+		setupLog.Error(fmt.Errorf("%s", strings.Join(errs, "; ")), "invalid no-override-annotation")
+		os.Exit(1)
+	}
+
+	labelsByHost, err := parseHostPairs(versionLabelsByHost)
+	if err != nil {
+		setupLog.Error(err, "invalid version-label-per-host")
+		os.Exit(1)
+	}
+	versionsByHost, err := parseHostPairs(defaultVersionsByHost)
+	if err != nil {
+		setupLog.Error(err, "invalid default-version-per-host")
+		os.Exit(1)
+	}
+	namespacesByHost, err := parseHostPairs(destinationRuleNamespacesByHost)
+	if err != nil {
+		setupLog.Error(err, "invalid destination-rule-namespace-per-host")
+		os.Exit(1)
+	}
+
+	var destinationRuleWriteLimiter *rate.Limiter
+	if destinationRuleWriteQPS > 0 {
+		if destinationRuleWriteBurst < 1 {
+			setupLog.Error(fmt.Errorf("burst must be positive: %d", destinationRuleWriteBurst), "invalid destination-rule-write-burst")
+			os.Exit(1)
+		}
+		destinationRuleWriteLimiter = rate.NewLimiter(rate.Limit(destinationRuleWriteQPS), destinationRuleWriteBurst)
+	}
+
+	var subsetTLS *istioapi.ClientTLSSettings
+	if subsetTLSMode != "" {
+		mode, ok := istioapi.ClientTLSSettings_TLSmode_value[subsetTLSMode]
+		if !ok {
+			setupLog.Error(fmt.Errorf("unknown TLS mode: %q", subsetTLSMode), "invalid subset-tls-mode")
+			os.Exit(1)
+		}
+		subsetTLS = &istioapi.ClientTLSSettings{Mode: istioapi.ClientTLSSettings_TLSmode(mode)}
+	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
@@ -119,12 +341,92 @@ func main() {
 		os.Exit(1)
 	}
 
+	var reconcileHealth *health.ReconcileHealth
+	if readyzErrorThreshold > 0 {
+		reconcileHealth = health.NewReconcileHealth(readyzErrorThreshold, readyzErrorWindow)
+	}
+
+	var trigger *watches.ReconcileTrigger
+	if enableDebugEndpoints {
+		trigger = watches.NewReconcileTrigger()
+		handler := trigger.Handler(controllers.DynamicEnvStatus(mgr.GetClient()), 0)
+		if err := mgr.AddMetricsExtraHandler(watches.ReconcileTriggerPath, handler); err != nil {
+			setupLog.Error(err, "unable to set up the reconcile debug endpoint")
+			os.Exit(1)
+		}
+	}
+
+	var baseLookupReader client.Reader
+	if baseLookupKubeconfig != "" {
+		cfg, err := clientcmd.BuildConfigFromFlags("", baseLookupKubeconfig)
+		if err != nil {
+			setupLog.Error(err, "invalid base-lookup-kubeconfig")
+			os.Exit(1)
+		}
+		baseCluster, err := cluster.New(cfg, func(o *cluster.Options) { o.Scheme = scheme })
+		if err != nil {
+			setupLog.Error(err, "unable to set up the base lookup cluster")
+			os.Exit(1)
+		}
+		if err := mgr.Add(baseCluster); err != nil {
+			setupLog.Error(err, "unable to add the base lookup cluster")
+			os.Exit(1)
+		}
+		baseLookupReader = baseCluster.GetClient()
+	}
+
+	destinationRuleMetrics := metrics.NewDestinationRuleMetrics()
+	if err := destinationRuleMetrics.Register(k8smetrics.Registry); err != nil {
+		setupLog.Error(err, "unable to register destination rule metrics")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.DynamicEnvReconciler{
-		Client:         mgr.GetClient(),
-		Scheme:         mgr.GetScheme(),
-		VersionLabel:   versionLabel,
-		DefaultVersion: defaultVersion,
-		LabelsToRemove: labelsToRemove,
+		Client:                          mgr.GetClient(),
+		APIReader:                       mgr.GetAPIReader(),
+		Scheme:                          mgr.GetScheme(),
+		VersionLabel:                    versionLabel,
+		VersionLabelsByHost:             labelsByHost,
+		DefaultVersion:                  defaultVersion,
+		DefaultVersionsByHost:           versionsByHost,
+		LabelsToRemove:                  labelsToRemove,
+		SharedDestinationRules:          sharedDestinationRules,
+		ClusterDomain:                   clusterDomain,
+		Recorder:                        mgr.GetEventRecorderFor("dynamicenv-controller"),
+		SubsetNameTemplate:              subsetNameTemplate,
+		MaxAnnotationOwners:             maxAnnotationOwners,
+		OwnerAnnotation:                 ownerAnnotation,
+		SubsetTLS:                       subsetTLS,
+		DestinationRuleMetrics:          destinationRuleMetrics,
+		WaitForDeployment:               waitForDeployment,
+		BaseDestinationRuleGracePeriod:  baseDestinationRuleGracePeriod,
+		BaseDestinationRuleBackoff:      baseDestinationRuleBackoff,
+		DestinationRuleNamespace:        destinationRuleNamespace,
+		DestinationRuleNamespacesByHost: namespacesByHost,
+		BaseLookupReader:                baseLookupReader,
+		StrictDestinationRuleOwnership:  strictDestinationRuleOwnership,
+		StrictHosts:                     strictHosts,
+		DestinationRuleServerSideApply:  destinationRuleServerSideApply,
+		NoOverrideAnnotation:            noOverrideAnnotation,
+		ResyncPeriod:                    resyncPeriod,
+		ServiceEntryHosts:               serviceEntryHosts,
+		MatchDestinationRulesByService:  matchDestinationRulesByService,
+		ExportedBaseDestinationRules:    exportedBaseDestinationRules,
+		ShortHostsInServiceNamespace:    shortHostsInServiceNamespace,
+		OperationTimeout:                operationTimeout,
+		DestinationRuleWriteLimiter:     destinationRuleWriteLimiter,
+		DestinationRuleHostConcurrency:  destinationRuleHostConcurrency,
+		FeatureGates:                    featureGates,
+		ReconcileTimeout:                reconcileTimeout,
+		StatusFlushInterval:             statusFlushInterval,
+		StatusTransitionHistory:         statusTransitionHistory,
+		AllowedNamespaces:               allowedNamespaces,
+		DeniedNamespaces:                deniedNamespaces,
+		PropagatedLabels:                propagatedLabels,
+		PropagatedAnnotations:           propagatedAnnotations,
+		ReconcileHealth:                 reconcileHealth,
+		RequeueBackoff:                  handlers.NewRequeueBackoff(requeueBackoff, maxRequeueBackoff),
+		Trigger:                         trigger,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DynamicEnv")
 		os.Exit(1)
@@ -132,6 +434,7 @@ func main() {
 	// prevents the webhooks from being started when the ENABLE_WEBHOOKS flag is set to false (for
 	// running locally)
 	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		riskifiedv1alpha1.DefaultSubsetVersion = defaultVersion
 		if err = (&riskifiedv1alpha1.DynamicEnv{}).SetupWebhookWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create webhook", "webhook", "DynamicEnv")
 			os.Exit(1)
@@ -153,6 +456,12 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if reconcileHealth != nil {
+		if err := mgr.AddReadyzCheck("reconciles", reconcileHealth.Check); err != nil {
+			setupLog.Error(err, "unable to set up reconciles ready check")
+			os.Exit(1)
+		}
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
@@ -0,0 +1,103 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package features holds the feature gates of the operator: named switches of experimental
+// behaviors that are off unless enabled (e.g. with `--feature-gates=ConcurrentHosts=true`), so they
+// could be rolled out gradually.
+package features
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The known feature gates
+const (
+	// Handle the service hosts of a subset concurrently (see
+	// `handlers.DestinationRuleHandler.HostConcurrency`)
+	ConcurrentHosts = "ConcurrentHosts"
+)
+
+var known = []string{ConcurrentHosts}
+
+// Gates are the states of the feature gates. Gates that were not set are off. It implements
+// `flag.Value` (as a comma-separated list of `name=bool` pairs).
+type Gates map[string]bool
+
+// Enabled returns whether the provided gate is on (safe to call on nil gates).
+func (g Gates) Enabled(name string) bool {
+	return g[name]
+}
+
+// Parse parses a comma-separated list of `name=bool` pairs (e.g. `ConcurrentHosts=true`), failing
+// on unknown gates and malformed pairs.
+func Parse(value string) (Gates, error) {
+	gates := Gates{}
+	if err := gates.Set(value); err != nil {
+		return nil, err
+	}
+	return gates, nil
+}
+
+func (g *Gates) String() string {
+	if g == nil || len(*g) == 0 {
+		return ""
+	}
+	var pairs []string
+	for name, enabled := range *g {
+		pairs = append(pairs, name+"="+strconv.FormatBool(enabled))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set adds the gates of the provided list (see Parse) to the current ones.
+func (g *Gates) Set(value string) error {
+	if *g == nil {
+		*g = Gates{}
+	}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, state, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("malformed feature gate %q (expected name=bool)", pair)
+		}
+		name = strings.TrimSpace(name)
+		if !isKnown(name) {
+			return fmt.Errorf("unknown feature gate %q (known gates: %s)", name, strings.Join(known, ", "))
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(state))
+		if err != nil {
+			return fmt.Errorf("invalid value of feature gate %q: %w", name, err)
+		}
+		(*g)[name] = enabled
+	}
+	return nil
+}
+
+func isKnown(name string) bool {
+	for _, k := range known {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
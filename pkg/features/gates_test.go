@@ -0,0 +1,63 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package features_test
+
+import (
+	"flag"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/riskified/dynamic-environment/pkg/features"
+)
+
+var _ = Describe("Gates", func() {
+	It("is off unless enabled", func() {
+		var gates features.Gates
+		Expect(gates.Enabled(features.ConcurrentHosts)).To(BeFalse())
+		gates, err := features.Parse("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gates.Enabled(features.ConcurrentHosts)).To(BeFalse())
+	})
+
+	It("parses the states of the gates", func() {
+		gates, err := features.Parse(" ConcurrentHosts = true ")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gates.Enabled(features.ConcurrentHosts)).To(BeTrue())
+		gates, err = features.Parse("ConcurrentHosts=true,ConcurrentHosts=false")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(gates.Enabled(features.ConcurrentHosts)).To(BeFalse())
+	})
+
+	DescribeTable("rejecting malformed gates",
+		func(value, message string) {
+			_, err := features.Parse(value)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("unknown gate", "Unknown=true", "unknown feature gate"),
+		Entry("missing state", "ConcurrentHosts", "malformed feature gate"),
+		Entry("invalid state", "ConcurrentHosts=maybe", "invalid value"),
+	)
+
+	It("could be used as a flag", func() {
+		var gates features.Gates
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.Var(&gates, "feature-gates", "")
+		Expect(flags.Parse([]string{"--feature-gates", "ConcurrentHosts=true"})).To(Succeed())
+		Expect(gates.Enabled(features.ConcurrentHosts)).To(BeTrue())
+		Expect(gates.String()).To(Equal("ConcurrentHosts=true"))
+	})
+})
@@ -18,6 +18,8 @@ package handlers
 
 import (
 	"context"
+	"github.com/go-logr/logr"
+	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -26,8 +28,9 @@ import (
 // see: https://stackoverflow.com/questions/31362044/anonymous-interface-implementation-in-golang
 type MockClient struct {
 	client.Client
-	getMethod  func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error
-	listMethod func(context.Context, client.ObjectList, ...client.ListOption) error
+	getMethod    func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error
+	listMethod   func(context.Context, client.ObjectList, ...client.ListOption) error
+	updateMethod func(context.Context, client.Object, ...client.UpdateOption) error
 }
 
 func (m MockClient) Get(c context.Context, ns types.NamespacedName, o client.Object, _ ...client.GetOption) error {
@@ -37,3 +40,35 @@ func (m MockClient) Get(c context.Context, ns types.NamespacedName, o client.Obj
 func (m MockClient) List(c context.Context, l client.ObjectList, o ...client.ListOption) error {
 	return m.listMethod(c, l, o...)
 }
+
+func (m MockClient) Update(c context.Context, o client.Object, opts ...client.UpdateOption) error {
+	if m.updateMethod == nil {
+		return nil
+	}
+	return m.updateMethod(c, o, opts...)
+}
+
+// Builds a DestinationRuleHandler of the "unique-name" subset (version "unique-version") in the
+// "namespace" namespace, whose client lists the provided base DestinationRules (the private
+// counterpart of the `mkDestinationRuleHandler` of the handlers_test package). The `overrides`
+// modify the fields of the built handler.
+func mkDestinationRuleHandler(drs []*istionetwork.DestinationRule, overrides ...func(*DestinationRuleHandler)) DestinationRuleHandler {
+	mc := MockClient{}
+	mc.listMethod = func(_ context.Context, list client.ObjectList, _ ...client.ListOption) error {
+		list.(*istionetwork.DestinationRuleList).Items = drs
+		return nil
+	}
+	h := DestinationRuleHandler{
+		Client:         mc,
+		UniqueName:     "unique-name",
+		UniqueVersion:  "unique-version",
+		Namespace:      "namespace",
+		VersionLabel:   "version",
+		DefaultVersion: "shared",
+		Log:            logr.Discard(),
+	}
+	for _, override := range overrides {
+		override(&h)
+	}
+	return h
+}
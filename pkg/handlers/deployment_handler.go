@@ -45,6 +45,9 @@ type DeploymentHandler struct {
 	UniqueVersion string
 	// THe owner of the deployment we need to handle (e.g. to configure watches)
 	Owner types.NamespacedName
+	// The key of the ownership annotation of this operator instance (defaults to
+	// `names.NamespacedNameAnnotation`, see `watches.Ownership`)
+	OwnerAnnotation string
 	// The deployment we should use as base
 	BaseDeployment *appsv1.Deployment
 	// Is it a consumer or subset
@@ -53,6 +56,9 @@ type DeploymentHandler struct {
 	LabelsToRemove []string
 	// The version label to use
 	VersionLabel string
+	// Additional version label keys (e.g. used by some of the services, see
+	// `DestinationRuleHandler.VersionLabelsByHost`) that are also set to our version
+	ExtraVersionLabels []string
 	// Status handler (to be able to update status)
 	StatusHandler *DynamicEnvStatusHandler
 	// The DynamicEnv matchers
@@ -61,12 +67,20 @@ type DeploymentHandler struct {
 	Updating bool
 	// The subset that contains the data of our deployment
 	Subset riskifiedv1alpha1.Subset
+	// Only compute the changes (see `PlannedChanges`) without applying them (or modifying the status)
+	DryRun bool
 	Log    logr.Logger
 	Ctx    context.Context
+
+	// The changes collected in dry-run mode
+	planned []PlannedChange
 }
 
 // Handles creation and manipulation of related Deployments.
 func (h *DeploymentHandler) Handle() error {
+	if h.DryRun {
+		h.Client, h.StatusHandler = enableDryRun(h.Client, h.StatusHandler, &h.planned)
+	}
 	subset := h.Subset
 	sDeployment := &appsv1.Deployment{}
 	searchName := types.NamespacedName{Name: h.UniqueName, Namespace: subset.Namespace}
@@ -101,6 +115,11 @@ func (h *DeploymentHandler) Handle() error {
 	return h.UpdateIfRequired()
 }
 
+// PlannedChanges returns the writes that would have been done by `Handle` (in dry-run mode).
+func (h *DeploymentHandler) PlannedChanges() []PlannedChange {
+	return h.planned
+}
+
 func (h *DeploymentHandler) GetStatus() (riskifiedv1alpha1.ResourceStatus, error) {
 
 	genStatus := func(s riskifiedv1alpha1.LifeCycleStatus) riskifiedv1alpha1.ResourceStatus {
@@ -194,23 +213,35 @@ func (h *DeploymentHandler) UpdateIfRequired() error {
 func (h *DeploymentHandler) createOverridingDeployment() (*appsv1.Deployment, error) {
 	oldMeta := h.BaseDeployment.ObjectMeta.DeepCopy()
 	newSpec := h.BaseDeployment.Spec.DeepCopy()
-	oldMeta.Labels[h.VersionLabel] = h.UniqueVersion
+	versionLabels := append([]string{h.VersionLabel}, h.ExtraVersionLabels...)
+	for _, l := range versionLabels {
+		oldMeta.Labels[l] = h.UniqueVersion
+	}
 	oldMeta.Labels[names.DynamicEnvLabel] = "true"
 	for _, l := range h.LabelsToRemove {
 		delete(oldMeta.Labels, l)
 	}
-	newSpec.Selector.MatchLabels[h.VersionLabel] = h.UniqueVersion
+	for _, l := range versionLabels {
+		newSpec.Selector.MatchLabels[l] = h.UniqueVersion
+	}
 	var replicas int32 = 1
 	if h.Subset.Replicas != nil {
 		replicas = *h.Subset.Replicas
 	}
 	*newSpec.Replicas = replicas
 	template := newSpec.Template
-	template.ObjectMeta.Labels[h.VersionLabel] = h.UniqueVersion
+	for _, l := range versionLabels {
+		template.ObjectMeta.Labels[l] = h.UniqueVersion
+	}
 	template.ObjectMeta.Labels[names.DynamicEnvLabel] = "true"
 	for k, v := range h.Subset.PodLabels {
 		template.ObjectMeta.Labels[k] = v
 	}
+	for k, v := range h.Subset.SubsetSelector {
+		if !helpers.StringSliceContains(k, versionLabels) {
+			template.ObjectMeta.Labels[k] = v
+		}
+	}
 
 	// Main container overrides
 	for _, c := range h.Subset.Containers {
@@ -251,7 +282,7 @@ func (h *DeploymentHandler) createOverridingDeployment() (*appsv1.Deployment, er
 		return dep, err
 	}
 
-	watches.AddToAnnotation(h.Owner, dep)
+	watches.Ownership{Key: h.OwnerAnnotation}.AddToAnnotation(h.Owner, dep)
 	return dep, nil
 }
 
@@ -29,6 +29,7 @@ import (
 	. "github.com/onsi/gomega"
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
 	v1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
 
@@ -111,6 +112,30 @@ var _ = Describe("Accepting alternative version label", func() {
 	})
 })
 
+var _ = Describe("Labeling the pods by the subset selector", func() {
+	It("adds the subset selector labels without overriding the version labels", func() {
+		deployment := v1.Deployment{}
+		deployment.Labels = map[string]string{"app": "details", "version": "shared"}
+		deployment.Spec.Replicas = new(int32)
+		deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "details", "version": "shared"}}
+		deployment.Spec.Template.Labels = map[string]string{"app": "details", "track": "stable", "version": "shared"}
+		h := DeploymentHandler{
+			UniqueName:     "unique",
+			UniqueVersion:  "unique-version",
+			BaseDeployment: &deployment,
+			VersionLabel:   "version",
+			Subset: riskifiedv1alpha1.Subset{
+				SubsetSelector: map[string]string{"track": "canary", "version": "shared"},
+			},
+			Log: logr.Discard(),
+		}
+		result, err := h.createOverridingDeployment()
+		Expect(err).To(BeNil())
+		Expect(result.Spec.Template.Labels).To(HaveKeyWithValue("track", "canary"))
+		Expect(result.Spec.Template.Labels).To(HaveKeyWithValue("version", "unique-version"))
+	})
+})
+
 var _ = Describe("Removing apecific labels from deployment", func() {
 
 	deploymentData := `{
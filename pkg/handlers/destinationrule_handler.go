@@ -17,113 +17,759 @@ limitations under the License.
 package handlers
 
 import (
+	"bytes"
 	"context"
 	goerrors "errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/go-logr/logr"
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"github.com/riskified/dynamic-environment/pkg/features"
 	"github.com/riskified/dynamic-environment/pkg/helpers"
+	"github.com/riskified/dynamic-environment/pkg/metrics"
+	"github.com/riskified/dynamic-environment/pkg/names"
 	"github.com/riskified/dynamic-environment/pkg/watches"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 	istioapi "istio.io/api/networking/v1alpha3"
 	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // A handler for managing DestinationRule manipulations.
+//
+// By default, every subset gets its own overriding DestinationRule per service host. When
+// `SharedDestinationRules` is set, all the dynamic environments share a single DestinationRule per
+// service host, each appending its own subset to it. This keeps the amount of Istio configuration
+// small but means that all the dynamic environments modify the same resource (which requires
+// retrying on conflicts) and that the traffic policies of the shared rule are inherited from the
+// base rule at the time the shared rule was created.
 type DestinationRuleHandler struct {
 	client.Client
+	// A direct (uncached) reader used by GetStatus when the (typically cache backed) Client misses a
+	// DestinationRule, e.g. one we've just created that the informer has not observed yet (optional).
+	APIReader client.Reader
+	// The reader used for discovering the base DestinationRules, e.g. of a config cluster other than
+	// the one we create the overriding rules in (defaults to Client).
+	BaseLookupReader client.Reader
 	// The unique name of the target DestinationRule
 	UniqueName string
 	// The unique version of the target DestinationRule
 	UniqueVersion string
-	// The namespace of the target DestinationRule
+	// The namespace of the subset (used to resolve short service hosts). Also the namespace of the
+	// target DestinationRule unless DestinationRuleNamespace is set.
 	Namespace string
+	// The namespace of the base and the generated DestinationRules, when they are kept apart from
+	// the services (e.g. a central Istio config namespace). Defaults to Namespace.
+	DestinationRuleNamespace string
+	// The namespaces of the base DestinationRules of specific service hosts (overriding
+	// DestinationRuleNamespace), for hosts whose base rules live elsewhere (e.g. some in the service
+	// namespace and some in a shared namespace). The generated rules of these hosts are created
+	// next to their base rules, so they get the same visibility.
+	DestinationRuleNamespacesByHost map[string]string
 	// The version label
 	VersionLabel string
+	// Version label keys for specific service hosts (overriding VersionLabel), for services whose
+	// subsets are selected by a different label key.
+	VersionLabelsByHost map[string]string
 	// The version that gets the default route
 	DefaultVersion string
+	// Default versions for specific service hosts (overriding DefaultVersion), for services whose
+	// base DestinationRules use another default subset.
+	DefaultVersionsByHost map[string]string
 	// Status handler (to be able to update status)
 	StatusHandler *DynamicEnvStatusHandler
 	// The host name of the service that points to the Deployment specified in
 	// the subset.
 	ServiceHosts []string
+	// Service hosts (in any form accepted by `helpers.NormalizeHost`) excluded from the subset:
+	// they are skipped and reported as Excluded.
+	ExcludedHosts []string
 	// The name/nmespace of the DynamicEnv that launches this DestinationRule
 	Owner types.NamespacedName
-	Log   logr.Logger
-	Ctx   context.Context
+	// The UID of the owning DynamicEnv (optional). It's recorded on the DestinationRules we claim
+	// (along with an owner reference when in the same namespace), and rules recorded with another UID
+	// (e.g. of a deleted DynamicEnv with the same name) are not considered ours.
+	OwnerUID types.UID
+	// Do not copy the traffic policies (global and default subset) of the base DestinationRule to
+	// the overriding one.
+	SkipTrafficPolicy bool
+	// Overrides the TLS settings of the generated subset (instead of the ones inherited from the base
+	// subset). Applies even when SkipTrafficPolicy is set.
+	SubsetTLS *istioapi.ClientTLSSettings
+	// Connection pool overrides for the generated subset (merged into the inherited subset policy).
+	ConnectionPool *riskifiedv1alpha1.ConnectionPoolSettings
+	// Load balancer settings for the generated subset (replacing the inherited ones).
+	LoadBalancer *riskifiedv1alpha1.LoadBalancerSettings
+	// Additional labels selecting the pods of the generated subset (along with the version label,
+	// which always selects the unique version).
+	SubsetSelector map[string]string
+	// TLS origination settings for the generated subset, e.g. for external HTTPS hosts (replacing
+	// the inherited ones and SubsetTLS).
+	TLS *riskifiedv1alpha1.ClientTLSSettings
+	// Overrides of specific ports of the generated subset, merged by port number into the port level
+	// settings inherited from the base subset (which are kept for the other ports).
+	PortLevelSettings []riskifiedv1alpha1.PortTrafficPolicy
+	// Append our subset to a single DestinationRule per service host (shared between dynamic
+	// environments) instead of creating a DestinationRule per subset.
+	SharedDestinationRules bool
+	// The cluster domain used to fully qualify service hosts (defaults to `cluster.local`)
+	ClusterDomain string
+	// Used to notify about skipped hosts on the owning DynamicEnv (optional)
+	Recorder record.EventRecorder
+	// A `text/template` for the name of the generated subset. Could use `.UniqueVersion` and
+	// `.BaseSubsetName` (the name of the default version subset in the base DestinationRule).
+	// Defaults to the unique version.
+	SubsetNameTemplate string
+	// The maximum number of dynamic environments that may share a single DestinationRule (only
+	// relevant with SharedDestinationRules, 0 for no limit)
+	MaxAnnotationOwners int
+	// The key of the ownership annotations of this operator instance (defaults to
+	// `names.NamespacedNameAnnotation`, see `watches.Ownership`)
+	OwnerAnnotation string
+	// Records the outcomes of handling the DestinationRules (optional)
+	Metrics *metrics.DestinationRuleMetrics
+	// Also handle hosts that are declared by ServiceEntries (e.g. mesh expansion) and have no base
+	// DestinationRule: our subset is bound to the ServiceEntry host (without inherited policies).
+	ServiceEntryHosts bool
+	// Fall back to matching base DestinationRules whose hosts resolve to the same Kubernetes Service
+	// as the requested host (following ExternalName Services within the cluster) when none of them
+	// matches the host itself, e.g. when they use another cluster domain or an alias of the Service.
+	MatchByService bool
+	// Also consider the base DestinationRules of other namespaces (e.g. the ones defined next to an
+	// ingress gateway) that are exported to our namespace (see `helpers.ExportedTo`), when none of the
+	// rules of our DestinationRule namespace match a host. Requires listing the DestinationRules of
+	// all the namespaces (once per Handle).
+	ExportedBaseDestinationRules bool
+	// Resolve the short hosts (bare service names, e.g. `payments`) of base DestinationRules of other
+	// namespaces than the one of the subset (e.g. a central DestinationRuleNamespace or the exported
+	// rules) relative to the subset namespace instead of their own, for central rules that are meant
+	// for the services of the namespaces they are exported to. Note that Istio itself resolves them
+	// relative to the namespace of the rule, so the generated rules get the fully qualified host.
+	ShortHostsInServiceNamespace bool
+	// Refuse to touch existing (per subset) DestinationRules with our name that are not owned by us
+	// (reporting them as Conflicting) instead of adopting them.
+	StrictOwnership bool
+	// Treat hosts without a base DestinationRule (once BaseDestinationRuleGracePeriod is over) as
+	// errors (MissingBaseDestinationRule) reported as Missing, so the DynamicEnv is degraded, instead
+	// of ignoring them. Hosts whose base DestinationRules lack the default subset or opted out are
+	// still ignored.
+	StrictHosts bool
+	// Do not create the DestinationRules (or add our subset to shared ones) until the subset
+	// deployment is running (according to the status). The hosts are reported as initializing until
+	// then.
+	WaitForDeployment bool
+	// Hosts without a base DestinationRule are expected to get one within this period since it was
+	// first found missing (e.g. both are applied by GitOps, in no particular order, or the base is
+	// being re-created). Until then they are reported as initializing and a requeue is requested
+	// (see RequeueAfter) instead of ignoring them as missing. Tracked per host by the MissingSince
+	// of the status entries. Disabled if 0.
+	BaseDestinationRuleGracePeriod time.Duration
+	// The delay between checks for the base DestinationRules of such hosts (defaults to
+	// DefaultBaseDestinationRuleBackoff)
+	BaseDestinationRuleBackoff time.Duration
+	// How often the statuses of the hosts handled so far are persisted during Handle (after each
+	// host if 0), so an interrupted reconcile (e.g. one that timed out) leaves an accurate partial
+	// status instead of a stale one.
+	StatusFlushInterval time.Duration
+	// Only compute the changes (see `PlannedChanges`) without applying them (or modifying the status)
+	DryRun bool
+	// Throttles the DestinationRule writes of Handle (creates, updates and patches) so the bursts of
+	// dynamic environments with many hosts do not trip the API server rate limits. Usually shared by
+	// all the handlers (optional).
+	WriteLimiter *rate.Limiter
+	// Write the generated (per subset) DestinationRules using server-side apply (as
+	// names.DestinationRuleFieldManager) instead of create / update, so we only own the fields we
+	// generate and do not conflict with other managers of these rules. Not applied to shared
+	// DestinationRules that already exist.
+	ServerSideApply bool
+	// Additional labels and annotations of the generated (per subset) DestinationRules (e.g.
+	// propagated from the DynamicEnv). The version label and the ownership annotations always win.
+	// Not applied to shared DestinationRules.
+	Labels      map[string]string
+	Annotations map[string]string
+	// The namespaces we may create DestinationRules in (all namespaces if empty). Hosts of other
+	// namespaces are reported as NamespaceNotAllowed.
+	AllowedNamespaces []string
+	// The namespaces we may not create DestinationRules in (takes precedence over AllowedNamespaces).
+	DeniedNamespaces []string
+	// Base DestinationRules with this annotation set to "true" are never overridden, their hosts are
+	// reported as OptedOut (defaults to `names.DefaultNoOverrideAnnotation`).
+	NoOverrideAnnotation string
+	// Computes the names of the generated DestinationRules (defaults to `DefaultNameStrategy`)
+	NameStrategy NameStrategy
+	// Bounds each DestinationRule API call (get, list, create, update, patch and delete, including
+	// its retries). No timeout (other than the one of Ctx) if 0.
+	OperationTimeout time.Duration
+	// The maximum number of service hosts handled concurrently by Handle, for subsets with many
+	// hosts (sequentially if 1 or less). The outcomes are collected in the order of ServiceHosts
+	// either way, but the statuses of the hosts are only persisted once all of them were handled.
+	// Requires the `features.ConcurrentHosts` gate.
+	HostConcurrency int
+	// The states of the feature gates of experimental behaviors (all off if nil)
+	FeatureGates features.Gates
+	// The log lines of Handle carry the `owner` and `subset` keys, along with `host`, `drName` and
+	// `status` where relevant.
+	Log logr.Logger
+	Ctx context.Context
 
 	ignoredMissing []string
 	activeHosts    []string
+	// Hosts with more than one candidate base DestinationRule
+	ambiguous []string
+	// Hosts whose DestinationRules belong to other owners (see StrictOwnership)
+	conflicting []string
+	// Hosts whose base DestinationRules have no subset with the default version
+	missingDefaultSubset []string
+	// Hosts whose base DestinationRules opted out of being overridden (see NoOverrideAnnotation)
+	optedOut []string
+	// Hosts whose base DestinationRules already contain our subset (see subsetInBase)
+	satisfiedByBase []string
+	// Hosts waiting for the subset deployment to become ready (see WaitForDeployment)
+	pending []string
+	// Hosts whose base DestinationRules may still be applied (see BaseDestinationRuleGracePeriod)
+	awaitingBase []string
+	// Hosts without a base DestinationRule that were not ignored (see StrictHosts)
+	missingBase []string
+	// When the base DestinationRules of the hosts were first found missing (see baseMissingSince)
+	missingSince map[string]metav1.Time
+	// Hosts whose DestinationRules we are not allowed to create (see AllowedNamespaces)
+	notAllowed []string
+	// Hosts that were skipped since they are excluded from the subset (see ExcludedHosts)
+	excluded []string
+	// Hosts whose DestinationRules were created but whose status failed to be persisted (see
+	// createMissingDestinationRule)
+	unrecorded []string
+	// The names of the generated subsets per service host
+	subsetNames map[string]string
+	// The changes collected in dry-run mode
+	planned []PlannedChange
+	// Whether the correlation ID was already added to the logger
+	correlated bool
+	// The DestinationRules per namespace, listed once per Handle (see listDestinationRules)
+	destinationRules map[string][]*istionetwork.DestinationRule
+	// The Services (if any) the hosts resolve to, looked up once per Handle (see resolveService)
+	resolvedServices map[types.NamespacedName]*types.NamespacedName
+	// The DestinationRule names per service host, resolved once per Handle (see resolveDRNames)
+	drNames map[string]string
+	// Hosts whose DestinationRule names collide with the ones of other hosts
+	nameCollisions map[string]DestinationRuleNameCollision
+	// The statuses of the handled hosts that were not persisted yet (see StatusFlushInterval)
+	unflushed []riskifiedv1alpha1.ResourceStatus
+	// When the statuses were last persisted during Handle
+	lastFlush time.Time
+	// Serializes the access to the StatusHandler while the hosts are handled concurrently (see
+	// HostConcurrency)
+	statusMu *sync.Mutex
+}
+
+// Returned internally when our subset should not be added yet (see WaitForDeployment)
+var errPendingDeployment = goerrors.New("waiting for the subset deployment")
+
+// The default delay between checks for missing base DestinationRules (see
+// BaseDestinationRuleGracePeriod)
+const DefaultBaseDestinationRuleBackoff = 10 * time.Second
+
+// The timeout of persisting the statuses of the handled hosts once the context of the reconcile is
+// done (see flushStatuses)
+const detachedStatusFlushTimeout = 10 * time.Second
+
+// The delay before reconciling again when the statuses of created DestinationRules failed to be
+// persisted (see createMissingDestinationRule)
+const unrecordedStatusRequeueDelay = 5 * time.Second
+
+// NewDestinationRuleHandler returns the provided handler once its required fields are validated
+// (returning MissingRequiredFields otherwise), instead of failing in the middle of Handle.
+func NewDestinationRuleHandler(h DestinationRuleHandler) (*DestinationRuleHandler, error) {
+	var missing []string
+	if h.Client == nil {
+		missing = append(missing, "Client")
+	}
+	if h.UniqueName == "" {
+		missing = append(missing, "UniqueName")
+	}
+	if h.UniqueVersion == "" {
+		missing = append(missing, "UniqueVersion")
+	}
+	if h.Namespace == "" {
+		missing = append(missing, "Namespace")
+	}
+	if h.VersionLabel == "" {
+		missing = append(missing, "VersionLabel")
+	}
+	if h.DefaultVersion == "" {
+		missing = append(missing, "DefaultVersion")
+	}
+	if h.StatusHandler == nil {
+		missing = append(missing, "StatusHandler")
+	} else if h.StatusHandler.DynamicEnv == nil {
+		missing = append(missing, "StatusHandler.DynamicEnv")
+	}
+	if h.Owner.Name == "" || h.Owner.Namespace == "" {
+		missing = append(missing, "Owner")
+	}
+	if len(missing) > 0 {
+		return nil, MissingRequiredFields{Handler: "DestinationRuleHandler", Fields: missing}
+	}
+	return &h, nil
 }
 
 // Handles creation and manipulation of related DestinationRules.
 func (h *DestinationRuleHandler) Handle() error {
-	for _, serviceHost := range h.ServiceHosts {
-		found := &istionetwork.DestinationRule{}
-		drName := h.calculateDRName(serviceHost)
-		if err := h.Get(h.Ctx, types.NamespacedName{Name: drName, Namespace: h.Namespace}, found); err != nil {
-			if errors.IsNotFound(err) {
-				if err := h.createMissingDestinationRule(drName, serviceHost); err != nil {
-					return err
+	if h.DryRun {
+		h.Client, h.StatusHandler = enableDryRun(h.Client, h.StatusHandler, &h.planned)
+		h.Recorder = nil
+		h.Metrics = nil
+	} else {
+		h.Client = limitWrites(h.Client, h.WriteLimiter)
+	}
+	if !h.correlated {
+		h.Log = helpers.CorrelatedLogger(h.Ctx, h.Log, h.Owner).WithValues("subset", h.UniqueName)
+		h.correlated = true
+	}
+	if !h.DryRun && h.StatusHandler != nil {
+		// Do not override the rules of a newer generation (it's reconciled by its own loop)
+		if err := h.StatusHandler.CheckGeneration(); err != nil {
+			return err
+		}
+	}
+	h.destinationRules = nil
+	h.resolvedServices = nil
+	h.missingSince = h.previousMissingSince()
+	err := h.handle()
+	if h.Metrics != nil {
+		if err != nil {
+			h.Metrics.ReconcileErrors.WithLabelValues(h.Owner.Namespace).Inc()
+		}
+		h.Metrics.ActiveHosts.WithLabelValues(h.Owner.Namespace, h.Owner.Name, h.UniqueName).Set(float64(len(h.activeHosts)))
+	}
+	return err
+}
+
+// Handles all the service hosts (even if some of them fail) and returns their combined errors (see
+// HostErrors). Empty or malformed hosts are skipped and reported as InvalidServiceHost, and hosts
+// whose DestinationRule names collide with the ones of other hosts as DestinationRuleNameCollision.
+// Excluded hosts (see ExcludedHosts) are skipped silently.
+func (h *DestinationRuleHandler) handle() error {
+	h.ServiceHosts = helpers.UniqueServiceHosts(h.ServiceHosts, h.Namespace)
+	h.resolveDRNames()
+	// The errors per service host (kept in the order of the hosts even if handled concurrently)
+	errs := make([]error, len(h.ServiceHosts))
+	var valid []string
+	var validIndexes []int
+	for i, serviceHost := range h.ServiceHosts {
+		if h.isExcluded(serviceHost) {
+			h.addExcluded(serviceHost)
+			continue
+		}
+		if err := helpers.ValidateServiceHost(serviceHost); err != nil {
+			h.Log.Info("Skipping invalid service host", "host", serviceHost, "reason", err.Error())
+			errs[i] = InvalidServiceHost{Host: serviceHost, Reason: err}
+			continue
+		}
+		if collision, ok := h.nameCollisions[serviceHost]; ok {
+			errs[i] = collision
+			continue
+		}
+		valid, validIndexes = append(valid, serviceHost), append(validIndexes, i)
+	}
+	if h.HostConcurrency > 1 && len(valid) > 1 && h.FeatureGates.Enabled(features.ConcurrentHosts) {
+		for i, err := range h.handleHostsConcurrently(valid) {
+			errs[validIndexes[i]] = err
+		}
+	} else {
+		for i, serviceHost := range valid {
+			errs[validIndexes[i]] = h.handleHost(serviceHost)
+			h.recordHostStatus(serviceHost)
+		}
+	}
+	var hostErrors []error
+	for _, err := range errs {
+		if err != nil {
+			hostErrors = append(hostErrors, err)
+		}
+	}
+	if err := h.flushStatuses(true); err != nil {
+		h.Log.Error(err, "Failed persisting the statuses of the handled hosts")
+	}
+
+	if len(h.conflicting) > 0 {
+		hostErrors = append(hostErrors,
+			fmt.Errorf("destination rules of other owners already exist for hosts: %s", strings.Join(h.conflicting, ", ")))
+	}
+	if len(hostErrors) > 0 {
+		return joinHostErrors(hostErrors)
+	}
+	if len(h.activeHosts) == 0 && len(h.pending) == 0 && len(h.awaitingBase) == 0 && len(h.excluded) < len(h.ServiceHosts) {
+		return h.noBaseDestinationRules()
+	}
+
+	return nil
+}
+
+func (h *DestinationRuleHandler) handleHost(serviceHost string) error {
+	found := &istionetwork.DestinationRule{}
+	drName := h.calculateDRName(serviceHost)
+	if h.SharedDestinationRules {
+		return h.handleSharedDestinationRule(drName, serviceHost)
+	}
+	err := h.withTimeout(func(ctx context.Context) error {
+		return retry.OnError(retry.DefaultBackoff, isTransientError, func() error {
+			return h.Get(ctx, types.NamespacedName{Name: drName, Namespace: h.drNamespace(serviceHost)}, found)
+		})
+	})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			if h.waitingForDeployment() {
+				h.addPending(serviceHost)
+				return nil
+			}
+			if subset := h.subsetInBase(serviceHost); subset != nil {
+				h.Log.Info("Base destination rule already contains our subset, skipping creation",
+					"drName", drName, "host", serviceHost, "subsetName", subset.Name)
+				h.setSubsetName(serviceHost, subset.Name)
+				if !helpers.StringSliceContainsFold(serviceHost, h.satisfiedByBase) {
+					h.satisfiedByBase = append(h.satisfiedByBase, serviceHost)
 				}
-				continue
+				h.addActiveHost(serviceHost)
+				return nil
 			}
+			return h.createMissingDestinationRule(drName, serviceHost)
+		}
+
+		return fmt.Errorf("error locating existing destination rule by name (%s): %w", serviceHost, err)
+	}
+	if h.isConflicting(found) {
+		h.addConflicting(found.Name, serviceHost)
+		return nil
+	}
+	if err := h.updateIfRequired(found, serviceHost); err != nil {
+		return fmt.Errorf("updating destination rule for '%s': %w", serviceHost, err)
+	}
+	h.addActiveHost(serviceHost)
+	return nil
+}
 
-			return fmt.Errorf("error locating existing destination rule by name (%s): %w", serviceHost, err)
+func (h *DestinationRuleHandler) noBaseDestinationRules() NoBaseDestinationRules {
+	result := NoBaseDestinationRules{Subset: h.UniqueName}
+	for _, sh := range h.ServiceHosts {
+		switch {
+		case helpers.StringSliceContainsFold(sh, h.ignoredMissing):
+			result.IgnoredMissing = append(result.IgnoredMissing, sh)
+		case helpers.StringSliceContainsFold(sh, h.missingDefaultSubset):
+			result.MissingDefaultSubset = append(result.MissingDefaultSubset, sh)
+		case helpers.StringSliceContainsFold(sh, h.optedOut):
+			result.OptedOut = append(result.OptedOut, sh)
+		default:
+			result.Missing = append(result.Missing, sh)
 		}
-		h.activeHosts = append(h.activeHosts, serviceHost)
 	}
+	return result
+}
 
-	if len(h.activeHosts) == 0 {
-		return fmt.Errorf("no base destination rules were found for subset: %s", h.UniqueName)
+// Whether we should hold off creating DestinationRules until the subset deployment is running.
+func (h *DestinationRuleHandler) waitingForDeployment() bool {
+	if !h.WaitForDeployment {
+		return false
 	}
+	if h.StatusHandler == nil || h.StatusHandler.DynamicEnv == nil {
+		return true
+	}
+	var waiting bool
+	h.withStatusLock(func() {
+		waiting = h.StatusHandler.DynamicEnv.Status.SubsetsStatus[h.UniqueName].Deployment.Status != riskifiedv1alpha1.Running
+	})
+	return waiting
+}
 
-	return nil
+func (h *DestinationRuleHandler) addPending(serviceHost string) {
+	if !helpers.StringSliceContainsFold(serviceHost, h.pending) {
+		h.Log.Info("Waiting for the subset deployment before handling destination rule", "host", serviceHost)
+		h.pending = append(h.pending, serviceHost)
+	}
+}
+
+// Reads a DestinationRule for GetStatus: from the Client first, falling back to the APIReader if
+// it's not found (see GetStatus).
+func (h *DestinationRuleHandler) getForStatus(key types.NamespacedName, dr *istionetwork.DestinationRule) error {
+	err := h.withTimeout(func(ctx context.Context) error {
+		return h.Get(ctx, key, dr)
+	})
+	if h.APIReader == nil || !errors.IsNotFound(err) {
+		return err
+	}
+	return h.withTimeout(func(ctx context.Context) error {
+		return h.APIReader.Get(ctx, key, dr)
+	})
+}
+
+// GetPendingHosts returns the hosts that are waiting for the subset deployment (see
+// WaitForDeployment).
+func (h *DestinationRuleHandler) GetPendingHosts() []string {
+	return h.pending
+}
+
+// RequeueAfter returns the delay before the DynamicEnv should be reconciled again, since some of
+// the hosts are still waiting for their base DestinationRules (see BaseDestinationRuleGracePeriod)
+// or the statuses of the DestinationRules we created failed to be persisted (0 if neither). It
+// never exceeds the end of the grace period, so these hosts are ignored as missing on time.
+func (h *DestinationRuleHandler) RequeueAfter() time.Duration {
+	if len(h.awaitingBase) == 0 {
+		if len(h.unrecorded) > 0 {
+			return unrecordedStatusRequeueDelay
+		}
+		return 0
+	}
+	backoff := h.BaseDestinationRuleBackoff
+	if backoff <= 0 {
+		backoff = DefaultBaseDestinationRuleBackoff
+	}
+	if len(h.unrecorded) > 0 && unrecordedStatusRequeueDelay < backoff {
+		backoff = unrecordedStatusRequeueDelay
+	}
+	for _, serviceHost := range h.awaitingBase {
+		if remaining := h.baseGracePeriodRemaining(serviceHost); remaining < backoff {
+			backoff = remaining
+		}
+	}
+	return backoff
+}
+
+// The time left until the missing base DestinationRule of the provided host is ignored (see
+// BaseDestinationRuleGracePeriod), 0 if the grace period is over (or disabled).
+func (h *DestinationRuleHandler) baseGracePeriodRemaining(serviceHost string) time.Duration {
+	if h.BaseDestinationRuleGracePeriod <= 0 || h.StatusHandler == nil || h.StatusHandler.DynamicEnv == nil {
+		return 0
+	}
+	since := h.baseMissingSince(serviceHost)
+	if remaining := h.BaseDestinationRuleGracePeriod - time.Since(since.Time); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Returns when the base DestinationRule of the provided host was first found missing: the
+// MissingSince of its previous status entry, or now if it was found missing just now (kept for the
+// rest of the reconcile and reported by GetStatus).
+func (h *DestinationRuleHandler) baseMissingSince(serviceHost string) metav1.Time {
+	for host, since := range h.missingSince {
+		if strings.EqualFold(host, serviceHost) {
+			return since
+		}
+	}
+	if h.missingSince == nil {
+		h.missingSince = make(map[string]metav1.Time)
+	}
+	now := metav1.Now()
+	h.missingSince[serviceHost] = now
+	return now
+}
+
+// Collects the MissingSince of the current status entries of our subset per service host. Read
+// before handling the hosts, since their entries may be replaced in the meantime (e.g. while
+// trying to create the DestinationRules).
+func (h *DestinationRuleHandler) previousMissingSince() map[string]metav1.Time {
+	if h.StatusHandler == nil || h.StatusHandler.DynamicEnv == nil {
+		return nil
+	}
+	result := make(map[string]metav1.Time)
+	for _, s := range h.StatusHandler.DynamicEnv.Status.SubsetsStatus[h.UniqueName].DestinationRules {
+		if s.MissingSince != nil && s.ServiceHost != "" {
+			result[s.ServiceHost] = *s.MissingSince
+		}
+	}
+	return result
 }
 
 // GetStatus here can only return missing or running is there is no real status
-// for DestinationRule, just whether it exists or missing.
+// for DestinationRule, just whether it exists or missing (or why it's missing).
+//
+// The DestinationRules are read through the Client, which is usually backed by the informer
+// cache, so the status may lag behind the API server (e.g. a subset that was just removed is still
+// reported as running). It converges as changes to the DestinationRules trigger another reconcile.
+// Rules that are missing from the cache are re-read from the APIReader (when configured), to avoid
+// reporting the rules we've just created as missing. Invalid service hosts (see
+// InvalidServiceHost) and hosts with colliding names (see DestinationRuleNameCollision) are reported
+// as failed, and excluded hosts (see ExcludedHosts) as Excluded.
 func (h *DestinationRuleHandler) GetStatus() (statuses []riskifiedv1alpha1.ResourceStatus, err error) {
-
-	genStatus := func(name string, s riskifiedv1alpha1.LifeCycleStatus) riskifiedv1alpha1.ResourceStatus {
-		return riskifiedv1alpha1.ResourceStatus{
-			Name:      name,
-			Namespace: h.Namespace,
-			Status:    s,
+	for _, sh := range helpers.UniqueServiceHosts(h.ServiceHosts, h.Namespace) {
+		status, err := h.hostStatus(sh)
+		if err != nil {
+			return statuses, err
 		}
+		statuses = append(statuses, status)
 	}
+	return statuses, nil
+}
 
-	for _, sh := range h.ServiceHosts {
-		found := &istionetwork.DestinationRule{}
-		drName := h.calculateDRName(sh)
-		if err := h.Get(h.Ctx, types.NamespacedName{Name: drName, Namespace: h.Namespace}, found); err != nil {
-			if errors.IsNotFound(err) {
-				if helpers.StringSliceContains(sh, h.ignoredMissing) {
-					statuses = append(statuses, genStatus(drName, riskifiedv1alpha1.IgnoredMissingDR))
-					continue
-				}
-				statuses = append(statuses, genStatus(drName, riskifiedv1alpha1.Missing))
-				continue
+// Collects the status of the provided (just handled) host, according to the outcome of handling it
+// (without reading its DestinationRule again), and persists it according to StatusFlushInterval.
+// Hosts that failed for other reasons keep their previous status until GetStatus.
+func (h *DestinationRuleHandler) recordHostStatus(serviceHost string) {
+	if h.StatusHandler == nil || h.StatusHandler.DynamicEnv == nil {
+		return
+	}
+	drName := h.calculateDRName(serviceHost)
+	var status riskifiedv1alpha1.ResourceStatus
+	if s, ok := h.listedStatus(drName, serviceHost); ok {
+		status = s
+	} else if helpers.StringSliceContainsFold(serviceHost, h.activeHosts) {
+		status = h.genStatus(drName, serviceHost, riskifiedv1alpha1.Running)
+	} else {
+		return
+	}
+	h.unflushed = append(h.unflushed, status)
+	if err := h.flushStatuses(false); err != nil {
+		h.Log.Error(err, "Failed persisting the statuses of the handled hosts")
+	}
+}
+
+// Persists the collected statuses of the handled hosts, unless StatusFlushInterval did not pass
+// since the last time (or `force` is set). Once the context is done (e.g. the reconcile timed out)
+// they are persisted using a detached context, as they would be lost otherwise. Failed statuses
+// are kept for the next flush.
+func (h *DestinationRuleHandler) flushStatuses(force bool) error {
+	if len(h.unflushed) == 0 || h.StatusHandler == nil {
+		return nil
+	}
+	if !force && h.StatusFlushInterval > 0 && time.Since(h.lastFlush) < h.StatusFlushInterval {
+		return nil
+	}
+	statusHandler := h.StatusHandler
+	if h.StatusHandler.Ctx != nil && h.StatusHandler.Ctx.Err() != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), detachedStatusFlushTimeout)
+		defer cancel()
+		detached := *h.StatusHandler
+		detached.Ctx = ctx
+		statusHandler = &detached
+	}
+	if err := statusHandler.AddDestinationRuleStatusEntries(h.UniqueName, h.unflushed); err != nil {
+		return err
+	}
+	h.unflushed = nil
+	h.lastFlush = time.Now()
+	return nil
+}
+
+// Returns the status of the DestinationRule of the provided service host (see GetStatus).
+func (h *DestinationRuleHandler) hostStatus(sh string) (riskifiedv1alpha1.ResourceStatus, error) {
+	found := &istionetwork.DestinationRule{}
+	drName := h.calculateDRName(sh)
+	if h.isExcluded(sh) {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.Excluded), nil
+	}
+	if _, collides := h.nameCollisions[sh]; collides || helpers.ValidateServiceHost(sh) != nil {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.Failed), nil
+	}
+	err := h.getForStatus(types.NamespacedName{Name: drName, Namespace: h.drNamespace(sh)}, found)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			if status, ok := h.listedStatus(drName, sh); ok {
+				return status, nil
 			}
-			return statuses, fmt.Errorf("error locating existing destination rule by name (%s): %w", drName, err)
+			return h.genStatus(drName, sh, riskifiedv1alpha1.Missing), nil
+		}
+		return riskifiedv1alpha1.ResourceStatus{}, fmt.Errorf("error locating existing destination rule by name (%s): %w", drName, err)
+	}
+	if found.DeletionTimestamp != nil {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.Terminating), nil
+	}
+	if !h.SharedDestinationRules && h.isConflicting(found) {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.Conflicting), nil
+	}
+	if h.SharedDestinationRules && findVersionSubset(found, h.versionLabel(sh), h.UniqueVersion) == nil {
+		if helpers.StringSliceContainsFold(sh, h.pending) {
+			return h.genStatus(drName, sh, riskifiedv1alpha1.Initializing), nil
 		}
-		statuses = append(statuses, genStatus(drName, riskifiedv1alpha1.Running))
+		return h.genStatus(drName, sh, riskifiedv1alpha1.Missing), nil
 	}
+	return h.genStatus(drName, sh, riskifiedv1alpha1.Running), nil
+}
 
-	return statuses, nil
+// Returns the status of a host without a DestinationRule of our own, if Handle listed it for a
+// reason (e.g. it was ignored since the base DestinationRule is missing).
+func (h *DestinationRuleHandler) listedStatus(drName, sh string) (riskifiedv1alpha1.ResourceStatus, bool) {
+	if helpers.StringSliceContainsFold(sh, h.satisfiedByBase) {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.Running), true
+	}
+	if helpers.StringSliceContainsFold(sh, h.awaitingBase) {
+		return h.withMissingSince(h.genStatus(drName, sh, riskifiedv1alpha1.Initializing)), true
+	}
+	if helpers.StringSliceContainsFold(sh, h.ignoredMissing) {
+		return h.withMissingSince(h.genStatus(drName, sh, riskifiedv1alpha1.IgnoredMissingDR)), true
+	}
+	if helpers.StringSliceContainsFold(sh, h.missingBase) {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.Missing), true
+	}
+	if helpers.StringSliceContainsFold(sh, h.missingDefaultSubset) {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.MissingDefaultSubset), true
+	}
+	if helpers.StringSliceContainsFold(sh, h.optedOut) {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.OptedOut), true
+	}
+	if helpers.StringSliceContainsFold(sh, h.ambiguous) {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.AmbiguousBaseDR), true
+	}
+	if helpers.StringSliceContainsFold(sh, h.notAllowed) {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.NamespaceNotAllowed), true
+	}
+	if helpers.StringSliceContainsFold(sh, h.pending) {
+		return h.genStatus(drName, sh, riskifiedv1alpha1.Initializing), true
+	}
+	return riskifiedv1alpha1.ResourceStatus{}, false
+}
+
+func (h *DestinationRuleHandler) genStatus(name, serviceHost string, s riskifiedv1alpha1.LifeCycleStatus) riskifiedv1alpha1.ResourceStatus {
+	return riskifiedv1alpha1.ResourceStatus{
+		Name:        name,
+		Namespace:   h.drNamespace(serviceHost),
+		ServiceHost: serviceHost,
+		Status:      s,
+	}
 }
 
+// Hosts that are missing their base DestinationRules keep reporting when it was first found missing
+// (see BaseDestinationRuleGracePeriod).
+func (h *DestinationRuleHandler) withMissingSince(s riskifiedv1alpha1.ResourceStatus) riskifiedv1alpha1.ResourceStatus {
+	if h.BaseDestinationRuleGracePeriod > 0 && h.StatusHandler != nil && h.StatusHandler.DynamicEnv != nil {
+		since := h.baseMissingSince(s.ServiceHost)
+		s.MissingSince = &since
+	}
+	return s
+}
+
+// AggregateStatus rolls the statuses of all the DestinationRules of this handler into a single
+// status (see `AggregateDestinationRuleStatuses`).
+func (h *DestinationRuleHandler) AggregateStatus() (riskifiedv1alpha1.LifeCycleStatus, error) {
+	statuses, err := h.GetStatus()
+	if err != nil {
+		return riskifiedv1alpha1.Unknown, err
+	}
+	return AggregateDestinationRuleStatuses(statuses), nil
+}
+
+// ApplyStatus persists the provided statuses along with any status of a handled host that was not
+// persisted yet (see StatusFlushInterval). Like the flushes during Handle, it persists them even if
+// the context is already done.
 func (h *DestinationRuleHandler) ApplyStatus(statuses []riskifiedv1alpha1.ResourceStatus) error {
-	for _, rs := range statuses {
-		if err := h.StatusHandler.AddDestinationRuleStatusEntry(h.UniqueName, rs); err != nil {
-			return err
-		}
+	if h.StatusHandler == nil {
+		return nil
 	}
-	return nil
+	h.unflushed = append(h.unflushed, statuses...)
+	return h.flushStatuses(true)
 }
 
 func (h *DestinationRuleHandler) GetSubset() string {
@@ -134,19 +780,85 @@ func (h *DestinationRuleHandler) GetHosts() []string {
 	return h.activeHosts
 }
 
-func (h *DestinationRuleHandler) createMissingDestinationRule(destinationRuleName, serviceHost string) error {
-	if err := h.setStatus(h.UniqueName, destinationRuleName, riskifiedv1alpha1.Initializing); err != nil {
-		return fmt.Errorf("failed to update status (prior to launching destination rule: %s): %w", serviceHost, err)
+// GetExcludedHosts returns the hosts that were skipped in the last Handle since they are excluded
+// from the subset (see ExcludedHosts).
+func (h *DestinationRuleHandler) GetExcludedHosts() []string {
+	return h.excluded
+}
+
+// IncludedHosts returns the service hosts that are not excluded from the subset (see
+// ExcludedHosts).
+func (h *DestinationRuleHandler) IncludedHosts() []string {
+	var result []string
+	for _, sh := range h.ServiceHosts {
+		if !h.isExcluded(sh) {
+			result = append(result, sh)
+		}
+	}
+	return result
+}
+
+// Whether the provided service host is excluded from the subset (see ExcludedHosts).
+func (h *DestinationRuleHandler) isExcluded(serviceHost string) bool {
+	normalized := helpers.NormalizeHost(serviceHost, h.Namespace, h.ClusterDomain)
+	for _, excluded := range h.ExcludedHosts {
+		if helpers.NormalizeHost(excluded, h.Namespace, h.ClusterDomain) == normalized {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *DestinationRuleHandler) addExcluded(serviceHost string) {
+	if !helpers.StringSliceContainsFold(serviceHost, h.excluded) {
+		h.Log.V(1).Info("Skipping host excluded from the subset", "host", serviceHost)
+		h.excluded = append(h.excluded, serviceHost)
 	}
+}
+
+// ActiveHosts returns (a copy of) the hosts that got an overriding DestinationRule in the last
+// Handle.
+func (h *DestinationRuleHandler) ActiveHosts() []string {
+	return append([]string(nil), h.activeHosts...)
+}
+
+// IgnoredMissingHosts returns (a copy of) the hosts that were ignored since they have no base
+// DestinationRule.
+func (h *DestinationRuleHandler) IgnoredMissingHosts() []string {
+	return append([]string(nil), h.ignoredMissing...)
+}
+
+// Creates the DestinationRule of the provided host and only then records it as running, so a
+// failing status update neither prevents the creation nor fails a host whose rule was created: the
+// host is still active and a requeue is requested (see RequeueAfter) to record its status, which
+// the next reconcile does once it finds the existing rule.
+func (h *DestinationRuleHandler) createMissingDestinationRule(destinationRuleName, serviceHost string) error {
 	if err := h.createOverridingDestinationRule(destinationRuleName, serviceHost); err != nil {
+		if errors.IsAlreadyExists(err) {
+			// Created in the meantime (e.g. stale cache), continue as if it was found.
+			return h.updateExistingDestinationRule(destinationRuleName, serviceHost)
+		}
 		if goerrors.As(err, &IgnoredMissing{}) {
-			h.ignoredMissing = append(h.ignoredMissing, serviceHost)
-			h.Log.Info("Added hostname to list of ignored missing", "hostname", serviceHost)
+			if err := h.ignore(serviceHost, err); err != nil {
+				return fmt.Errorf("creating destination rule for '%s': %w", serviceHost, err)
+			}
 		} else {
+			if goerrors.As(err, &AmbiguousBaseDestinationRule{}) {
+				h.ambiguous = append(h.ambiguous, serviceHost)
+			}
+			if goerrors.As(err, &NamespaceNotAllowed{}) {
+				h.addNotAllowed(serviceHost)
+			}
 			return fmt.Errorf("creating destination rule for '%s': %w", serviceHost, err)
 		}
-	} else {
-		h.activeHosts = append(h.activeHosts, serviceHost)
+		return nil
+	}
+	h.addActiveHost(serviceHost)
+	if err := h.setStatus(h.UniqueName, destinationRuleName, serviceHost, riskifiedv1alpha1.Running); err != nil {
+		h.Log.Error(err, "Failed to update status (after launching destination rule), requeueing", "drName", destinationRuleName, "host", serviceHost)
+		if !helpers.StringSliceContainsFold(serviceHost, h.unrecorded) {
+			h.unrecorded = append(h.unrecorded, serviceHost)
+		}
 	}
 	return nil
 }
@@ -156,72 +868,1362 @@ func (h *DestinationRuleHandler) createOverridingDestinationRule(drName, service
 	if err != nil {
 		return fmt.Errorf("creating overriding destination rule: %w", err)
 	}
-	h.Log.Info("Deploying newly created destination rule", "destination rule name", h.UniqueName, "service-host", drName)
-	watches.AddToAnnotation(h.Owner, newDestinationRule)
-	if err = h.Create(h.Ctx, newDestinationRule); err != nil {
+	if !h.namespaceAllowed(newDestinationRule.Namespace) {
+		return NamespaceNotAllowed{Namespace: newDestinationRule.Namespace}
+	}
+	h.Log.Info("Deploying newly created destination rule", "drName", drName, "host", serviceHost)
+	if err := h.claim(newDestinationRule, newDestinationRule.Spec.Subsets[0].Name, 0); err != nil {
+		return err
+	}
+	err = h.withTimeout(func(ctx context.Context) error {
+		return retry.OnError(retry.DefaultBackoff, isTransientError, func() error {
+			if h.ServerSideApply {
+				return h.apply(ctx, newDestinationRule)
+			}
+			return h.Create(ctx, newDestinationRule)
+		})
+	})
+	if err != nil {
 		return fmt.Errorf("error deploying new destination rule version=%q service-host=%q: %w", h.UniqueName, drName, err)
 	}
+	if h.Metrics != nil {
+		h.Metrics.Created.WithLabelValues(h.Owner.Namespace).Inc()
+	}
 	return nil
 }
 
-func (h *DestinationRuleHandler) generateOverridingDestinationRule(serviceHost string) (*istionetwork.DestinationRule, error) {
-	originalDestinationRule, err := h.locateDestinationRuleByHostname(serviceHost)
-	if err != nil {
-		return nil, fmt.Errorf("locating default destination rule for '%s': %w", h.ServiceHosts, err)
-	}
-	subset := &istioapi.Subset{
-		Labels: map[string]string{h.VersionLabel: h.UniqueVersion},
-		Name:   h.UniqueVersion,
-	}
-	newDestinationRule := &istionetwork.DestinationRule{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      h.calculateDRName(serviceHost),
-			Namespace: h.Namespace,
-			Labels: map[string]string{
-				h.VersionLabel: h.UniqueVersion,
-			},
-		},
-		Spec: istioapi.DestinationRule{
-			Host: originalDestinationRule.Spec.Host,
-			Subsets: []*istioapi.Subset{
-				subset,
-			},
-		},
+// Cleanup releases all the DestinationRules in our namespaces that are owned by us (according to
+// the ownership annotation, so it also catches rules that are no longer referenced by the status).
+// A DestinationRule is deleted only if no other owners remain.
+func (h *DestinationRuleHandler) Cleanup() error {
+	for _, namespace := range h.drNamespaces() {
+		if err := h.cleanupNamespace(namespace); err != nil {
+			return err
+		}
 	}
-	return newDestinationRule, nil
+	return nil
 }
 
-func (h *DestinationRuleHandler) locateDestinationRuleByHostname(hostName string) (*istionetwork.DestinationRule, error) {
+func (h *DestinationRuleHandler) cleanupNamespace(namespace string) error {
 	destinationRules := &istionetwork.DestinationRuleList{}
-	if err := h.List(h.Ctx, destinationRules, client.InNamespace(h.Namespace)); err != nil {
-		return nil, fmt.Errorf("error listing existing destination rules: %w", err)
+	err := h.withTimeout(func(ctx context.Context) error {
+		return h.List(ctx, destinationRules, client.InNamespace(namespace))
+	})
+	if err != nil {
+		return fmt.Errorf("listing destination rules for cleanup: %w", err)
 	}
-	for _, dr := range destinationRules.Items {
-		if helpers.MatchNamespacedHost(hostName, h.Namespace, dr.Spec.Host, dr.Namespace) {
-			for _, s := range dr.Spec.Subsets {
-				if s.Labels[h.VersionLabel] == h.DefaultVersion {
-					return dr, nil
-				}
+	for _, dr := range watches.FilterOwned(h.ownership(), destinationRules.Items, h.Owner, h.OwnerUID) {
+		if ReleaseDestinationRule(h.ownership(), dr, h.Owner, h.versionLabel(dr.Spec.Host), h.UniqueVersion) {
+			h.Log.Info("Deleting destination rule", "drName", dr.Name)
+			err := h.withTimeout(func(ctx context.Context) error { return h.Delete(ctx, dr) })
+			if err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("deleting destination rule %q: %w", dr.Name, err)
 			}
+			continue
+		}
+		h.Log.Info("Releasing ownership of destination rule", "drName", dr.Name)
+		if err := h.withTimeout(func(ctx context.Context) error { return h.Update(ctx, dr) }); err != nil {
+			return fmt.Errorf("releasing destination rule %q: %w", dr.Name, err)
 		}
 	}
-	h.Log.Info("Couldn't find DestinationRule per hostname with default version", "default-version",
-		h.VersionLabel, "namespace", h.Namespace, "hostname", hostName)
-	return nil, IgnoredMissing{}
+	return nil
 }
 
-func (h *DestinationRuleHandler) setStatus(subset, drName string, status riskifiedv1alpha1.LifeCycleStatus) error {
-	currentState := riskifiedv1alpha1.ResourceStatus{
-		Name:      drName,
-		Namespace: h.Namespace,
-		Status:    status,
+func (h *DestinationRuleHandler) addActiveHost(serviceHost string) {
+	if !helpers.StringSliceContainsFold(serviceHost, h.activeHosts) {
+		h.activeHosts = append(h.activeHosts, serviceHost)
 	}
-	if err := h.StatusHandler.AddDestinationRuleStatusEntry(subset, currentState); err != nil {
+}
+
+// Whether the provided (per subset) DestinationRule belongs to someone else and should not be touched
+// (see StrictOwnership).
+func (h *DestinationRuleHandler) isConflicting(dr *istionetwork.DestinationRule) bool {
+	return h.StrictOwnership && !h.owns(dr)
+}
+
+// Whether the provided DestinationRule is annotated with us as its owner. If a UID is recorded for
+// our name it must be ours.
+func (h *DestinationRuleHandler) owns(dr *istionetwork.DestinationRule) bool {
+	return h.ownership().ContainsOwner(h.Owner, h.OwnerUID, dr)
+}
+
+// The ownership annotations of this operator instance (see OwnerAnnotation).
+func (h *DestinationRuleHandler) ownership() watches.Ownership {
+	return watches.Ownership{Key: h.OwnerAnnotation}
+}
+
+// Whether our UID (if we have one) is recorded on the provided DestinationRule.
+func (h *DestinationRuleHandler) stamped(dr *istionetwork.DestinationRule) bool {
+	uid, _ := h.ownership().OwnerUID(h.Owner, dr)
+	return h.OwnerUID == "" || uid == h.OwnerUID
+}
+
+// Marks the provided DestinationRule as ours: adds us to its owners (see
+// `watches.Ownership.AddToAnnotationChecked`), records our UID and sets an owner reference to us if it's in our
+// namespace.
+func (h *DestinationRuleHandler) claim(dr *istionetwork.DestinationRule, subset string, maxOwners int) error {
+	if err := h.ownership().AddToAnnotationChecked(h.Owner, dr, maxOwners); err != nil {
 		return err
 	}
+	recordSubsetOwner(h.ownership(), dr, subset, h.Owner)
+	if h.OwnerUID == "" {
+		return nil
+	}
+	h.ownership().AddOwnerUID(h.Owner, h.OwnerUID, dr)
+	if dr.Namespace == h.Owner.Namespace {
+		refs := removeOwnerReferences(dr.OwnerReferences, h.Owner.Name)
+		dr.OwnerReferences = append(refs, metav1.OwnerReference{
+			APIVersion: riskifiedv1alpha1.GroupVersion.String(),
+			Kind:       "DynamicEnv",
+			Name:       h.Owner.Name,
+			UID:        h.OwnerUID,
+		})
+	}
 	return nil
 }
 
-func (h *DestinationRuleHandler) calculateDRName(serviceHost string) string {
-	return h.UniqueName + "-" + serviceHost
+// Marks the provided service host as conflicting and notifies about it (once per host).
+func (h *DestinationRuleHandler) addConflicting(drName, serviceHost string) {
+	if helpers.StringSliceContainsFold(serviceHost, h.conflicting) {
+		return
+	}
+	h.conflicting = append(h.conflicting, serviceHost)
+	h.Log.Info("Destination rule is not owned by us, leaving it as is", "drName", drName, "host", serviceHost)
+	if h.Recorder != nil && h.StatusHandler != nil && h.StatusHandler.DynamicEnv != nil {
+		h.Recorder.Eventf(h.StatusHandler.DynamicEnv, corev1.EventTypeWarning, names.ConflictingDestinationRuleReason,
+			"Destination rule %q for host %q belongs to another owner", drName, serviceHost)
+	}
+}
+
+// Ignores the provided service host according to the reason of the (IgnoredMissing) error. Hosts
+// without a base DestinationRule are only ignored once BaseDestinationRuleGracePeriod is over, and
+// not at all with StrictHosts (returning MissingBaseDestinationRule instead).
+func (h *DestinationRuleHandler) ignore(serviceHost string, err error) error {
+	var withoutDefault BaseWithoutDefaultSubset
+	if goerrors.As(err, &withoutDefault) {
+		h.addMissingDefaultSubset(withoutDefault)
+		return nil
+	}
+	var optedOut BaseOptedOut
+	if goerrors.As(err, &optedOut) {
+		h.addOptedOut(optedOut)
+		return nil
+	}
+	if h.baseGracePeriodRemaining(serviceHost) > 0 {
+		h.addAwaitingBase(serviceHost)
+		return nil
+	}
+	if h.StrictHosts {
+		if !helpers.StringSliceContainsFold(serviceHost, h.missingBase) {
+			h.missingBase = append(h.missingBase, serviceHost)
+		}
+		return MissingBaseDestinationRule{Host: serviceHost}
+	}
+	h.addIgnoredMissing(serviceHost)
+	return nil
+}
+
+func (h *DestinationRuleHandler) addAwaitingBase(serviceHost string) {
+	if !helpers.StringSliceContainsFold(serviceHost, h.awaitingBase) {
+		h.Log.Info("Base destination rule not found yet, will check again", "host", serviceHost)
+		h.awaitingBase = append(h.awaitingBase, serviceHost)
+	}
+}
+
+// Marks the host of the provided error as missing the default subset and notifies about it (once per
+// host).
+func (h *DestinationRuleHandler) addMissingDefaultSubset(e BaseWithoutDefaultSubset) {
+	if helpers.StringSliceContainsFold(e.Host, h.missingDefaultSubset) {
+		return
+	}
+	h.missingDefaultSubset = append(h.missingDefaultSubset, e.Host)
+	h.Log.Info("Base destination rule has no subset with the default version, ignoring hostname",
+		"host", e.Host, "default-version", e.Version, "destination-rules", e.Names)
+	if h.Recorder != nil && h.StatusHandler != nil && h.StatusHandler.DynamicEnv != nil {
+		h.Recorder.Eventf(h.StatusHandler.DynamicEnv, corev1.EventTypeWarning, names.MissingDefaultSubsetReason,
+			"Base destination rule for host %q has no subset with the default version %q: %s",
+			e.Host, e.Version, strings.Join(e.Names, ", "))
+	}
+}
+
+// Marks the host of the provided error as opted out and notifies about it (once per host).
+func (h *DestinationRuleHandler) addOptedOut(e BaseOptedOut) {
+	if helpers.StringSliceContainsFold(e.Host, h.optedOut) {
+		return
+	}
+	h.optedOut = append(h.optedOut, e.Host)
+	h.Log.Info("Base destination rule opted out of being overridden, ignoring hostname",
+		"host", e.Host, "destination-rules", e.Names)
+	if h.Recorder != nil && h.StatusHandler != nil && h.StatusHandler.DynamicEnv != nil {
+		h.Recorder.Eventf(h.StatusHandler.DynamicEnv, corev1.EventTypeNormal, names.OptedOutDestinationRuleReason,
+			"Base destination rule for host %q opted out of being overridden: %s", e.Host, strings.Join(e.Names, ", "))
+	}
+}
+
+// Whether we may create DestinationRules in the provided namespace (see AllowedNamespaces and
+// DeniedNamespaces).
+func (h *DestinationRuleHandler) namespaceAllowed(namespace string) bool {
+	if helpers.StringSliceContains(namespace, h.DeniedNamespaces) {
+		return false
+	}
+	return len(h.AllowedNamespaces) == 0 || helpers.StringSliceContains(namespace, h.AllowedNamespaces)
+}
+
+// Marks the provided service host as not allowed and notifies about it (once per host).
+func (h *DestinationRuleHandler) addNotAllowed(serviceHost string) {
+	if helpers.StringSliceContainsFold(serviceHost, h.notAllowed) {
+		return
+	}
+	h.notAllowed = append(h.notAllowed, serviceHost)
+	h.Log.Info("Not allowed to create destination rules in namespace", "namespace", h.drNamespace(serviceHost), "host", serviceHost)
+	if h.Recorder != nil && h.StatusHandler != nil && h.StatusHandler.DynamicEnv != nil {
+		h.Recorder.Eventf(h.StatusHandler.DynamicEnv, corev1.EventTypeWarning, names.NamespaceNotAllowedReason,
+			"Creating the destination rule for host %q in namespace %q is not allowed", serviceHost, h.drNamespace(serviceHost))
+	}
+}
+
+// Marks the provided service host as ignored missing and notifies about it (once per host).
+func (h *DestinationRuleHandler) addIgnoredMissing(serviceHost string) {
+	if helpers.StringSliceContainsFold(serviceHost, h.ignoredMissing) {
+		return
+	}
+	h.ignoredMissing = append(h.ignoredMissing, serviceHost)
+	h.Log.Info("Added hostname to list of ignored missing", "host", serviceHost)
+	if h.Metrics != nil {
+		h.Metrics.IgnoredMissing.WithLabelValues(h.Owner.Namespace).Inc()
+	}
+	if h.Recorder != nil && h.StatusHandler != nil && h.StatusHandler.DynamicEnv != nil {
+		h.Recorder.Eventf(h.StatusHandler.DynamicEnv, corev1.EventTypeWarning, names.IgnoredMissingDestinationRuleReason,
+			"Could not find base destination rule with default version for host %q", serviceHost)
+	}
+}
+
+// Re-fetches an existing overriding DestinationRule and updates it if required.
+func (h *DestinationRuleHandler) updateExistingDestinationRule(drName, serviceHost string) error {
+	found := &istionetwork.DestinationRule{}
+	err := h.withTimeout(func(ctx context.Context) error {
+		return h.Get(ctx, types.NamespacedName{Name: drName, Namespace: h.drNamespace(serviceHost)}, found)
+	})
+	if err != nil {
+		return fmt.Errorf("fetching already existing destination rule (%s): %w", drName, err)
+	}
+	if h.isConflicting(found) {
+		h.addConflicting(drName, serviceHost)
+		return nil
+	}
+	if err := h.updateIfRequired(found, serviceHost); err != nil {
+		return fmt.Errorf("updating destination rule for '%s': %w", serviceHost, err)
+	}
+	h.addActiveHost(serviceHost)
+	return nil
+}
+
+// Creates the shared DestinationRule for the provided service host or adds our subset to it if it
+// already exists. Since other dynamic environments may modify it concurrently we retry on
+// conflicts.
+func (h *DestinationRuleHandler) handleSharedDestinationRule(drName, serviceHost string) error {
+	isRetryable := func(err error) bool {
+		return errors.IsAlreadyExists(err) || isTransientError(err)
+	}
+	err := retry.OnError(retry.DefaultRetry, isRetryable, func() error {
+		found := &istionetwork.DestinationRule{}
+		err := h.withTimeout(func(ctx context.Context) error {
+			return h.Get(ctx, types.NamespacedName{Name: drName, Namespace: h.drNamespace(serviceHost)}, found)
+		})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				if h.waitingForDeployment() {
+					return errPendingDeployment
+				}
+				return h.createOverridingDestinationRule(drName, serviceHost)
+			}
+			return fmt.Errorf("error locating shared destination rule by name (%s): %w", drName, err)
+		}
+		desired, err := h.generateOverridingDestinationRule(serviceHost)
+		if err != nil {
+			return err
+		}
+		// The shared rules are named after the host, so a rule of another service could only get our
+		// name by a (hash) collision
+		if !helpers.SameService(found.Spec.Host, found.Namespace, desired.Spec.Host, desired.Namespace) {
+			return fmt.Errorf("shared destination rule %q is of host %q rather than %q", drName, found.Spec.Host, desired.Spec.Host)
+		}
+		ourSubset := desired.Spec.Subsets[0]
+		versionLabel := h.versionLabel(serviceHost)
+		current := findVersionSubset(found, versionLabel, h.UniqueVersion)
+		if current != nil && current.Name == ourSubset.Name {
+			return nil
+		}
+		if current == nil && h.waitingForDeployment() {
+			return errPendingDeployment
+		}
+		removeVersionSubsets(found, versionLabel, h.UniqueVersion)
+		// A subset with our name but selecting by another (e.g. previous) version label key
+		removeNamedSubset(found, ourSubset.Name)
+		found.Spec.Subsets = append(found.Spec.Subsets, ourSubset)
+		if err := h.claim(found, ourSubset.Name, h.MaxAnnotationOwners); err != nil {
+			return err
+		}
+		h.Log.Info("Adding subset to shared destination rule", "drName", drName, "subsetName", ourSubset.Name)
+		if err := h.withTimeout(func(ctx context.Context) error { return h.Update(ctx, found) }); err != nil {
+			return err
+		}
+		if h.Metrics != nil {
+			h.Metrics.Updated.WithLabelValues(h.Owner.Namespace).Inc()
+		}
+		return nil
+	})
+	if err != nil {
+		if goerrors.Is(err, errPendingDeployment) {
+			h.addPending(serviceHost)
+			return nil
+		}
+		if goerrors.As(err, &IgnoredMissing{}) {
+			if err := h.ignore(serviceHost, err); err != nil {
+				return fmt.Errorf("adding subset to shared destination rule for '%s': %w", serviceHost, err)
+			}
+			return nil
+		}
+		if goerrors.As(err, &AmbiguousBaseDestinationRule{}) {
+			h.ambiguous = append(h.ambiguous, serviceHost)
+		}
+		if goerrors.As(err, &NamespaceNotAllowed{}) {
+			h.addNotAllowed(serviceHost)
+		}
+		return fmt.Errorf("adding subset to shared destination rule for '%s': %w", serviceHost, err)
+	}
+	h.addActiveHost(serviceHost)
+	return nil
+}
+
+// Updates the provided (existing) overriding DestinationRule if it does not match the one we would
+// generate from the current DynamicEnv (e.g. the version was modified).
+func (h *DestinationRuleHandler) updateIfRequired(found *istionetwork.DestinationRule, serviceHost string) error {
+	desired, err := h.generateOverridingDestinationRule(serviceHost)
+	if err != nil {
+		if goerrors.As(err, &IgnoredMissing{}) {
+			h.Log.V(1).Info("Base destination rule is missing, leaving existing destination rule as is", "drName", found.Name)
+			return nil
+		}
+		return err
+	}
+	stale := h.staleVersionLabels(found, h.versionLabel(serviceHost))
+	owned := h.owns(found)
+	propagated := containsEntries(found.Labels, desired.Labels) && containsEntries(found.Annotations, desired.Annotations)
+	upToDate, err := isDestinationRuleUpToDate(found, desired)
+	if err != nil {
+		return err
+	}
+	if upToDate && len(stale) == 0 && owned && h.stamped(found) && propagated {
+		return nil
+	}
+	if !owned {
+		h.Log.Info("Adopting existing destination rule", "drName", found.Name, "host", serviceHost)
+	}
+	h.Log.Info("Updating outdated destination rule", "drName", found.Name, "host", serviceHost)
+	found.Spec.Host = desired.Spec.Host
+	found.Spec.Subsets = desired.Spec.Subsets
+	if found.Labels == nil {
+		found.Labels = map[string]string{}
+	}
+	for _, k := range stale {
+		h.Log.Info("Removing stale version label from destination rule", "drName", found.Name, "label", k)
+		delete(found.Labels, k)
+	}
+	for k, v := range desired.Labels {
+		found.Labels[k] = v
+	}
+	if len(desired.Annotations) > 0 && found.Annotations == nil {
+		found.Annotations = map[string]string{}
+	}
+	for k, v := range desired.Annotations {
+		found.Annotations[k] = v
+	}
+	if err := h.claim(found, desired.Spec.Subsets[0].Name, 0); err != nil {
+		return err
+	}
+	err = h.withTimeout(func(ctx context.Context) error {
+		if h.ServerSideApply {
+			return h.apply(ctx, appliedDestinationRule(h.ownership(), found, desired))
+		}
+		return h.Update(ctx, found)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating destination rule %q: %w", found.Name, err)
+	}
+	if h.Metrics != nil {
+		h.Metrics.Updated.WithLabelValues(h.Owner.Namespace).Inc()
+	}
+	return nil
+}
+
+// Server-side applies the provided DestinationRule (see ServerSideApply). Conflicts are forced, as
+// the generated rules are ours.
+func (h *DestinationRuleHandler) apply(ctx context.Context, dr *istionetwork.DestinationRule) error {
+	dr.TypeMeta = metav1.TypeMeta{APIVersion: istionetwork.SchemeGroupVersion.String(), Kind: "DestinationRule"}
+	dr.ResourceVersion = ""
+	dr.ManagedFields = nil
+	return h.Patch(ctx, dr, client.Apply, client.FieldOwner(names.DestinationRuleFieldManager), client.ForceOwnership)
+}
+
+// Returns the fields of the provided (updated) DestinationRule we manage when using server-side
+// apply: the spec, the generated labels and annotations, the ownership annotations and the owner
+// references. The rest (e.g. labels added by others) is left to their managers.
+func appliedDestinationRule(ownership watches.Ownership, dr, desired *istionetwork.DestinationRule) *istionetwork.DestinationRule {
+	applied := &istionetwork.DestinationRule{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            dr.Name,
+			Namespace:       dr.Namespace,
+			Labels:          desired.Labels,
+			Annotations:     map[string]string{},
+			OwnerReferences: dr.OwnerReferences,
+		},
+	}
+	dr.Spec.DeepCopyInto(&applied.Spec)
+	for k, v := range desired.Annotations {
+		applied.Annotations[k] = v
+	}
+	for _, k := range []string{ownership.NamespacedNameKey(), ownership.OwnerUIDsKey(), ownership.SubsetOwnersKey()} {
+		if v, ok := dr.Annotations[k]; ok {
+			applied.Annotations[k] = v
+		}
+	}
+	return applied
+}
+
+// Returns the labels of the provided (owned) DestinationRule that select our version under a key
+// other than the configured version label (e.g. after the version label key was migrated). Once
+// removed the DestinationRule only carries the configured key, so repeated reconciles (even while
+// workloads temporarily carry both keys) do not flip it back and forth.
+func (h *DestinationRuleHandler) staleVersionLabels(dr *istionetwork.DestinationRule, versionLabel string) []string {
+	var stale []string
+	for k, v := range dr.Labels {
+		if k != versionLabel && k != names.DynamicEnvLabel && v == h.UniqueVersion {
+			stale = append(stale, k)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+func (h *DestinationRuleHandler) generateOverridingDestinationRule(serviceHost string) (*istionetwork.DestinationRule, error) {
+	originalDestinationRule, defaultSubset, err := h.locateDestinationRuleByHostname(serviceHost)
+	if err != nil {
+		return nil, fmt.Errorf("locating default destination rule for '%s': %w", h.ServiceHosts, err)
+	}
+	versionLabel := h.versionLabel(serviceHost)
+	if err := h.validateVersionLabel(versionLabel); err != nil {
+		return nil, err
+	}
+	subsetName, err := h.renderSubsetName(defaultSubset.Name)
+	if err != nil {
+		return nil, err
+	}
+	h.setSubsetName(serviceHost, subsetName)
+	subsetLabels := map[string]string{}
+	for k, v := range h.SubsetSelector {
+		subsetLabels[k] = v
+	}
+	subsetLabels[versionLabel] = h.UniqueVersion
+	subset := &istioapi.Subset{
+		Labels: subsetLabels,
+		Name:   subsetName,
+	}
+	var trafficPolicy *istioapi.TrafficPolicy
+	if !h.SkipTrafficPolicy {
+		trafficPolicy = originalDestinationRule.Spec.TrafficPolicy.DeepCopy()
+		subset.TrafficPolicy = defaultSubset.TrafficPolicy.DeepCopy()
+	}
+	if h.SubsetTLS != nil {
+		if subset.TrafficPolicy == nil {
+			subset.TrafficPolicy = &istioapi.TrafficPolicy{}
+		}
+		subset.TrafficPolicy.Tls = h.SubsetTLS.DeepCopy()
+	}
+	if h.ConnectionPool != nil {
+		if err := h.ConnectionPool.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid connection pool override: %w", err)
+		}
+		if subset.TrafficPolicy == nil {
+			subset.TrafficPolicy = &istioapi.TrafficPolicy{}
+		}
+		subset.TrafficPolicy.ConnectionPool = mergeConnectionPool(subset.TrafficPolicy.ConnectionPool, h.ConnectionPool)
+	}
+	if h.LoadBalancer != nil {
+		if err := h.LoadBalancer.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid load balancer override: %w", err)
+		}
+		if subset.TrafficPolicy == nil {
+			subset.TrafficPolicy = &istioapi.TrafficPolicy{}
+		}
+		subset.TrafficPolicy.LoadBalancer = toIstioLoadBalancer(h.LoadBalancer)
+	}
+	if h.TLS != nil {
+		if err := h.TLS.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid TLS override: %w", err)
+		}
+		if subset.TrafficPolicy == nil {
+			subset.TrafficPolicy = &istioapi.TrafficPolicy{}
+		}
+		subset.TrafficPolicy.Tls = toIstioTLS(h.TLS)
+	}
+	for i := range h.PortLevelSettings {
+		override := &h.PortLevelSettings[i]
+		if err := override.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid port level override: %w", err)
+		}
+		if subset.TrafficPolicy == nil {
+			subset.TrafficPolicy = &istioapi.TrafficPolicy{}
+		}
+		mergePortTrafficPolicy(subset.TrafficPolicy, override)
+	}
+	host := originalDestinationRule.Spec.Host
+	switch ns := originalDestinationRule.Namespace; {
+	case helpers.IsWildcardHost(host): // our rule should only affect the requested host
+		host = helpers.NormalizeHost(serviceHost, h.Namespace, h.ClusterDomain)
+	case h.ShortHostsInServiceNamespace && ns != "" && ns != h.Namespace && helpers.IsShortHost(host):
+		host = helpers.NormalizeHost(host, h.Namespace, h.ClusterDomain)
+	case ns != "" && ns != h.drNamespace(serviceHost) && helpers.IsShortHost(host):
+		// The short hosts of rules exported from other namespaces are relative to their namespace
+		// (qualified and external hosts mean the same in any namespace)
+		host = helpers.NormalizeHost(host, ns, h.ClusterDomain)
+	}
+	var drLabels, drAnnotations map[string]string
+	if !h.SharedDestinationRules { // a shared rule does not belong to a single version
+		drLabels = map[string]string{}
+		for k, v := range h.Labels {
+			drLabels[k] = v
+		}
+		drLabels[versionLabel] = h.UniqueVersion
+		for k, v := range h.Annotations {
+			if k == h.ownership().NamespacedNameKey() || k == h.ownership().OwnerUIDsKey() {
+				continue
+			}
+			if drAnnotations == nil {
+				drAnnotations = map[string]string{}
+			}
+			drAnnotations[k] = v
+		}
+	}
+	newDestinationRule := &istionetwork.DestinationRule{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        h.calculateDRName(serviceHost),
+			Namespace:   h.drNamespace(serviceHost),
+			Labels:      drLabels,
+			Annotations: drAnnotations,
+		},
+		Spec: istioapi.DestinationRule{
+			Host:          host,
+			TrafficPolicy: trafficPolicy,
+			Subsets: []*istioapi.Subset{
+				subset,
+			},
+			// Keep the visibility of the base rule (e.g. namespace local)
+			ExportTo:         append([]string(nil), originalDestinationRule.Spec.ExportTo...),
+			WorkloadSelector: originalDestinationRule.Spec.WorkloadSelector.DeepCopy(),
+		},
+	}
+	if !h.SharedDestinationRules {
+		hash, err := managedSpecHash(newDestinationRule)
+		if err != nil {
+			return nil, err
+		}
+		if newDestinationRule.Annotations == nil {
+			newDestinationRule.Annotations = map[string]string{}
+		}
+		newDestinationRule.Annotations[names.DestinationRuleSpecHashAnnotation] = hash
+		// Kept up to date as part of the annotations we propagate (see updateIfRequired). The
+		// ServiceEntry hosts have no base rule.
+		if originalDestinationRule.Name != "" {
+			newDestinationRule.Annotations[names.DestinationRuleBaseAnnotation] =
+				originalDestinationRule.Namespace + "/" + originalDestinationRule.Name
+		}
+	}
+	return newDestinationRule, nil
+}
+
+// Returns a hash of the parts of the spec of the provided DestinationRule we manage: the host and
+// the subsets (see updateIfRequired).
+func managedSpecHash(dr *istionetwork.DestinationRule) (string, error) {
+	managed := &istioapi.DestinationRule{Host: dr.Spec.Host, Subsets: dr.Spec.Subsets}
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(managed)
+	if err != nil {
+		return "", fmt.Errorf("hashing destination rule %q: %w", dr.Name, err)
+	}
+	return helpers.Shorten(helpers.AsSha256(string(encoded)), 16), nil
+}
+
+// Returns the namespace where the base and the generated DestinationRules of the provided service
+// host are located.
+func (h *DestinationRuleHandler) drNamespace(serviceHost string) string {
+	return helpers.ValueForHost(serviceHost, h.Namespace, h.ClusterDomain, h.defaultDRNamespace(), h.DestinationRuleNamespacesByHost)
+}
+
+// Returns the namespace of the DestinationRules of hosts without a specific namespace.
+func (h *DestinationRuleHandler) defaultDRNamespace() string {
+	if h.DestinationRuleNamespace != "" {
+		return h.DestinationRuleNamespace
+	}
+	return h.Namespace
+}
+
+// Returns all the namespaces our DestinationRules may be located in (see drNamespace).
+func (h *DestinationRuleHandler) drNamespaces() []string {
+	namespaces := []string{h.defaultDRNamespace()}
+	for _, namespace := range h.DestinationRuleNamespacesByHost {
+		namespaces = append(namespaces, namespace)
+	}
+	namespaces = helpers.UniqueStringSlice(namespaces)
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Returns the version label key used by the provided service host.
+func (h *DestinationRuleHandler) versionLabel(serviceHost string) string {
+	return helpers.VersionLabelFor(serviceHost, h.Namespace, h.ClusterDomain, h.VersionLabel, h.VersionLabelsByHost)
+}
+
+func (h *DestinationRuleHandler) defaultVersion(serviceHost string) string {
+	return helpers.ValueForHost(serviceHost, h.Namespace, h.ClusterDomain, h.DefaultVersion, h.DefaultVersionsByHost)
+}
+
+// Validates that the version label (and our version as its value) are legal before we use them
+// in the generated subset (otherwise the API server rejects the DestinationRule with a less
+// descriptive error).
+func (h *DestinationRuleHandler) validateVersionLabel(versionLabel string) error {
+	if errs := validation.IsQualifiedName(versionLabel); len(errs) > 0 {
+		return fmt.Errorf("version label %q is not a valid label key: %s", versionLabel, strings.Join(errs, "; "))
+	}
+	if h.UniqueVersion == "" {
+		return fmt.Errorf("version (value of label %q) must not be empty", versionLabel)
+	}
+	if errs := validation.IsValidLabelValue(h.UniqueVersion); len(errs) > 0 {
+		return fmt.Errorf("version %q is not a valid value for label %q: %s", h.UniqueVersion, versionLabel, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Renders the name of the generated subset from `SubsetNameTemplate` (defaults to the unique
+// version).
+func (h *DestinationRuleHandler) renderSubsetName(baseSubsetName string) (string, error) {
+	if h.SubsetNameTemplate == "" {
+		return h.UniqueVersion, nil
+	}
+	tmpl, err := template.New("subset-name").Option("missingkey=error").Parse(h.SubsetNameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("parsing subset name template %q: %w", h.SubsetNameTemplate, err)
+	}
+	var buf bytes.Buffer
+	data := map[string]string{"UniqueVersion": h.UniqueVersion, "BaseSubsetName": baseSubsetName}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("rendering subset name template %q: %w", h.SubsetNameTemplate, err)
+	}
+	name := buf.String()
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return "", fmt.Errorf("rendered subset name %q is not a valid DNS-1123 label: %s", name, strings.Join(errs, "; "))
+	}
+	return name, nil
+}
+
+func (h *DestinationRuleHandler) setSubsetName(serviceHost, name string) {
+	if h.subsetNames == nil {
+		h.subsetNames = make(map[string]string)
+	}
+	h.subsetNames[serviceHost] = name
+}
+
+// PlannedChanges returns the writes that would have been done by `Handle` (in dry-run mode).
+func (h *DestinationRuleHandler) PlannedChanges() []PlannedChange {
+	return h.planned
+}
+
+// GetSubsetNames returns the names of the generated subsets per service host (only for hosts with a
+// located base DestinationRule).
+func (h *DestinationRuleHandler) GetSubsetNames() map[string]string {
+	return h.subsetNames
+}
+
+// Locates the base DestinationRule for the provided hostname. Returns the DestinationRule along
+// with its default version subset. Base rules that opted out of being overridden (see
+// NoOverrideAnnotation) are skipped. If all the matches of a host opted out it's reported as
+// BaseOptedOut, rather than falling back to wildcard matches (or Service matches, see
+// MatchByService). The rules exported from other namespaces (see ExportedBaseDestinationRules) are
+// only considered if none of the rules of our namespace match.
+func (h *DestinationRuleHandler) locateDestinationRuleByHostname(hostName string) (*istionetwork.DestinationRule, *istioapi.Subset, error) {
+	destinationRules, err := h.listDestinationRules(h.drNamespace(hostName))
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates := [][]*istionetwork.DestinationRule{destinationRules}
+	if h.ExportedBaseDestinationRules {
+		exported, err := h.exportedDestinationRules(h.drNamespace(hostName))
+		if err != nil {
+			return nil, nil, err
+		}
+		candidates = append(candidates, exported)
+	}
+	versionLabel := h.versionLabel(hostName)
+	defaultVersion := h.defaultVersion(hostName)
+	exactMatch := func(dr *istionetwork.DestinationRule) bool {
+		if h.ShortHostsInServiceNamespace && dr.Namespace != h.Namespace {
+			return helpers.MatchShortHostInNamespace(hostName, h.Namespace, dr.Spec.Host, dr.Namespace, h.ClusterDomain)
+		}
+		return helpers.MatchNamespacedHost(hostName, h.Namespace, dr.Spec.Host, dr.Namespace, h.ClusterDomain)
+	}
+	wildcardMatch := func(dr *istionetwork.DestinationRule) bool {
+		return helpers.MatchWildcardHost(hostName, h.Namespace, dr.Spec.Host, dr.Namespace, h.ClusterDomain)
+	}
+	matchers := []func(*istionetwork.DestinationRule) bool{exactMatch, wildcardMatch}
+	// The first failure to resolve the Service of a host while matching by Service
+	var resolveErr error
+	if h.MatchByService {
+		// The Service of the requested host is only resolved if there is no exact or wildcard match
+		var service *types.NamespacedName
+		resolved := false
+		serviceMatch := func(dr *istionetwork.DestinationRule) bool {
+			// Exact matches were already considered
+			if resolveErr != nil || exactMatch(dr) || helpers.IsWildcardHost(dr.Spec.Host) {
+				return false
+			}
+			if !resolved {
+				service, resolveErr = h.resolveService(hostName, h.Namespace)
+				resolved = true
+			}
+			if service == nil {
+				return false
+			}
+			drService, err := h.resolveService(dr.Spec.Host, dr.Namespace)
+			if err != nil {
+				resolveErr = err
+				return false
+			}
+			return drService != nil && *drService == *service
+		}
+		matchers = append(matchers, serviceMatch)
+	}
+	// Host matching rules that lack the default version subset (reported if there is no other match).
+	// The rules we (or other dynamic environments) generated never have one, so they are skipped.
+	var withoutDefault []string
+	// The rules of our namespace take precedence over the exported ones. Within each, exact matches
+	// take precedence over wildcard matches (which take precedence over Service matches).
+	for _, rules := range candidates {
+		for _, matcher := range matchers {
+			var matchingDR *istionetwork.DestinationRule
+			var matchingSubset *istioapi.Subset
+			var matchingNames []string
+			var optedOut []string
+			for _, dr := range rules {
+				if !matcher(dr) {
+					continue
+				}
+				if h.optsOut(dr) {
+					optedOut = append(optedOut, dr.Namespace+"/"+dr.Name)
+					continue
+				}
+				subset := findVersionSubset(dr, versionLabel, defaultVersion)
+				if subset == nil {
+					if len(h.ownership().OwnersOf(dr)) == 0 {
+						withoutDefault = append(withoutDefault, dr.Namespace+"/"+dr.Name)
+					}
+					continue
+				}
+				if matchingDR == nil {
+					matchingDR, matchingSubset = dr, subset
+				}
+				matchingNames = append(matchingNames, dr.Namespace+"/"+dr.Name)
+			}
+			if resolveErr != nil {
+				return nil, nil, resolveErr
+			}
+			if len(matchingNames) > 1 {
+				sort.Strings(matchingNames)
+				return nil, nil, AmbiguousBaseDestinationRule{Host: hostName, Names: matchingNames}
+			}
+			if matchingDR != nil {
+				return matchingDR, matchingSubset, nil
+			}
+			if len(optedOut) > 0 {
+				sort.Strings(optedOut)
+				return nil, nil, BaseOptedOut{Host: hostName, Names: optedOut}
+			}
+		}
+	}
+	if h.ServiceEntryHosts {
+		found, err := h.serviceEntryDeclares(hostName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if found {
+			// There are no base subsets to inherit from, just bind our subset to the external host
+			h.Log.V(1).Info("Using ServiceEntry host without base destination rule", "host", hostName)
+			base := &istionetwork.DestinationRule{Spec: istioapi.DestinationRule{Host: hostName}}
+			return base, &istioapi.Subset{Name: defaultVersion}, nil
+		}
+	}
+	if len(withoutDefault) > 0 {
+		sort.Strings(withoutDefault)
+		return nil, nil, BaseWithoutDefaultSubset{
+			Host: hostName, Version: defaultVersion, Names: helpers.UniqueStringSlice(withoutDefault),
+		}
+	}
+	h.Log.Info("Couldn't find DestinationRule per hostname with default version", "default-version",
+		defaultVersion, "version-label", versionLabel, "namespace", h.Namespace, "host", hostName)
+	return nil, nil, IgnoredMissing{}
+}
+
+// Returns the subset of the base DestinationRule of the provided host that already carries our
+// version (e.g. someone pre-created it), if any. An overriding DestinationRule would be redundant in
+// this case (and would make two subsets match our version). Failures to locate the base rule are
+// ignored here, as they are reported when generating the overriding DestinationRule.
+func (h *DestinationRuleHandler) subsetInBase(serviceHost string) *istioapi.Subset {
+	base, _, err := h.locateDestinationRuleByHostname(serviceHost)
+	if err != nil {
+		return nil
+	}
+	return findVersionSubset(base, h.versionLabel(serviceHost), h.UniqueVersion)
+}
+
+// Whether the provided base DestinationRule opted out of being overridden (see NoOverrideAnnotation).
+func (h *DestinationRuleHandler) optsOut(dr *istionetwork.DestinationRule) bool {
+	annotation := h.NoOverrideAnnotation
+	if annotation == "" {
+		annotation = names.DefaultNoOverrideAnnotation
+	}
+	return strings.EqualFold(dr.Annotations[annotation], "true")
+}
+
+// Returns the DestinationRules of the other namespaces (than the provided one) that are exported to
+// our namespace (see ExportedBaseDestinationRules).
+func (h *DestinationRuleHandler) exportedDestinationRules(namespace string) ([]*istionetwork.DestinationRule, error) {
+	all, err := h.listDestinationRules(metav1.NamespaceAll)
+	if err != nil {
+		return nil, err
+	}
+	var result []*istionetwork.DestinationRule
+	for _, dr := range all {
+		if dr.Namespace != namespace && helpers.ExportedTo(dr.Spec.ExportTo, dr.Namespace, h.Namespace) {
+			result = append(result, dr)
+		}
+	}
+	return result, nil
+}
+
+// Lists the DestinationRules of the provided namespace (of all the namespaces if empty) through
+// BaseLookupReader if configured. The list is reused for all the hosts of a single Handle (the base
+// rules are not expected to change in the meantime). Note that it does not include the rules we
+// created since (they never serve as base rules as they lack the default version subset).
+func (h *DestinationRuleHandler) listDestinationRules(namespace string) ([]*istionetwork.DestinationRule, error) {
+	if listed, ok := h.destinationRules[namespace]; ok {
+		return listed, nil
+	}
+	var reader client.Reader = h.Client
+	if h.BaseLookupReader != nil {
+		reader = h.BaseLookupReader
+	}
+	destinationRules := &istionetwork.DestinationRuleList{}
+	err := h.withTimeout(func(ctx context.Context) error {
+		return reader.List(ctx, destinationRules, client.InNamespace(namespace))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing existing destination rules: %w", err)
+	}
+	if h.destinationRules == nil {
+		h.destinationRules = make(map[string][]*istionetwork.DestinationRule)
+	}
+	h.destinationRules[namespace] = destinationRules.Items
+	return destinationRules.Items, nil
+}
+
+// Resolves the Kubernetes Service the provided host (in namespace) addresses, following
+// ExternalName Services that point at other Services within the cluster (a single hop). Returns nil
+// if the host does not address an existing Service. The Services are looked up through
+// BaseLookupReader (like the base DestinationRules) once per Handle.
+func (h *DestinationRuleHandler) resolveService(host, namespace string) (*types.NamespacedName, error) {
+	key, ok := helpers.ServiceForHost(host, namespace, h.ClusterDomain)
+	if !ok {
+		return nil, nil
+	}
+	if resolved, ok := h.resolvedServices[key]; ok {
+		return resolved, nil
+	}
+	var reader client.Reader = h.Client
+	if h.BaseLookupReader != nil {
+		reader = h.BaseLookupReader
+	}
+	service := &corev1.Service{}
+	err := h.withTimeout(func(ctx context.Context) error {
+		return reader.Get(ctx, key, service)
+	})
+	var resolved *types.NamespacedName
+	switch {
+	case errors.IsNotFound(err):
+	case err != nil:
+		return nil, fmt.Errorf("error resolving the service of host '%s': %w", host, err)
+	case service.Spec.Type == corev1.ServiceTypeExternalName:
+		if target, ok := helpers.ServiceForHost(service.Spec.ExternalName, key.Namespace, h.ClusterDomain); ok {
+			resolved = &target
+		} else {
+			resolved = &key
+		}
+	default:
+		resolved = &key
+	}
+	if h.resolvedServices == nil {
+		h.resolvedServices = make(map[types.NamespacedName]*types.NamespacedName)
+	}
+	h.resolvedServices[key] = resolved
+	return resolved, nil
+}
+
+// Checks whether the provided host is declared by a ServiceEntry (visible from our namespace).
+func (h *DestinationRuleHandler) serviceEntryDeclares(hostName string) (bool, error) {
+	serviceEntries := &istionetwork.ServiceEntryList{}
+	err := h.withTimeout(func(ctx context.Context) error {
+		return h.List(ctx, serviceEntries, client.InNamespace(h.Namespace))
+	})
+	if err != nil {
+		return false, fmt.Errorf("error listing service entries: %w", err)
+	}
+	for _, se := range serviceEntries.Items {
+		for _, host := range se.Spec.Hosts {
+			if helpers.MatchNamespacedHost(hostName, h.Namespace, host, se.Namespace, h.ClusterDomain) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (h *DestinationRuleHandler) setStatus(subset, drName, serviceHost string, status riskifiedv1alpha1.LifeCycleStatus) error {
+	currentState := riskifiedv1alpha1.ResourceStatus{
+		Name:        drName,
+		Namespace:   h.drNamespace(serviceHost),
+		ServiceHost: serviceHost,
+		Status:      status,
+	}
+	if h.StatusHandler == nil {
+		return nil
+	}
+	h.Log.V(1).Info("Setting destination rule status", "drName", drName, "host", serviceHost, "status", status)
+	var err error
+	h.withStatusLock(func() {
+		err = h.StatusHandler.AddDestinationRuleStatusEntry(subset, currentState)
+	})
+	return err
+}
+
+// Calculates the name of the overriding (or shared) DestinationRule for the provided service host. If the
+// name exceeds the allowed length of a resource name (or is not a valid name at all, e.g. for
+// wildcard ServiceEntry hosts) we replace the service host with a short hash of it (it has to be
+// deterministic, otherwise we'll orphan previously created rules).
+func (h *DestinationRuleHandler) calculateDRName(serviceHost string) string {
+	h.resolveDRNames()
+	if name, ok := h.drNames[serviceHost]; ok {
+		return name
+	}
+	return h.strategyDRName(serviceHost)
+}
+
+func (h *DestinationRuleHandler) drNamePrefix() string {
+	if h.SharedDestinationRules {
+		return names.SharedDestinationRulePrefix
+	}
+	return h.UniqueName
+}
+
+func (h *DestinationRuleHandler) strategyDRName(serviceHost string) string {
+	if h.NameStrategy == nil {
+		return DefaultNameStrategy{}.DestinationRuleName(h.drNamePrefix(), serviceHost)
+	}
+	return h.NameStrategy.DestinationRuleName(h.drNamePrefix(), serviceHost)
+}
+
+// Resolves the DestinationRule names of all the (valid) service hosts, making sure no two hosts
+// share a rule (e.g. when their hashes collide), as they would clobber each other. The first host
+// keeps the colliding name, while the following ones fall back to a longer hash of the host (with
+// the default naming) or are marked as colliding. It only depends on the service hosts, so the
+// names stay the same between reconciles.
+func (h *DestinationRuleHandler) resolveDRNames() {
+	if h.drNames != nil {
+		return
+	}
+	h.drNames = make(map[string]string)
+	h.nameCollisions = make(map[string]DestinationRuleNameCollision)
+	hostsByName := make(map[types.NamespacedName]string)
+	_, defaultStrategy := h.NameStrategy.(DefaultNameStrategy)
+	defaultStrategy = defaultStrategy || h.NameStrategy == nil
+	for _, sh := range helpers.UniqueServiceHosts(h.ServiceHosts, h.Namespace) {
+		if helpers.ValidateServiceHost(sh) != nil || h.isExcluded(sh) {
+			continue
+		}
+		key := types.NamespacedName{Namespace: h.drNamespace(sh), Name: h.strategyDRName(sh)}
+		other, collides := hostsByName[key]
+		if collides && defaultStrategy {
+			longer := types.NamespacedName{Namespace: key.Namespace, Name: hashedDRName(h.drNamePrefix(), sh, drNameLongHashLength)}
+			if owner, taken := hostsByName[longer]; taken {
+				key, other = longer, owner
+			} else {
+				h.Log.Info("Destination rule name collides with the one of another host, using a longer hash",
+					"drName", key.Name, "host", sh, "collidesWith", other, "fallback", longer.Name)
+				key, collides = longer, false
+			}
+		}
+		if collides {
+			h.Log.Info("Skipping host with a colliding destination rule name", "drName", key.Name, "host", sh, "collidesWith", other)
+			h.nameCollisions[sh] = DestinationRuleNameCollision{Name: key.Name, Host: sh, CollidesWith: other}
+			h.notifyNameCollision(key.Name, sh, other)
+			h.drNames[sh] = key.Name
+			continue
+		}
+		hostsByName[key] = sh
+		h.drNames[sh] = key.Name
+	}
+}
+
+func (h *DestinationRuleHandler) notifyNameCollision(drName, serviceHost, other string) {
+	if h.Recorder != nil && h.StatusHandler != nil && h.StatusHandler.DynamicEnv != nil {
+		h.Recorder.Eventf(h.StatusHandler.DynamicEnv, corev1.EventTypeWarning, names.DestinationRuleNameCollisionReason,
+			"Destination rule name %q of host %q collides with the one of host %q", drName, serviceHost, other)
+	}
+}
+
+// Whether all the provided entries exist in the map (with the same values).
+func containsEntries(m, entries map[string]string) bool {
+	for k, v := range entries {
+		if current, ok := m[k]; !ok || current != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks whether the host and subsets of the existing DestinationRule match the desired ones, by
+// their hashes (see managedSpecHash). The hash recorded when the existing rule was last written
+// should match the desired one (otherwise the desired spec changed, e.g. the version was modified)
+// as well as the hash of its current spec (otherwise it was modified by others).
+func isDestinationRuleUpToDate(existing, desired *istionetwork.DestinationRule) (bool, error) {
+	desiredHash, ok := desired.Annotations[names.DestinationRuleSpecHashAnnotation]
+	if !ok {
+		return false, nil
+	}
+	if existing.Annotations[names.DestinationRuleSpecHashAnnotation] != desiredHash {
+		return false, nil
+	}
+	existingHash, err := managedSpecHash(existing)
+	if err != nil {
+		return false, err
+	}
+	return existingHash == desiredHash, nil
+}
+
+// RecordOwnedDestinationRules updates the per DynamicEnv gauges of the provided metrics: the number of
+// DestinationRules in the provided namespaces that are owned by the DynamicEnv (according to the
+// provided ownership annotations) and the number of its hosts that were ignored due to a missing
+// base DestinationRule (according to the provided statuses).
+func RecordOwnedDestinationRules(ctx context.Context, c client.Reader, ownership watches.Ownership, m *metrics.DestinationRuleMetrics, namespaces []string,
+	de *riskifiedv1alpha1.DynamicEnv, statuses []riskifiedv1alpha1.ResourceStatus) error {
+	owner := types.NamespacedName{Name: de.Name, Namespace: de.Namespace}
+	owned := 0
+	for _, namespace := range namespaces {
+		destinationRules := &istionetwork.DestinationRuleList{}
+		if err := c.List(ctx, destinationRules, client.InNamespace(namespace)); err != nil {
+			return fmt.Errorf("listing owned destination rules: %w", err)
+		}
+		owned += len(watches.FilterOwned(ownership, destinationRules.Items, owner, de.UID))
+	}
+	ignored := 0
+	for _, s := range statuses {
+		if s.Status == riskifiedv1alpha1.IgnoredMissingDR {
+			ignored++
+		}
+	}
+	m.OwnedDestinationRules.WithLabelValues(owner.Namespace, owner.Name).Set(float64(owned))
+	m.IgnoredMissingHosts.WithLabelValues(owner.Namespace, owner.Name).Set(float64(ignored))
+	return nil
+}
+
+// ReleaseDestinationRule removes the provided owner (and its subsets) from the DestinationRule,
+// according to the provided ownership annotations. The subsets are identified by the provenance
+// annotation (see watches.SubsetOwnersAnnotation), or by
+// the version label for rules written before it was recorded. Returns true if the DestinationRule
+// should be deleted: no other owners and no other subsets remain. Subsets that were added by others
+// (e.g. merged by hand into one of our rules) are kept, so such a rule is only updated.
+func ReleaseDestinationRule(ownership watches.Ownership, dr *istionetwork.DestinationRule, owner types.NamespacedName, versionLabel, version string) bool {
+	ownership.RemoveFromAnnotation(owner, dr)
+	if dr.Namespace == owner.Namespace {
+		dr.OwnerReferences = removeOwnerReferences(dr.OwnerReferences, owner.Name)
+	}
+	owners := ownership.SubsetOwners(dr)
+	removed := false
+	for subset, o := range owners {
+		if o == owner {
+			removeNamedSubset(dr, subset)
+			delete(owners, subset)
+			removed = true
+		}
+	}
+	if !removed {
+		removeVersionSubsets(dr, versionLabel, version)
+	}
+	ownership.SetSubsetOwners(dr, existingSubsetOwners(dr, owners))
+	return len(ownership.OwnersOf(dr)) == 0 && len(dr.Spec.Subsets) == 0
+}
+
+// Records the provided owner of the subset in the provenance annotation of the DestinationRule (see
+// watches.SubsetOwnersAnnotation), dropping the entries of subsets that no longer exist (e.g.
+// renamed).
+func recordSubsetOwner(ownership watches.Ownership, dr *istionetwork.DestinationRule, subset string, owner types.NamespacedName) {
+	owners := ownership.SubsetOwners(dr)
+	owners[subset] = owner
+	ownership.SetSubsetOwners(dr, existingSubsetOwners(dr, owners))
+}
+
+// Returns the provided owners of the subsets that exist in the DestinationRule.
+func existingSubsetOwners(dr *istionetwork.DestinationRule, owners map[string]types.NamespacedName) map[string]types.NamespacedName {
+	result := map[string]types.NamespacedName{}
+	for _, s := range dr.Spec.Subsets {
+		if owner, ok := owners[s.Name]; ok {
+			result[s.Name] = owner
+		}
+	}
+	return result
+}
+
+// ContainsVersionSubset returns whether the DestinationRule has a subset selecting the provided
+// version.
+func ContainsVersionSubset(dr *istionetwork.DestinationRule, versionLabel, version string) bool {
+	return findVersionSubset(dr, versionLabel, version) != nil
+}
+
+// Returns the subset that selects the provided version (nil if not found).
+func findVersionSubset(dr *istionetwork.DestinationRule, versionLabel, version string) *istioapi.Subset {
+	for _, s := range dr.Spec.Subsets {
+		if s.Labels[versionLabel] == version {
+			return s
+		}
+	}
+	return nil
+}
+
+func removeVersionSubsets(dr *istionetwork.DestinationRule, versionLabel, version string) {
+	var subsets []*istioapi.Subset
+	for _, s := range dr.Spec.Subsets {
+		if s.Labels[versionLabel] != version {
+			subsets = append(subsets, s)
+		}
+	}
+	dr.Spec.Subsets = subsets
+}
+
+// Removes the references to the DynamicEnv with the provided name (whatever its UID).
+func removeOwnerReferences(refs []metav1.OwnerReference, name string) []metav1.OwnerReference {
+	var result []metav1.OwnerReference
+	for _, ref := range refs {
+		if ref.Kind == "DynamicEnv" && ref.Name == name && strings.HasPrefix(ref.APIVersion, riskifiedv1alpha1.GroupVersion.Group+"/") {
+			continue
+		}
+		result = append(result, ref)
+	}
+	return result
+}
+
+// Returns a copy of the inherited connection pool settings with the values specified in the
+// override replacing the inherited ones.
+func mergeConnectionPool(inherited *istioapi.ConnectionPoolSettings, override *riskifiedv1alpha1.ConnectionPoolSettings) *istioapi.ConnectionPoolSettings {
+	merged := inherited.DeepCopy()
+	if merged == nil {
+		merged = &istioapi.ConnectionPoolSettings{}
+	}
+	if tcp := override.TCP; tcp != nil {
+		if merged.Tcp == nil {
+			merged.Tcp = &istioapi.ConnectionPoolSettings_TCPSettings{}
+		}
+		if tcp.MaxConnections != 0 {
+			merged.Tcp.MaxConnections = tcp.MaxConnections
+		}
+		if tcp.ConnectTimeout != nil {
+			merged.Tcp.ConnectTimeout = durationpb.New(tcp.ConnectTimeout.Duration)
+		}
+	}
+	if http := override.HTTP; http != nil {
+		if merged.Http == nil {
+			merged.Http = &istioapi.ConnectionPoolSettings_HTTPSettings{}
+		}
+		if http.HTTP1MaxPendingRequests != 0 {
+			merged.Http.Http1MaxPendingRequests = http.HTTP1MaxPendingRequests
+		}
+		if http.HTTP2MaxRequests != 0 {
+			merged.Http.Http2MaxRequests = http.HTTP2MaxRequests
+		}
+		if http.MaxRequestsPerConnection != 0 {
+			merged.Http.MaxRequestsPerConnection = http.MaxRequestsPerConnection
+		}
+		if http.MaxRetries != 0 {
+			merged.Http.MaxRetries = http.MaxRetries
+		}
+	}
+	return merged
+}
+
+// Applies the provided (valid) override to the settings of its port in the provided policy (adding
+// them if the port has no settings yet).
+func mergePortTrafficPolicy(policy *istioapi.TrafficPolicy, override *riskifiedv1alpha1.PortTrafficPolicy) {
+	var portPolicy *istioapi.TrafficPolicy_PortTrafficPolicy
+	for _, p := range policy.PortLevelSettings {
+		if p.GetPort().GetNumber() == override.Port {
+			portPolicy = p
+			break
+		}
+	}
+	if portPolicy == nil {
+		portPolicy = &istioapi.TrafficPolicy_PortTrafficPolicy{Port: &istioapi.PortSelector{Number: override.Port}}
+		policy.PortLevelSettings = append(policy.PortLevelSettings, portPolicy)
+	}
+	if override.ConnectionPool != nil {
+		portPolicy.ConnectionPool = mergeConnectionPool(portPolicy.ConnectionPool, override.ConnectionPool)
+	}
+	if override.LoadBalancer != nil {
+		portPolicy.LoadBalancer = toIstioLoadBalancer(override.LoadBalancer)
+	}
+	if override.TLS != nil {
+		portPolicy.Tls = toIstioTLS(override.TLS)
+	}
+}
+
+// Converts the provided (valid) load balancer settings to their Istio counterpart.
+func toIstioLoadBalancer(lb *riskifiedv1alpha1.LoadBalancerSettings) *istioapi.LoadBalancerSettings {
+	if lb.ConsistentHash == nil {
+		simple := istioapi.LoadBalancerSettings_SimpleLB(istioapi.LoadBalancerSettings_SimpleLB_value[lb.Simple])
+		return &istioapi.LoadBalancerSettings{LbPolicy: &istioapi.LoadBalancerSettings_Simple{Simple: simple}}
+	}
+	hash := &istioapi.LoadBalancerSettings_ConsistentHashLB{}
+	switch key := lb.ConsistentHash; {
+	case key.HTTPHeaderName != "":
+		hash.HashKey = &istioapi.LoadBalancerSettings_ConsistentHashLB_HttpHeaderName{HttpHeaderName: key.HTTPHeaderName}
+	case key.HTTPCookie != nil:
+		hash.HashKey = &istioapi.LoadBalancerSettings_ConsistentHashLB_HttpCookie{
+			HttpCookie: &istioapi.LoadBalancerSettings_ConsistentHashLB_HTTPCookie{
+				Name: key.HTTPCookie.Name,
+				Path: key.HTTPCookie.Path,
+				Ttl:  durationpb.New(key.HTTPCookie.TTL.Duration),
+			},
+		}
+	case key.UseSourceIP:
+		hash.HashKey = &istioapi.LoadBalancerSettings_ConsistentHashLB_UseSourceIp{UseSourceIp: true}
+	case key.HTTPQueryParameterName != "":
+		hash.HashKey = &istioapi.LoadBalancerSettings_ConsistentHashLB_HttpQueryParameterName{HttpQueryParameterName: key.HTTPQueryParameterName}
+	}
+	return &istioapi.LoadBalancerSettings{LbPolicy: &istioapi.LoadBalancerSettings_ConsistentHash{ConsistentHash: hash}}
+}
+
+// Converts the provided (valid) TLS settings to their Istio counterpart.
+func toIstioTLS(tls *riskifiedv1alpha1.ClientTLSSettings) *istioapi.ClientTLSSettings {
+	return &istioapi.ClientTLSSettings{
+		Mode:            istioapi.ClientTLSSettings_TLSmode(istioapi.ClientTLSSettings_TLSmode_value[tls.Mode]),
+		Sni:             tls.SNI,
+		CredentialName:  tls.CredentialName,
+		CaCertificates:  tls.CaCertificates,
+		SubjectAltNames: append([]string(nil), tls.SubjectAltNames...),
+	}
+}
+
+func removeNamedSubset(dr *istionetwork.DestinationRule, name string) {
+	var subsets []*istioapi.Subset
+	for _, s := range dr.Spec.Subsets {
+		if s.Name != name {
+			subsets = append(subsets, s)
+		}
+	}
+	dr.Spec.Subsets = subsets
+}
+
+// The precedence of DestinationRule statuses when aggregating them (first wins).
+var drStatusPrecedence = []riskifiedv1alpha1.LifeCycleStatus{
+	riskifiedv1alpha1.Failed,
+	riskifiedv1alpha1.AmbiguousBaseDR,
+	riskifiedv1alpha1.Conflicting,
+	riskifiedv1alpha1.NamespaceNotAllowed,
+	riskifiedv1alpha1.Missing,
+	riskifiedv1alpha1.Terminating,
+	riskifiedv1alpha1.Initializing,
+	riskifiedv1alpha1.MissingDefaultSubset,
+	riskifiedv1alpha1.OptedOut,
+	riskifiedv1alpha1.IgnoredMissingDR,
+	riskifiedv1alpha1.Excluded,
+	riskifiedv1alpha1.Running,
+}
+
+// AggregateDestinationRuleStatuses reduces the provided statuses into a single status according to
+// the following precedence: Failed > AmbiguousBaseDR > Conflicting > NamespaceNotAllowed > Missing >
+// Terminating > Initializing > MissingDefaultSubset > OptedOut > IgnoredMissingDR > Excluded >
+// Running. Any other status is treated as Initializing. Returns Unknown if no statuses are provided.
+func AggregateDestinationRuleStatuses(statuses []riskifiedv1alpha1.ResourceStatus) riskifiedv1alpha1.LifeCycleStatus {
+	indexOf := func(s riskifiedv1alpha1.LifeCycleStatus) int {
+		for idx, item := range drStatusPrecedence {
+			if s == item {
+				return idx
+			}
+		}
+		return -1
+	}
+	rank := func(s riskifiedv1alpha1.LifeCycleStatus) int {
+		if idx := indexOf(s); idx >= 0 {
+			return idx
+		}
+		return indexOf(riskifiedv1alpha1.Initializing)
+	}
+	if len(statuses) == 0 {
+		return riskifiedv1alpha1.Unknown
+	}
+	result := riskifiedv1alpha1.Running
+	for _, s := range statuses {
+		if rank(s.Status) < rank(result) {
+			result = drStatusPrecedence[rank(s.Status)]
+		}
+	}
+	return result
+}
+
+// Runs the provided client call with a context derived from Ctx (bounded by OperationTimeout).
+// Failures due to the context being done (or already done before the call) are reported as such.
+func (h *DestinationRuleHandler) withTimeout(call func(ctx context.Context) error) error {
+	parent := h.Ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	if err := parent.Err(); err != nil {
+		return h.contextError(err)
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if h.OperationTimeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, h.OperationTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+	if err := call(ctx); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return h.contextError(ctxErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Describes the provided error of a done context, telling timeouts (see OperationTimeout) apart.
+func (h *DestinationRuleHandler) contextError(err error) error {
+	if goerrors.Is(err, context.DeadlineExceeded) && h.OperationTimeout > 0 {
+		return fmt.Errorf("operation timed out (after %s): %w", h.OperationTimeout, err)
+	}
+	if goerrors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("operation deadline exceeded: %w", err)
+	}
+	return fmt.Errorf("operation canceled: %w", err)
+}
+
+// Whether the provided error is a transient API error (e.g. conflict or throttling) worth retrying.
+func isTransientError(err error) bool {
+	return errors.IsConflict(err) || errors.IsTooManyRequests(err) || errors.IsInternalError(err) ||
+		errors.IsServerTimeout(err) || errors.IsTimeout(err) || errors.IsServiceUnavailable(err)
 }
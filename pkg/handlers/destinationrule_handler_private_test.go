@@ -23,12 +23,22 @@ package handlers
 
 import (
 	"context"
+	goerrors "errors"
+	"strings"
+	"time"
+
 	"github.com/go-logr/logr"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	istioapi "istio.io/api/networking/v1alpha3"
+	istiotype "istio.io/api/type/v1beta1"
 	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -79,3 +89,794 @@ var _ = Describe("Accepting alternative version label and version", func() {
 		Expect(dr).NotTo(BeNil())
 	})
 })
+
+var _ = Describe("Selecting the subset pods by multiple labels", func() {
+	serviceName := "service-name"
+	mkHandler := func(selector map[string]string) DestinationRuleHandler {
+		return mkDestinationRuleHandler([]*istionetwork.DestinationRule{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "service", Namespace: "namespace"},
+				Spec: istioapi.DestinationRule{
+					Host: serviceName,
+					Subsets: []*istioapi.Subset{
+						{Name: "shared", Labels: map[string]string{"version": "shared", "track": "stable"}},
+					},
+				},
+			},
+		}, func(h *DestinationRuleHandler) {
+			h.ServiceHosts = []string{serviceName}
+			h.SubsetSelector = selector
+		})
+	}
+
+	It("selects the pods by the version label only by default", func() {
+		h := mkHandler(nil)
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].Labels).To(Equal(map[string]string{"version": "unique-version"}))
+	})
+
+	It("selects the pods by both the version label and the additional labels", func() {
+		h := mkHandler(map[string]string{"track": "canary"})
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].Labels).To(Equal(map[string]string{"version": "unique-version", "track": "canary"}))
+	})
+
+	It("always selects the unique version by the version label", func() {
+		h := mkHandler(map[string]string{"version": "shared", "track": "canary"})
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].Labels).To(Equal(map[string]string{"version": "unique-version", "track": "canary"}))
+	})
+})
+
+var _ = Describe("Inheriting the base destination rule traffic policy", func() {
+	serviceName := "service-name"
+	mkHandler := func(skipTrafficPolicy bool) DestinationRuleHandler {
+		return mkDestinationRuleHandler([]*istionetwork.DestinationRule{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "service", Namespace: "namespace"},
+				Spec: istioapi.DestinationRule{
+					Host: serviceName,
+					TrafficPolicy: &istioapi.TrafficPolicy{
+						OutlierDetection: &istioapi.OutlierDetection{
+							Consecutive_5XxErrors: wrapperspb.UInt32(7),
+							BaseEjectionTime:      durationpb.New(15 * time.Minute),
+						},
+					},
+					Subsets: []*istioapi.Subset{
+						{
+							Name:   "shared",
+							Labels: map[string]string{"version": "shared"},
+							TrafficPolicy: &istioapi.TrafficPolicy{
+								ConnectionPool: &istioapi.ConnectionPoolSettings{
+									Tcp: &istioapi.ConnectionPoolSettings_TCPSettings{MaxConnections: 42},
+								},
+								Tls: &istioapi.ClientTLSSettings{Mode: istioapi.ClientTLSSettings_ISTIO_MUTUAL},
+								PortLevelSettings: []*istioapi.TrafficPolicy_PortTrafficPolicy{
+									{
+										Port: &istioapi.PortSelector{Number: 8080},
+										Tls:  &istioapi.ClientTLSSettings{Mode: istioapi.ClientTLSSettings_DISABLE},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}, func(h *DestinationRuleHandler) {
+			h.ServiceHosts = []string{serviceName}
+			h.SkipTrafficPolicy = skipTrafficPolicy
+		})
+	}
+
+	It("copies the outlier detection of the base destination rule", func() {
+		h := mkHandler(false)
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		outlierDetection := dr.Spec.TrafficPolicy.GetOutlierDetection()
+		Expect(outlierDetection.GetConsecutive_5XxErrors().GetValue()).To(Equal(uint32(7)))
+		Expect(outlierDetection.GetBaseEjectionTime().AsDuration()).To(Equal(15 * time.Minute))
+	})
+
+	It("copies the traffic policy of the default version subset", func() {
+		h := mkHandler(false)
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets).To(HaveLen(1))
+		Expect(dr.Spec.Subsets[0].TrafficPolicy.GetConnectionPool().GetTcp().GetMaxConnections()).To(Equal(int32(42)))
+	})
+
+	It("preserves the TLS settings of the default version subset", func() {
+		h := mkHandler(false)
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		policy := dr.Spec.Subsets[0].TrafficPolicy
+		Expect(policy.GetTls().GetMode()).To(Equal(istioapi.ClientTLSSettings_ISTIO_MUTUAL))
+		Expect(policy.GetPortLevelSettings()).To(HaveLen(1))
+		Expect(policy.GetPortLevelSettings()[0].GetPort().GetNumber()).To(Equal(uint32(8080)))
+		Expect(policy.GetPortLevelSettings()[0].GetTls().GetMode()).To(Equal(istioapi.ClientTLSSettings_DISABLE))
+	})
+
+	It("overrides the TLS settings of the subset if requested", func() {
+		h := mkHandler(false)
+		h.SubsetTLS = &istioapi.ClientTLSSettings{Mode: istioapi.ClientTLSSettings_DISABLE}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		policy := dr.Spec.Subsets[0].TrafficPolicy
+		Expect(policy.GetTls().GetMode()).To(Equal(istioapi.ClientTLSSettings_DISABLE))
+		Expect(policy.GetConnectionPool().GetTcp().GetMaxConnections()).To(Equal(int32(42)))
+	})
+
+	It("sets the overriding TLS settings even with a clean policy", func() {
+		h := mkHandler(true)
+		h.SubsetTLS = &istioapi.ClientTLSSettings{Mode: istioapi.ClientTLSSettings_ISTIO_MUTUAL}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].TrafficPolicy.GetTls().GetMode()).To(Equal(istioapi.ClientTLSSettings_ISTIO_MUTUAL))
+		Expect(dr.Spec.Subsets[0].TrafficPolicy.GetConnectionPool()).To(BeNil())
+	})
+
+	It("merges the connection pool override into the inherited subset policy", func() {
+		h := mkHandler(false)
+		h.ConnectionPool = &riskifiedv1alpha1.ConnectionPoolSettings{
+			TCP:  &riskifiedv1alpha1.TCPConnectionPool{ConnectTimeout: &metav1.Duration{Duration: 30 * time.Millisecond}},
+			HTTP: &riskifiedv1alpha1.HTTPConnectionPool{HTTP2MaxRequests: 10},
+		}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		pool := dr.Spec.Subsets[0].TrafficPolicy.GetConnectionPool()
+		Expect(pool.GetTcp().GetMaxConnections()).To(Equal(int32(42)))
+		Expect(pool.GetTcp().GetConnectTimeout().AsDuration()).To(Equal(30 * time.Millisecond))
+		Expect(pool.GetHttp().GetHttp2MaxRequests()).To(Equal(int32(10)))
+		Expect(dr.Spec.Subsets[0].TrafficPolicy.GetTls().GetMode()).To(Equal(istioapi.ClientTLSSettings_ISTIO_MUTUAL))
+	})
+
+	It("overrides the inherited connection pool values that are specified", func() {
+		h := mkHandler(false)
+		h.ConnectionPool = &riskifiedv1alpha1.ConnectionPoolSettings{
+			TCP: &riskifiedv1alpha1.TCPConnectionPool{MaxConnections: 5},
+		}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].TrafficPolicy.GetConnectionPool().GetTcp().GetMaxConnections()).To(Equal(int32(5)))
+	})
+
+	It("sets only the connection pool override with a clean policy", func() {
+		h := mkHandler(true)
+		h.ConnectionPool = &riskifiedv1alpha1.ConnectionPoolSettings{
+			HTTP: &riskifiedv1alpha1.HTTPConnectionPool{MaxRetries: 3},
+		}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		policy := dr.Spec.Subsets[0].TrafficPolicy
+		Expect(policy.GetConnectionPool().GetHttp().GetMaxRetries()).To(Equal(int32(3)))
+		Expect(policy.GetConnectionPool().GetTcp()).To(BeNil())
+		Expect(policy.GetTls()).To(BeNil())
+	})
+
+	It("rejects invalid connection pool overrides", func() {
+		h := mkHandler(false)
+		h.ConnectionPool = &riskifiedv1alpha1.ConnectionPoolSettings{
+			HTTP: &riskifiedv1alpha1.HTTPConnectionPool{MaxRetries: -1},
+		}
+		_, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(MatchError(ContainSubstring("http.maxRetries must not be negative")))
+	})
+
+	It("sets a consistent hash by header on the generated subset", func() {
+		h := mkHandler(false)
+		h.LoadBalancer = &riskifiedv1alpha1.LoadBalancerSettings{
+			ConsistentHash: &riskifiedv1alpha1.ConsistentHashLB{HTTPHeaderName: "x-session-id"},
+		}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		policy := dr.Spec.Subsets[0].TrafficPolicy
+		Expect(policy.GetLoadBalancer().GetConsistentHash().GetHttpHeaderName()).To(Equal("x-session-id"))
+		Expect(policy.GetLoadBalancer().GetSimple()).To(Equal(istioapi.LoadBalancerSettings_UNSPECIFIED))
+		Expect(policy.GetConnectionPool().GetTcp().GetMaxConnections()).To(Equal(int32(42)))
+	})
+
+	It("sets a consistent hash by cookie on the generated subset", func() {
+		h := mkHandler(true)
+		h.LoadBalancer = &riskifiedv1alpha1.LoadBalancerSettings{
+			ConsistentHash: &riskifiedv1alpha1.ConsistentHashLB{
+				HTTPCookie: &riskifiedv1alpha1.HTTPCookie{Name: "session", Path: "/", TTL: metav1.Duration{Duration: time.Hour}},
+			},
+		}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		cookie := dr.Spec.Subsets[0].TrafficPolicy.GetLoadBalancer().GetConsistentHash().GetHttpCookie()
+		Expect(cookie.GetName()).To(Equal("session"))
+		Expect(cookie.GetPath()).To(Equal("/"))
+		Expect(cookie.GetTtl().AsDuration()).To(Equal(time.Hour))
+	})
+
+	It("overrides the load balancer with a simple round robin", func() {
+		h := mkHandler(true)
+		h.LoadBalancer = &riskifiedv1alpha1.LoadBalancerSettings{Simple: "ROUND_ROBIN"}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		lb := dr.Spec.Subsets[0].TrafficPolicy.GetLoadBalancer()
+		Expect(lb.GetSimple()).To(Equal(istioapi.LoadBalancerSettings_ROUND_ROBIN))
+		Expect(lb.GetConsistentHash()).To(BeNil())
+	})
+
+	It("rejects load balancers with both simple and consistent hash", func() {
+		h := mkHandler(false)
+		h.LoadBalancer = &riskifiedv1alpha1.LoadBalancerSettings{
+			Simple:         "RANDOM",
+			ConsistentHash: &riskifiedv1alpha1.ConsistentHashLB{UseSourceIP: true},
+		}
+		_, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(MatchError(ContainSubstring("exactly one of simple and consistentHash")))
+	})
+
+	It("originates TLS from the generated subset", func() {
+		h := mkHandler(false)
+		h.SubsetTLS = &istioapi.ClientTLSSettings{Mode: istioapi.ClientTLSSettings_DISABLE}
+		h.TLS = &riskifiedv1alpha1.ClientTLSSettings{
+			Mode:            "SIMPLE",
+			SNI:             "api.example.com",
+			CredentialName:  "example-ca",
+			SubjectAltNames: []string{"api.example.com"},
+		}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		tls := dr.Spec.Subsets[0].TrafficPolicy.GetTls()
+		Expect(tls.GetMode()).To(Equal(istioapi.ClientTLSSettings_SIMPLE))
+		Expect(tls.GetSni()).To(Equal("api.example.com"))
+		Expect(tls.GetCredentialName()).To(Equal("example-ca"))
+		Expect(tls.GetSubjectAltNames()).To(Equal([]string{"api.example.com"}))
+		Expect(dr.Spec.Subsets[0].TrafficPolicy.GetConnectionPool().GetTcp().GetMaxConnections()).To(Equal(int32(42)))
+	})
+
+	It("originates TLS even with a clean policy", func() {
+		h := mkHandler(true)
+		h.TLS = &riskifiedv1alpha1.ClientTLSSettings{Mode: "MUTUAL", SNI: "api.example.com", CredentialName: "client-certs"}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].TrafficPolicy.GetTls().GetMode()).To(Equal(istioapi.ClientTLSSettings_MUTUAL))
+		Expect(dr.Spec.TrafficPolicy).To(BeNil())
+	})
+
+	It("rejects TLS origination without SNI", func() {
+		h := mkHandler(false)
+		h.TLS = &riskifiedv1alpha1.ClientTLSSettings{Mode: "SIMPLE"}
+		_, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(MatchError(ContainSubstring("tls.sni must be specified for SIMPLE mode")))
+	})
+
+	It("generates clean policy if requested", func() {
+		h := mkHandler(true)
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.TrafficPolicy).To(BeNil())
+		Expect(dr.Spec.Subsets[0].TrafficPolicy).To(BeNil())
+	})
+})
+
+var _ = Describe("Port level traffic policies of the generated subset", func() {
+	serviceName := "service-name"
+	mkHandler := func() DestinationRuleHandler {
+		return mkDestinationRuleHandler([]*istionetwork.DestinationRule{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "service", Namespace: "namespace"},
+				Spec: istioapi.DestinationRule{
+					Host: serviceName,
+					Subsets: []*istioapi.Subset{
+						{
+							Name:   "shared",
+							Labels: map[string]string{"version": "shared"},
+							TrafficPolicy: &istioapi.TrafficPolicy{
+								PortLevelSettings: []*istioapi.TrafficPolicy_PortTrafficPolicy{
+									{
+										Port: &istioapi.PortSelector{Number: 9080},
+										Tls:  &istioapi.ClientTLSSettings{Mode: istioapi.ClientTLSSettings_ISTIO_MUTUAL},
+										ConnectionPool: &istioapi.ConnectionPoolSettings{
+											Tcp: &istioapi.ConnectionPoolSettings_TCPSettings{MaxConnections: 42},
+										},
+									},
+									{
+										Port: &istioapi.PortSelector{Number: 8080},
+										Tls:  &istioapi.ClientTLSSettings{Mode: istioapi.ClientTLSSettings_DISABLE},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}, func(h *DestinationRuleHandler) {
+			h.ServiceHosts = []string{serviceName}
+		})
+	}
+	tlsModes := func(dr *istionetwork.DestinationRule) map[uint32]istioapi.ClientTLSSettings_TLSmode {
+		modes := map[uint32]istioapi.ClientTLSSettings_TLSmode{}
+		for _, p := range dr.Spec.Subsets[0].TrafficPolicy.GetPortLevelSettings() {
+			modes[p.GetPort().GetNumber()] = p.GetTls().GetMode()
+		}
+		return modes
+	}
+
+	It("copies the TLS modes of both ports", func() {
+		h := mkHandler()
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(tlsModes(dr)).To(Equal(map[uint32]istioapi.ClientTLSSettings_TLSmode{
+			9080: istioapi.ClientTLSSettings_ISTIO_MUTUAL,
+			8080: istioapi.ClientTLSSettings_DISABLE,
+		}))
+	})
+
+	It("keeps the port level settings when the subset TLS settings are overridden", func() {
+		h := mkHandler()
+		h.SubsetTLS = &istioapi.ClientTLSSettings{Mode: istioapi.ClientTLSSettings_ISTIO_MUTUAL}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].TrafficPolicy.GetTls().GetMode()).To(Equal(istioapi.ClientTLSSettings_ISTIO_MUTUAL))
+		Expect(tlsModes(dr)).To(HaveKeyWithValue(uint32(8080), istioapi.ClientTLSSettings_DISABLE))
+	})
+
+	It("overrides the settings of a single port", func() {
+		h := mkHandler()
+		h.PortLevelSettings = []riskifiedv1alpha1.PortTrafficPolicy{{
+			Port: 9080,
+			TLS:  &riskifiedv1alpha1.ClientTLSSettings{Mode: "DISABLE"},
+			ConnectionPool: &riskifiedv1alpha1.ConnectionPoolSettings{
+				HTTP: &riskifiedv1alpha1.HTTPConnectionPool{HTTP2MaxRequests: 10},
+			},
+		}}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(tlsModes(dr)).To(Equal(map[uint32]istioapi.ClientTLSSettings_TLSmode{
+			9080: istioapi.ClientTLSSettings_DISABLE,
+			8080: istioapi.ClientTLSSettings_DISABLE,
+		}))
+		pool := dr.Spec.Subsets[0].TrafficPolicy.GetPortLevelSettings()[0].GetConnectionPool()
+		Expect(pool.GetTcp().GetMaxConnections()).To(Equal(int32(42)))
+		Expect(pool.GetHttp().GetHttp2MaxRequests()).To(Equal(int32(10)))
+	})
+
+	It("adds the settings of a port the base subset does not configure", func() {
+		h := mkHandler()
+		h.PortLevelSettings = []riskifiedv1alpha1.PortTrafficPolicy{{
+			Port:         7070,
+			LoadBalancer: &riskifiedv1alpha1.LoadBalancerSettings{Simple: "LEAST_REQUEST"},
+		}}
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		settings := dr.Spec.Subsets[0].TrafficPolicy.GetPortLevelSettings()
+		Expect(settings).To(HaveLen(3))
+		Expect(settings[2].GetPort().GetNumber()).To(Equal(uint32(7070)))
+		Expect(settings[2].GetLoadBalancer().GetSimple()).To(Equal(istioapi.LoadBalancerSettings_LEAST_REQUEST))
+		Expect(settings[2].GetTls()).To(BeNil())
+	})
+
+	It("does not modify the base destination rule", func() {
+		h := mkHandler()
+		h.PortLevelSettings = []riskifiedv1alpha1.PortTrafficPolicy{{Port: 8080, TLS: &riskifiedv1alpha1.ClientTLSSettings{Mode: "ISTIO_MUTUAL"}}}
+		_, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		base, _, err := h.locateDestinationRuleByHostname(serviceName)
+		Expect(err).To(BeNil())
+		Expect(base.Spec.Subsets[0].TrafficPolicy.GetPortLevelSettings()[1].GetTls().GetMode()).To(Equal(istioapi.ClientTLSSettings_DISABLE))
+	})
+
+	It("rejects invalid port level overrides", func() {
+		h := mkHandler()
+		h.PortLevelSettings = []riskifiedv1alpha1.PortTrafficPolicy{{Port: 8080, TLS: &riskifiedv1alpha1.ClientTLSSettings{Mode: "SIMPLE"}}}
+		_, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(MatchError(ContainSubstring("port 8080: tls.sni must be specified for SIMPLE mode")))
+	})
+})
+
+var _ = Describe("Carrying over the base destination rule visibility", func() {
+	serviceName := "service-name"
+	mkHandler := func(exportTo []string) DestinationRuleHandler {
+		return mkDestinationRuleHandler([]*istionetwork.DestinationRule{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "service", Namespace: "namespace"},
+				Spec: istioapi.DestinationRule{
+					Host:     serviceName,
+					ExportTo: exportTo,
+					WorkloadSelector: &istiotype.WorkloadSelector{
+						MatchLabels: map[string]string{"app": "client"},
+					},
+					Subsets: []*istioapi.Subset{
+						{Name: "shared", Labels: map[string]string{"version": "shared"}},
+					},
+				},
+			},
+		}, func(h *DestinationRuleHandler) {
+			h.ServiceHosts = []string{serviceName}
+		})
+	}
+
+	It("keeps the exportTo of the base destination rule", func() {
+		h := mkHandler([]string{"."})
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.ExportTo).To(Equal([]string{"."}))
+		Expect(dr.Spec.WorkloadSelector.GetMatchLabels()).To(Equal(map[string]string{"app": "client"}))
+	})
+
+	It("leaves exportTo unset if the base destination rule has none", func() {
+		h := mkHandler(nil)
+		dr, err := h.generateOverridingDestinationRule(serviceName)
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.ExportTo).To(BeNil())
+	})
+})
+
+var _ = Describe("Locating base destination rule with a custom cluster domain", func() {
+	It("matches a base destination rule with an FQDN host in the custom domain", func() {
+		mc := struct{ MockClient }{}
+		mc.listMethod = func(_ context.Context, drs client.ObjectList, _ ...client.ListOption) error {
+			drs.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "details", Namespace: "shared"},
+					Spec: istioapi.DestinationRule{
+						Host:    "details.ns.svc.mesh.internal",
+						Subsets: []*istioapi.Subset{{Name: "shared", Labels: map[string]string{"version": "shared"}}},
+					},
+				},
+			}
+			return nil
+		}
+		h := DestinationRuleHandler{
+			Client:         mc,
+			Namespace:      "ns",
+			VersionLabel:   "version",
+			DefaultVersion: "shared",
+			ClusterDomain:  "mesh.internal",
+			Log:            logr.Logger{},
+		}
+		dr, _, err := h.locateDestinationRuleByHostname("details")
+		Expect(err).To(BeNil())
+		Expect(dr.Name).To(Equal("details"))
+	})
+})
+
+var _ = Describe("Locating base destination rule with a wildcard host", func() {
+	mkHandler := func(drs ...*istionetwork.DestinationRule) DestinationRuleHandler {
+		return mkDestinationRuleHandler(drs, func(h *DestinationRuleHandler) {
+			h.Namespace = "prod"
+		})
+	}
+	mkDR := func(name, host string) *istionetwork.DestinationRule {
+		return &istionetwork.DestinationRule{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "prod"},
+			Spec: istioapi.DestinationRule{
+				Host:    host,
+				Subsets: []*istioapi.Subset{{Name: "shared", Labels: map[string]string{"version": "shared"}}},
+			},
+		}
+	}
+
+	It("matches a wildcard base destination rule and uses the concrete host", func() {
+		h := mkHandler(mkDR("wildcard", "*.prod.svc.cluster.local"))
+		dr, err := h.generateOverridingDestinationRule("api.prod.svc.cluster.local")
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Host).To(Equal("api.prod.svc.cluster.local"))
+	})
+
+	It("prefers an exact match over a wildcard one", func() {
+		h := mkHandler(mkDR("wildcard", "*.prod.svc.cluster.local"), mkDR("exact", "api"))
+		dr, _, err := h.locateDestinationRuleByHostname("api.prod.svc.cluster.local")
+		Expect(err).To(BeNil())
+		Expect(dr.Name).To(Equal("exact"))
+	})
+
+	It("does not match a wildcard of another namespace", func() {
+		h := mkHandler(mkDR("wildcard", "*.staging.svc.cluster.local"))
+		_, _, err := h.locateDestinationRuleByHostname("api.prod.svc.cluster.local")
+		Expect(err).To(Equal(IgnoredMissing{}))
+	})
+})
+
+var _ = Describe("Rendering the generated subset name", func() {
+	mkHandler := func(template string) DestinationRuleHandler {
+		return mkDestinationRuleHandler([]*istionetwork.DestinationRule{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "details", Namespace: "ns"},
+				Spec: istioapi.DestinationRule{
+					Host:    "details",
+					Subsets: []*istioapi.Subset{{Name: "main", Labels: map[string]string{"version": "shared"}}},
+				},
+			},
+		}, func(h *DestinationRuleHandler) {
+			h.Namespace = "ns"
+			h.SubsetNameTemplate = template
+		})
+	}
+
+	It("defaults to the unique version", func() {
+		h := mkHandler("")
+		dr, err := h.generateOverridingDestinationRule("details")
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].Name).To(Equal("unique-version"))
+		Expect(h.GetSubsetNames()).To(Equal(map[string]string{"details": "unique-version"}))
+	})
+
+	It("renders a custom template", func() {
+		h := mkHandler("{{ .BaseSubsetName }}-{{ .UniqueVersion }}")
+		dr, err := h.generateOverridingDestinationRule("details")
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].Name).To(Equal("main-unique-version"))
+		Expect(dr.Spec.Subsets[0].Labels).To(Equal(map[string]string{"version": "unique-version"}))
+		Expect(h.GetSubsetNames()).To(Equal(map[string]string{"details": "main-unique-version"}))
+	})
+
+	It("fails if the rendered name is not a valid DNS-1123 label", func() {
+		h := mkHandler("{{ .BaseSubsetName }}_{{ .UniqueVersion }}")
+		_, err := h.generateOverridingDestinationRule("details")
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("not a valid DNS-1123 label"))
+	})
+})
+
+var _ = Describe("Validating the version label", func() {
+	DescribeTable(
+		"rejects illegal labels before generating the destination rule",
+		func(versionLabel, version, expectedError string) {
+			h := DestinationRuleHandler{UniqueVersion: version}
+			err := h.validateVersionLabel(versionLabel)
+			if expectedError == "" {
+				Expect(err).To(BeNil())
+				return
+			}
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(expectedError))
+		},
+		Entry("valid label and version", "version", "feature-branch-12", ""),
+		Entry("invalid version", "version", "feature/my-branch", `version "feature/my-branch" is not a valid value`),
+		Entry("too long version", "version", strings.Repeat("a", 64), "is not a valid value"),
+		Entry("empty version", "version", "", "must not be empty"),
+		Entry("invalid label key", "my version", "v1", "is not a valid label key"),
+	)
+})
+
+var _ = Describe("Version label per service host", func() {
+	mkHandler := func() DestinationRuleHandler {
+		return mkDestinationRuleHandler([]*istionetwork.DestinationRule{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "details", Namespace: "namespace"},
+				Spec: istioapi.DestinationRule{
+					Host:    "details",
+					Subsets: []*istioapi.Subset{{Name: "shared", Labels: map[string]string{"version": "shared"}}},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "reviews", Namespace: "namespace"},
+				Spec: istioapi.DestinationRule{
+					Host:    "reviews.namespace.svc.cluster.local",
+					Subsets: []*istioapi.Subset{{Name: "shared", Labels: map[string]string{"release": "shared"}}},
+				},
+			},
+		}, func(h *DestinationRuleHandler) {
+			h.VersionLabelsByHost = map[string]string{"reviews.namespace": "release"}
+			h.ServiceHosts = []string{"details", "reviews"}
+		})
+	}
+
+	It("uses the global version label for services without a mapping", func() {
+		h := mkHandler()
+		dr, err := h.generateOverridingDestinationRule("details")
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].Labels).To(Equal(map[string]string{"version": "unique-version"}))
+		Expect(dr.Labels).To(Equal(map[string]string{"version": "unique-version"}))
+	})
+
+	It("uses the mapped version label for both matching and generating the subset", func() {
+		h := mkHandler()
+		dr, err := h.generateOverridingDestinationRule("reviews")
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Host).To(Equal("reviews.namespace.svc.cluster.local"))
+		Expect(dr.Spec.Subsets[0].Labels).To(Equal(map[string]string{"release": "unique-version"}))
+		Expect(dr.Labels).To(Equal(map[string]string{"release": "unique-version"}))
+	})
+
+	It("does not match a service by the label of another service", func() {
+		h := mkHandler()
+		h.VersionLabelsByHost = nil
+		_, err := h.generateOverridingDestinationRule("reviews")
+		Expect(err).To(MatchError(IgnoredMissing{}))
+	})
+})
+
+var _ = Describe("Calculating destination rule name", func() {
+	It("concatenates the unique name and the service host for short names", func() {
+		h := DestinationRuleHandler{UniqueName: "details-default-simple"}
+		Expect(h.calculateDRName("details")).To(Equal("details-default-simple-details"))
+	})
+
+	It("hashes the service host if the name is too long", func() {
+		h := DestinationRuleHandler{UniqueName: strings.Repeat("a", 200)}
+		serviceHost := "payments" + strings.Repeat(".long-part", 10) + ".svc.cluster.local"
+		name := h.calculateDRName(serviceHost)
+		Expect(len(name)).To(BeNumerically("<=", 253))
+		Expect(name).To(HavePrefix(h.UniqueName + "-"))
+		Expect(name).NotTo(ContainSubstring("payments"))
+	})
+
+	It("generates the same hashed name for the same host", func() {
+		h := DestinationRuleHandler{UniqueName: strings.Repeat("a", 200)}
+		serviceHost := strings.Repeat("payments.", 10) + "svc.cluster.local"
+		Expect(h.calculateDRName(serviceHost)).To(Equal(h.calculateDRName(serviceHost)))
+		Expect(h.calculateDRName(serviceHost)).NotTo(Equal(h.calculateDRName("other." + serviceHost)))
+	})
+})
+
+var _ = Describe("Colliding destination rule names", func() {
+	prefix := strings.Repeat("a", 200)
+	hosts := []string{
+		"payments" + strings.Repeat(".long-part", 10) + ".svc.cluster.local",
+		"orders" + strings.Repeat(".long-part", 10) + ".svc.cluster.local",
+	}
+	// Makes the hashes of all the hosts share the provided prefix.
+	forceCollision := func(hashPrefix string) {
+		original := hashServiceHost
+		hashServiceHost = func(serviceHost string) string {
+			return hashPrefix + original(serviceHost)
+		}
+		DeferCleanup(func() { hashServiceHost = original })
+	}
+
+	It("falls back to a longer hash when the short hashes of two hosts collide", func() {
+		forceCollision(strings.Repeat("0", drNameHashLength))
+		h := DestinationRuleHandler{UniqueName: prefix, Namespace: "ns", ServiceHosts: hosts, Log: logr.Discard()}
+		first, second := h.calculateDRName(hosts[0]), h.calculateDRName(hosts[1])
+		Expect(first).To(Equal(prefix + "-" + strings.Repeat("0", drNameHashLength)))
+		Expect(second).To(HavePrefix(first))
+		Expect(second).NotTo(Equal(first))
+		Expect(len(second)).To(BeNumerically("<=", 253))
+		Expect(h.nameCollisions).To(BeEmpty())
+	})
+
+	It("skips the host if the longer hashes collide as well", func() {
+		forceCollision(strings.Repeat("0", drNameLongHashLength))
+		hosts := append(hosts, "reviews"+strings.Repeat(".long-part", 10)+".svc.cluster.local")
+		mc := struct{ MockClient }{}
+		mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+			var items []*istionetwork.DestinationRule
+			for _, host := range hosts {
+				items = append(items, &istionetwork.DestinationRule{
+					ObjectMeta: metav1.ObjectMeta{Name: host, Namespace: "ns"},
+					Spec: istioapi.DestinationRule{
+						Host:    host,
+						Subsets: []*istioapi.Subset{{Name: "shared", Labels: map[string]string{"version": "shared"}}},
+					},
+				})
+			}
+			o.(*istionetwork.DestinationRuleList).Items = items
+			return nil
+		}
+		mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+			return errors.NewNotFound(schema.GroupResource{}, key.Name)
+		}
+		h := DestinationRuleHandler{
+			Client:         mc,
+			UniqueName:     prefix,
+			UniqueVersion:  "version",
+			Namespace:      "ns",
+			VersionLabel:   "version",
+			DefaultVersion: "shared",
+			ServiceHosts:   hosts,
+			DryRun:         true,
+			StatusHandler: &DynamicEnvStatusHandler{
+				Client:     mc,
+				Ctx:        context.Background(),
+				DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+			},
+			Log: logr.Discard(),
+		}
+		err := h.Handle()
+		var collision DestinationRuleNameCollision
+		Expect(goerrors.As(err, &collision)).To(BeTrue())
+		Expect(collision.Host).To(Equal(hosts[2]))
+		Expect(collision.CollidesWith).To(Equal(hosts[1]))
+		Expect(h.planned).To(HaveLen(2))
+		Expect(h.planned[0].Object.GetName()).To(Equal(prefix + "-" + strings.Repeat("0", drNameHashLength)))
+		Expect(h.planned[1].Object.GetName()).To(Equal(prefix + "-" + strings.Repeat("0", drNameLongHashLength)))
+		statuses, err := h.GetStatus()
+		Expect(err).To(BeNil())
+		Expect(statuses).To(HaveLen(3))
+		Expect(statuses[0].Status).NotTo(Equal(riskifiedv1alpha1.Failed))
+		Expect(statuses[1].Status).NotTo(Equal(riskifiedv1alpha1.Failed))
+		Expect(statuses[2].Status).To(Equal(riskifiedv1alpha1.Failed))
+	})
+
+	It("does not consider rules in different namespaces as colliding", func() {
+		forceCollision(strings.Repeat("0", drNameLongHashLength))
+		h := DestinationRuleHandler{
+			UniqueName:                      prefix,
+			Namespace:                       "ns",
+			ServiceHosts:                    hosts,
+			DestinationRuleNamespacesByHost: map[string]string{hosts[1]: "other"},
+			Log:                             logr.Discard(),
+		}
+		Expect(h.calculateDRName(hosts[0])).To(Equal(h.calculateDRName(hosts[1])))
+		Expect(h.nameCollisions).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Comparing service hosts regardless of case", func() {
+	It("reports ignored missing hosts that were recorded with another case", func() {
+		mc := struct{ MockClient }{}
+		mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+			return errors.NewNotFound(schema.GroupResource{}, key.Name)
+		}
+		h := DestinationRuleHandler{
+			Client:         mc,
+			UniqueName:     "unique",
+			Namespace:      "ns",
+			ServiceHosts:   []string{"Details.ns.svc.cluster.local"},
+			Log:            logr.Discard(),
+			ignoredMissing: []string{"details.ns.svc.cluster.local"},
+		}
+		statuses, err := h.GetStatus()
+		Expect(err).To(BeNil())
+		Expect(statuses).To(HaveLen(1))
+		Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.IgnoredMissingDR))
+	})
+
+	It("does not record the same host twice", func() {
+		h := DestinationRuleHandler{Log: logr.Discard()}
+		h.addIgnoredMissing("details")
+		h.addIgnoredMissing("DETAILS")
+		Expect(h.ignoredMissing).To(Equal([]string{"details"}))
+	})
+})
+
+var _ = Describe("Default version per service host", func() {
+	mkHandler := func() DestinationRuleHandler {
+		return mkDestinationRuleHandler([]*istionetwork.DestinationRule{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "details", Namespace: "namespace"},
+				Spec: istioapi.DestinationRule{
+					Host:    "details",
+					Subsets: []*istioapi.Subset{{Name: "stable", Labels: map[string]string{"version": "stable"}}},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "reviews", Namespace: "namespace"},
+				Spec: istioapi.DestinationRule{
+					Host: "reviews",
+					Subsets: []*istioapi.Subset{
+						{Name: "stable", Labels: map[string]string{"version": "stable"}},
+						{Name: "production", Labels: map[string]string{"version": "production"}},
+					},
+				},
+			},
+		}, func(h *DestinationRuleHandler) {
+			h.DefaultVersion = "stable"
+			h.DefaultVersionsByHost = map[string]string{"reviews.namespace": "production"}
+			h.SubsetNameTemplate = "{{ .BaseSubsetName }}-{{ .UniqueVersion }}"
+			h.ServiceHosts = []string{"details", "reviews"}
+		})
+	}
+
+	It("uses the global default version for services without a mapping", func() {
+		h := mkHandler()
+		_, subset, err := h.locateDestinationRuleByHostname("details")
+		Expect(err).To(BeNil())
+		Expect(subset.Name).To(Equal("stable"))
+	})
+
+	It("uses the mapped default version to locate the base subset", func() {
+		h := mkHandler()
+		dr, err := h.generateOverridingDestinationRule("reviews")
+		Expect(err).To(BeNil())
+		Expect(dr.Spec.Subsets[0].Name).To(Equal("production-unique-version"))
+	})
+
+	It("does not locate a default subset by the version of another service", func() {
+		h := mkHandler()
+		h.DefaultVersion = "production"
+		h.DefaultVersionsByHost = nil
+		_, _, err := h.locateDestinationRuleByHostname("details")
+		Expect(err).To(MatchError(IgnoredMissing{}))
+	})
+})
@@ -18,18 +18,40 @@ package handlers_test
 
 import (
 	"context"
+	"encoding/json"
+	goerrors "errors"
 	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"github.com/riskified/dynamic-environment/pkg/features"
 	"github.com/riskified/dynamic-environment/pkg/handlers"
+	"github.com/riskified/dynamic-environment/pkg/helpers"
+	"github.com/riskified/dynamic-environment/pkg/metrics"
+	"github.com/riskified/dynamic-environment/pkg/names"
+	"github.com/riskified/dynamic-environment/pkg/watches"
+	"golang.org/x/time/rate"
 	"io"
+	"istio.io/api/networking/v1alpha3"
 	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/tools/record"
 	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
 	ctrl "sigs.k8s.io/controller-runtime"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -66,15 +88,816 @@ var _ = Describe("DestinationRuleHandler", func() {
 				}
 				expected := []riskifiedv1alpha1.ResourceStatus{
 					{
-						Name:      "unique-service",
-						Namespace: "ns",
-						Status:    riskifiedv1alpha1.Missing,
+						Name:        "unique-service",
+						Namespace:   "ns",
+						ServiceHost: "service",
+						Status:      riskifiedv1alpha1.Missing,
 					},
 				}
 				result, err := handler.GetStatus()
 				Expect(err).To(BeNil())
 				Expect(result).To(Equal(expected))
 			})
+
+			It("uses the shortened destination rule name for long service hosts", func() {
+				var searchedName string
+				mc := struct{ MockClient }{}
+				mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+					searchedName = key.Name
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				handler := handlers.DestinationRuleHandler{
+					Client:       mc,
+					UniqueName:   strings.Repeat("unique", 30),
+					Namespace:    "ns",
+					ServiceHosts: []string{strings.Repeat("service.", 10) + "svc.cluster.local"},
+				}
+				result, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(result).To(HaveLen(1))
+				Expect(len(result[0].Name)).To(BeNumerically("<=", 253))
+				Expect(result[0].Name).To(Equal(searchedName))
+			})
+
+			It("records the shortened destination rule name and its service host in the status", func() {
+				serviceHost := strings.Repeat("service.", 10) + "svc.cluster.local"
+				mc := struct{ MockClient }{}
+				mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				statusHandler := &handlers.DynamicEnvStatusHandler{
+					Client:     mc,
+					Ctx:        context.Background(),
+					DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+				}
+				handler := handlers.DestinationRuleHandler{
+					Client:        mc,
+					UniqueName:    strings.Repeat("unique", 30),
+					Namespace:     "ns",
+					ServiceHosts:  []string{serviceHost},
+					StatusHandler: statusHandler,
+				}
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(handler.ApplyStatus(statuses)).To(Succeed())
+				recorded := statusHandler.DynamicEnv.Status.SubsetsStatus[handler.UniqueName].DestinationRules
+				Expect(recorded).To(HaveLen(1))
+				Expect(recorded[0].Name).To(Equal(statuses[0].Name))
+				Expect(recorded[0].Name).NotTo(ContainSubstring(serviceHost))
+				Expect(len(recorded[0].Name)).To(BeNumerically("<=", 253))
+				Expect(recorded[0].Namespace).To(Equal("ns"))
+				Expect(recorded[0].ServiceHost).To(Equal(serviceHost))
+			})
+
+			It("applying the same statuses twice keeps the status stable", func() {
+				updates := 0
+				mc := struct{ MockClient }{}
+				mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				mc.statusUpdateMethod = func(context.Context, client.Object, ...client.SubResourceUpdateOption) error {
+					updates++
+					return nil
+				}
+				statusHandler := &handlers.DynamicEnvStatusHandler{
+					Client:     mc,
+					Ctx:        context.Background(),
+					DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+				}
+				handler := handlers.DestinationRuleHandler{
+					Client:        mc,
+					UniqueName:    "unique",
+					Namespace:     "ns",
+					ServiceHosts:  []string{"service1", "service2"},
+					StatusHandler: statusHandler,
+				}
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(handler.ApplyStatus(statuses)).To(Succeed())
+				Expect(updates).To(Equal(1))
+				first := statusHandler.DynamicEnv.Status.DeepCopy()
+				Expect(handler.ApplyStatus(statuses)).To(Succeed())
+				Expect(updates).To(Equal(1))
+				Expect(statusHandler.DynamicEnv.Status).To(Equal(*first))
+				Expect(first.SubsetsStatus["unique"].DestinationRules).To(HaveLen(2))
+			})
+
+			It("returns 'terminating' for destination rules that are being deleted", func() {
+				mc := struct{ MockClient }{}
+				mc.getMethod = func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					now := metav1.Now()
+					o.SetDeletionTimestamp(&now)
+					o.SetFinalizers([]string{"example.com/finalizer"})
+					return nil
+				}
+				handler := handlers.DestinationRuleHandler{
+					Client:       mc,
+					UniqueName:   "unique",
+					Namespace:    "ns",
+					ServiceHosts: []string{"service"},
+				}
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(Equal([]riskifiedv1alpha1.ResourceStatus{
+					{Name: "unique-service", Namespace: "ns", ServiceHost: "service", Status: riskifiedv1alpha1.Terminating},
+				}))
+			})
+
+			It("falls back to the API reader for destination rules missing from the cache", func() {
+				cache := struct{ MockClient }{}
+				cache.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				var read []string
+				reader := struct{ MockClient }{}
+				reader.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+					read = append(read, key.Name)
+					return nil
+				}
+				handler := handlers.DestinationRuleHandler{
+					Client:       cache,
+					APIReader:    reader,
+					UniqueName:   "unique",
+					Namespace:    "ns",
+					ServiceHosts: []string{"service"},
+					Log:          logr.Discard(),
+				}
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(read).To(Equal([]string{"unique-service"}))
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Running))
+			})
+
+			It("does not read from the API reader when the cache has the destination rule", func() {
+				cache := struct{ MockClient }{}
+				cache.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+					return nil
+				}
+				reader := struct{ MockClient }{}
+				reader.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+					Fail("should not read from the API server")
+					return nil
+				}
+				handler := handlers.DestinationRuleHandler{
+					Client:       cache,
+					APIReader:    reader,
+					UniqueName:   "unique",
+					Namespace:    "ns",
+					ServiceHosts: []string{"service"},
+					Log:          logr.Discard(),
+				}
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Running))
+			})
+		})
+	})
+
+	Context("Cleanup", func() {
+		owner := types.NamespacedName{Name: "owner", Namespace: "ns"}
+		mkDR := func(name, owners string, subsets ...string) *istionetwork.DestinationRule {
+			dr := &istionetwork.DestinationRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        name,
+					Namespace:   "ns",
+					Annotations: map[string]string{watches.NamespacedNameAnnotation: owners},
+				},
+			}
+			for _, s := range subsets {
+				dr.Spec.Subsets = append(dr.Spec.Subsets, &v1alpha3.Subset{Name: s, Labels: map[string]string{"version": s}})
+			}
+			return dr
+		}
+		mkHandler := func(drs []*istionetwork.DestinationRule, deleted, updated *[]string) handlers.DestinationRuleHandler {
+			return mkDestinationRuleHandler(func(mc *MockClient) {
+				mc.listMethod = listingDestinationRules(drs...)
+				mc.deleteMethod = func(_ context.Context, o client.Object, _ ...client.DeleteOption) error {
+					*deleted = append(*deleted, o.GetName())
+					return nil
+				}
+				mc.updateMethod = func(_ context.Context, o client.Object, _ ...client.UpdateOption) error {
+					*updated = append(*updated, o.GetName())
+					return nil
+				}
+			}, func(h *handlers.DestinationRuleHandler) {
+				h.Owner = owner
+				h.Ctx = context.Background()
+			})
+		}
+
+		It("deletes destination rules we solely own", func() {
+			var deleted, updated []string
+			drs := []*istionetwork.DestinationRule{
+				mkDR("ours", "ns/owner", "version"),
+				mkDR("not-ours", "ns/other", "other-version"),
+			}
+			handler := mkHandler(drs, &deleted, &updated)
+			Expect(handler.Cleanup()).To(Succeed())
+			Expect(deleted).To(Equal([]string{"ours"}))
+			Expect(updated).To(BeEmpty())
+		})
+
+		It("bounds the deletes and releases by the operation timeout", func() {
+			var deleted, updated []string
+			for _, blocked := range []string{"delete", "update"} {
+				drs := []*istionetwork.DestinationRule{
+					mkDR("ours", "ns/owner", "version"),
+					mkDR("merged", "ns/owner", "version", "another"),
+				}
+				handler := mkHandler(drs, &deleted, &updated)
+				mc := handler.Client.(MockClient)
+				block := func(ctx context.Context) error {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				if blocked == "delete" {
+					mc.deleteMethod = func(ctx context.Context, _ client.Object, _ ...client.DeleteOption) error { return block(ctx) }
+				} else {
+					mc.updateMethod = func(ctx context.Context, _ client.Object, _ ...client.UpdateOption) error { return block(ctx) }
+				}
+				handler.Client = mc
+				handler.OperationTimeout = 10 * time.Millisecond
+				err := handler.Cleanup()
+				Expect(err).To(MatchError(ContainSubstring("operation timed out (after 10ms)")), blocked)
+				Expect(goerrors.Is(err, context.DeadlineExceeded)).To(BeTrue(), blocked)
+			}
+		})
+
+		It("removes only our subset from a destination rule with other subsets", func() {
+			var deleted, updated []string
+			merged := mkDR("merged", "ns/owner", "version", "hand-merged", "another")
+			handler := mkHandler([]*istionetwork.DestinationRule{merged}, &deleted, &updated)
+			Expect(handler.Cleanup()).To(Succeed())
+			Expect(deleted).To(BeEmpty())
+			Expect(updated).To(Equal([]string{"merged"}))
+			Expect(watches.ContainsAnnotation(owner, merged)).To(BeFalse())
+			Expect(merged.Spec.Subsets).To(HaveLen(2))
+			Expect(merged.Spec.Subsets[0].Name).To(Equal("hand-merged"))
+			Expect(merged.Spec.Subsets[1].Name).To(Equal("another"))
+		})
+
+		It("deletes the destination rule when removing its last subset", func() {
+			var deleted, updated []string
+			ours := mkDR("ours", "ns/owner", "version")
+			handler := mkHandler([]*istionetwork.DestinationRule{ours}, &deleted, &updated)
+			Expect(handler.Cleanup()).To(Succeed())
+			Expect(deleted).To(Equal([]string{"ours"}))
+			Expect(updated).To(BeEmpty())
+			Expect(ours.Spec.Subsets).To(BeEmpty())
+		})
+
+		It("only releases destination rules with other owners", func() {
+			var deleted, updated []string
+			shared := mkDR("shared", "ns/other,ns/owner", "other-version", "version")
+			handler := mkHandler([]*istionetwork.DestinationRule{shared}, &deleted, &updated)
+			Expect(handler.Cleanup()).To(Succeed())
+			Expect(deleted).To(BeEmpty())
+			Expect(updated).To(Equal([]string{"shared"}))
+			Expect(watches.ContainsAnnotation(owner, shared)).To(BeFalse())
+			Expect(shared.Spec.Subsets).To(HaveLen(1))
+			Expect(shared.Spec.Subsets[0].Name).To(Equal("other-version"))
+		})
+
+		It("does not clean up destination rules of a previous owner with the same name", func() {
+			var deleted, updated []string
+			ours := mkDR("ours", "ns/owner", "version")
+			watches.AddOwnerUID(owner, "new-uid", ours)
+			stale := mkDR("stale", "ns/owner", "version")
+			watches.AddOwnerUID(owner, "old-uid", stale)
+			handler := mkHandler([]*istionetwork.DestinationRule{ours, stale}, &deleted, &updated)
+			handler.OwnerUID = "new-uid"
+			Expect(handler.Cleanup()).To(Succeed())
+			Expect(deleted).To(Equal([]string{"ours"}))
+			Expect(updated).To(BeEmpty())
+		})
+
+		It("removes our owner reference when releasing a shared destination rule", func() {
+			shared := mkDR("shared", "ns/other,ns/owner", "other-version", "version")
+			shared.OwnerReferences = []metav1.OwnerReference{
+				{APIVersion: "riskified.com/v1alpha1", Kind: "DynamicEnv", Name: "owner", UID: "uid"},
+				{APIVersion: "riskified.com/v1alpha1", Kind: "DynamicEnv", Name: "other", UID: "other-uid"},
+			}
+			Expect(handlers.ReleaseDestinationRule(watches.Ownership{}, shared, owner, "version", "version")).To(BeFalse())
+			Expect(shared.OwnerReferences).To(HaveLen(1))
+			Expect(shared.OwnerReferences[0].Name).To(Equal("other"))
+		})
+
+		It("removes the subsets recorded for us by the provenance annotation", func() {
+			other := types.NamespacedName{Name: "other", Namespace: "ns"}
+			// Our subset selects by a previous version label key, and the subset of the other owner
+			// happens to select our version
+			shared := mkDR("shared", "ns/other,ns/owner")
+			shared.Spec.Subsets = []*v1alpha3.Subset{
+				{Name: "ours", Labels: map[string]string{"old-version": "version"}},
+				{Name: "theirs", Labels: map[string]string{"version": "version"}},
+			}
+			watches.SetSubsetOwners(shared, map[string]types.NamespacedName{"ours": owner, "theirs": other})
+			Expect(handlers.ReleaseDestinationRule(watches.Ownership{}, shared, owner, "version", "version")).To(BeFalse())
+			Expect(shared.Spec.Subsets).To(HaveLen(1))
+			Expect(shared.Spec.Subsets[0].Name).To(Equal("theirs"))
+			Expect(watches.SubsetOwners(shared)).To(Equal(map[string]types.NamespacedName{"theirs": other}))
+
+			Expect(handlers.ReleaseDestinationRule(watches.Ownership{}, shared, other, "version", "other-version")).To(BeTrue())
+			Expect(shared.Annotations).NotTo(HaveKey(watches.SubsetOwnersAnnotation))
+		})
+	})
+
+	Context("ServerSideApply", func() {
+		type applied struct {
+			obj     client.Object
+			patch   client.Patch
+			options client.PatchOptions
+		}
+
+		mkHandler := func(existing *istionetwork.DestinationRule, patches *[]applied) handlers.DestinationRuleHandler {
+			return mkDestinationRuleHandler(func(mc *MockClient) {
+				mc.getMethod = func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					if existing == nil {
+						return errors.NewNotFound(schema.GroupResource{}, "error")
+					}
+					existing.DeepCopyInto(o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				mc.createMethod = func(context.Context, client.Object, ...client.CreateOption) error {
+					Fail("the destination rule should be applied instead of created")
+					return nil
+				}
+				mc.updateMethod = func(context.Context, client.Object, ...client.UpdateOption) error {
+					Fail("the destination rule should be applied instead of updated")
+					return nil
+				}
+				mc.patchMethod = func(_ context.Context, o client.Object, p client.Patch, opts ...client.PatchOption) error {
+					a := applied{obj: o.DeepCopyObject().(client.Object), patch: p}
+					a.options.ApplyOptions(opts)
+					*patches = append(*patches, a)
+					return nil
+				}
+			}, func(h *handlers.DestinationRuleHandler) {
+				h.Owner = types.NamespacedName{Name: "owner", Namespace: "owner-ns"}
+				h.ServerSideApply = true
+			})
+		}
+
+		It("applies new destination rules with our field manager", func() {
+			var patches []applied
+			handler := mkHandler(nil, &patches)
+			Expect(handler.Handle()).To(Succeed())
+			Expect(patches).To(HaveLen(1))
+			Expect(patches[0].patch.Type()).To(Equal(types.ApplyPatchType))
+			Expect(patches[0].options.FieldManager).To(Equal(names.DestinationRuleFieldManager))
+			Expect(patches[0].options.Force).To(HaveValue(BeTrue()))
+			gvk := patches[0].obj.GetObjectKind().GroupVersionKind()
+			Expect(gvk).To(Equal(istionetwork.SchemeGroupVersion.WithKind("DestinationRule")))
+			Expect(handler.GetHosts()).To(Equal([]string{"details"}))
+		})
+
+		It("applies only the fields we manage when updating an outdated destination rule", func() {
+			existing := &istionetwork.DestinationRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "unique-details",
+					Namespace:       "ns",
+					ResourceVersion: "42",
+					Labels:          map[string]string{"team": "details"},
+					Annotations:     map[string]string{watches.NamespacedNameAnnotation: "owner-ns/owner"},
+				},
+				Spec: v1alpha3.DestinationRule{Host: "details"},
+			}
+			var patches []applied
+			handler := mkHandler(existing, &patches)
+			Expect(handler.Handle()).To(Succeed())
+			Expect(patches).To(HaveLen(1))
+			dr := patches[0].obj.(*istionetwork.DestinationRule)
+			Expect(patches[0].patch.Type()).To(Equal(types.ApplyPatchType))
+			Expect(dr.ResourceVersion).To(BeEmpty())
+			Expect(dr.Labels).NotTo(HaveKey("team"))
+			Expect(dr.Annotations).To(HaveKeyWithValue(watches.NamespacedNameAnnotation, "owner-ns/owner"))
+			Expect(dr.Spec.Subsets).To(HaveLen(1))
+			Expect(dr.Spec.Subsets[0].Labels).To(HaveKeyWithValue("version", "version"))
+		})
+	})
+
+	Context("WaitForDeployment", func() {
+		// The existing shared destination rule (shared mode only, none if nil) and its updates
+		var existingShared *istionetwork.DestinationRule
+		var updated []*istionetwork.DestinationRule
+		BeforeEach(func() {
+			existingShared, updated = nil, nil
+		})
+		mkHandler := func(deploymentStatus riskifiedv1alpha1.LifeCycleStatus, created *[]string) handlers.DestinationRuleHandler {
+			de := &riskifiedv1alpha1.DynamicEnv{}
+			if deploymentStatus != "" {
+				de.Status.SubsetsStatus = map[string]riskifiedv1alpha1.SubsetStatus{
+					"unique": {Deployment: riskifiedv1alpha1.ResourceStatus{Name: "unique", Namespace: "ns", Status: deploymentStatus}},
+				}
+			}
+			return mkDestinationRuleHandler(func(mc *MockClient) {
+				mc.getMethod = func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					if dr, ok := o.(*istionetwork.DestinationRule); ok && existingShared != nil {
+						existingShared.DeepCopyInto(dr)
+						return nil
+					}
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+					*created = append(*created, o.GetName())
+					return nil
+				}
+				mc.updateMethod = func(_ context.Context, o client.Object, _ ...client.UpdateOption) error {
+					updated = append(updated, o.(*istionetwork.DestinationRule))
+					return nil
+				}
+			}, func(h *handlers.DestinationRuleHandler) {
+				h.StatusHandler.DynamicEnv = de
+				h.WaitForDeployment = true
+			})
+		}
+
+		It("does not create the destination rule while the deployment is absent", func() {
+			var created []string
+			handler := mkHandler("", &created)
+			Expect(handler.Handle()).To(Succeed())
+			Expect(created).To(BeEmpty())
+			Expect(handler.GetHosts()).To(BeEmpty())
+			Expect(handler.GetPendingHosts()).To(Equal([]string{"details"}))
+			statuses, err := handler.GetStatus()
+			Expect(err).To(BeNil())
+			Expect(statuses).To(HaveLen(1))
+			Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Initializing))
+		})
+
+		It("requests a requeue while the host is initializing", func() {
+			var created []string
+			handler := mkHandler("", &created)
+			Expect(handler.Handle()).To(Succeed())
+			statuses, err := handler.GetStatus()
+			Expect(err).To(BeNil())
+			Expect(handlers.RequiresRequeue(statuses)).To(BeTrue())
+		})
+
+		It("does not create the destination rule while the deployment is initializing", func() {
+			var created []string
+			handler := mkHandler(riskifiedv1alpha1.Initializing, &created)
+			Expect(handler.Handle()).To(Succeed())
+			Expect(created).To(BeEmpty())
+		})
+
+		It("creates the destination rule once the deployment is running", func() {
+			var created []string
+			handler := mkHandler(riskifiedv1alpha1.Running, &created)
+			Expect(handler.Handle()).To(Succeed())
+			Expect(created).To(HaveLen(1))
+			Expect(handler.GetHosts()).To(Equal([]string{"details"}))
+			Expect(handler.GetPendingHosts()).To(BeEmpty())
+		})
+
+		Context("with shared destination rules", func() {
+			mkShared := func() *istionetwork.DestinationRule {
+				return &istionetwork.DestinationRule{
+					ObjectMeta: metav1.ObjectMeta{Name: "shared-details", Namespace: "ns"},
+					Spec: v1alpha3.DestinationRule{
+						Host:    "details",
+						Subsets: []*v1alpha3.Subset{{Name: "other-subset", Labels: map[string]string{"version": "other"}}},
+					},
+				}
+			}
+
+			It("does not create the shared destination rule while the deployment is initializing", func() {
+				var created []string
+				handler := mkHandler(riskifiedv1alpha1.Initializing, &created)
+				handler.SharedDestinationRules = true
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(BeEmpty())
+				Expect(handler.GetHosts()).To(BeEmpty())
+				Expect(handler.GetPendingHosts()).To(Equal([]string{"details"}))
+			})
+
+			It("does not add our subset to the existing shared destination rule while the deployment is initializing", func() {
+				var created []string
+				existingShared = mkShared()
+				handler := mkHandler(riskifiedv1alpha1.Initializing, &created)
+				handler.SharedDestinationRules = true
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(BeEmpty())
+				Expect(handler.GetPendingHosts()).To(Equal([]string{"details"}))
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Initializing))
+			})
+
+			It("adds our subset to the existing shared destination rule once the deployment is running", func() {
+				var created []string
+				existingShared = mkShared()
+				handler := mkHandler(riskifiedv1alpha1.Running, &created)
+				handler.SharedDestinationRules = true
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(updated[0].Spec.Subsets).To(HaveLen(2))
+				Expect(handler.GetHosts()).To(Equal([]string{"details"}))
+				Expect(handler.GetPendingHosts()).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("status updates around the creation", func() {
+		// Records the order of the creates and the status updates, failing the ones that are set
+		var calls []string
+		var createErr, statusErr error
+		mkHandler := func() handlers.DestinationRuleHandler {
+			calls, createErr, statusErr = nil, nil, nil
+			return mkDestinationRuleHandler(func(mc *MockClient) {
+				mc.createMethod = func(context.Context, client.Object, ...client.CreateOption) error {
+					calls = append(calls, "create")
+					return createErr
+				}
+				mc.statusUpdateMethod = func(context.Context, client.Object, ...client.SubResourceUpdateOption) error {
+					calls = append(calls, "status")
+					return statusErr
+				}
+			})
+		}
+
+		It("creates the destination rule before setting its status to running", func() {
+			handler := mkHandler()
+			Expect(handler.Handle()).To(Succeed())
+			Expect(calls).To(Equal([]string{"create", "status"}))
+			recorded := handler.StatusHandler.DynamicEnv.Status.SubsetsStatus["unique"].DestinationRules
+			Expect(recorded).To(HaveLen(1))
+			Expect(recorded[0].Status).To(Equal(riskifiedv1alpha1.Running))
+			Expect(handler.RequeueAfter()).To(BeZero())
+		})
+
+		It("requests a requeue instead of failing when the status update fails after the create", func() {
+			handler := mkHandler()
+			statusErr = errors.NewInternalError(goerrors.New("status unavailable"))
+			Expect(handler.Handle()).To(Succeed())
+			Expect(calls[0]).To(Equal("create"))
+			Expect(calls).To(ContainElement("status"))
+			Expect(handler.ActiveHosts()).To(Equal([]string{"details"}))
+			Expect(handler.RequeueAfter()).To(BeNumerically(">", 0))
+		})
+
+		It("does not touch the status when the create fails", func() {
+			handler := mkHandler()
+			createErr = errors.NewBadRequest("invalid destination rule")
+			Expect(handler.Handle()).NotTo(Succeed())
+			Expect(calls).To(Equal([]string{"create"}))
+			Expect(handler.ActiveHosts()).To(BeEmpty())
+			Expect(handler.StatusHandler.DynamicEnv.Status.SubsetsStatus["unique"].DestinationRules).To(BeEmpty())
+			Expect(handler.RequeueAfter()).To(BeZero())
+		})
+
+		It("attempts the create even when the status updates fail", func() {
+			handler := mkHandler()
+			statusErr = errors.NewInternalError(goerrors.New("status unavailable"))
+			createErr = errors.NewBadRequest("invalid destination rule")
+			Expect(handler.Handle()).NotTo(Succeed())
+			Expect(calls).To(Equal([]string{"create"}))
+		})
+	})
+
+	Context("Correlation ID", func() {
+		It("adds the correlation ID and the owner to all the log lines", func() {
+			mc := struct{ MockClient }{}
+			mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+				dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+				return nil
+			}
+			mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+				return errors.NewNotFound(schema.GroupResource{}, "error")
+			}
+			var lines []string
+			logger := funcr.New(func(_, args string) { lines = append(lines, args) }, funcr.Options{})
+			ctx, id := helpers.WithCorrelationID(context.Background())
+			handler := handlers.DestinationRuleHandler{
+				Client:         mc,
+				UniqueName:     "unique",
+				UniqueVersion:  "version",
+				Namespace:      "ns",
+				VersionLabel:   "version",
+				DefaultVersion: "shared",
+				ServiceHosts:   []string{"details", "service2"},
+				Owner:          types.NamespacedName{Name: "de", Namespace: "owner-ns"},
+				StatusHandler: &handlers.DynamicEnvStatusHandler{
+					Client:     mc,
+					Ctx:        ctx,
+					DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+				},
+				Log: logger,
+				Ctx: ctx,
+			}
+			Expect(handler.Handle()).To(Succeed())
+			Expect(id).NotTo(BeEmpty())
+			Expect(lines).NotTo(BeEmpty())
+			for _, line := range lines {
+				Expect(line).To(ContainSubstring(fmt.Sprintf(`"correlationID"="%s"`, id)))
+				Expect(line).To(ContainSubstring(`"owner"="owner-ns/de"`))
+			}
+		})
+
+		It("logs with consistent structured keys", func() {
+			mc := struct{ MockClient }{}
+			mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+				dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+				return nil
+			}
+			mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+				return errors.NewNotFound(schema.GroupResource{}, "error")
+			}
+			lines := map[string]map[string]interface{}{}
+			logger := funcr.NewJSON(func(obj string) {
+				line := map[string]interface{}{}
+				Expect(json.Unmarshal([]byte(obj), &line)).To(Succeed())
+				lines[line["msg"].(string)] = line
+			}, funcr.Options{Verbosity: 1})
+			handler := handlers.DestinationRuleHandler{
+				Client:         mc,
+				UniqueName:     "unique",
+				UniqueVersion:  "version",
+				Namespace:      "ns",
+				VersionLabel:   "version",
+				DefaultVersion: "shared",
+				ServiceHosts:   []string{"details"},
+				Owner:          types.NamespacedName{Name: "de", Namespace: "owner-ns"},
+				StatusHandler: &handlers.DynamicEnvStatusHandler{
+					Client:     mc,
+					Ctx:        context.Background(),
+					DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+				},
+				Log: logger,
+				Ctx: context.Background(),
+			}
+			Expect(handler.Handle()).To(Succeed())
+			Expect(lines).NotTo(BeEmpty())
+			for _, line := range lines {
+				Expect(line).To(HaveKeyWithValue("owner", "owner-ns/de"))
+				Expect(line).To(HaveKeyWithValue("subset", "unique"))
+			}
+			Expect(lines).To(HaveKey("Deploying newly created destination rule"))
+			deploying := lines["Deploying newly created destination rule"]
+			Expect(deploying).To(HaveKeyWithValue("drName", "unique-details"))
+			Expect(deploying).To(HaveKeyWithValue("host", "details"))
+			Expect(lines).To(HaveKey("Setting destination rule status"))
+			Expect(lines["Setting destination rule status"]).To(HaveKeyWithValue("status", "running"))
+		})
+	})
+
+	Context("Metrics", func() {
+		It("counts the created destination rules and the ignored missing hosts", func() {
+			mc := struct{ MockClient }{}
+			mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+				dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+				return nil
+			}
+			mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+				return errors.NewNotFound(schema.GroupResource{}, "error")
+			}
+			m := metrics.NewDestinationRuleMetrics()
+			Expect(m.Register(prometheus.NewRegistry())).To(Succeed())
+			handler := handlers.DestinationRuleHandler{
+				Client:         mc,
+				UniqueName:     "unique",
+				UniqueVersion:  "version",
+				Namespace:      "ns",
+				VersionLabel:   "version",
+				DefaultVersion: "shared",
+				ServiceHosts:   []string{"details", "service2"},
+				Owner:          types.NamespacedName{Name: "de", Namespace: "owner-ns"},
+				StatusHandler: &handlers.DynamicEnvStatusHandler{
+					Client:     mc,
+					Ctx:        context.Background(),
+					DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+				},
+				Metrics: m,
+				Log:     ctrl.Log,
+			}
+			Expect(handler.Handle()).To(Succeed())
+			Expect(testutil.ToFloat64(m.Created.WithLabelValues("owner-ns"))).To(Equal(float64(1)))
+			Expect(testutil.ToFloat64(m.IgnoredMissing.WithLabelValues("owner-ns"))).To(Equal(float64(1)))
+			Expect(testutil.ToFloat64(m.ActiveHosts.WithLabelValues("owner-ns", "de", "unique"))).To(Equal(float64(1)))
+			Expect(testutil.ToFloat64(m.ReconcileErrors.WithLabelValues("owner-ns"))).To(Equal(float64(0)))
+		})
+
+		It("drops the active hosts of the subsets of a deleted dynamic environment", func() {
+			m := metrics.NewDestinationRuleMetrics()
+			Expect(m.Register(prometheus.NewRegistry())).To(Succeed())
+			m.ActiveHosts.WithLabelValues("owner-ns", "de", "details-de").Set(1)
+			m.ActiveHosts.WithLabelValues("owner-ns", "de", "reviews-de").Set(2)
+			m.ActiveHosts.WithLabelValues("owner-ns", "other", "details-other").Set(1)
+			m.ForgetOwner(types.NamespacedName{Name: "de", Namespace: "owner-ns"})
+			Expect(testutil.CollectAndCount(m.ActiveHosts)).To(Equal(1))
+			Expect(testutil.ToFloat64(m.ActiveHosts.WithLabelValues("owner-ns", "other", "details-other"))).To(Equal(float64(1)))
+		})
+
+		It("counts the destination rules owned by each dynamic environment", func() {
+			base, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+			Expect(err).To(BeNil())
+			reviews := base.DeepCopy()
+			reviews.Name, reviews.Spec.Host = "reviews", "reviews"
+			existing := []*istionetwork.DestinationRule{base, reviews}
+			mc := struct{ MockClient }{}
+			mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+				o.(*istionetwork.DestinationRuleList).Items = existing
+				return nil
+			}
+			mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+				return errors.NewNotFound(schema.GroupResource{}, key.Name)
+			}
+			mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+				existing = append(existing, o.(*istionetwork.DestinationRule))
+				return nil
+			}
+			de := &riskifiedv1alpha1.DynamicEnv{ObjectMeta: metav1.ObjectMeta{Name: "de", Namespace: "owner-ns", UID: "uid"}}
+			m := metrics.NewDestinationRuleMetrics()
+			Expect(m.Register(prometheus.NewRegistry())).To(Succeed())
+			handler := handlers.DestinationRuleHandler{
+				Client:         mc,
+				UniqueName:     "unique",
+				UniqueVersion:  "version",
+				Namespace:      "ns",
+				VersionLabel:   "version",
+				DefaultVersion: "shared",
+				ServiceHosts:   []string{"details", "reviews", "service2"},
+				Owner:          types.NamespacedName{Name: "de", Namespace: "owner-ns"},
+				OwnerUID:       "uid",
+				StatusHandler: &handlers.DynamicEnvStatusHandler{
+					Client:     mc,
+					Ctx:        context.Background(),
+					DynamicEnv: de,
+				},
+				Log: logr.Discard(),
+			}
+			Expect(handler.Handle()).To(Succeed())
+			// Owned by another dynamic environment
+			other := base.DeepCopy()
+			other.Name = "other-details"
+			watches.AddToAnnotation(types.NamespacedName{Name: "other", Namespace: "owner-ns"}, other)
+			existing = append(existing, other)
+
+			statuses, err := handler.GetStatus()
+			Expect(err).To(BeNil())
+			Expect(handlers.RecordOwnedDestinationRules(context.Background(), mc, watches.Ownership{}, m, []string{"ns"}, de, statuses)).To(Succeed())
+			Expect(testutil.ToFloat64(m.OwnedDestinationRules.WithLabelValues("owner-ns", "de"))).To(Equal(float64(2)))
+			Expect(testutil.ToFloat64(m.IgnoredMissingHosts.WithLabelValues("owner-ns", "de"))).To(Equal(float64(1)))
+
+			m.ForgetOwner(types.NamespacedName{Name: "de", Namespace: "owner-ns"})
+			Expect(testutil.CollectAndCount(m.OwnedDestinationRules)).To(Equal(0))
+			Expect(testutil.CollectAndCount(m.IgnoredMissingHosts)).To(Equal(0))
+		})
+	})
+
+	Context("DryRun", func() {
+		It("collects the planned changes without writing anything", func() {
+			mc := struct{ MockClient }{}
+			mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+				dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+				return nil
+			}
+			mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+				return errors.NewNotFound(schema.GroupResource{}, "error")
+			}
+			failOnWrite := func() error {
+				Fail("unexpected API write in dry-run mode")
+				return nil
+			}
+			mc.createMethod = func(context.Context, client.Object, ...client.CreateOption) error { return failOnWrite() }
+			mc.updateMethod = func(context.Context, client.Object, ...client.UpdateOption) error { return failOnWrite() }
+			mc.deleteMethod = func(context.Context, client.Object, ...client.DeleteOption) error { return failOnWrite() }
+			mc.statusUpdateMethod = func(context.Context, client.Object, ...client.SubResourceUpdateOption) error { return failOnWrite() }
+			de := &riskifiedv1alpha1.DynamicEnv{}
+			handler := handlers.DestinationRuleHandler{
+				Client:         mc,
+				UniqueName:     "unique",
+				UniqueVersion:  "version",
+				Namespace:      "ns",
+				VersionLabel:   "version",
+				DefaultVersion: "shared",
+				ServiceHosts:   []string{"details", "service2"},
+				StatusHandler: &handlers.DynamicEnvStatusHandler{
+					Client:     mc,
+					Ctx:        context.Background(),
+					DynamicEnv: de,
+				},
+				DryRun: true,
+				Log:    ctrl.Log,
+			}
+			Expect(handler.Handle()).To(Succeed())
+			planned := handler.PlannedChanges()
+			Expect(planned).To(HaveLen(1))
+			Expect(planned[0].Operation).To(Equal(handlers.PlannedCreate))
+			dr := planned[0].Object.(*istionetwork.DestinationRule)
+			Expect(dr.Spec.Subsets).To(HaveLen(1))
+			Expect(dr.Spec.Subsets[0].Name).To(Equal("version"))
+			Expect(de.Status).To(Equal(riskifiedv1alpha1.DynamicEnvStatus{}))
 		})
 	})
 
@@ -93,10 +916,13 @@ var _ = Describe("DestinationRuleHandler", func() {
 					return errors.NewNotFound(schema.GroupResource{}, "error")
 				}
 				handler := handlers.DestinationRuleHandler{
-					Client:       mc,
-					UniqueName:   "unique",
-					Namespace:    "ns",
-					ServiceHosts: []string{"details", "service2"},
+					Client:         mc,
+					UniqueName:     "unique",
+					UniqueVersion:  "version",
+					Namespace:      "ns",
+					VersionLabel:   "version",
+					DefaultVersion: "shared",
+					ServiceHosts:   []string{"details", "service2"},
 					StatusHandler: &handlers.DynamicEnvStatusHandler{
 						Client:     mc,
 						Ctx:        context.Background(),
@@ -108,6 +934,77 @@ var _ = Describe("DestinationRuleHandler", func() {
 				Expect(err).To(BeNil())
 			})
 
+			It("emits a single warning event per ignored missing host", func() {
+				mc := struct{ MockClient }{}
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+					Expect(err).To(BeNil())
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+					return nil
+				}
+				mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				recorder := record.NewFakeRecorder(10)
+				handler := handlers.DestinationRuleHandler{
+					Client:         mc,
+					UniqueName:     "unique",
+					UniqueVersion:  "version",
+					Namespace:      "ns",
+					VersionLabel:   "version",
+					DefaultVersion: "shared",
+					ServiceHosts:   []string{"details", "service2", "service2"},
+					StatusHandler: &handlers.DynamicEnvStatusHandler{
+						Client:     mc,
+						Ctx:        context.Background(),
+						DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+					},
+					Recorder: recorder,
+					Log:      ctrl.Log,
+				}
+				Expect(handler.Handle()).To(Succeed())
+				Expect(recorder.Events).To(HaveLen(1))
+				event := <-recorder.Events
+				Expect(event).To(HavePrefix("Warning IgnoredMissingDestinationRule"))
+				Expect(event).To(ContainSubstring("service2"))
+			})
+
+			It("processes duplicate service hosts only once", func() {
+				var fetched []string
+				mc := struct{ MockClient }{}
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+					Expect(err).To(BeNil())
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+					return nil
+				}
+				mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+					fetched = append(fetched, key.Name)
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				handler := handlers.DestinationRuleHandler{
+					Client:         mc,
+					UniqueName:     "unique",
+					UniqueVersion:  "version",
+					Namespace:      "ns",
+					VersionLabel:   "version",
+					DefaultVersion: "shared",
+					ServiceHosts:   []string{"details", "service2", "details", "service2"},
+					StatusHandler: &handlers.DynamicEnvStatusHandler{
+						Client:     mc,
+						Ctx:        context.Background(),
+						DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+					},
+					Log: ctrl.Log,
+				}
+				Expect(handler.Handle()).To(Succeed())
+				Expect(fetched).To(Equal([]string{"unique-details", "unique-service2"}))
+				Expect(handler.GetHosts()).To(Equal([]string{"details"}))
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(2))
+			})
+
 			It("returns error if destination rules for all hosts were missing", func() {
 				mc := struct{ MockClient }{}
 				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
@@ -135,7 +1032,2413 @@ var _ = Describe("DestinationRuleHandler", func() {
 				err := handler.Handle()
 				Expect(err).NotTo(BeNil())
 				Expect(err.Error()).To(ContainSubstring("no base destination rules"))
+				Expect(err.Error()).To(ContainSubstring("ignored missing hosts: service1, service2"))
+				var noBase handlers.NoBaseDestinationRules
+				Expect(goerrors.As(err, &noBase)).To(BeTrue())
+				Expect(noBase.Subset).To(Equal("unique"))
+				Expect(noBase.IgnoredMissing).To(Equal([]string{"service1", "service2"}))
+				Expect(noBase.Missing).To(BeEmpty())
+				Expect(goerrors.As(err, &handlers.IgnoredMissing{})).To(BeTrue())
+			})
+
+			It("distinguishes ignored missing hosts from other missing hosts", func() {
+				err := handlers.NoBaseDestinationRules{
+					Subset:         "unique",
+					IgnoredMissing: []string{"service1"},
+					Missing:        []string{"service2"},
+				}
+				Expect(err.Error()).To(Equal(
+					"no base destination rules were found for subset: unique (ignored missing hosts: service1) (missing hosts: service2)"))
+				Expect(goerrors.As(handlers.NoBaseDestinationRules{Missing: []string{"service2"}}, &handlers.IgnoredMissing{})).To(BeFalse())
+			})
+
+			Context("with strict hosts", func() {
+				newHandler := func(strict bool) handlers.DestinationRuleHandler {
+					mc := struct{ MockClient }{}
+					mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+						dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+						Expect(err).To(BeNil())
+						o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+						return nil
+					}
+					mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+						return errors.NewNotFound(schema.GroupResource{}, "error")
+					}
+					return handlers.DestinationRuleHandler{
+						Client:         mc,
+						UniqueName:     "unique",
+						UniqueVersion:  "version",
+						Namespace:      "ns",
+						VersionLabel:   "version",
+						DefaultVersion: "shared",
+						ServiceHosts:   []string{"details", "service2"},
+						StrictHosts:    strict,
+						StatusHandler: &handlers.DynamicEnvStatusHandler{
+							Client:     mc,
+							Ctx:        context.Background(),
+							DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+						},
+						Log: ctrl.Log,
+					}
+				}
+
+				It("returns an error and reports the host as missing", func() {
+					handler := newHandler(true)
+					err := handler.Handle()
+					Expect(err).NotTo(BeNil())
+					var missing handlers.MissingBaseDestinationRule
+					Expect(goerrors.As(err, &missing)).To(BeTrue())
+					Expect(missing.Host).To(Equal("service2"))
+					Expect(goerrors.As(err, &handlers.IgnoredMissing{})).To(BeFalse())
+					Expect(handler.IgnoredMissingHosts()).To(BeEmpty())
+					statuses, err := handler.GetStatus()
+					Expect(err).To(BeNil())
+					Expect(statuses).To(HaveLen(2))
+					Expect(statuses[1].Status).To(Equal(riskifiedv1alpha1.Missing))
+				})
+
+				It("ignores the missing host when disabled", func() {
+					handler := newHandler(false)
+					Expect(handler.Handle()).To(Succeed())
+					Expect(handler.IgnoredMissingHosts()).To(Equal([]string{"service2"}))
+					statuses, err := handler.GetStatus()
+					Expect(err).To(BeNil())
+					Expect(statuses).To(HaveLen(2))
+					Expect(statuses[1].Status).To(Equal(riskifiedv1alpha1.IgnoredMissingDR))
+				})
 			})
 		})
-	})
-})
+
+		Context("base destination rules that were not applied yet", func() {
+			// The base destination rule of the host was missing for the provided duration (according
+			// to the previous status) or just found missing if 0.
+			mkHandler := func(missingFor time.Duration) handlers.DestinationRuleHandler {
+				de := &riskifiedv1alpha1.DynamicEnv{}
+				de.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+				if missingFor > 0 {
+					since := metav1.NewTime(time.Now().Add(-missingFor))
+					de.Status.SubsetsStatus = map[string]riskifiedv1alpha1.SubsetStatus{
+						"unique": {DestinationRules: []riskifiedv1alpha1.ResourceStatus{{
+							Name:         "unique-details",
+							Namespace:    "ns",
+							ServiceHost:  "details",
+							Status:       riskifiedv1alpha1.Initializing,
+							MissingSince: &since,
+						}}},
+					}
+				}
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules()
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.StatusHandler.DynamicEnv = de
+					h.BaseDestinationRuleGracePeriod = time.Minute
+					h.BaseDestinationRuleBackoff = 5 * time.Second
+				})
+			}
+
+			It("requests a requeue instead of ignoring the host during the grace period", func() {
+				handler := mkHandler(time.Second)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.RequeueAfter()).To(Equal(5 * time.Second))
+				Expect(handler.IgnoredMissingHosts()).To(BeEmpty())
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Initializing))
+			})
+
+			It("starts the grace period once the base is found missing, regardless of the age of the DynamicEnv", func() {
+				handler := mkHandler(0)
+				before := time.Now()
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.RequeueAfter()).To(Equal(5 * time.Second))
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Initializing))
+				Expect(statuses[0].MissingSince).NotTo(BeNil())
+				Expect(statuses[0].MissingSince.Time).To(BeTemporally(">=", before.Truncate(time.Second)))
+			})
+
+			It("keeps reporting when the base was first found missing", func() {
+				handler := mkHandler(30 * time.Second)
+				since := *handler.StatusHandler.DynamicEnv.Status.SubsetsStatus["unique"].DestinationRules[0].MissingSince
+				Expect(handler.Handle()).To(Succeed())
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].MissingSince).To(Equal(&since))
+			})
+
+			It("does not requeue beyond the end of the grace period", func() {
+				handler := mkHandler(58 * time.Second)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.RequeueAfter()).To(BeNumerically("<=", 2*time.Second))
+				Expect(handler.RequeueAfter()).To(BeNumerically(">", 0))
+			})
+
+			It("ignores the host once the grace period is over", func() {
+				handler := mkHandler(2 * time.Minute)
+				err := handler.Handle()
+				Expect(goerrors.As(err, &handlers.IgnoredMissing{})).To(BeTrue())
+				Expect(handler.RequeueAfter()).To(BeZero())
+				Expect(handler.IgnoredMissingHosts()).To(Equal([]string{"details"}))
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.IgnoredMissingDR))
+				Expect(statuses[0].MissingSince).NotTo(BeNil())
+			})
+
+			It("ignores the host right away without a grace period", func() {
+				handler := mkHandler(time.Second)
+				handler.BaseDestinationRuleGracePeriod = 0
+				err := handler.Handle()
+				Expect(goerrors.As(err, &handlers.IgnoredMissing{})).To(BeTrue())
+				Expect(handler.RequeueAfter()).To(BeZero())
+			})
+		})
+
+		Context("ambiguous base destination rules", func() {
+			It("reports an ambiguous status if several base destination rules match", func() {
+				mc := struct{ MockClient }{}
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					first, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+					Expect(err).To(BeNil())
+					second := first.DeepCopy()
+					second.Name = "details-duplicate"
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{first, second}
+					return nil
+				}
+				mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				handler := handlers.DestinationRuleHandler{
+					Client:         mc,
+					UniqueName:     "unique",
+					Namespace:      "ns",
+					VersionLabel:   "version",
+					DefaultVersion: "shared",
+					ServiceHosts:   []string{"details"},
+					StatusHandler: &handlers.DynamicEnvStatusHandler{
+						Client:     mc,
+						Ctx:        context.Background(),
+						DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+					},
+					Log: ctrl.Log,
+				}
+				err := handler.Handle()
+				Expect(err).NotTo(BeNil())
+				var ambiguous handlers.AmbiguousBaseDestinationRule
+				Expect(goerrors.As(err, &ambiguous)).To(BeTrue())
+				Expect(ambiguous.Names).To(HaveLen(2))
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.AmbiguousBaseDR))
+			})
+		})
+
+		Context("base destination rules without the default subset", func() {
+			var recorder *record.FakeRecorder
+
+			mkHandler := func(items ...*istionetwork.DestinationRule) handlers.DestinationRuleHandler {
+				recorder = record.NewFakeRecorder(10)
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules(items...)
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.Recorder = recorder
+				})
+			}
+
+			subsetless := func() *istionetwork.DestinationRule {
+				dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				dr.Spec.Subsets = nil
+				return dr
+			}
+
+			It("reports a subsetless base destination rule as missing the default subset", func() {
+				handler := mkHandler(subsetless())
+				err := handler.Handle()
+				Expect(err).NotTo(BeNil())
+				var noBase handlers.NoBaseDestinationRules
+				Expect(goerrors.As(err, &noBase)).To(BeTrue())
+				Expect(noBase.MissingDefaultSubset).To(Equal([]string{"details"}))
+				Expect(noBase.IgnoredMissing).To(BeEmpty())
+				Expect(noBase.Missing).To(BeEmpty())
+				Expect(handler.IgnoredMissingHosts()).To(BeEmpty())
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.MissingDefaultSubset))
+			})
+
+			It("emits a single missing default subset event naming the base destination rule", func() {
+				handler := mkHandler(subsetless())
+				handler.ServiceHosts = []string{"details", "details"}
+				_ = handler.Handle()
+				_ = handler.Handle()
+				Expect(recorder.Events).To(HaveLen(1))
+				event := <-recorder.Events
+				Expect(event).To(HavePrefix("Warning MissingDefaultSubset"))
+				Expect(event).To(ContainSubstring("ns/details"))
+				Expect(event).To(ContainSubstring(`"shared"`))
+			})
+
+			It("reports base destination rules with only other versions as missing the default subset", func() {
+				dr := subsetless()
+				dr.Spec.Subsets = []*v1alpha3.Subset{{Name: "canary", Labels: map[string]string{"version": "canary"}}}
+				handler := mkHandler(dr)
+				var noBase handlers.NoBaseDestinationRules
+				Expect(goerrors.As(handler.Handle(), &noBase)).To(BeTrue())
+				Expect(noBase.MissingDefaultSubset).To(Equal([]string{"details"}))
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.MissingDefaultSubset))
+			})
+
+			It("distinguishes hosts missing the default subset from hosts without base destination rules", func() {
+				handler := mkHandler(subsetless())
+				handler.ServiceHosts = []string{"details", "service2"}
+				err := handler.Handle()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("ignored missing hosts: service2"))
+				Expect(err.Error()).To(ContainSubstring("hosts missing the default subset: details"))
+				Expect(goerrors.As(err, &handlers.IgnoredMissing{})).To(BeTrue())
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(2))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.MissingDefaultSubset))
+				Expect(statuses[1].Status).To(Equal(riskifiedv1alpha1.IgnoredMissingDR))
+				Expect(recorder.Events).To(HaveLen(2))
+			})
+
+			It("prefers a base destination rule with the default subset", func() {
+				base, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				policyOnly := subsetless()
+				policyOnly.Name = "details-policy"
+				handler := mkHandler(policyOnly, base)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.ActiveHosts()).To(Equal([]string{"details"}))
+				Expect(recorder.Events).To(BeEmpty())
+			})
+
+			It("ignores generated destination rules when looking for base destination rules", func() {
+				generated := subsetless()
+				generated.Name = "other-details"
+				watches.AddToAnnotation(types.NamespacedName{Name: "other", Namespace: "ns"}, generated)
+				handler := mkHandler(generated)
+				_ = handler.Handle()
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.IgnoredMissingDR))
+			})
+
+			It("describes the base destination rules missing the default subset", func() {
+				err := handlers.BaseWithoutDefaultSubset{Host: "details", Version: "shared", Names: []string{"ns/details"}}
+				Expect(err.Error()).To(Equal(`base destination rules for host "details" have no subset with the default version "shared": ns/details`))
+				Expect(goerrors.As(err, &handlers.IgnoredMissing{})).To(BeTrue())
+			})
+		})
+
+		Context("base destination rules that already contain our subset", func() {
+			var created []string
+
+			mkHandler := func(subsets ...*v1alpha3.Subset) handlers.DestinationRuleHandler {
+				created = nil
+				base := fixtureDestinationRule()
+				base.Spec.Subsets = append(base.Spec.Subsets, subsets...)
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules(base)
+					mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+						created = append(created, o.GetName())
+						return nil
+					}
+				})
+			}
+
+			It("does not create an overriding destination rule", func() {
+				handler := mkHandler(&v1alpha3.Subset{Name: "pre-created", Labels: map[string]string{"version": "version"}})
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(BeEmpty())
+				Expect(handler.ActiveHosts()).To(Equal([]string{"details"}))
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Name).To(Equal("unique-details"))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Running))
+			})
+
+			It("routes to the existing subset", func() {
+				handler := mkHandler(&v1alpha3.Subset{Name: "pre-created", Labels: map[string]string{"version": "version"}})
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.GetSubsetNames()).To(Equal(map[string]string{"details": "pre-created"}))
+			})
+
+			It("creates an overriding destination rule if the base only contains other versions", func() {
+				handler := mkHandler(&v1alpha3.Subset{Name: "canary", Labels: map[string]string{"version": "canary"}})
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(Equal([]string{"unique-details"}))
+			})
+		})
+
+		Context("base destination rules that opted out", func() {
+			var recorder *record.FakeRecorder
+			var created []string
+
+			mkHandler := func(items ...*istionetwork.DestinationRule) handlers.DestinationRuleHandler {
+				created = nil
+				recorder = record.NewFakeRecorder(10)
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules(items...)
+					mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+						created = append(created, o.GetName())
+						return nil
+					}
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.Recorder = recorder
+				})
+			}
+
+			optedOut := func(annotation, value string) *istionetwork.DestinationRule {
+				dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				dr.Annotations = map[string]string{annotation: value}
+				return dr
+			}
+
+			It("does not override a base destination rule that opted out", func() {
+				handler := mkHandler(optedOut(names.DefaultNoOverrideAnnotation, "true"))
+				err := handler.Handle()
+				var noBase handlers.NoBaseDestinationRules
+				Expect(goerrors.As(err, &noBase)).To(BeTrue())
+				Expect(noBase.OptedOut).To(Equal([]string{"details"}))
+				Expect(noBase.Missing).To(BeEmpty())
+				Expect(goerrors.As(err, &handlers.IgnoredMissing{})).To(BeTrue())
+				Expect(created).To(BeEmpty())
+				Expect(handler.ActiveHosts()).To(BeEmpty())
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.OptedOut))
+				Expect(recorder.Events).To(HaveLen(1))
+				Expect(<-recorder.Events).To(HavePrefix("Normal OptedOutDestinationRule"))
+			})
+
+			It("overrides base destination rules whose annotation is not set to true", func() {
+				handler := mkHandler(optedOut(names.DefaultNoOverrideAnnotation, "false"))
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(Equal([]string{"unique-details"}))
+			})
+
+			It("uses the configured annotation", func() {
+				handler := mkHandler(optedOut("example.com/keep-as-is", "true"))
+				handler.NoOverrideAnnotation = "example.com/keep-as-is"
+				Expect(goerrors.As(handler.Handle(), &handlers.NoBaseDestinationRules{})).To(BeTrue())
+				Expect(created).To(BeEmpty())
+
+				handler = mkHandler(optedOut(names.DefaultNoOverrideAnnotation, "true"))
+				handler.NoOverrideAnnotation = "example.com/keep-as-is"
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(Equal([]string{"unique-details"}))
+			})
+
+			It("does not fall back to a wildcard base destination rule", func() {
+				wildcard, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				wildcard.Name = "wildcard"
+				wildcard.Spec.Host = "*.ns.svc.cluster.local"
+				handler := mkHandler(optedOut(names.DefaultNoOverrideAnnotation, "true"), wildcard)
+				_ = handler.Handle()
+				Expect(created).To(BeEmpty())
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.OptedOut))
+			})
+
+			It("keeps overriding the other hosts", func() {
+				other, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				other.Name = "reviews"
+				other.Spec.Host = "reviews"
+				handler := mkHandler(optedOut(names.DefaultNoOverrideAnnotation, "true"), other)
+				handler.ServiceHosts = []string{"details", "reviews"}
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(Equal([]string{"unique-reviews"}))
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.OptedOut))
+			})
+
+			It("describes the base destination rules that opted out", func() {
+				err := handlers.BaseOptedOut{Host: "details", Names: []string{"ns/details"}}
+				Expect(err.Error()).To(Equal(`base destination rules for host "details" opted out of being overridden: ns/details`))
+				Expect(goerrors.As(err, &handlers.IgnoredMissing{})).To(BeTrue())
+			})
+		})
+
+		Context("excluded hosts", func() {
+			mkHandler := func(created *[]string, excluded ...string) handlers.DestinationRuleHandler {
+				details := fixtureDestinationRule()
+				reviews := details.DeepCopy()
+				reviews.Name, reviews.Spec.Host = "reviews", "reviews"
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules(details, reviews)
+					mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+						*created = append(*created, o.(*istionetwork.DestinationRule).Spec.Host)
+						return nil
+					}
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.ServiceHosts = []string{"details", "reviews"}
+					h.ExcludedHosts = excluded
+				})
+			}
+
+			It("does not create destination rules for excluded hosts", func() {
+				var created []string
+				handler := mkHandler(&created, "reviews.ns.svc.cluster.local")
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(Equal([]string{"details"}))
+				Expect(handler.GetHosts()).To(Equal([]string{"details"}))
+				Expect(handler.GetExcludedHosts()).To(Equal([]string{"reviews"}))
+				Expect(handler.IncludedHosts()).To(Equal([]string{"details"}))
+			})
+
+			It("reports excluded hosts as excluded", func() {
+				var created []string
+				handler := mkHandler(&created, "Reviews")
+				Expect(handler.Handle()).To(Succeed())
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(2))
+				Expect(statuses[1].ServiceHost).To(Equal("reviews"))
+				Expect(statuses[1].Status).To(Equal(riskifiedv1alpha1.Excluded))
+			})
+
+			It("does not fail when all the hosts are excluded", func() {
+				var created []string
+				handler := mkHandler(&created, "details", "reviews")
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(BeEmpty())
+				Expect(handler.IncludedHosts()).To(BeEmpty())
+			})
+		})
+
+		Context("propagated labels and annotations", func() {
+			var created []*istionetwork.DestinationRule
+
+			mkHandler := func() handlers.DestinationRuleHandler {
+				created = nil
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.createMethod = recordingCreated(&created)
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.Owner = types.NamespacedName{Name: "owner", Namespace: "ns"}
+					h.Labels = map[string]string{"team": "payments", "cost-center": "42"}
+					h.Annotations = map[string]string{"example.com/owner-team": "payments"}
+				})
+			}
+
+			It("adds the propagated labels and annotations to the created destination rule", func() {
+				handler := mkHandler()
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Labels).To(Equal(map[string]string{"team": "payments", "cost-center": "42", "version": "version"}))
+				Expect(created[0].Annotations).To(HaveKeyWithValue("example.com/owner-team", "payments"))
+				Expect(created[0].Annotations).To(HaveKeyWithValue(watches.NamespacedNameAnnotation, "ns/owner"))
+			})
+
+			It("keeps the version label and ownership annotation on conflict", func() {
+				handler := mkHandler()
+				handler.Labels["version"] = "other"
+				handler.Annotations[watches.NamespacedNameAnnotation] = "ns/other"
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Labels).To(HaveKeyWithValue("version", "version"))
+				Expect(created[0].Annotations).To(HaveKeyWithValue(watches.NamespacedNameAnnotation, "ns/owner"))
+			})
+
+			It("records the owner under the configured ownership annotation", func() {
+				handler := mkHandler()
+				handler.OwnerAnnotation = "tenant.example.com/owners"
+				handler.OwnerUID = "uid"
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Annotations).To(HaveKeyWithValue("tenant.example.com/owners", "ns/owner"))
+				Expect(created[0].Annotations).To(HaveKeyWithValue("tenant.example.com/owners-uids", "ns/owner=uid"))
+				Expect(created[0].Annotations).NotTo(HaveKey(watches.NamespacedNameAnnotation))
+			})
+
+			It("does not add the propagated labels to shared destination rules", func() {
+				handler := mkHandler()
+				handler.SharedDestinationRules = true
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Labels).NotTo(HaveKey("team"))
+				Expect(created[0].Annotations).NotTo(HaveKey("example.com/owner-team"))
+			})
+
+			It("adds the propagated labels to an existing destination rule missing them", func() {
+				var updated []*istionetwork.DestinationRule
+				handler := mkHandler()
+				mc := handler.Client.(MockClient)
+				existing := &istionetwork.DestinationRule{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "unique-details",
+						Namespace:   "ns",
+						Labels:      map[string]string{"version": "version"},
+						Annotations: map[string]string{watches.NamespacedNameAnnotation: "ns/owner"},
+					},
+					Spec: v1alpha3.DestinationRule{
+						Host:    "details",
+						Subsets: []*v1alpha3.Subset{{Name: "version", Labels: map[string]string{"version": "version"}}},
+					},
+				}
+				mc.getMethod = func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					existing.DeepCopyInto(o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				mc.updateMethod = func(_ context.Context, o client.Object, _ ...client.UpdateOption) error {
+					updated = append(updated, o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				handler.Client = mc
+				handler.Labels = map[string]string{"team": "payments"}
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(updated[0].Labels).To(Equal(map[string]string{"team": "payments", "version": "version"}))
+				Expect(updated[0].Annotations).To(HaveKeyWithValue("example.com/owner-team", "payments"))
+			})
+		})
+
+		Context("namespace scoping", func() {
+			var created []string
+			var recorder *record.FakeRecorder
+
+			mkHandler := func() handlers.DestinationRuleHandler {
+				created = nil
+				recorder = record.NewFakeRecorder(10)
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+						created = append(created, o.GetNamespace()+"/"+o.GetName())
+						return nil
+					}
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.Recorder = recorder
+				})
+			}
+
+			expectNotAllowed := func(handler handlers.DestinationRuleHandler) {
+				err := handler.Handle()
+				var notAllowed handlers.NamespaceNotAllowed
+				Expect(goerrors.As(err, &notAllowed)).To(BeTrue())
+				Expect(notAllowed.Namespace).To(Equal("ns"))
+				Expect(created).To(BeEmpty())
+				Expect(recorder.Events).To(Receive(HavePrefix("Warning " + names.NamespaceNotAllowedReason)))
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.NamespaceNotAllowed))
+			}
+
+			It("creates destination rules in all namespaces by default", func() {
+				handler := mkHandler()
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(Equal([]string{"ns/unique-details"}))
+			})
+
+			It("creates destination rules in allowed namespaces", func() {
+				handler := mkHandler()
+				handler.AllowedNamespaces = []string{"other", "ns"}
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(Equal([]string{"ns/unique-details"}))
+			})
+
+			It("does not create destination rules in namespaces missing from the allowlist", func() {
+				handler := mkHandler()
+				handler.AllowedNamespaces = []string{"other"}
+				expectNotAllowed(handler)
+			})
+
+			It("does not create destination rules in denied namespaces", func() {
+				handler := mkHandler()
+				handler.DeniedNamespaces = []string{"ns"}
+				expectNotAllowed(handler)
+			})
+
+			It("prefers the denylist over the allowlist", func() {
+				handler := mkHandler()
+				handler.AllowedNamespaces = []string{"ns"}
+				handler.DeniedNamespaces = []string{"ns"}
+				expectNotAllowed(handler)
+			})
+
+			It("does not create shared destination rules in denied namespaces", func() {
+				handler := mkHandler()
+				handler.SharedDestinationRules = true
+				handler.DeniedNamespaces = []string{"ns"}
+				expectNotAllowed(handler)
+			})
+		})
+
+		Context("superseded generations", func() {
+			It("does not write anything when reconciling a superseded generation", func() {
+				writes := 0
+				mc := struct{ MockClient }{}
+				mc.getMethod = func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					if de, ok := o.(*riskifiedv1alpha1.DynamicEnv); ok {
+						de.Generation = 3
+						return nil
+					}
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				mc.listMethod = func(context.Context, client.ObjectList, ...client.ListOption) error {
+					Fail("should not look for base destination rules")
+					return nil
+				}
+				mc.createMethod = func(context.Context, client.Object, ...client.CreateOption) error {
+					writes++
+					return nil
+				}
+				mc.statusUpdateMethod = func(context.Context, client.Object, ...client.SubResourceUpdateOption) error {
+					writes++
+					return nil
+				}
+				de := &riskifiedv1alpha1.DynamicEnv{}
+				de.Generation = 2
+				handler := handlers.DestinationRuleHandler{
+					Client:         mc,
+					UniqueName:     "unique",
+					UniqueVersion:  "version",
+					Namespace:      "ns",
+					VersionLabel:   "version",
+					DefaultVersion: "shared",
+					ServiceHosts:   []string{"details"},
+					StatusHandler:  &handlers.DynamicEnvStatusHandler{Client: mc, Ctx: context.Background(), DynamicEnv: de},
+					Log:            logr.Discard(),
+				}
+				err := handler.Handle()
+				Expect(err).To(MatchError(handlers.SupersededGeneration{Generation: 2, Latest: 3}))
+				Expect(writes).To(BeZero())
+				Expect(de.Status.SubsetsStatus).To(BeEmpty())
+			})
+		})
+
+		Context("per host errors", func() {
+			var created []string
+
+			mkHandler := func(failing ...string) handlers.DestinationRuleHandler {
+				created = nil
+				details := fixtureDestinationRule()
+				reviews := details.DeepCopy()
+				reviews.Name, reviews.Spec.Host = "reviews", "reviews"
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules(details, reviews)
+					mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+						if helpers.StringSliceContains(key.Name, failing) {
+							return errors.NewForbidden(schema.GroupResource{Resource: "destinationrules"}, key.Name, fmt.Errorf("denied"))
+						}
+						return errors.NewNotFound(schema.GroupResource{}, key.Name)
+					}
+					mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+						created = append(created, o.GetName())
+						return nil
+					}
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.ServiceHosts = []string{"details", "reviews"}
+				})
+			}
+
+			It("keeps handling the other hosts when one of them fails", func() {
+				handler := mkHandler("unique-details")
+				err := handler.Handle()
+				Expect(err).To(MatchError(ContainSubstring("details")))
+				Expect(errors.IsForbidden(err)).To(BeTrue())
+				Expect(created).To(Equal([]string{"unique-reviews"}))
+				Expect(handler.ActiveHosts()).To(Equal([]string{"reviews"}))
+				recorded := handler.StatusHandler.DynamicEnv.Status.SubsetsStatus["unique"].DestinationRules
+				Expect(recorded).To(HaveLen(1))
+				Expect(recorded[0].Name).To(Equal("unique-reviews"))
+			})
+
+			It("combines the errors of all the failing hosts", func() {
+				handler := mkHandler("unique-details", "unique-reviews")
+				err := handler.Handle()
+				var hostErrors handlers.HostErrors
+				Expect(goerrors.As(err, &hostErrors)).To(BeTrue())
+				Expect(hostErrors).To(HaveLen(2))
+				Expect(err.Error()).To(ContainSubstring("(details)"))
+				Expect(err.Error()).To(ContainSubstring("(reviews)"))
+				Expect(created).To(BeEmpty())
+			})
+		})
+
+		It("matches any of the combined host errors", func() {
+			err := handlers.HostErrors{
+				fmt.Errorf("first: %w", handlers.NamespaceNotAllowed{Namespace: "ns"}),
+				fmt.Errorf("second: %w", context.DeadlineExceeded),
+			}
+			Expect(err.Error()).To(Equal(`first: creating destination rules in namespace "ns" is not allowed; second: context deadline exceeded`))
+			Expect(goerrors.As(err, &handlers.NamespaceNotAllowed{})).To(BeTrue())
+			Expect(goerrors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(goerrors.Is(err, context.Canceled)).To(BeFalse())
+		})
+
+		Context("transient API errors", func() {
+			mkHandler := func(mc client.Client) handlers.DestinationRuleHandler {
+				return mkDestinationRuleHandler(nil, withClient(mc))
+			}
+			mkClient := func() MockClient {
+				mc := MockClient{}
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+					Expect(err).To(BeNil())
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+					return nil
+				}
+				mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				return mc
+			}
+
+			It("retries creating the destination rule after a conflict", func() {
+				attempts := 0
+				mc := mkClient()
+				mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+					attempts++
+					if attempts == 1 {
+						return errors.NewConflict(schema.GroupResource{}, o.GetName(), fmt.Errorf("conflict"))
+					}
+					return nil
+				}
+				handler := mkHandler(mc)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(attempts).To(Equal(2))
+				Expect(handler.GetHosts()).To(Equal([]string{"details"}))
+			})
+
+			It("retries fetching the destination rule when throttled", func() {
+				attempts := 0
+				mc := mkClient()
+				mc.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+					attempts++
+					if attempts == 1 {
+						return errors.NewTooManyRequests("slow down", 0)
+					}
+					return errors.NewNotFound(schema.GroupResource{}, "error")
+				}
+				handler := mkHandler(mc)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(attempts).To(Equal(2))
+			})
+
+			It("does not retry fatal errors", func() {
+				attempts := 0
+				mc := mkClient()
+				mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+					attempts++
+					return errors.NewBadRequest("invalid")
+				}
+				handler := mkHandler(mc)
+				Expect(handler.Handle()).NotTo(Succeed())
+				Expect(attempts).To(Equal(1))
+			})
+
+			It("treats an already existing destination rule as found", func() {
+				var updated []*istionetwork.DestinationRule
+				created := false
+				mc := mkClient()
+				mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+					created = true
+					return errors.NewAlreadyExists(schema.GroupResource{}, o.GetName())
+				}
+				mc.getMethod = func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					if !created {
+						return errors.NewNotFound(schema.GroupResource{}, "error")
+					}
+					existing := &istionetwork.DestinationRule{
+						ObjectMeta: metav1.ObjectMeta{Name: "unique-details", Namespace: "ns"},
+						Spec:       v1alpha3.DestinationRule{Host: "details"},
+					}
+					existing.DeepCopyInto(o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				mc.updateMethod = func(_ context.Context, o client.Object, _ ...client.UpdateOption) error {
+					updated = append(updated, o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				handler := mkHandler(mc)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(updated[0].Spec.Subsets).To(HaveLen(1))
+				Expect(handler.GetHosts()).To(Equal([]string{"details"}))
+			})
+		})
+
+		Context("destination rules in a separate namespace", func() {
+			var listedNamespaces, fetchedNamespaces []string
+			var created []*istionetwork.DestinationRule
+			var statusHandler *handlers.DynamicEnvStatusHandler
+			mkHandler := func(baseHost string) handlers.DestinationRuleHandler {
+				listedNamespaces, fetchedNamespaces, created = nil, nil, nil
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = func(_ context.Context, o client.ObjectList, opts ...client.ListOption) error {
+						lo := &client.ListOptions{}
+						lo.ApplyOptions(opts)
+						listedNamespaces = append(listedNamespaces, lo.Namespace)
+						o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{
+							mkBaseDestinationRule("details", "istio-config", baseHost),
+						}
+						return nil
+					}
+					mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+						fetchedNamespaces = append(fetchedNamespaces, key.Namespace)
+						return errors.NewNotFound(schema.GroupResource{}, key.Name)
+					}
+					mc.createMethod = recordingCreated(&created)
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.Namespace = "team"
+					h.DestinationRuleNamespace = "istio-config"
+					h.ClusterDomain = "cluster.local"
+					h.Owner = types.NamespacedName{Name: "owner", Namespace: "team"}
+					statusHandler = h.StatusHandler
+				})
+			}
+
+			It("locates the base destination rule and creates ours in the destination rule namespace", func() {
+				handler := mkHandler("details.team.svc.cluster.local")
+				Expect(handler.Handle()).To(Succeed())
+				Expect(listedNamespaces).To(ConsistOf("istio-config"))
+				Expect(fetchedNamespaces).NotTo(BeEmpty())
+				for _, ns := range fetchedNamespaces {
+					Expect(ns).To(Equal("istio-config"))
+				}
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Namespace).To(Equal("istio-config"))
+				Expect(created[0].Spec.Host).To(Equal("details.team.svc.cluster.local"))
+				recorded := statusHandler.DynamicEnv.Status.SubsetsStatus["unique"].DestinationRules
+				Expect(recorded).To(HaveLen(1))
+				Expect(recorded[0].Namespace).To(Equal("istio-config"))
+			})
+
+			It("records our UID without an owner reference across namespaces", func() {
+				handler := mkHandler("details.team.svc.cluster.local")
+				handler.OwnerUID = "uid"
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].OwnerReferences).To(BeEmpty())
+				Expect(watches.ContainsOwner(handler.Owner, "uid", created[0])).To(BeTrue())
+				Expect(watches.ContainsOwner(handler.Owner, "other-uid", created[0])).To(BeFalse())
+			})
+
+			It("does not match short base hosts of the destination rule namespace", func() {
+				// A short host in the central namespace refers to a service of that namespace
+				handler := mkHandler("details")
+				Expect(handler.Handle()).NotTo(Succeed())
+				Expect(created).To(BeEmpty())
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.IgnoredMissingDR))
+			})
+
+			It("defaults to the subset namespace", func() {
+				handler := mkHandler("details")
+				handler.DestinationRuleNamespace = ""
+				_, _ = handler.GetStatus()
+				Expect(fetchedNamespaces).To(ConsistOf("team"))
+			})
+		})
+
+		Context("destination rule namespaces per host", func() {
+			var listedNamespaces []string
+			var created []*istionetwork.DestinationRule
+			mkHandler := func() handlers.DestinationRuleHandler {
+				listedNamespaces, created = nil, nil
+				bases := map[string]*istionetwork.DestinationRule{
+					"team":         mkBaseDestinationRule("details", "team", "details"),
+					"istio-config": mkBaseDestinationRule("reviews", "istio-config", "reviews.team.svc.cluster.local"),
+				}
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = func(_ context.Context, o client.ObjectList, opts ...client.ListOption) error {
+						lo := &client.ListOptions{}
+						lo.ApplyOptions(opts)
+						listedNamespaces = append(listedNamespaces, lo.Namespace)
+						o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{bases[lo.Namespace].DeepCopy()}
+						return nil
+					}
+					mc.getMethod = func(_ context.Context, key types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+						for _, dr := range created {
+							if dr.Name == key.Name && dr.Namespace == key.Namespace {
+								dr.DeepCopyInto(o.(*istionetwork.DestinationRule))
+								return nil
+							}
+						}
+						return errors.NewNotFound(schema.GroupResource{}, key.Name)
+					}
+					mc.createMethod = recordingCreated(&created)
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.Namespace = "team"
+					h.DestinationRuleNamespacesByHost = map[string]string{"reviews": "istio-config"}
+					h.ServiceHosts = []string{"details", "reviews"}
+					h.ClusterDomain = "cluster.local"
+					h.Owner = types.NamespacedName{Name: "owner", Namespace: "team"}
+				})
+			}
+
+			It("locates the base destination rule of each host in its own namespace", func() {
+				handler := mkHandler()
+				Expect(handler.Handle()).To(Succeed())
+				Expect(listedNamespaces).To(ConsistOf("team", "istio-config"))
+				Expect(handler.GetHosts()).To(ConsistOf("details", "reviews"))
+			})
+
+			It("creates our destination rules next to the base destination rules", func() {
+				handler := mkHandler()
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(2))
+				namespaces := map[string]string{}
+				for _, dr := range created {
+					namespaces[dr.Spec.Host] = dr.Namespace
+				}
+				Expect(namespaces).To(Equal(map[string]string{
+					"details":                        "team",
+					"reviews.team.svc.cluster.local": "istio-config",
+				}))
+			})
+
+			It("reports the status of each host in its own namespace", func() {
+				handler := mkHandler()
+				Expect(handler.Handle()).To(Succeed())
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(2))
+				for _, st := range statuses {
+					Expect(st.Status).To(Equal(riskifiedv1alpha1.Running))
+				}
+				Expect(statuses[0].Namespace).To(Equal("team"))
+				Expect(statuses[1].Namespace).To(Equal("istio-config"))
+			})
+
+			It("cleans up all the namespaces", func() {
+				handler := mkHandler()
+				Expect(handler.Cleanup()).To(Succeed())
+				Expect(listedNamespaces).To(Equal([]string{"istio-config", "team"}))
+			})
+		})
+
+		Context("invalid service hosts", func() {
+			var gets []string
+			var created []*istionetwork.DestinationRule
+			mkHandler := func(hosts ...string) handlers.DestinationRuleHandler {
+				gets, created = nil, nil
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules(mkBaseDestinationRule("details", "team", "details"))
+					mc.getMethod = func(_ context.Context, key types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+						gets = append(gets, key.Name)
+						for _, dr := range created {
+							if dr.Name == key.Name && dr.Namespace == key.Namespace {
+								dr.DeepCopyInto(o.(*istionetwork.DestinationRule))
+								return nil
+							}
+						}
+						return errors.NewNotFound(schema.GroupResource{}, key.Name)
+					}
+					mc.createMethod = recordingCreated(&created)
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.Namespace = "team"
+					h.ServiceHosts = hosts
+					h.ClusterDomain = "cluster.local"
+					h.Owner = types.NamespacedName{Name: "owner", Namespace: "team"}
+				})
+			}
+
+			DescribeTable(
+				"skips the invalid host and reports it",
+				func(host string) {
+					handler := mkHandler("details", host)
+					err := handler.Handle()
+					var invalid handlers.InvalidServiceHost
+					Expect(goerrors.As(err, &invalid)).To(BeTrue())
+					Expect(invalid.Host).To(Equal(host))
+					Expect(created).To(HaveLen(1))
+					Expect(created[0].Spec.Host).To(Equal("details"))
+					Expect(gets).To(Equal([]string{"unique-details"}))
+				},
+				Entry("empty host", ""),
+				Entry("illegal host", "details_v1.team"),
+			)
+
+			It("reports the invalid hosts as failed", func() {
+				handler := mkHandler("details", "", "Details..team")
+				Expect(handler.Handle()).NotTo(Succeed())
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				byHost := map[string]riskifiedv1alpha1.LifeCycleStatus{}
+				for _, st := range statuses {
+					byHost[st.ServiceHost] = st.Status
+				}
+				Expect(byHost).To(Equal(map[string]riskifiedv1alpha1.LifeCycleStatus{
+					"details":       riskifiedv1alpha1.Running,
+					"":              riskifiedv1alpha1.Failed,
+					"Details..team": riskifiedv1alpha1.Failed,
+				}))
+				Expect(handlers.AggregateDestinationRuleStatuses(statuses)).To(Equal(riskifiedv1alpha1.Failed))
+			})
+
+			It("combines the errors of all the invalid hosts", func() {
+				handler := mkHandler("", "details_v1.team")
+				err := handler.Handle()
+				var hostErrors handlers.HostErrors
+				Expect(goerrors.As(err, &hostErrors)).To(BeTrue())
+				Expect(hostErrors).To(HaveLen(2))
+				Expect(err.Error()).To(ContainSubstring("service host is empty"))
+				Expect(err.Error()).To(ContainSubstring(`invalid service host "details_v1.team"`))
+			})
+		})
+
+		Context("inspecting the handled hosts", func() {
+			mkHandler := func() handlers.DestinationRuleHandler {
+				return mkDestinationRuleHandler(nil, func(h *handlers.DestinationRuleHandler) {
+					h.ServiceHosts = []string{"details", "reviews", "ratings"}
+					h.Owner = types.NamespacedName{Name: "owner", Namespace: "ns"}
+				})
+			}
+
+			It("returns the active and ignored missing hosts", func() {
+				handler := mkHandler()
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.ActiveHosts()).To(Equal([]string{"details"}))
+				Expect(handler.IgnoredMissingHosts()).To(Equal([]string{"reviews", "ratings"}))
+				Expect(handler.ActiveHosts()).To(Equal(handler.GetHosts()))
+			})
+
+			It("returns copies of the hosts", func() {
+				handler := mkHandler()
+				Expect(handler.Handle()).To(Succeed())
+				handler.ActiveHosts()[0] = "changed"
+				handler.IgnoredMissingHosts()[0] = "changed"
+				Expect(handler.ActiveHosts()).To(Equal([]string{"details"}))
+				Expect(handler.IgnoredMissingHosts()).To(Equal([]string{"reviews", "ratings"}))
+			})
+		})
+
+		Context("listing base destination rules", func() {
+			It("lists the destination rules once for all hosts sharing a base rule", func() {
+				var lists int
+				var created []*istionetwork.DestinationRule
+				mc := MockClient{}
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					lists++
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{
+						{
+							ObjectMeta: metav1.ObjectMeta{Name: "wildcard", Namespace: "ns"},
+							Spec: v1alpha3.DestinationRule{
+								Host:    "*.ns.svc.cluster.local",
+								Subsets: []*v1alpha3.Subset{{Name: "shared", Labels: map[string]string{"version": "shared"}}},
+							},
+						},
+					}
+					return nil
+				}
+				mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+					return errors.NewNotFound(schema.GroupResource{}, key.Name)
+				}
+				mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+					created = append(created, o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				handler := handlers.DestinationRuleHandler{
+					Client:         mc,
+					UniqueName:     "unique",
+					UniqueVersion:  "version",
+					Namespace:      "ns",
+					VersionLabel:   "version",
+					DefaultVersion: "shared",
+					ServiceHosts:   []string{"details", "reviews", "ratings"},
+					ClusterDomain:  "cluster.local",
+					Owner:          types.NamespacedName{Name: "owner", Namespace: "ns"},
+					StatusHandler: &handlers.DynamicEnvStatusHandler{
+						Client:     mc,
+						Ctx:        context.Background(),
+						DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+					},
+					Log: logr.Discard(),
+				}
+				Expect(handler.Handle()).To(Succeed())
+				Expect(lists).To(Equal(1))
+				var hosts []string
+				for _, dr := range created {
+					hosts = append(hosts, dr.Spec.Host)
+				}
+				Expect(hosts).To(ConsistOf(
+					"details.ns.svc.cluster.local", "reviews.ns.svc.cluster.local", "ratings.ns.svc.cluster.local"))
+
+				// Every Handle sees the current base rules
+				Expect(handler.Handle()).To(Succeed())
+				Expect(lists).To(Equal(2))
+			})
+
+			It("discovers the base destination rules through the base lookup reader", func() {
+				var created []*istionetwork.DestinationRule
+				mc := MockClient{}
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					Fail("the base destination rules should not be listed through the main client")
+					return nil
+				}
+				mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+					return errors.NewNotFound(schema.GroupResource{}, key.Name)
+				}
+				mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+					created = append(created, o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				configCluster := MockClient{}
+				configCluster.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+					Expect(err).To(BeNil())
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+					return nil
+				}
+				handler := handlers.DestinationRuleHandler{
+					Client:           mc,
+					BaseLookupReader: configCluster,
+					UniqueName:       "unique",
+					UniqueVersion:    "version",
+					Namespace:        "ns",
+					VersionLabel:     "version",
+					DefaultVersion:   "shared",
+					ServiceHosts:     []string{"details"},
+					StatusHandler: &handlers.DynamicEnvStatusHandler{
+						Client:     mc,
+						Ctx:        context.Background(),
+						DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+					},
+					Log: logr.Discard(),
+				}
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Name).To(Equal("unique-details"))
+				Expect(created[0].Spec.Host).To(Equal("details"))
+			})
+		})
+
+		Context("operation timeouts", func() {
+			var calls int
+			mkHandler := func(ctx context.Context, blockingGet bool) handlers.DestinationRuleHandler {
+				calls = 0
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.getMethod = func(ctx context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+						calls++
+						if blockingGet {
+							<-ctx.Done()
+							return ctx.Err()
+						}
+						return errors.NewNotFound(schema.GroupResource{}, key.Name)
+					}
+					mc.listMethod = func(_ context.Context, _ client.ObjectList, _ ...client.ListOption) error {
+						calls++
+						return nil
+					}
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.Owner = types.NamespacedName{Name: "owner", Namespace: "ns"}
+					h.Ctx = ctx
+				})
+			}
+
+			It("does not call the client with an already canceled context", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				handler := mkHandler(ctx, false)
+				err := handler.Handle()
+				Expect(err).To(MatchError(ContainSubstring("operation canceled")))
+				Expect(goerrors.Is(err, context.Canceled)).To(BeTrue())
+				Expect(calls).To(BeZero())
+			})
+
+			It("reports calls exceeding the operation timeout", func() {
+				handler := mkHandler(context.Background(), true)
+				handler.OperationTimeout = 10 * time.Millisecond
+				err := handler.Handle()
+				Expect(err).To(MatchError(ContainSubstring("operation timed out (after 10ms)")))
+				Expect(goerrors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+				Expect(calls).To(Equal(1))
+			})
+		})
+
+		Context("write rate limiting", func() {
+			var createdAt []time.Time
+			mkHandler := func(ctx context.Context, limiter *rate.Limiter) handlers.DestinationRuleHandler {
+				createdAt = nil
+				hosts := []string{"details", "reviews", "ratings"}
+				var items []*istionetwork.DestinationRule
+				for _, host := range hosts {
+					items = append(items, mkBaseDestinationRule(host, "ns", host))
+				}
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules(items...)
+					mc.createMethod = func(context.Context, client.Object, ...client.CreateOption) error {
+						createdAt = append(createdAt, time.Now())
+						return nil
+					}
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.ServiceHosts = hosts
+					h.WriteLimiter = limiter
+					h.Ctx = ctx
+				})
+			}
+
+			It("throttles the creation of destination rules", func() {
+				interval := 50 * time.Millisecond
+				handler := mkHandler(context.Background(), rate.NewLimiter(rate.Every(interval), 1))
+				Expect(handler.Handle()).To(Succeed())
+				Expect(createdAt).To(HaveLen(3))
+				for i := 1; i < len(createdAt); i++ {
+					Expect(createdAt[i].Sub(createdAt[i-1])).To(BeNumerically(">=", interval*8/10), "create %d", i)
+				}
+			})
+
+			It("does not throttle without a limiter", func() {
+				handler := mkHandler(context.Background(), nil)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(createdAt).To(HaveLen(3))
+			})
+
+			It("stops waiting once the context is canceled", func() {
+				limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(50*time.Millisecond, cancel)
+				handler := mkHandler(ctx, limiter)
+				start := time.Now()
+				err := handler.Handle()
+				Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+				Expect(err).To(MatchError(ContainSubstring("operation canceled")))
+				Expect(createdAt).To(HaveLen(1))
+			})
+		})
+
+		Context("concurrent hosts", func() {
+			// Even hosts have base destination rules, odd ones are missing them
+			var hosts []string
+			for i := 0; i < 50; i++ {
+				hosts = append(hosts, fmt.Sprintf("service-%02d", i))
+			}
+			var mu sync.Mutex
+			var created []string
+			var inFlight, maxInFlight int
+			mkHandler := func(concurrency int) handlers.DestinationRuleHandler {
+				created, inFlight, maxInFlight = nil, 0, 0
+				var items []*istionetwork.DestinationRule
+				for i := 0; i < len(hosts); i += 2 {
+					items = append(items, mkBaseDestinationRule(hosts[i], "ns", hosts[i]))
+				}
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules(items...)
+					mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+						mu.Lock()
+						inFlight++
+						if inFlight > maxInFlight {
+							maxInFlight = inFlight
+						}
+						mu.Unlock()
+						time.Sleep(5 * time.Millisecond)
+						mu.Lock()
+						defer mu.Unlock()
+						inFlight--
+						created = append(created, o.(*istionetwork.DestinationRule).Spec.Host)
+						return nil
+					}
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.ServiceHosts = hosts
+					h.Owner = types.NamespacedName{Name: "owner", Namespace: "owner-ns"}
+					h.HostConcurrency = concurrency
+					h.FeatureGates = features.Gates{features.ConcurrentHosts: true}
+					h.Ctx = context.Background()
+				})
+			}
+			var withBase, withoutBase []string
+			for i, host := range hosts {
+				if i%2 == 0 {
+					withBase = append(withBase, host)
+				} else {
+					withoutBase = append(withoutBase, host)
+				}
+			}
+
+			It("handles all the hosts with bounded concurrency", func() {
+				handler := mkHandler(8)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(ConsistOf(withBase))
+				Expect(maxInFlight).To(BeNumerically(">", 1))
+				Expect(maxInFlight).To(BeNumerically("<=", 8))
+			})
+
+			It("keeps the outcomes in the order of the hosts", func() {
+				handler := mkHandler(8)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.ActiveHosts()).To(Equal(withBase))
+				Expect(handler.IgnoredMissingHosts()).To(Equal(withoutBase))
+				Expect(handler.GetSubsetNames()).To(HaveLen(len(withBase)))
+				var statusHosts []string
+				for _, s := range handler.StatusHandler.DynamicEnv.Status.SubsetsStatus["unique"].DestinationRules {
+					statusHosts = append(statusHosts, s.ServiceHost)
+				}
+				Expect(statusHosts).To(Equal(hosts))
+			})
+
+			It("handles the hosts sequentially when the feature gate is off", func() {
+				handler := mkHandler(8)
+				handler.FeatureGates = nil
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(Equal(withBase))
+				Expect(maxInFlight).To(Equal(1))
+			})
+
+			It("has the same outcomes as handling the hosts sequentially", func() {
+				sequential := mkHandler(1)
+				Expect(sequential.Handle()).To(Succeed())
+				Expect(maxInFlight).To(Equal(1))
+				concurrent := mkHandler(8)
+				Expect(concurrent.Handle()).To(Succeed())
+				Expect(concurrent.ActiveHosts()).To(Equal(sequential.ActiveHosts()))
+				Expect(concurrent.IgnoredMissingHosts()).To(Equal(sequential.IgnoredMissingHosts()))
+				Expect(concurrent.GetSubsetNames()).To(Equal(sequential.GetSubsetNames()))
+				Expect(concurrent.StatusHandler.DynamicEnv.Status).To(Equal(sequential.StatusHandler.DynamicEnv.Status))
+			})
+
+			It("reports the errors of all the failed hosts in the order of the hosts", func() {
+				handler := mkHandler(8)
+				mc := handler.Client.(MockClient)
+				mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+					return fmt.Errorf("failed creating %s", o.(*istionetwork.DestinationRule).Spec.Host)
+				}
+				handler.Client = mc
+				err := handler.Handle()
+				Expect(err).To(HaveOccurred())
+				var previous int
+				for _, host := range withBase {
+					i := strings.Index(err.Error(), "failed creating "+host)
+					Expect(i).To(BeNumerically(">", previous), host)
+					previous = i
+				}
+			})
+		})
+
+		It("handles the different forms of a service host once", func() {
+			var created []*istionetwork.DestinationRule
+			mc := MockClient{}
+			mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+				dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+				return nil
+			}
+			mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+				return errors.NewNotFound(schema.GroupResource{}, key.Name)
+			}
+			mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+				created = append(created, o.(*istionetwork.DestinationRule))
+				return nil
+			}
+			handler := handlers.DestinationRuleHandler{
+				Client:         mc,
+				UniqueName:     "unique",
+				UniqueVersion:  "version",
+				Namespace:      "ns",
+				VersionLabel:   "version",
+				DefaultVersion: "shared",
+				ServiceHosts:   []string{"details", "details.ns", "details.ns.svc.cluster.local"},
+				Log:            logr.Discard(),
+			}
+			Expect(handler.Handle()).To(Succeed())
+			Expect(created).To(HaveLen(1))
+			Expect(handler.ActiveHosts()).To(Equal([]string{"details"}))
+			Expect(handler.GetHosts()).To(Equal([]string{"details"}))
+		})
+
+		It("locates the lower case base destination rule of a mixed case service host", func() {
+			var created []*istionetwork.DestinationRule
+			mc := MockClient{}
+			mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+				dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+				return nil
+			}
+			mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+				return errors.NewNotFound(schema.GroupResource{}, key.Name)
+			}
+			mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+				created = append(created, o.(*istionetwork.DestinationRule))
+				return nil
+			}
+			handler := handlers.DestinationRuleHandler{
+				Client:         mc,
+				UniqueName:     "unique",
+				UniqueVersion:  "version",
+				Namespace:      "ns",
+				VersionLabel:   "version",
+				DefaultVersion: "shared",
+				ServiceHosts:   []string{"Details.NS.svc.cluster.local"},
+				Log:            logr.Discard(),
+			}
+			Expect(handler.Handle()).To(Succeed())
+			Expect(handler.IgnoredMissingHosts()).To(BeEmpty())
+			Expect(handler.ActiveHosts()).To(Equal([]string{"Details.NS.svc.cluster.local"}))
+			Expect(created).To(HaveLen(1))
+			Expect(created[0].Spec.Host).To(Equal("details"))
+		})
+
+		It("handles IPv6 service hosts", func() {
+			var created []*istionetwork.DestinationRule
+			mc := MockClient{}
+			mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+				base, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+				Expect(err).To(BeNil())
+				base.Name, base.Spec.Host = "legacy", "2001:db8:0:0:0:0:0:1"
+				o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{base}
+				return nil
+			}
+			mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+				return errors.NewNotFound(schema.GroupResource{}, key.Name)
+			}
+			mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+				created = append(created, o.(*istionetwork.DestinationRule))
+				return nil
+			}
+			handler := handlers.DestinationRuleHandler{
+				Client:         mc,
+				UniqueName:     "unique",
+				UniqueVersion:  "version",
+				Namespace:      "ns",
+				VersionLabel:   "version",
+				DefaultVersion: "shared",
+				ServiceHosts:   []string{"[2001:DB8::1]"},
+				Log:            logr.Discard(),
+			}
+			Expect(handler.Handle()).To(Succeed())
+			Expect(created).To(HaveLen(1))
+			Expect(created[0].Name).To(Equal("unique-2001-db8--1"))
+			Expect(created[0].Spec.Host).To(Equal("2001:db8:0:0:0:0:0:1"))
+			Expect(handler.ActiveHosts()).To(Equal([]string{"[2001:DB8::1]"}))
+		})
+
+		Context("NewDestinationRuleHandler", func() {
+			valid := func() handlers.DestinationRuleHandler {
+				mc := MockClient{}
+				return handlers.DestinationRuleHandler{
+					Client:         mc,
+					UniqueName:     "unique",
+					UniqueVersion:  "version",
+					Namespace:      "ns",
+					VersionLabel:   "version",
+					DefaultVersion: "shared",
+					Owner:          types.NamespacedName{Name: "owner", Namespace: "ns"},
+					StatusHandler: &handlers.DynamicEnvStatusHandler{
+						Client:     mc,
+						Ctx:        context.Background(),
+						DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+					},
+					Log: logr.Discard(),
+				}
+			}
+
+			It("returns a handler with all the required fields", func() {
+				handler, err := handlers.NewDestinationRuleHandler(valid())
+				Expect(err).To(BeNil())
+				Expect(handler.UniqueName).To(Equal("unique"))
+			})
+
+			It("reports all the missing fields", func() {
+				h := valid()
+				h.Client = nil
+				h.DefaultVersion = ""
+				h.StatusHandler = nil
+				handler, err := handlers.NewDestinationRuleHandler(h)
+				Expect(handler).To(BeNil())
+				Expect(err).To(MatchError(handlers.MissingRequiredFields{
+					Handler: "DestinationRuleHandler",
+					Fields:  []string{"Client", "DefaultVersion", "StatusHandler"},
+				}))
+				Expect(err.Error()).To(Equal("DestinationRuleHandler is missing required fields: Client, DefaultVersion, StatusHandler"))
+			})
+
+			It("requires the dynamic environment of the status handler and the owner", func() {
+				h := valid()
+				h.StatusHandler.DynamicEnv = nil
+				h.Owner = types.NamespacedName{Name: "owner"}
+				_, err := handlers.NewDestinationRuleHandler(h)
+				Expect(err).To(MatchError(handlers.MissingRequiredFields{
+					Handler: "DestinationRuleHandler",
+					Fields:  []string{"StatusHandler.DynamicEnv", "Owner"},
+				}))
+			})
+
+			It("does not fail creating destination rules without a status handler", func() {
+				mc := MockClient{}
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					details, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+					Expect(err).To(BeNil())
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{details}
+					return nil
+				}
+				mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+					return errors.NewNotFound(schema.GroupResource{}, key.Name)
+				}
+				var created []string
+				mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+					created = append(created, o.GetName())
+					return nil
+				}
+				h := valid()
+				h.Client = mc
+				h.StatusHandler = nil
+				h.ServiceHosts = []string{"details"}
+				Expect(h.Handle()).To(Succeed())
+				Expect(created).To(Equal([]string{"unique-details"}))
+				Expect(h.ApplyStatus(nil)).To(Succeed())
+			})
+		})
+
+		Context("partial status", func() {
+			var persisted []riskifiedv1alpha1.ResourceStatus
+
+			// Cancels the context once the DestinationRule of `cancelAt` is fetched
+			mkHandler := func(cancelAt string) handlers.DestinationRuleHandler {
+				persisted = nil
+				ctx, cancel := context.WithCancel(context.Background())
+				DeferCleanup(cancel)
+				var items []*istionetwork.DestinationRule
+				for _, host := range []string{"details", "reviews", "ratings"} {
+					dr := fixtureDestinationRule()
+					dr.Name, dr.Spec.Host = host, host
+					items = append(items, dr)
+				}
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules(items...)
+					mc.getMethod = func(ctx context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+						if key.Name == cancelAt {
+							cancel()
+							return ctx.Err()
+						}
+						return errors.NewNotFound(schema.GroupResource{}, key.Name)
+					}
+					mc.statusUpdateMethod = func(ctx context.Context, o client.Object, _ ...client.SubResourceUpdateOption) error {
+						if err := ctx.Err(); err != nil {
+							return err
+						}
+						persisted = o.(*riskifiedv1alpha1.DynamicEnv).Status.DeepCopy().SubsetsStatus["unique"].DestinationRules
+						return nil
+					}
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.ServiceHosts = []string{"details", "reviews", "ratings"}
+					h.StatusHandler.Ctx = ctx
+					h.Ctx = ctx
+				})
+			}
+
+			persistedStatus := func(name string) riskifiedv1alpha1.LifeCycleStatus {
+				for _, s := range persisted {
+					if s.Name == name {
+						return s.Status
+					}
+				}
+				return ""
+			}
+
+			It("persists the status of the hosts handled before the reconcile was canceled", func() {
+				handler := mkHandler("unique-reviews")
+				err := handler.Handle()
+				Expect(goerrors.Is(err, context.Canceled)).To(BeTrue())
+				Expect(persisted).To(HaveLen(1))
+				Expect(persistedStatus("unique-details")).To(Equal(riskifiedv1alpha1.Running))
+			})
+
+			It("persists the statuses collected since the last flush once the context is done", func() {
+				handler := mkHandler("unique-ratings")
+				handler.StatusFlushInterval = time.Hour
+				err := handler.Handle()
+				Expect(goerrors.Is(err, context.Canceled)).To(BeTrue())
+				Expect(persisted).To(HaveLen(2))
+				Expect(persistedStatus("unique-details")).To(Equal(riskifiedv1alpha1.Running))
+				Expect(persistedStatus("unique-reviews")).To(Equal(riskifiedv1alpha1.Running))
+			})
+
+			It("applies the statuses even if the context is done", func() {
+				handler := mkHandler("unique-ratings")
+				_ = handler.Handle()
+				persisted = nil
+				statuses := []riskifiedv1alpha1.ResourceStatus{{Name: "unique-ratings", Namespace: "ns", Status: riskifiedv1alpha1.Missing}}
+				Expect(handler.ApplyStatus(statuses)).To(Succeed())
+				Expect(persistedStatus("unique-ratings")).To(Equal(riskifiedv1alpha1.Missing))
+			})
+		})
+
+		Context("service entry hosts", func() {
+			var created []*istionetwork.DestinationRule
+			mkHandler := func(host string, serviceEntryHosts []string) handlers.DestinationRuleHandler {
+				created = nil
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+						switch list := o.(type) {
+						case *istionetwork.DestinationRuleList:
+							list.Items = []*istionetwork.DestinationRule{}
+						case *istionetwork.ServiceEntryList:
+							list.Items = []*istionetwork.ServiceEntry{
+								{
+									ObjectMeta: metav1.ObjectMeta{Name: "external-api", Namespace: "ns"},
+									Spec:       v1alpha3.ServiceEntry{Hosts: serviceEntryHosts},
+								},
+							}
+						}
+						return nil
+					}
+					mc.createMethod = recordingCreated(&created)
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.ServiceHosts = []string{host}
+					h.ServiceEntryHosts = true
+					h.Owner = types.NamespacedName{Name: "owner", Namespace: "ns"}
+				})
+			}
+
+			It("creates a destination rule bound to the service entry host", func() {
+				handler := mkHandler("api.example.com", []string{"api.example.com"})
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Spec.Host).To(Equal("api.example.com"))
+				Expect(created[0].Spec.TrafficPolicy).To(BeNil())
+				Expect(created[0].Spec.Subsets).To(HaveLen(1))
+				Expect(created[0].Spec.Subsets[0].Labels).To(HaveKeyWithValue("version", "version"))
+				Expect(created[0].Spec.Subsets[0].TrafficPolicy).To(BeNil())
+			})
+
+			It("uses a valid name for wildcard hosts", func() {
+				handler := mkHandler("*.example.com", []string{"*.example.com"})
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Spec.Host).To(Equal("*.example.com"))
+				Expect(validation.IsDNS1123Subdomain(created[0].Name)).To(BeEmpty())
+			})
+
+			It("ignores hosts that are not declared by service entries", func() {
+				handler := mkHandler("api.example.com", []string{"other.example.com"})
+				Expect(handler.Handle()).NotTo(Succeed())
+				Expect(created).To(BeEmpty())
+			})
+
+			It("ignores service entries unless enabled", func() {
+				handler := mkHandler("api.example.com", []string{"api.example.com"})
+				handler.ServiceEntryHosts = false
+				Expect(handler.Handle()).NotTo(Succeed())
+				Expect(created).To(BeEmpty())
+			})
+		})
+
+		Context("matching by service", func() {
+			var created []*istionetwork.DestinationRule
+			mkHandler := func(baseHost string, matchByService bool, services ...*corev1.Service) handlers.DestinationRuleHandler {
+				created = nil
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = listingDestinationRules(mkBaseDestinationRule("reviews", "ns", baseHost))
+					mc.getMethod = func(_ context.Context, key types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+						if svc, ok := o.(*corev1.Service); ok {
+							for _, s := range services {
+								if s.Namespace == key.Namespace && s.Name == key.Name {
+									s.DeepCopyInto(svc)
+									return nil
+								}
+							}
+						}
+						return errors.NewNotFound(schema.GroupResource{}, key.Name)
+					}
+					mc.createMethod = recordingCreated(&created)
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.ServiceHosts = []string{"reviews"}
+					h.MatchByService = matchByService
+				})
+			}
+			mkService := func(name string, externalName string) *corev1.Service {
+				svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns"}}
+				if externalName != "" {
+					svc.Spec.Type = corev1.ServiceTypeExternalName
+					svc.Spec.ExternalName = externalName
+				}
+				return svc
+			}
+
+			It("matches base destination rules whose host resolves to the same service", func() {
+				handler := mkHandler("reviews.ns.svc.mesh.internal", true, mkService("reviews", ""))
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.GetHosts()).To(Equal([]string{"reviews"}))
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Spec.Host).To(Equal("reviews.ns.svc.mesh.internal"))
+			})
+
+			It("matches base destination rules of services the host is an alias of", func() {
+				handler := mkHandler("reviews-v2", true, mkService("reviews", "reviews-v2.ns.svc.cluster.local"), mkService("reviews-v2", ""))
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.GetHosts()).To(Equal([]string{"reviews"}))
+				Expect(created).To(HaveLen(1))
+			})
+
+			It("ignores hosts that do not resolve to an existing service", func() {
+				handler := mkHandler("reviews.ns.svc.mesh.internal", true)
+				Expect(handler.Handle()).NotTo(Succeed())
+				Expect(handler.IgnoredMissingHosts()).To(Equal([]string{"reviews"}))
+				Expect(created).To(BeEmpty())
+			})
+
+			It("does not match by service by default", func() {
+				handler := mkHandler("reviews.ns.svc.mesh.internal", false, mkService("reviews", ""))
+				Expect(handler.Handle()).NotTo(Succeed())
+				Expect(handler.IgnoredMissingHosts()).To(Equal([]string{"reviews"}))
+				Expect(created).To(BeEmpty())
+			})
+		})
+
+		Context("exported base destination rules", func() {
+			var created []*istionetwork.DestinationRule
+			mkBase := func(namespace, host string, exportTo ...string) *istionetwork.DestinationRule {
+				return &istionetwork.DestinationRule{
+					ObjectMeta: metav1.ObjectMeta{Name: "reviews", Namespace: namespace},
+					Spec: v1alpha3.DestinationRule{
+						Host:     host,
+						ExportTo: exportTo,
+						Subsets:  []*v1alpha3.Subset{{Name: "shared", Labels: map[string]string{"version": "shared"}}},
+					},
+				}
+			}
+			mkHandler := func(exported bool, rules ...*istionetwork.DestinationRule) handlers.DestinationRuleHandler {
+				created = nil
+				return mkDestinationRuleHandler(func(mc *MockClient) {
+					mc.listMethod = func(_ context.Context, o client.ObjectList, opts ...client.ListOption) error {
+						listOpts := &client.ListOptions{}
+						listOpts.ApplyOptions(opts)
+						var items []*istionetwork.DestinationRule
+						for _, dr := range rules {
+							if listOpts.Namespace == "" || listOpts.Namespace == dr.Namespace {
+								items = append(items, dr)
+							}
+						}
+						o.(*istionetwork.DestinationRuleList).Items = items
+						return nil
+					}
+					mc.createMethod = recordingCreated(&created)
+				}, func(h *handlers.DestinationRuleHandler) {
+					h.ServiceHosts = []string{"reviews"}
+					h.ExportedBaseDestinationRules = exported
+				})
+			}
+
+			It("uses a base destination rule of another namespace that is exported to ours", func() {
+				handler := mkHandler(true, mkBase("gateway", "reviews.ns.svc.cluster.local", "ns", "gateway"))
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.ActiveHosts()).To(Equal([]string{"reviews"}))
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Namespace).To(Equal("ns"))
+				Expect(created[0].Spec.Host).To(Equal("reviews.ns.svc.cluster.local"))
+				Expect(created[0].Spec.ExportTo).To(Equal([]string{"ns", "gateway"}))
+			})
+
+			It("qualifies the short hosts of exported rules by their namespace", func() {
+				handler := mkHandler(true, mkBase("gateway", "reviews"))
+				handler.ServiceHosts = []string{"reviews.gateway"}
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Namespace).To(Equal("ns"))
+				Expect(created[0].Spec.Host).To(Equal("reviews.gateway.svc.cluster.local"))
+			})
+
+			It("keeps the external hosts of exported rules as is", func() {
+				handler := mkHandler(true, mkBase("gateway", "httpbin.org"))
+				handler.ServiceHosts = []string{"httpbin.org"}
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Spec.Host).To(Equal("httpbin.org"))
+			})
+
+			It("keeps the fully qualified hosts of exported rules as is", func() {
+				handler := mkHandler(true, mkBase("gateway", "reviews.ns.svc.cluster.local"))
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Spec.Host).To(Equal("reviews.ns.svc.cluster.local"))
+			})
+
+			It("ignores base destination rules that are not exported to our namespace", func() {
+				handler := mkHandler(true,
+					mkBase("gateway", "reviews.ns.svc.cluster.local", "."),
+					mkBase("other", "reviews.ns.svc.cluster.local", "other", "~"),
+				)
+				Expect(handler.Handle()).NotTo(Succeed())
+				Expect(handler.IgnoredMissingHosts()).To(Equal([]string{"reviews"}))
+				Expect(created).To(BeEmpty())
+			})
+
+			It("prefers the base destination rules of our namespace", func() {
+				local := mkBase("ns", "reviews")
+				local.Spec.Subsets[0].Name = "local"
+				handler := mkHandler(true, mkBase("gateway", "reviews.ns.svc.cluster.local", "*"), local)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Spec.Host).To(Equal("reviews"))
+			})
+
+			It("does not consider exported destination rules by default", func() {
+				handler := mkHandler(false, mkBase("gateway", "reviews.ns.svc.cluster.local", "ns"))
+				Expect(handler.Handle()).NotTo(Succeed())
+				Expect(handler.IgnoredMissingHosts()).To(Equal([]string{"reviews"}))
+				Expect(created).To(BeEmpty())
+			})
+
+			It("resolves the short hosts of exported rules in our namespace if requested", func() {
+				handler := mkHandler(true, mkBase("mesh", "reviews", "ns"))
+				handler.ShortHostsInServiceNamespace = true
+				Expect(handler.Handle()).To(Succeed())
+				Expect(handler.ActiveHosts()).To(Equal([]string{"reviews"}))
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Namespace).To(Equal("ns"))
+				Expect(created[0].Spec.Host).To(Equal("reviews.ns.svc.cluster.local"))
+			})
+
+			It("resolves the short hosts of exported rules in their namespace by default", func() {
+				handler := mkHandler(true, mkBase("mesh", "reviews", "ns"))
+				Expect(handler.Handle()).NotTo(Succeed())
+				Expect(handler.IgnoredMissingHosts()).To(Equal([]string{"reviews"}))
+				Expect(created).To(BeEmpty())
+			})
+
+			It("qualifies the short hosts of a central destination rule namespace by ours", func() {
+				handler := mkHandler(false, mkBase("mesh", "reviews"))
+				handler.DestinationRuleNamespace = "mesh"
+				handler.ShortHostsInServiceNamespace = true
+				Expect(handler.Handle()).To(Succeed())
+				Expect(created).To(HaveLen(1))
+				Expect(created[0].Namespace).To(Equal("mesh"))
+				Expect(created[0].Spec.Host).To(Equal("reviews.ns.svc.cluster.local"))
+			})
+		})
+
+		Context("existing overriding destination rule", func() {
+			mkHandler := func(mc client.Client, version string) handlers.DestinationRuleHandler {
+				return mkDestinationRuleHandler(nil, withClient(mc), func(h *handlers.DestinationRuleHandler) {
+					h.UniqueVersion = version
+					h.Owner = types.NamespacedName{Name: "owner", Namespace: "ns"}
+				})
+			}
+			mkExisting := func(version string) *istionetwork.DestinationRule {
+				return &istionetwork.DestinationRule{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "unique-details",
+						Namespace:   "ns",
+						Labels:      map[string]string{"version": version},
+						Annotations: map[string]string{watches.NamespacedNameAnnotation: "ns/owner"},
+					},
+					Spec: v1alpha3.DestinationRule{
+						Host: "details",
+						Subsets: []*v1alpha3.Subset{
+							{Name: version, Labels: map[string]string{"version": version}},
+						},
+					},
+				}
+			}
+			mkClient := func(existing *istionetwork.DestinationRule, updated *[]*istionetwork.DestinationRule) MockClient {
+				mc := MockClient{}
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+					Expect(err).To(BeNil())
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+					return nil
+				}
+				mc.getMethod = func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					existing.DeepCopyInto(o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				mc.updateMethod = func(_ context.Context, o client.Object, _ ...client.UpdateOption) error {
+					*updated = append(*updated, o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				return mc
+			}
+
+			It("updates the destination rule in place if the version was modified", func() {
+				var updated []*istionetwork.DestinationRule
+				mc := mkClient(mkExisting("old-version"), &updated)
+				handler := mkHandler(mc, "new-version")
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				subsets := updated[0].Spec.Subsets
+				Expect(subsets).To(HaveLen(1))
+				Expect(subsets[0].Name).To(Equal("new-version"))
+				Expect(subsets[0].Labels).To(Equal(map[string]string{"version": "new-version"}))
+				Expect(updated[0].Labels["version"]).To(Equal("new-version"))
+				Expect(watches.ContainsAnnotation(types.NamespacedName{Name: "owner", Namespace: "ns"}, updated[0])).To(BeTrue())
+			})
+
+			// Returns the existing destination rule as stamped by us (with the spec hash)
+			mkUpToDate := func(version string) *istionetwork.DestinationRule {
+				var updated []*istionetwork.DestinationRule
+				handler := mkHandler(mkClient(mkExisting(version), &updated), version)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				return updated[0]
+			}
+
+			It("does not update an up to date destination rule", func() {
+				var updated []*istionetwork.DestinationRule
+				mc := mkClient(mkUpToDate("version"), &updated)
+				handler := mkHandler(mc, "version")
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(BeEmpty())
+			})
+
+			It("records the spec hash on a destination rule missing it", func() {
+				var updated []*istionetwork.DestinationRule
+				handler := mkHandler(mkClient(mkExisting("version"), &updated), "version")
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(updated[0].Annotations).To(HaveKeyWithValue(names.DestinationRuleSpecHashAnnotation, Not(BeEmpty())))
+				Expect(updated[0].Spec.Subsets).To(HaveLen(1))
+				Expect(updated[0].Spec.Subsets[0].Labels).To(Equal(map[string]string{"version": "version"}))
+			})
+
+			It("updates a destination rule whose spec was modified by others", func() {
+				var updated []*istionetwork.DestinationRule
+				existing := mkUpToDate("version")
+				existing.Spec.Subsets[0].Labels["version"] = "modified"
+				handler := mkHandler(mkClient(existing, &updated), "version")
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(updated[0].Spec.Subsets[0].Labels).To(Equal(map[string]string{"version": "version"}))
+			})
+
+			It("updates a destination rule whose desired spec changed", func() {
+				var updated []*istionetwork.DestinationRule
+				existing := mkUpToDate("version")
+				handler := mkHandler(mkClient(existing, &updated), "version")
+				handler.SubsetSelector = map[string]string{"track": "canary"}
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(updated[0].Spec.Subsets[0].Labels).To(Equal(map[string]string{"version": "version", "track": "canary"}))
+				Expect(updated[0].Annotations[names.DestinationRuleSpecHashAnnotation]).NotTo(
+					Equal(existing.Annotations[names.DestinationRuleSpecHashAnnotation]))
+			})
+
+			It("records the base destination rule it was derived from", func() {
+				existing := mkUpToDate("version")
+				Expect(existing.Annotations).To(HaveKeyWithValue(names.DestinationRuleBaseAnnotation, "ns/details"))
+			})
+
+			It("updates the base destination rule it was derived from once the base changes", func() {
+				var updated []*istionetwork.DestinationRule
+				existing := mkUpToDate("version")
+				mc := mkClient(existing, &updated)
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+					Expect(err).To(BeNil())
+					dr.Name = "details-replacement"
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+					return nil
+				}
+				handler := mkHandler(mc, "version")
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(updated[0].Annotations).To(HaveKeyWithValue(names.DestinationRuleBaseAnnotation, "ns/details-replacement"))
+			})
+
+			It("records our UID and owner reference on a destination rule missing them", func() {
+				var updated []*istionetwork.DestinationRule
+				handler := mkHandler(mkClient(mkExisting("version"), &updated), "version")
+				handler.OwnerUID = "uid"
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				uid, ok := watches.OwnerUID(handler.Owner, updated[0])
+				Expect(ok).To(BeTrue())
+				Expect(uid).To(BeEquivalentTo("uid"))
+				Expect(updated[0].OwnerReferences).To(ConsistOf(metav1.OwnerReference{
+					APIVersion: "riskified.com/v1alpha1", Kind: "DynamicEnv", Name: "owner", UID: "uid",
+				}))
+			})
+
+			It("replaces the owner reference of a previous owner with the same name when adopting", func() {
+				var updated []*istionetwork.DestinationRule
+				stale := mkExisting("version")
+				watches.AddOwnerUID(types.NamespacedName{Name: "owner", Namespace: "ns"}, "old-uid", stale)
+				stale.OwnerReferences = []metav1.OwnerReference{
+					{APIVersion: "riskified.com/v1alpha1", Kind: "DynamicEnv", Name: "owner", UID: "old-uid"},
+				}
+				handler := mkHandler(mkClient(stale, &updated), "version")
+				handler.OwnerUID = "new-uid"
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(updated[0].OwnerReferences).To(HaveLen(1))
+				Expect(updated[0].OwnerReferences[0].UID).To(BeEquivalentTo("new-uid"))
+				Expect(updated[0].Annotations[watches.OwnerUIDsAnnotation]).To(Equal("ns/owner=new-uid"))
+			})
+
+			Context("not owned by us", func() {
+				owner := types.NamespacedName{Name: "owner", Namespace: "ns"}
+				mkForeign := func() *istionetwork.DestinationRule {
+					existing := mkExisting("version")
+					existing.Annotations = map[string]string{watches.NamespacedNameAnnotation: "other-ns/other"}
+					return existing
+				}
+
+				It("adopts the destination rule by default", func() {
+					var updated []*istionetwork.DestinationRule
+					handler := mkHandler(mkClient(mkForeign(), &updated), "version")
+					Expect(handler.Handle()).To(Succeed())
+					Expect(updated).To(HaveLen(1))
+					Expect(watches.ContainsAnnotation(owner, updated[0])).To(BeTrue())
+					Expect(watches.ContainsAnnotation(types.NamespacedName{Name: "other", Namespace: "other-ns"}, updated[0])).To(BeTrue())
+					Expect(handler.GetHosts()).To(Equal([]string{"details"}))
+				})
+
+				It("reports a conflict and leaves the destination rule as is in strict mode", func() {
+					var updated []*istionetwork.DestinationRule
+					recorder := record.NewFakeRecorder(10)
+					handler := mkHandler(mkClient(mkForeign(), &updated), "new-version")
+					handler.StrictOwnership = true
+					handler.Recorder = recorder
+					err := handler.Handle()
+					Expect(err).To(MatchError(ContainSubstring("other owners")))
+					Expect(updated).To(BeEmpty())
+					Expect(handler.GetHosts()).To(BeEmpty())
+					Expect(recorder.Events).To(Receive(ContainSubstring(names.ConflictingDestinationRuleReason)))
+
+					statuses, err := handler.GetStatus()
+					Expect(err).To(BeNil())
+					Expect(statuses).To(HaveLen(1))
+					Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Conflicting))
+				})
+
+				It("rejects destination rules of a previous owner with the same name in strict mode", func() {
+					var updated []*istionetwork.DestinationRule
+					stale := mkExisting("version")
+					watches.AddOwnerUID(owner, "old-uid", stale)
+					handler := mkHandler(mkClient(stale, &updated), "version")
+					handler.OwnerUID = "new-uid"
+					handler.StrictOwnership = true
+					Expect(handler.Handle()).To(MatchError(ContainSubstring("other owners")))
+					Expect(updated).To(BeEmpty())
+					statuses, err := handler.GetStatus()
+					Expect(err).To(BeNil())
+					Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Conflicting))
+				})
+
+				It("handles our own destination rules normally in strict mode", func() {
+					var updated []*istionetwork.DestinationRule
+					handler := mkHandler(mkClient(mkExisting("old-version"), &updated), "new-version")
+					handler.StrictOwnership = true
+					Expect(handler.Handle()).To(Succeed())
+					Expect(updated).To(HaveLen(1))
+					statuses, err := handler.GetStatus()
+					Expect(err).To(BeNil())
+					Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Running))
+				})
+			})
+		})
+
+		Context("version label key migration", func() {
+			const newLabel = "app.kubernetes.io/version"
+			mkExisting := func(labels map[string]string, subsetLabels map[string]string) *istionetwork.DestinationRule {
+				return &istionetwork.DestinationRule{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "unique-details",
+						Namespace:   "ns",
+						Labels:      labels,
+						Annotations: map[string]string{watches.NamespacedNameAnnotation: "ns/owner"},
+					},
+					Spec: v1alpha3.DestinationRule{
+						Host:    "details",
+						Subsets: []*v1alpha3.Subset{{Name: "version", Labels: subsetLabels}},
+					},
+				}
+			}
+			// The client persists updates, so consecutive reconciles see the result of the previous ones.
+			mkClient := func(existing *istionetwork.DestinationRule, updated *[]*istionetwork.DestinationRule) MockClient {
+				mc := MockClient{}
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					base := &istionetwork.DestinationRule{
+						ObjectMeta: metav1.ObjectMeta{Name: "details", Namespace: "ns"},
+						Spec: v1alpha3.DestinationRule{
+							Host:    "details",
+							Subsets: []*v1alpha3.Subset{{Name: "shared", Labels: map[string]string{newLabel: "shared"}}},
+						},
+					}
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{base}
+					return nil
+				}
+				mc.getMethod = func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					existing.DeepCopyInto(o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				mc.updateMethod = func(_ context.Context, o client.Object, _ ...client.UpdateOption) error {
+					dr := o.(*istionetwork.DestinationRule)
+					*updated = append(*updated, dr.DeepCopy())
+					dr.DeepCopyInto(existing)
+					return nil
+				}
+				return mc
+			}
+			mkHandler := func(mc client.Client) handlers.DestinationRuleHandler {
+				return mkDestinationRuleHandler(nil, withClient(mc), func(h *handlers.DestinationRuleHandler) {
+					h.VersionLabel = newLabel
+					h.Owner = types.NamespacedName{Name: "owner", Namespace: "ns"}
+				})
+			}
+
+			It("migrates a destination rule created with the previous version label key", func() {
+				var updated []*istionetwork.DestinationRule
+				existing := mkExisting(
+					map[string]string{"version": "version", names.DynamicEnvLabel: "true"},
+					map[string]string{"version": "version"},
+				)
+				handler := mkHandler(mkClient(existing, &updated))
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(updated[0].Labels).To(HaveKeyWithValue(newLabel, "version"))
+				Expect(updated[0].Labels).To(HaveKeyWithValue(names.DynamicEnvLabel, "true"))
+				Expect(updated[0].Labels).NotTo(HaveKey("version"))
+				Expect(updated[0].Spec.Subsets).To(HaveLen(1))
+				Expect(updated[0].Spec.Subsets[0].Labels).To(Equal(map[string]string{newLabel: "version"}))
+			})
+
+			It("removes the stale key when both keys coexist and does not thrash afterwards", func() {
+				var updated []*istionetwork.DestinationRule
+				existing := mkExisting(
+					map[string]string{"version": "version", newLabel: "version"},
+					map[string]string{newLabel: "version"},
+				)
+				mc := mkClient(existing, &updated)
+				handler := mkHandler(mc)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(updated[0].Labels).To(Equal(map[string]string{newLabel: "version"}))
+
+				again := mkHandler(mc)
+				Expect(again.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+			})
+		})
+
+		Context("shared destination rules", func() {
+			otherOwner := types.NamespacedName{Name: "other", Namespace: "ns"}
+			owner := types.NamespacedName{Name: "owner", Namespace: "ns"}
+			mkShared := func() *istionetwork.DestinationRule {
+				return &istionetwork.DestinationRule{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "dynamic-environment-shared-details",
+						Namespace:   "ns",
+						Annotations: map[string]string{watches.NamespacedNameAnnotation: "ns/other"},
+					},
+					Spec: v1alpha3.DestinationRule{
+						Host: "details",
+						Subsets: []*v1alpha3.Subset{
+							{Name: "other-version", Labels: map[string]string{"version": "other-version"}},
+						},
+					},
+				}
+			}
+			mkClient := func(updated *[]*istionetwork.DestinationRule, conflicts int) MockClient {
+				mc := MockClient{}
+				mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+					dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+					Expect(err).To(BeNil())
+					o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+					return nil
+				}
+				mc.getMethod = func(_ context.Context, key types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					Expect(key.Name).To(Equal("dynamic-environment-shared-details"))
+					mkShared().DeepCopyInto(o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				mc.updateMethod = func(_ context.Context, o client.Object, _ ...client.UpdateOption) error {
+					*updated = append(*updated, o.(*istionetwork.DestinationRule))
+					if len(*updated) <= conflicts {
+						return errors.NewConflict(schema.GroupResource{}, o.GetName(), fmt.Errorf("conflict"))
+					}
+					return nil
+				}
+				return mc
+			}
+			mkHandler := func(mc client.Client) handlers.DestinationRuleHandler {
+				return mkDestinationRuleHandler(nil, withClient(mc), func(h *handlers.DestinationRuleHandler) {
+					h.Owner = owner
+					h.SharedDestinationRules = true
+				})
+			}
+
+			It("appends our subset to the existing shared destination rule", func() {
+				var updated []*istionetwork.DestinationRule
+				handler := mkHandler(mkClient(&updated, 0))
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				var subsetNames []string
+				for _, s := range updated[0].Spec.Subsets {
+					subsetNames = append(subsetNames, s.Name)
+				}
+				Expect(subsetNames).To(Equal([]string{"other-version", "version"}))
+				Expect(watches.ContainsAnnotation(owner, updated[0])).To(BeTrue())
+				Expect(watches.ContainsAnnotation(otherOwner, updated[0])).To(BeTrue())
+				Expect(handler.GetHosts()).To(Equal([]string{"details"}))
+			})
+
+			It("records the provenance of our subset", func() {
+				var updated []*istionetwork.DestinationRule
+				handler := mkHandler(mkClient(&updated, 0))
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+				Expect(watches.SubsetOwners(updated[0])).To(Equal(map[string]types.NamespacedName{"version": owner}))
+			})
+
+			It("accepts a shared destination rule with another form of our host", func() {
+				var updated []*istionetwork.DestinationRule
+				mc := mkClient(&updated, 0)
+				mc.getMethod = func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					shared := mkShared()
+					shared.Spec.Host = "details.ns.svc.cluster.local"
+					shared.DeepCopyInto(o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				handler := mkHandler(mc)
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(1))
+			})
+
+			It("refuses to add our subset to a shared destination rule of another host", func() {
+				var updated []*istionetwork.DestinationRule
+				mc := mkClient(&updated, 0)
+				mc.getMethod = func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+					shared := mkShared()
+					shared.Spec.Host = "reviews"
+					shared.DeepCopyInto(o.(*istionetwork.DestinationRule))
+					return nil
+				}
+				handler := mkHandler(mc)
+				Expect(handler.Handle()).To(MatchError(ContainSubstring(`is of host "reviews" rather than "details"`)))
+				Expect(updated).To(BeEmpty())
+			})
+
+			It("retries on conflicts", func() {
+				var updated []*istionetwork.DestinationRule
+				handler := mkHandler(mkClient(&updated, 2))
+				Expect(handler.Handle()).To(Succeed())
+				Expect(updated).To(HaveLen(3))
+			})
+
+			It("reports missing status if our subset is not in the shared destination rule", func() {
+				var updated []*istionetwork.DestinationRule
+				handler := mkHandler(mkClient(&updated, 0))
+				statuses, err := handler.GetStatus()
+				Expect(err).To(BeNil())
+				Expect(statuses).To(HaveLen(1))
+				Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Missing))
+			})
+
+			It("releases only our subset and ownership", func() {
+				dr := mkShared()
+				watches.AddToAnnotation(owner, dr)
+				dr.Spec.Subsets = append(dr.Spec.Subsets, &v1alpha3.Subset{Name: "version", Labels: map[string]string{"version": "version"}})
+				Expect(handlers.ReleaseDestinationRule(watches.Ownership{}, dr, owner, "version", "version")).To(BeFalse())
+				Expect(dr.Spec.Subsets).To(HaveLen(1))
+				Expect(dr.Spec.Subsets[0].Name).To(Equal("other-version"))
+				Expect(watches.ContainsAnnotation(owner, dr)).To(BeFalse())
+				Expect(handlers.ReleaseDestinationRule(watches.Ownership{}, dr, otherOwner, "version", "other-version")).To(BeTrue())
+			})
+		})
+	})
+})
+
+var _ = Describe("AggregateDestinationRuleStatuses", func() {
+	mkStatuses := func(statuses ...riskifiedv1alpha1.LifeCycleStatus) []riskifiedv1alpha1.ResourceStatus {
+		var result []riskifiedv1alpha1.ResourceStatus
+		for idx, s := range statuses {
+			result = append(result, riskifiedv1alpha1.ResourceStatus{Name: fmt.Sprint("dr", idx), Namespace: "ns", Status: s})
+		}
+		return result
+	}
+
+	DescribeTable(
+		"follows the status precedence",
+		func(statuses []riskifiedv1alpha1.ResourceStatus, expected riskifiedv1alpha1.LifeCycleStatus) {
+			Expect(handlers.AggregateDestinationRuleStatuses(statuses)).To(Equal(expected))
+		},
+		Entry("no statuses", nil, riskifiedv1alpha1.Unknown),
+		Entry("all running", mkStatuses(riskifiedv1alpha1.Running, riskifiedv1alpha1.Running), riskifiedv1alpha1.Running),
+		Entry("ignored missing over running",
+			mkStatuses(riskifiedv1alpha1.Running, riskifiedv1alpha1.IgnoredMissingDR), riskifiedv1alpha1.IgnoredMissingDR),
+		Entry("missing default subset over ignored missing",
+			mkStatuses(riskifiedv1alpha1.IgnoredMissingDR, riskifiedv1alpha1.MissingDefaultSubset), riskifiedv1alpha1.MissingDefaultSubset),
+		Entry("missing default subset over opted out",
+			mkStatuses(riskifiedv1alpha1.OptedOut, riskifiedv1alpha1.MissingDefaultSubset), riskifiedv1alpha1.MissingDefaultSubset),
+		Entry("opted out over ignored missing",
+			mkStatuses(riskifiedv1alpha1.IgnoredMissingDR, riskifiedv1alpha1.OptedOut), riskifiedv1alpha1.OptedOut),
+		Entry("ignored missing over excluded",
+			mkStatuses(riskifiedv1alpha1.Excluded, riskifiedv1alpha1.IgnoredMissingDR), riskifiedv1alpha1.IgnoredMissingDR),
+		Entry("excluded over running",
+			mkStatuses(riskifiedv1alpha1.Running, riskifiedv1alpha1.Excluded), riskifiedv1alpha1.Excluded),
+		Entry("initializing over missing default subset",
+			mkStatuses(riskifiedv1alpha1.MissingDefaultSubset, riskifiedv1alpha1.Initializing), riskifiedv1alpha1.Initializing),
+		Entry("initializing over ignored missing",
+			mkStatuses(riskifiedv1alpha1.IgnoredMissingDR, riskifiedv1alpha1.Initializing, riskifiedv1alpha1.Running), riskifiedv1alpha1.Initializing),
+		Entry("terminating over initializing",
+			mkStatuses(riskifiedv1alpha1.Initializing, riskifiedv1alpha1.Terminating, riskifiedv1alpha1.Running), riskifiedv1alpha1.Terminating),
+		Entry("missing over terminating",
+			mkStatuses(riskifiedv1alpha1.Terminating, riskifiedv1alpha1.Missing), riskifiedv1alpha1.Missing),
+		Entry("missing over initializing",
+			mkStatuses(riskifiedv1alpha1.Initializing, riskifiedv1alpha1.Missing, riskifiedv1alpha1.IgnoredMissingDR), riskifiedv1alpha1.Missing),
+		Entry("ambiguous over missing",
+			mkStatuses(riskifiedv1alpha1.Missing, riskifiedv1alpha1.AmbiguousBaseDR), riskifiedv1alpha1.AmbiguousBaseDR),
+		Entry("conflicting over missing",
+			mkStatuses(riskifiedv1alpha1.Missing, riskifiedv1alpha1.Conflicting, riskifiedv1alpha1.Running), riskifiedv1alpha1.Conflicting),
+		Entry("namespace not allowed over missing",
+			mkStatuses(riskifiedv1alpha1.Missing, riskifiedv1alpha1.NamespaceNotAllowed), riskifiedv1alpha1.NamespaceNotAllowed),
+		Entry("ambiguous over conflicting",
+			mkStatuses(riskifiedv1alpha1.Conflicting, riskifiedv1alpha1.AmbiguousBaseDR), riskifiedv1alpha1.AmbiguousBaseDR),
+		Entry("unlisted statuses are treated as initializing",
+			mkStatuses(riskifiedv1alpha1.Running, riskifiedv1alpha1.Updating), riskifiedv1alpha1.Initializing),
+	)
+})
+
+// Compares the API server reads of GetStatus with a warm cache (the Client) and a cold one (every
+// read falls back to the APIReader), for a DynamicEnv with many service hosts.
+func BenchmarkDestinationRuleHandlerGetStatus(b *testing.B) {
+	var hosts []string
+	for i := 0; i < 50; i++ {
+		hosts = append(hosts, fmt.Sprintf("service%d", i))
+	}
+	run := func(b *testing.B, cached bool) {
+		apiReads := 0
+		cache := struct{ MockClient }{}
+		cache.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+			if cached {
+				return nil
+			}
+			return errors.NewNotFound(schema.GroupResource{}, "error")
+		}
+		reader := struct{ MockClient }{}
+		reader.getMethod = func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error {
+			apiReads++
+			return nil
+		}
+		handler := handlers.DestinationRuleHandler{
+			Client:       cache,
+			APIReader:    reader,
+			UniqueName:   "unique",
+			Namespace:    "ns",
+			ServiceHosts: hosts,
+			Log:          logr.Discard(),
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := handler.GetStatus(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(apiReads)/float64(b.N), "apiserver-reads/op")
+	}
+	b.Run("warm cache", func(b *testing.B) { run(b, true) })
+	b.Run("cold cache", func(b *testing.B) { run(b, false) })
+}
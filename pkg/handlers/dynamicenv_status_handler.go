@@ -18,8 +18,15 @@ package handlers
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+	"time"
 
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -28,6 +35,9 @@ type DynamicEnvStatusHandler struct {
 	client.Client
 	Ctx        context.Context
 	DynamicEnv *riskifiedv1alpha1.DynamicEnv
+	// The number of the latest life cycle status transitions recorded per resource (see
+	// `ResourceStatus.Transitions`). Transitions are not recorded if 0.
+	TransitionHistoryLimit int
 }
 
 // Adds (or updates) a status entry to the *Deployments* status section (if not
@@ -41,24 +51,50 @@ func (h *DynamicEnvStatusHandler) AddDeploymentStatusEntry(subset string, newSta
 
 // Add a status entry to the *DestinationRules* status section (if not exists).
 func (h *DynamicEnvStatusHandler) AddDestinationRuleStatusEntry(subset string, newStatus riskifiedv1alpha1.ResourceStatus) error {
+	return h.AddDestinationRuleStatusEntries(subset, []riskifiedv1alpha1.ResourceStatus{newStatus})
+}
+
+// AddDestinationRuleStatusEntries upserts the provided DestinationRule statuses of the subset (keyed
+// by the name and namespace of each resource) using a single status update. Applying the same
+// statuses again (e.g. when reconciling twice in a row) does not update the status.
+func (h *DynamicEnvStatusHandler) AddDestinationRuleStatusEntries(subset string, newStatuses []riskifiedv1alpha1.ResourceStatus) error {
 	currentStatus := h.safeGetSubsetsStatus(subset)
-	modified, newStatuses := SyncStatusResources(newStatus, currentStatus.DestinationRules)
+	modified, newStatuses := SyncStatusResourceList(newStatuses, currentStatus.DestinationRules)
 	if modified {
-		currentStatus.DestinationRules = newStatuses
+		currentStatus.DestinationRules = h.recordTransitions(currentStatus.DestinationRules, newStatuses)
 		h.DynamicEnv.Status.SubsetsStatus[subset] = currentStatus
-		return h.Status().Update(h.Ctx, h.DynamicEnv)
+		return h.updateStatus()
 	}
 	return nil
 }
 
+// SetDestinationRuleStatuses replaces the DestinationRule statuses of the subset (e.g. dropping
+// the entries of the rules that are gone), using a single status update (only if modified).
+func (h *DynamicEnvStatusHandler) SetDestinationRuleStatuses(subset string, statuses []riskifiedv1alpha1.ResourceStatus) error {
+	currentStatus := h.safeGetSubsetsStatus(subset)
+	statuses = h.recordTransitions(currentStatus.DestinationRules, statuses)
+	if reflect.DeepEqual(currentStatus.DestinationRules, statuses) {
+		return nil
+	}
+	currentStatus.DestinationRules = statuses
+	h.DynamicEnv.Status.SubsetsStatus[subset] = currentStatus
+	return h.updateStatus()
+}
+
 // Add a status entry to the *VirtualServices* status section (if not exists).
 func (h *DynamicEnvStatusHandler) AddVirtualServiceStatusEntry(subset string, newStatus riskifiedv1alpha1.ResourceStatus) error {
+	return h.AddVirtualServiceStatusEntries(subset, []riskifiedv1alpha1.ResourceStatus{newStatus})
+}
+
+// AddVirtualServiceStatusEntries is the VirtualService counterpart of
+// `AddDestinationRuleStatusEntries`.
+func (h *DynamicEnvStatusHandler) AddVirtualServiceStatusEntries(subset string, newStatuses []riskifiedv1alpha1.ResourceStatus) error {
 	currentStatus := h.safeGetSubsetsStatus(subset)
-	modified, newStatuses := SyncStatusResources(newStatus, currentStatus.VirtualServices)
+	modified, newStatuses := SyncStatusResourceList(newStatuses, currentStatus.VirtualServices)
 	if modified {
-		currentStatus.VirtualServices = newStatuses
+		currentStatus.VirtualServices = h.recordTransitions(currentStatus.VirtualServices, newStatuses)
 		h.DynamicEnv.Status.SubsetsStatus[subset] = currentStatus
-		return h.Status().Update(h.Ctx, h.DynamicEnv)
+		return h.updateStatus()
 	}
 	return nil
 }
@@ -71,22 +107,215 @@ func (h *DynamicEnvStatusHandler) AddGlobalVirtualServiceError(subset, msg strin
 	statusErrors.VirtualServices = currentErrors
 	currentStatus.Errors = &statusErrors
 	h.DynamicEnv.Status.SubsetsStatus[subset] = currentStatus
-	return h.Status().Update(h.Ctx, h.DynamicEnv)
+	return h.updateStatus()
 }
 
+// Sets the global state (along with the matching `Ready` condition) and the counters.
 func (h *DynamicEnvStatusHandler) SetGlobalState(state riskifiedv1alpha1.GlobalReadyStatus, totalCount int, notReadyCount int) error {
 	h.DynamicEnv.Status.State = state
 	h.DynamicEnv.Status.TotalCount = totalCount
 	h.DynamicEnv.Status.TotalReady = totalCount - notReadyCount
-	return h.Status().Update(h.Ctx, h.DynamicEnv)
+	condition := metav1.Condition{
+		Type:    string(riskifiedv1alpha1.ConditionReady),
+		Status:  metav1.ConditionFalse,
+		Reason:  "Processing",
+		Message: fmt.Sprintf("%d out of %d subsets and consumers are ready", totalCount-notReadyCount, totalCount),
+	}
+	switch state {
+	case riskifiedv1alpha1.Ready:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "Ready"
+	case riskifiedv1alpha1.Degraded:
+		condition.Reason = "Degraded"
+	}
+	h.setCondition(condition)
+	return h.updateStatus()
+}
+
+// Sets the overall phase of the DynamicEnv (see `ComputeDynamicEnvPhase`). Updates the status only
+// if the phase was changed.
+func (h *DynamicEnvStatusHandler) SetPhase(phase riskifiedv1alpha1.DynamicEnvPhase) error {
+	if h.DynamicEnv.Status.Phase == phase {
+		return nil
+	}
+	h.DynamicEnv.Status.Phase = phase
+	return h.updateStatus()
+}
+
+// Marks the DynamicEnv as expired (see `DynamicEnvSpec.TTLSecondsAfterCreation`): sets the Expired
+// phase along with the Expired condition (and an unready Ready condition). Updates the status only
+// if anything was changed.
+func (h *DynamicEnvStatusHandler) SetExpired(expiredAt time.Time) error {
+	modified := h.DynamicEnv.Status.Phase != riskifiedv1alpha1.PhaseExpired
+	h.DynamicEnv.Status.Phase = riskifiedv1alpha1.PhaseExpired
+	message := fmt.Sprintf("Expired at %s, the resources were cleaned up", expiredAt.UTC().Format(time.RFC3339))
+	modified = h.setCondition(metav1.Condition{
+		Type:    string(riskifiedv1alpha1.ConditionExpired),
+		Status:  metav1.ConditionTrue,
+		Reason:  "TTLExceeded",
+		Message: message,
+	}) || modified
+	modified = h.setCondition(metav1.Condition{
+		Type:    string(riskifiedv1alpha1.ConditionReady),
+		Status:  metav1.ConditionFalse,
+		Reason:  "Expired",
+		Message: message,
+	}) || modified
+	if modified {
+		return h.updateStatus()
+	}
+	return nil
+}
+
+// Removes the Expired condition (e.g. once the TTL was extended). Only modifies the in-memory status,
+// it's persisted along with the next status update.
+func (h *DynamicEnvStatusHandler) ClearExpired() {
+	meta.RemoveStatusCondition(&h.DynamicEnv.Status.Conditions, string(riskifiedv1alpha1.ConditionExpired))
+}
+
+// ComputeDynamicEnvPhase computes the overall phase from the statuses of all the resources of the
+// DynamicEnv (deployments, destination rules and virtual services). The precedence is:
+//   - Degraded: if any of the resources failed (`Failed`, `AmbiguousBaseDR`, `Conflicting`,
+//     `NamespaceNotAllowed`).
+//   - Missing: if any of the resources is `Missing`.
+//   - Processing: if any of the resources is not ready yet, e.g. `Terminating` (or if there are no
+//     statuses at all).
+//   - Ready: if all the resources are either `Running` or ignored (`IgnoredMissingDR`,
+//     `IgnoredMissingVS`, `MissingDefaultSubset`, `OptedOut`, `Excluded`).
+func ComputeDynamicEnvPhase(statuses []riskifiedv1alpha1.LifeCycleStatus) riskifiedv1alpha1.DynamicEnvPhase {
+	if len(statuses) == 0 {
+		return riskifiedv1alpha1.PhaseProcessing
+	}
+	degraded, missing, processing := false, false, false
+	for _, s := range statuses {
+		switch s {
+		case riskifiedv1alpha1.Running, riskifiedv1alpha1.IgnoredMissingDR, riskifiedv1alpha1.IgnoredMissingVS,
+			riskifiedv1alpha1.MissingDefaultSubset, riskifiedv1alpha1.OptedOut, riskifiedv1alpha1.Excluded:
+		case riskifiedv1alpha1.Failed, riskifiedv1alpha1.AmbiguousBaseDR, riskifiedv1alpha1.Conflicting,
+			riskifiedv1alpha1.NamespaceNotAllowed:
+			degraded = true
+		case riskifiedv1alpha1.Missing:
+			missing = true
+		default:
+			processing = true
+		}
+	}
+	switch {
+	case degraded:
+		return riskifiedv1alpha1.PhaseDegraded
+	case missing:
+		return riskifiedv1alpha1.PhaseMissing
+	case processing:
+		return riskifiedv1alpha1.PhaseProcessing
+	}
+	return riskifiedv1alpha1.PhaseReady
+}
+
+// Sets the DestinationRulesReady condition from the aggregated status of all the destination rules
+// (see `AggregateDestinationRuleStatuses`). Updates the status only if the condition was changed.
+func (h *DynamicEnvStatusHandler) SetDestinationRulesCondition(aggregated riskifiedv1alpha1.LifeCycleStatus) error {
+	condition := metav1.Condition{
+		Type:    string(riskifiedv1alpha1.ConditionDestinationRulesReady),
+		Status:  metav1.ConditionFalse,
+		Reason:  "DestinationRulesNotReady",
+		Message: fmt.Sprintf("Aggregated destination rules status: %s", aggregated),
+	}
+	if aggregated == riskifiedv1alpha1.Running || aggregated == riskifiedv1alpha1.IgnoredMissingDR ||
+		aggregated == riskifiedv1alpha1.MissingDefaultSubset || aggregated == riskifiedv1alpha1.OptedOut ||
+		aggregated == riskifiedv1alpha1.Excluded {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "DestinationRulesReady"
+	}
+	if modified := h.setCondition(condition); modified {
+		return h.updateStatus()
+	}
+	return nil
+}
+
+func (h *DynamicEnvStatusHandler) setCondition(condition metav1.Condition) bool {
+	condition.ObservedGeneration = h.DynamicEnv.Generation
+	return SetCondition(&h.DynamicEnv.Status.Conditions, condition)
+}
+
+// SetCondition adds (or updates) the provided condition in the provided conditions. The transition
+// time is only modified if the status of the condition has changed. Returns whether anything has
+// changed.
+func SetCondition(conditions *[]metav1.Condition, condition metav1.Condition) bool {
+	if existing := GetCondition(*conditions, condition.Type); existing != nil &&
+		existing.Status == condition.Status &&
+		existing.Reason == condition.Reason &&
+		existing.Message == condition.Message &&
+		existing.ObservedGeneration == condition.ObservedGeneration {
+		return false
+	}
+	meta.SetStatusCondition(conditions, condition)
+	return true
+}
+
+// CheckGeneration returns a `SupersededGeneration` error if the latest version of the DynamicEnv
+// (or its status) belongs to a newer generation than the one we're reconciling, so the callers
+// could avoid writing stale changes. A DynamicEnv without a generation (e.g. not persisted yet) is
+// never superseded.
+func (h *DynamicEnvStatusHandler) CheckGeneration() error {
+	if h.DynamicEnv.Generation == 0 {
+		return nil
+	}
+	latest := &riskifiedv1alpha1.DynamicEnv{}
+	if err := h.Get(h.Ctx, client.ObjectKeyFromObject(h.DynamicEnv), latest); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("fetching dynamic environment to check its generation: %w", err)
+	}
+	return h.supersededBy(latest)
+}
+
+func (h *DynamicEnvStatusHandler) supersededBy(latest *riskifiedv1alpha1.DynamicEnv) error {
+	generation := h.DynamicEnv.Generation
+	newest := latest.Generation
+	if latest.Status.ObservedGeneration > newest {
+		newest = latest.Status.ObservedGeneration
+	}
+	if newest > generation {
+		return SupersededGeneration{Generation: generation, Latest: newest}
+	}
+	return nil
+}
+
+// Updates the status of the DynamicEnv (recording the generation it was computed for). On conflict,
+// re-fetches the DynamicEnv and re-applies our in-memory status on top of it (so the accumulated
+// entries are not lost), unless it was superseded by a newer generation (see `CheckGeneration`).
+func (h *DynamicEnvStatusHandler) updateStatus() error {
+	h.DynamicEnv.Status.ObservedGeneration = h.DynamicEnv.Generation
+	status := h.DynamicEnv.Status.DeepCopy()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		err := h.Status().Update(h.Ctx, h.DynamicEnv)
+		if errors.IsConflict(err) {
+			latest := &riskifiedv1alpha1.DynamicEnv{}
+			if getErr := h.Get(h.Ctx, client.ObjectKeyFromObject(h.DynamicEnv), latest); getErr != nil {
+				return fmt.Errorf("fetching dynamic environment after status conflict: %w", getErr)
+			}
+			if supersededErr := h.supersededBy(latest); supersededErr != nil {
+				return supersededErr
+			}
+			latest.Status = *status.DeepCopy()
+			*h.DynamicEnv = *latest
+		}
+		return err
+	})
+}
+
+// GetCondition returns the condition with the provided type (or nil if there is no such condition).
+func GetCondition(conditions []metav1.Condition, conditionType string) *metav1.Condition {
+	return meta.FindStatusCondition(conditions, conditionType)
 }
 
 func (h *DynamicEnvStatusHandler) addSubsetDeploymentStatusEntry(subset string, newStatus riskifiedv1alpha1.ResourceStatus) error {
 	currentStatus := h.safeGetSubsetsStatus(subset)
 	if !currentStatus.Deployment.IsEqual(newStatus) {
-		currentStatus.Deployment = newStatus
+		currentStatus.Deployment = h.recordTransition(currentStatus.Deployment, newStatus)
 		h.DynamicEnv.Status.SubsetsStatus[subset] = currentStatus
-		return h.Status().Update(h.Ctx, h.DynamicEnv)
+		return h.updateStatus()
 	}
 	return nil
 }
@@ -94,15 +323,62 @@ func (h *DynamicEnvStatusHandler) addSubsetDeploymentStatusEntry(subset string,
 func (h *DynamicEnvStatusHandler) addConsumerDeploymentStatusEntry(subset string, newStatus riskifiedv1alpha1.ResourceStatus) error {
 	currentStatus := h.safeGetConsumersStatus(subset)
 	if !currentStatus.IsEqual(newStatus) {
+		currentStatus.Transitions = h.recordTransition(currentStatus.ResourceStatus, newStatus).Transitions
 		currentStatus.Name = newStatus.Name
 		currentStatus.Namespace = newStatus.Namespace
 		currentStatus.Status = newStatus.Status
 		h.DynamicEnv.Status.ConsumersStatus[subset] = currentStatus
-		return h.Status().Update(h.Ctx, h.DynamicEnv)
+		return h.updateStatus()
 	}
 	return nil
 }
 
+// Records the status transitions of the provided resources (see recordTransition), matching their
+// previous statuses by name and namespace.
+func (h *DynamicEnvStatusHandler) recordTransitions(previous, current []riskifiedv1alpha1.ResourceStatus) []riskifiedv1alpha1.ResourceStatus {
+	if h.TransitionHistoryLimit <= 0 {
+		return current
+	}
+	result := make([]riskifiedv1alpha1.ResourceStatus, 0, len(current))
+	for _, s := range current {
+		for _, p := range previous {
+			if p.Name == s.Name && p.Namespace == s.Namespace {
+				s = h.recordTransition(p, s)
+				break
+			}
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// Returns the current status of a resource along with the transitions recorded for it so far, adding
+// a transition if its life cycle status has changed. Only the latest TransitionHistoryLimit
+// transitions are kept. The first status of a resource is not a transition.
+func (h *DynamicEnvStatusHandler) recordTransition(previous, current riskifiedv1alpha1.ResourceStatus) riskifiedv1alpha1.ResourceStatus {
+	if h.TransitionHistoryLimit <= 0 || previous.Name != current.Name || previous.Namespace != current.Namespace {
+		return current
+	}
+	transitions := current.Transitions
+	if transitions == nil {
+		transitions = append([]riskifiedv1alpha1.StatusTransition(nil), previous.Transitions...)
+	}
+	if previous.Status != "" && previous.Status != current.Status {
+		transitions = append(transitions, riskifiedv1alpha1.StatusTransition{
+			From: previous.Status,
+			To:   current.Status,
+			At:   metav1.Now(),
+		})
+	}
+	if len(transitions) > h.TransitionHistoryLimit {
+		transitions = transitions[len(transitions)-h.TransitionHistoryLimit:]
+	}
+	if len(transitions) > 0 {
+		current.Transitions = transitions
+	}
+	return current
+}
+
 func (h *DynamicEnvStatusHandler) safeGetSubsetsStatus(subset string) riskifiedv1alpha1.SubsetStatus {
 	if h.DynamicEnv.Status.SubsetsStatus == nil {
 		h.DynamicEnv.Status.SubsetsStatus = make(map[string]riskifiedv1alpha1.SubsetStatus)
@@ -197,10 +473,22 @@ func SyncStatusResources(
 	for _, resource := range currentStatuses {
 		newStatus := resource
 		if resource.Name == s.Name && resource.Namespace == s.Namespace {
+			if exists {
+				// Drop duplicate entries of the same resource (keeping the position of the first)
+				modified = true
+				continue
+			}
 			exists = true
-			if resource.Status != s.Status {
+			if resource.Status != s.Status || (s.ServiceHost != "" && resource.ServiceHost != s.ServiceHost) {
 				modified = true
 				newStatus = s
+				if newStatus.ServiceHost == "" {
+					newStatus.ServiceHost = resource.ServiceHost
+				}
+			} else if s.MissingSince != nil && !s.MissingSince.Equal(resource.MissingSince) {
+				// The same status keeps its MissingSince unless a new one is provided
+				modified = true
+				newStatus.MissingSince = s.MissingSince
 			}
 		}
 		result = append(result, newStatus)
@@ -212,6 +500,21 @@ func SyncStatusResources(
 	return modified, result
 }
 
+// SyncStatusResourceList syncs each of the provided statuses into the current ones (see
+// `SyncStatusResources`). Reports whether any of them modified the result.
+func SyncStatusResourceList(
+	statuses []riskifiedv1alpha1.ResourceStatus,
+	currentStatuses []riskifiedv1alpha1.ResourceStatus,
+) (modified bool, result []riskifiedv1alpha1.ResourceStatus) {
+	result = currentStatuses
+	for _, s := range statuses {
+		m, synced := SyncStatusResources(s, result)
+		modified = modified || m
+		result = synced
+	}
+	return modified, result
+}
+
 func SyncGlobalErrors(msg string, errors []riskifiedv1alpha1.StatusError) []riskifiedv1alpha1.StatusError {
 	var result []riskifiedv1alpha1.StatusError
 	if len(errors) == 0 {
@@ -238,7 +541,7 @@ func (h *DynamicEnvStatusHandler) setHashForSubset(name string, hash uint64) err
 	}
 	subsetStatus.Hash = int64(hash)
 	h.DynamicEnv.Status.SubsetsStatus[name] = subsetStatus
-	return h.Status().Update(h.Ctx, h.DynamicEnv)
+	return h.updateStatus()
 }
 
 func (h *DynamicEnvStatusHandler) setHashForConsumer(name string, hash uint64) error {
@@ -251,5 +554,5 @@ func (h *DynamicEnvStatusHandler) setHashForConsumer(name string, hash uint64) e
 	}
 	consumerStatus.Hash = int64(hash)
 	h.DynamicEnv.Status.ConsumersStatus[name] = consumerStatus
-	return h.Status().Update(h.Ctx, h.DynamicEnv)
+	return h.updateStatus()
 }
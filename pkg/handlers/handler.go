@@ -17,6 +17,10 @@ limitations under the License.
 package handlers
 
 import (
+	goerrors "errors"
+	"fmt"
+	"strings"
+
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
 )
 
@@ -54,3 +58,198 @@ type MRHandler interface {
 type IgnoredMissing struct{}
 
 func (im IgnoredMissing) Error() string { return "Ignored Missing Resource" }
+
+// MissingBaseDestinationRule indicates that there is no base DestinationRule for a hostname, while
+// such hosts may not be ignored (see `DestinationRuleHandler.StrictHosts`).
+type MissingBaseDestinationRule struct {
+	Host string
+}
+
+func (e MissingBaseDestinationRule) Error() string {
+	return fmt.Sprintf("no base destination rule was found for host %q", e.Host)
+}
+
+// AmbiguousBaseDestinationRule indicates that more than one DestinationRule could serve as the base
+// DestinationRule for a hostname (e.g. they all contain a subset with the default version).
+type AmbiguousBaseDestinationRule struct {
+	Host  string
+	Names []string
+}
+
+func (a AmbiguousBaseDestinationRule) Error() string {
+	return fmt.Sprintf("found multiple base destination rules for host %q: %s", a.Host, strings.Join(a.Names, ", "))
+}
+
+// BaseWithoutDefaultSubset indicates that there are DestinationRules for a hostname, but none of them
+// contains a subset with the default version (e.g. they only define top-level traffic policies). The
+// host is ignored (it wraps IgnoredMissing), but unlike a missing base DestinationRule the fix is to
+// add the default version subset.
+type BaseWithoutDefaultSubset struct {
+	Host    string
+	Version string
+	Names   []string
+}
+
+func (b BaseWithoutDefaultSubset) Error() string {
+	return fmt.Sprintf("base destination rules for host %q have no subset with the default version %q: %s",
+		b.Host, b.Version, strings.Join(b.Names, ", "))
+}
+
+func (b BaseWithoutDefaultSubset) Unwrap() error {
+	return IgnoredMissing{}
+}
+
+// BaseOptedOut indicates that the base DestinationRules of a hostname opted out of being overridden
+// (see `DestinationRuleHandler.NoOverrideAnnotation`). The host is ignored (it wraps IgnoredMissing).
+type BaseOptedOut struct {
+	Host  string
+	Names []string
+}
+
+func (b BaseOptedOut) Error() string {
+	return fmt.Sprintf("base destination rules for host %q opted out of being overridden: %s", b.Host, strings.Join(b.Names, ", "))
+}
+
+func (b BaseOptedOut) Unwrap() error {
+	return IgnoredMissing{}
+}
+
+// HostErrors combines the errors of several service hosts (so handling all of them is attempted
+// before failing). `errors.Is` and `errors.As` match any of the combined errors.
+type HostErrors []error
+
+func (e HostErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e HostErrors) Is(target error) bool {
+	for _, err := range e {
+		if goerrors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e HostErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if goerrors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Combines the provided errors into HostErrors (nil if there are none, the error itself if there is
+// only one).
+func joinHostErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return HostErrors(errs)
+}
+
+// MissingRequiredFields indicates that a handler was built without some of its required fields
+// (e.g. see NewDestinationRuleHandler).
+type MissingRequiredFields struct {
+	Handler string
+	Fields  []string
+}
+
+func (e MissingRequiredFields) Error() string {
+	return fmt.Sprintf("%s is missing required fields: %s", e.Handler, strings.Join(e.Fields, ", "))
+}
+
+// InvalidServiceHost indicates that a service host of the subset is empty or malformed (see
+// `helpers.ValidateServiceHost`), so it's skipped.
+type InvalidServiceHost struct {
+	Host   string
+	Reason error
+}
+
+func (e InvalidServiceHost) Error() string {
+	return fmt.Sprintf("skipping destination rule: %s", e.Reason)
+}
+
+func (e InvalidServiceHost) Unwrap() error {
+	return e.Reason
+}
+
+// DestinationRuleNameCollision indicates that the DestinationRule name of a service host collides
+// with the one of another host of the subset (e.g. their hashes collide), so it's skipped rather
+// than clobbering the rule of the other host.
+type DestinationRuleNameCollision struct {
+	Name         string
+	Host         string
+	CollidesWith string
+}
+
+func (e DestinationRuleNameCollision) Error() string {
+	return fmt.Sprintf("destination rule name %q of host %s collides with the one of host %s", e.Name, e.Host, e.CollidesWith)
+}
+
+// NamespaceNotAllowed indicates that the controller may not create resources in the namespace (see
+// `DestinationRuleHandler.AllowedNamespaces`).
+type NamespaceNotAllowed struct {
+	Namespace string
+}
+
+func (n NamespaceNotAllowed) Error() string {
+	return fmt.Sprintf("creating destination rules in namespace %q is not allowed", n.Namespace)
+}
+
+// NoBaseDestinationRules indicates that none of the hosts of a subset got an overriding
+// DestinationRule. IgnoredMissing lists the hosts without a matching base DestinationRule,
+// MissingDefaultSubset the hosts whose base DestinationRules lack the default version subset,
+// OptedOut the hosts whose base DestinationRules opted out of being overridden and Missing lists the
+// rest. It wraps IgnoredMissing if any of the hosts were ignored.
+type NoBaseDestinationRules struct {
+	Subset               string
+	IgnoredMissing       []string
+	MissingDefaultSubset []string
+	OptedOut             []string
+	Missing              []string
+}
+
+func (n NoBaseDestinationRules) Error() string {
+	msg := fmt.Sprintf("no base destination rules were found for subset: %s", n.Subset)
+	if len(n.IgnoredMissing) > 0 {
+		msg += fmt.Sprintf(" (ignored missing hosts: %s)", strings.Join(n.IgnoredMissing, ", "))
+	}
+	if len(n.MissingDefaultSubset) > 0 {
+		msg += fmt.Sprintf(" (hosts missing the default subset: %s)", strings.Join(n.MissingDefaultSubset, ", "))
+	}
+	if len(n.OptedOut) > 0 {
+		msg += fmt.Sprintf(" (opted out hosts: %s)", strings.Join(n.OptedOut, ", "))
+	}
+	if len(n.Missing) > 0 {
+		msg += fmt.Sprintf(" (missing hosts: %s)", strings.Join(n.Missing, ", "))
+	}
+	return msg
+}
+
+func (n NoBaseDestinationRules) Unwrap() error {
+	if len(n.IgnoredMissing) > 0 || len(n.MissingDefaultSubset) > 0 || len(n.OptedOut) > 0 {
+		return IgnoredMissing{}
+	}
+	return nil
+}
+
+// SupersededGeneration indicates that the DynamicEnv was modified (or its status was written for a
+// newer generation) while we were reconciling an older generation of it. Writing our changes would
+// override the ones of the newer generation, which is reconciled by its own loop.
+type SupersededGeneration struct {
+	Generation int64
+	Latest     int64
+}
+
+func (s SupersededGeneration) Error() string {
+	return fmt.Sprintf("generation %d of the dynamic environment was superseded by generation %d", s.Generation, s.Latest)
+}
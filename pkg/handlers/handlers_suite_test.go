@@ -20,8 +20,16 @@ import (
 	"context"
 	"testing"
 
+	"github.com/go-logr/logr"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"github.com/riskified/dynamic-environment/pkg/handlers"
+	"istio.io/api/networking/v1alpha3"
+	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -36,8 +44,14 @@ func TestAPIs(t *testing.T) {
 // see: https://stackoverflow.com/questions/31362044/anonymous-interface-implementation-in-golang
 type MockClient struct {
 	client.Client
-	getMethod  func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error
-	listMethod func(context.Context, client.ObjectList, ...client.ListOption) error
+	getMethod    func(context.Context, types.NamespacedName, client.Object, ...client.GetOption) error
+	listMethod   func(context.Context, client.ObjectList, ...client.ListOption) error
+	updateMethod func(context.Context, client.Object, ...client.UpdateOption) error
+	deleteMethod func(context.Context, client.Object, ...client.DeleteOption) error
+	createMethod func(context.Context, client.Object, ...client.CreateOption) error
+	patchMethod  func(context.Context, client.Object, client.Patch, ...client.PatchOption) error
+	// The status update method (defaults to success)
+	statusUpdateMethod func(context.Context, client.Object, ...client.SubResourceUpdateOption) error
 }
 
 func (m MockClient) Get(c context.Context, ns types.NamespacedName, o client.Object, _ ...client.GetOption) error {
@@ -48,18 +62,127 @@ func (m MockClient) List(c context.Context, l client.ObjectList, o ...client.Lis
 	return m.listMethod(c, l, o...)
 }
 
-func (m MockClient) Create(_ context.Context, _ client.Object, _ ...client.CreateOption) error {
-	return nil
+func (m MockClient) Update(c context.Context, o client.Object, opts ...client.UpdateOption) error {
+	if m.updateMethod == nil {
+		return nil
+	}
+	return m.updateMethod(c, o, opts...)
+}
+
+func (m MockClient) Delete(c context.Context, o client.Object, opts ...client.DeleteOption) error {
+	if m.deleteMethod == nil {
+		return nil
+	}
+	return m.deleteMethod(c, o, opts...)
+}
+
+func (m MockClient) Create(c context.Context, o client.Object, opts ...client.CreateOption) error {
+	if m.createMethod == nil {
+		return nil
+	}
+	return m.createMethod(c, o, opts...)
+}
+
+func (m MockClient) Patch(c context.Context, o client.Object, p client.Patch, opts ...client.PatchOption) error {
+	if m.patchMethod == nil {
+		return nil
+	}
+	return m.patchMethod(c, o, p, opts...)
 }
 
 func (m MockClient) Status() client.SubResourceWriter {
-	return MockStatus{}
+	return MockStatus{updateMethod: m.statusUpdateMethod}
 }
 
 type MockStatus struct {
 	client.SubResourceWriter
+	updateMethod func(context.Context, client.Object, ...client.SubResourceUpdateOption) error
+}
+
+func (m MockStatus) Update(c context.Context, o client.Object, opts ...client.SubResourceUpdateOption) error {
+	if m.updateMethod == nil {
+		return nil
+	}
+	return m.updateMethod(c, o, opts...)
+}
+
+// Builds the DestinationRuleHandler most of the DestinationRuleHandler specs start from: the "unique"
+// subset (version "version") of the "details" service host in the "ns" namespace, whose only base
+// DestinationRule is the one of `fixtureDestinationRule` and with no overriding DestinationRule yet.
+// The `mockClient` hook (if not nil) overrides the methods of the client before the handler (and its
+// status handler) captures it, and the `overrides` modify the fields of the built handler.
+func mkDestinationRuleHandler(mockClient func(*MockClient), overrides ...func(*handlers.DestinationRuleHandler)) handlers.DestinationRuleHandler {
+	mc := MockClient{}
+	mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+		o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{fixtureDestinationRule()}
+		return nil
+	}
+	mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+		return errors.NewNotFound(schema.GroupResource{}, key.Name)
+	}
+	if mockClient != nil {
+		mockClient(&mc)
+	}
+	h := handlers.DestinationRuleHandler{
+		Client:         mc,
+		UniqueName:     "unique",
+		UniqueVersion:  "version",
+		Namespace:      "ns",
+		VersionLabel:   "version",
+		DefaultVersion: "shared",
+		ServiceHosts:   []string{"details"},
+		StatusHandler: &handlers.DynamicEnvStatusHandler{
+			Client:     mc,
+			Ctx:        context.Background(),
+			DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+		},
+		Log: logr.Discard(),
+	}
+	for _, override := range overrides {
+		override(&h)
+	}
+	return h
+}
+
+// Replaces the client of the handler and of its status handler (see `mkDestinationRuleHandler`),
+// e.g. with a client built by the spec.
+func withClient(c client.Client) func(*handlers.DestinationRuleHandler) {
+	return func(h *handlers.DestinationRuleHandler) {
+		h.Client = c
+		h.StatusHandler.Client = c
+	}
+}
+
+// A list method returning the provided DestinationRules
+func listingDestinationRules(drs ...*istionetwork.DestinationRule) func(context.Context, client.ObjectList, ...client.ListOption) error {
+	return func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+		o.(*istionetwork.DestinationRuleList).Items = drs
+		return nil
+	}
+}
+
+// A create method recording the created DestinationRules
+func recordingCreated(created *[]*istionetwork.DestinationRule) func(context.Context, client.Object, ...client.CreateOption) error {
+	return func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+		*created = append(*created, o.(*istionetwork.DestinationRule))
+		return nil
+	}
+}
+
+// The base DestinationRule of the "details" host in the "ns" namespace (with the "shared" subset)
+func fixtureDestinationRule() *istionetwork.DestinationRule {
+	dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+	Expect(err).To(BeNil())
+	return dr
 }
 
-func (_ MockStatus) Update(_ context.Context, _ client.Object, _ ...client.SubResourceUpdateOption) error {
-	return nil
+// A base DestinationRule of the provided host with the "shared" subset
+func mkBaseDestinationRule(name, namespace, host string) *istionetwork.DestinationRule {
+	return &istionetwork.DestinationRule{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: v1alpha3.DestinationRule{
+			Host:    host,
+			Subsets: []*v1alpha3.Subset{{Name: "shared", Labels: map[string]string{"version": "shared"}}},
+		},
+	}
 }
@@ -0,0 +1,215 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"github.com/riskified/dynamic-environment/pkg/helpers"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// Handles the provided (valid) hosts using up to HostConcurrency workers and returns their errors
+// (in the order of the hosts). Every host is handled by a copy of the handler that collects its
+// outcomes, which are merged back in the order of the hosts once all of them were handled, so the
+// results do not depend on the order the workers finished in. The statuses of the hosts are only
+// recorded after the merge (except the ones of the created rules, see createMissingDestinationRule).
+func (h *DestinationRuleHandler) handleHostsConcurrently(hosts []string) []error {
+	// List the DestinationRules once up front, instead of by each of the workers. Failures are
+	// reported by the workers that need them.
+	for _, serviceHost := range hosts {
+		_, _ = h.listDestinationRules(h.drNamespace(serviceHost))
+	}
+	h.statusMu = &sync.Mutex{}
+	defer func() { h.statusMu = nil }()
+
+	workers := make([]*DestinationRuleHandler, len(hosts))
+	errs := make([]error, len(hosts))
+	var group errgroup.Group
+	group.SetLimit(h.HostConcurrency)
+	for i, serviceHost := range hosts {
+		i, serviceHost := i, serviceHost
+		workers[i] = h.hostWorker()
+		group.Go(func() error {
+			errs[i] = workers[i].handleHost(serviceHost)
+			return nil
+		})
+	}
+	_ = group.Wait()
+	for _, w := range workers {
+		h.mergeWorker(w)
+	}
+	for _, serviceHost := range hosts {
+		h.recordHostStatus(serviceHost)
+	}
+	if err := h.flushStatuses(true); err != nil {
+		h.Log.Error(err, "Failed persisting the statuses of the handled hosts")
+	}
+	if err := h.sortStatusEntries(); err != nil {
+		h.Log.Error(err, "Failed persisting the order of the statuses of the handled hosts")
+	}
+	return errs
+}
+
+// Orders the status entries of our DestinationRules by the order of their hosts, since the workers
+// add the entries of the rules they create (see createMissingDestinationRule) in the order they get
+// to them. Entries of other hosts are kept last. Persisted only if the order changed.
+func (h *DestinationRuleHandler) sortStatusEntries() error {
+	if h.StatusHandler == nil || h.StatusHandler.DynamicEnv == nil {
+		return nil
+	}
+	position := make(map[string]int, len(h.ServiceHosts))
+	for i, serviceHost := range h.ServiceHosts {
+		position[strings.ToLower(serviceHost)] = i
+	}
+	positionOf := func(s riskifiedv1alpha1.ResourceStatus) int {
+		if p, ok := position[strings.ToLower(s.ServiceHost)]; ok {
+			return p
+		}
+		return len(h.ServiceHosts)
+	}
+	entries := append([]riskifiedv1alpha1.ResourceStatus(nil),
+		h.StatusHandler.DynamicEnv.Status.SubsetsStatus[h.UniqueName].DestinationRules...)
+	less := func(i, j int) bool { return positionOf(entries[i]) < positionOf(entries[j]) }
+	if sort.SliceIsSorted(entries, less) {
+		return nil
+	}
+	sort.SliceStable(entries, less)
+	return h.StatusHandler.SetDestinationRuleStatuses(h.UniqueName, entries)
+}
+
+// Returns a copy of the handler for handling a single host concurrently with the others: it
+// collects its own outcomes and works on copies of the caches, while the access to the status
+// handler (and the events about the DynamicEnv) is serialized with the other workers.
+func (h *DestinationRuleHandler) hostWorker() *DestinationRuleHandler {
+	w := new(DestinationRuleHandler)
+	*w = *h
+	w.ignoredMissing, w.activeHosts, w.ambiguous, w.conflicting = nil, nil, nil, nil
+	w.missingDefaultSubset, w.optedOut, w.satisfiedByBase, w.pending = nil, nil, nil, nil
+	w.awaitingBase, w.missingBase, w.notAllowed, w.excluded, w.unrecorded = nil, nil, nil, nil, nil
+	w.subsetNames, w.planned, w.unflushed = nil, nil, nil
+	w.missingSince = copyMap(h.missingSince)
+	w.destinationRules = copyMap(h.destinationRules)
+	w.resolvedServices = copyMap(h.resolvedServices)
+	if c, ok := w.Client.(dryRunClient); ok {
+		c.planned = &w.planned
+		w.Client = c
+	}
+	if w.Recorder != nil {
+		w.Recorder = lockedRecorder{EventRecorder: w.Recorder, mu: h.statusMu}
+	}
+	return w
+}
+
+// Merges the outcomes collected by the provided worker (see hostWorker).
+func (h *DestinationRuleHandler) mergeWorker(w *DestinationRuleHandler) {
+	h.ignoredMissing = mergeHosts(h.ignoredMissing, w.ignoredMissing)
+	h.activeHosts = mergeHosts(h.activeHosts, w.activeHosts)
+	h.ambiguous = mergeHosts(h.ambiguous, w.ambiguous)
+	h.conflicting = mergeHosts(h.conflicting, w.conflicting)
+	h.missingDefaultSubset = mergeHosts(h.missingDefaultSubset, w.missingDefaultSubset)
+	h.optedOut = mergeHosts(h.optedOut, w.optedOut)
+	h.satisfiedByBase = mergeHosts(h.satisfiedByBase, w.satisfiedByBase)
+	h.pending = mergeHosts(h.pending, w.pending)
+	h.awaitingBase = mergeHosts(h.awaitingBase, w.awaitingBase)
+	h.missingBase = mergeHosts(h.missingBase, w.missingBase)
+	h.notAllowed = mergeHosts(h.notAllowed, w.notAllowed)
+	h.excluded = mergeHosts(h.excluded, w.excluded)
+	h.unrecorded = mergeHosts(h.unrecorded, w.unrecorded)
+	for serviceHost, name := range w.subsetNames {
+		h.setSubsetName(serviceHost, name)
+	}
+	h.planned = append(h.planned, w.planned...)
+	h.missingSince = mergeMap(h.missingSince, w.missingSince)
+	h.destinationRules = mergeMap(h.destinationRules, w.destinationRules)
+	h.resolvedServices = mergeMap(h.resolvedServices, w.resolvedServices)
+}
+
+// Runs the provided function while holding the lock of the status handler, if the hosts are
+// handled concurrently (see HostConcurrency).
+func (h *DestinationRuleHandler) withStatusLock(f func()) {
+	if h.statusMu != nil {
+		h.statusMu.Lock()
+		defer h.statusMu.Unlock()
+	}
+	f()
+}
+
+// Appends the hosts that are not already in dst (ignoring case).
+func mergeHosts(dst, src []string) []string {
+	for _, serviceHost := range src {
+		if !helpers.StringSliceContainsFold(serviceHost, dst) {
+			dst = append(dst, serviceHost)
+		}
+	}
+	return dst
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	if m == nil {
+		return nil
+	}
+	result := make(map[K]V, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
+// Adds the entries of src that are missing from dst.
+func mergeMap[K comparable, V any](dst, src map[K]V) map[K]V {
+	for k, v := range src {
+		if _, ok := dst[k]; ok {
+			continue
+		}
+		if dst == nil {
+			dst = make(map[K]V, len(src))
+		}
+		dst[k] = v
+	}
+	return dst
+}
+
+// An EventRecorder holding the lock of the status handler while recording, since the events refer
+// to the DynamicEnv that the status writes of the other workers modify.
+type lockedRecorder struct {
+	record.EventRecorder
+	mu *sync.Mutex
+}
+
+func (r lockedRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.EventRecorder.Event(object, eventtype, reason, message)
+}
+
+func (r lockedRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.EventRecorder.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func (r lockedRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.EventRecorder.AnnotatedEventf(object, annotations, eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"github.com/riskified/dynamic-environment/pkg/helpers"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// Kubernetes limits resource names to 253 characters.
+	maxDRNameLength = validation.DNS1123SubdomainMaxLength
+	// The length of the service host hash used in overflowing DestinationRule names.
+	drNameHashLength = 10
+	// The length of the service host hash used when the short hashes of two hosts collide.
+	drNameLongHashLength = 32
+)
+
+// Hashes the service hosts for the DestinationRule names (overridden in tests to force collisions).
+var hashServiceHost = func(serviceHost string) string {
+	return helpers.AsSha256(serviceHost)
+}
+
+// NameStrategy computes the names of the DestinationRules we generate. It must be deterministic, as
+// the same names are computed when creating the rules and when reporting their status.
+type NameStrategy interface {
+	// DestinationRuleName returns the name of the DestinationRule for the provided service host. The
+	// prefix is the unique name of the subset (or the shared prefix for shared DestinationRules).
+	DestinationRuleName(prefix, serviceHost string) string
+}
+
+// DefaultNameStrategy names the DestinationRules `<prefix>-<service host>`, replacing the service
+// host with its hash if the result is not a valid resource name (e.g. too long). IPv6 hosts are
+// sanitized first (see `helpers.SanitizeHostForName`).
+type DefaultNameStrategy struct{}
+
+func (DefaultNameStrategy) DestinationRuleName(prefix, serviceHost string) string {
+	serviceHost = helpers.SanitizeHostForName(serviceHost)
+	name := prefix + "-" + serviceHost
+	if len(name) <= maxDRNameLength && len(validation.IsDNS1123Subdomain(name)) == 0 {
+		return name
+	}
+	return hashedDRName(prefix, serviceHost, drNameHashLength)
+}
+
+// Names the DestinationRule `<prefix>-<hash of the service host>`, shortening the hash if required
+// to keep the name within the allowed length.
+func hashedDRName(prefix, serviceHost string, hashLength int) string {
+	if available := maxDRNameLength - len(prefix) - 1; hashLength > available {
+		hashLength = available
+	}
+	return prefix + "-" + helpers.Shorten(hashServiceHost(serviceHost), hashLength)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers_test
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"github.com/riskified/dynamic-environment/pkg/handlers"
+	"github.com/riskified/dynamic-environment/pkg/helpers"
+	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Prefixes the default names with the owning team (e.g. `payments-<prefix>-<host>`)
+type teamNameStrategy struct {
+	team string
+}
+
+func (t teamNameStrategy) DestinationRuleName(prefix, serviceHost string) string {
+	return t.team + "-" + handlers.DefaultNameStrategy{}.DestinationRuleName(prefix, serviceHost)
+}
+
+var _ = Describe("DefaultNameStrategy", func() {
+	strategy := handlers.DefaultNameStrategy{}
+
+	It("concatenates the prefix and the service host", func() {
+		Expect(strategy.DestinationRuleName("details-default-simple", "details")).To(Equal("details-default-simple-details"))
+	})
+
+	It("hashes service hosts that would make an invalid (or too long) name", func() {
+		prefix := strings.Repeat("a", 200)
+		name := strategy.DestinationRuleName(prefix, strings.Repeat("payments.", 10)+"svc.cluster.local")
+		Expect(len(name)).To(BeNumerically("<=", 253))
+		Expect(name).To(HavePrefix(prefix + "-"))
+		Expect(name).NotTo(ContainSubstring("payments"))
+		Expect(strategy.DestinationRuleName("unique", "Details")).To(HavePrefix("unique-"))
+		Expect(strategy.DestinationRuleName("unique", "Details")).NotTo(ContainSubstring("Details"))
+	})
+
+	It("sanitizes IPv6 service hosts", func() {
+		Expect(strategy.DestinationRuleName("unique", "[2001:db8::1]")).To(Equal("unique-2001-db8--1"))
+		Expect(strategy.DestinationRuleName("unique", "::1")).To(Equal("unique---1"))
+	})
+})
+
+var _ = Describe("Custom name strategies", func() {
+	It("names the created destination rules and their statuses consistently", func() {
+		var created []string
+		mc := struct{ MockClient }{}
+		mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+			dr, err := destinationRuleFromYaml("fixtures/destination-rule-with-unrelated-hostname.yaml")
+			Expect(err).To(BeNil())
+			o.(*istionetwork.DestinationRuleList).Items = []*istionetwork.DestinationRule{dr}
+			return nil
+		}
+		mc.getMethod = func(_ context.Context, key types.NamespacedName, _ client.Object, _ ...client.GetOption) error {
+			if helpers.StringSliceContains(key.Name, created) {
+				return nil
+			}
+			return errors.NewNotFound(schema.GroupResource{}, key.Name)
+		}
+		mc.createMethod = func(_ context.Context, o client.Object, _ ...client.CreateOption) error {
+			created = append(created, o.GetName())
+			return nil
+		}
+		handler := handlers.DestinationRuleHandler{
+			Client:         mc,
+			UniqueName:     "unique",
+			UniqueVersion:  "version",
+			Namespace:      "ns",
+			VersionLabel:   "version",
+			DefaultVersion: "shared",
+			ServiceHosts:   []string{"details"},
+			NameStrategy:   teamNameStrategy{team: "payments"},
+			StatusHandler: &handlers.DynamicEnvStatusHandler{
+				Client:     mc,
+				Ctx:        context.Background(),
+				DynamicEnv: &riskifiedv1alpha1.DynamicEnv{},
+			},
+			Log: logr.Discard(),
+		}
+		Expect(handler.Handle()).To(Succeed())
+		Expect(created).To(Equal([]string{"payments-unique-details"}))
+		statuses, err := handler.GetStatus()
+		Expect(err).To(BeNil())
+		Expect(statuses).To(HaveLen(1))
+		Expect(statuses[0].Name).To(Equal("payments-unique-details"))
+		Expect(statuses[0].Status).To(Equal(riskifiedv1alpha1.Running))
+	})
+})
@@ -0,0 +1,111 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PlannedOperation is the kind of write a handler would have done if it wasn't in dry-run mode.
+type PlannedOperation string
+
+const (
+	PlannedCreate PlannedOperation = "create"
+	PlannedUpdate PlannedOperation = "update"
+	PlannedDelete PlannedOperation = "delete"
+	PlannedApply  PlannedOperation = "apply"
+)
+
+// PlannedChange is a single write a handler would have done if it wasn't in dry-run mode.
+type PlannedChange struct {
+	Operation PlannedOperation
+	// The object as it would have been written
+	Object client.Object
+}
+
+// A client that records all the writes (instead of sending them to the API server) while reads are
+// passed to the wrapped client. Status writes are dropped.
+type dryRunClient struct {
+	client.Client
+	planned *[]PlannedChange
+}
+
+func (c dryRunClient) record(operation PlannedOperation, obj client.Object) {
+	*c.planned = append(*c.planned, PlannedChange{Operation: operation, Object: obj.DeepCopyObject().(client.Object)})
+}
+
+func (c dryRunClient) Create(_ context.Context, obj client.Object, _ ...client.CreateOption) error {
+	c.record(PlannedCreate, obj)
+	return nil
+}
+
+func (c dryRunClient) Update(_ context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	c.record(PlannedUpdate, obj)
+	return nil
+}
+
+func (c dryRunClient) Patch(_ context.Context, obj client.Object, patch client.Patch, _ ...client.PatchOption) error {
+	if patch.Type() == types.ApplyPatchType {
+		c.record(PlannedApply, obj)
+		return nil
+	}
+	c.record(PlannedUpdate, obj)
+	return nil
+}
+
+func (c dryRunClient) Delete(_ context.Context, obj client.Object, _ ...client.DeleteOption) error {
+	c.record(PlannedDelete, obj)
+	return nil
+}
+
+func (c dryRunClient) Status() client.SubResourceWriter {
+	return dryRunStatusWriter{}
+}
+
+type dryRunStatusWriter struct{}
+
+func (dryRunStatusWriter) Create(context.Context, client.Object, client.Object, ...client.SubResourceCreateOption) error {
+	return nil
+}
+
+func (dryRunStatusWriter) Update(context.Context, client.Object, ...client.SubResourceUpdateOption) error {
+	return nil
+}
+
+func (dryRunStatusWriter) Patch(context.Context, client.Object, client.Patch, ...client.SubResourcePatchOption) error {
+	return nil
+}
+
+// Returns a client recording the writes into `planned` along with a status handler that works on a
+// copy of the DynamicEnv (so neither the API server nor the in-memory status are modified).
+func enableDryRun(c client.Client, statusHandler *DynamicEnvStatusHandler, planned *[]PlannedChange) (client.Client, *DynamicEnvStatusHandler) {
+	if _, ok := c.(dryRunClient); ok {
+		return c, statusHandler
+	}
+	if statusHandler != nil {
+		statusHandler = &DynamicEnvStatusHandler{
+			Client:                 dryRunClient{Client: statusHandler.Client, planned: planned},
+			Ctx:                    statusHandler.Ctx,
+			DynamicEnv:             statusHandler.DynamicEnv.DeepCopy(),
+			TransitionHistoryLimit: statusHandler.TransitionHistoryLimit,
+		}
+	}
+	return dryRunClient{Client: c, planned: planned}, statusHandler
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/time/rate"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// A client that waits for the limiter before every write while reads are passed to the wrapped
+// client as is. Waiting is aborted once the context of the call is done, so a canceled (or timed
+// out) reconcile never blocks on the limiter.
+type rateLimitedClient struct {
+	client.Client
+	limiter *rate.Limiter
+}
+
+func (c rateLimitedClient) wait(ctx context.Context) error {
+	if err := c.limiter.Wait(ctx); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// The context would be done before a token is available
+		return fmt.Errorf("waiting for the write rate limiter: %w", err)
+	}
+	return nil
+}
+
+func (c rateLimitedClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c rateLimitedClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c rateLimitedClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c rateLimitedClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+// Returns a client whose writes are throttled by the provided limiter (the provided client if there
+// is no limiter or it's throttled already).
+func limitWrites(c client.Client, limiter *rate.Limiter) client.Client {
+	if limiter == nil {
+		return c
+	}
+	if _, ok := c.(rateLimitedClient); ok {
+		return c
+	}
+	return rateLimitedClient{Client: c, limiter: limiter}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The defaults of RequeueBackoff
+const (
+	DefaultRequeueBackoff    = time.Second
+	DefaultMaxRequeueBackoff = time.Minute
+)
+
+// RequeueBackoff computes the delays before reconciling again the DynamicEnvs whose resources did
+// not converge yet (see RequiresRequeue). The delay is doubled on every consecutive attempt of a
+// DynamicEnv (up to Max) and starts over once it is Reset.
+type RequeueBackoff struct {
+	// The delay of the first attempt (defaults to DefaultRequeueBackoff)
+	Base time.Duration
+	// The maximum delay (defaults to DefaultMaxRequeueBackoff)
+	Max time.Duration
+
+	mu       sync.Mutex
+	attempts map[types.NamespacedName]int
+}
+
+func NewRequeueBackoff(base, max time.Duration) *RequeueBackoff {
+	return &RequeueBackoff{Base: base, Max: max}
+}
+
+// Next returns the delay before the next attempt of the provided DynamicEnv and counts the attempt.
+func (b *RequeueBackoff) Next(key types.NamespacedName) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.attempts == nil {
+		b.attempts = map[types.NamespacedName]int{}
+	}
+	base, limit := b.Base, b.Max
+	if base <= 0 {
+		base = DefaultRequeueBackoff
+	}
+	if limit <= 0 {
+		limit = DefaultMaxRequeueBackoff
+	}
+	delay := base
+	for i := 0; i < b.attempts[key] && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	b.attempts[key]++
+	return delay
+}
+
+// Reset starts the delays of the provided DynamicEnv over (e.g. once it converged or was deleted).
+func (b *RequeueBackoff) Reset(key types.NamespacedName) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.attempts, key)
+}
+
+// RequiresRequeue returns whether any of the provided statuses is expected to change without a
+// change to the DynamicEnv or to the resources we watch (e.g. a DestinationRule that is still
+// initializing or missing), so the DynamicEnv should be reconciled again.
+func RequiresRequeue(statuses []riskifiedv1alpha1.ResourceStatus) bool {
+	for _, s := range statuses {
+		if s.Status == riskifiedv1alpha1.Initializing || s.Status == riskifiedv1alpha1.Missing {
+			return true
+		}
+	}
+	return false
+}
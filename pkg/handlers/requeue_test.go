@@ -0,0 +1,82 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"github.com/riskified/dynamic-environment/pkg/handlers"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("RequeueBackoff", func() {
+	de := types.NamespacedName{Namespace: "ns", Name: "de"}
+	other := types.NamespacedName{Namespace: "ns", Name: "other"}
+
+	It("doubles the delay up to the maximum", func() {
+		b := handlers.NewRequeueBackoff(time.Second, 5*time.Second)
+		var delays []time.Duration
+		for i := 0; i < 5; i++ {
+			delays = append(delays, b.Next(de))
+		}
+		Expect(delays).To(Equal([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}))
+	})
+
+	It("backs off each dynamic environment independently", func() {
+		b := handlers.NewRequeueBackoff(time.Second, time.Minute)
+		b.Next(de)
+		b.Next(de)
+		Expect(b.Next(other)).To(Equal(time.Second))
+		Expect(b.Next(de)).To(Equal(4 * time.Second))
+	})
+
+	It("starts over once reset", func() {
+		b := handlers.NewRequeueBackoff(time.Second, time.Minute)
+		b.Next(de)
+		b.Next(de)
+		b.Reset(de)
+		Expect(b.Next(de)).To(Equal(time.Second))
+	})
+
+	It("uses the defaults when not configured", func() {
+		b := &handlers.RequeueBackoff{}
+		Expect(b.Next(de)).To(Equal(handlers.DefaultRequeueBackoff))
+		for i := 0; i < 20; i++ {
+			b.Next(de)
+		}
+		Expect(b.Next(de)).To(Equal(handlers.DefaultMaxRequeueBackoff))
+	})
+})
+
+var _ = DescribeTable(
+	"RequiresRequeue",
+	func(expected bool, statuses ...riskifiedv1alpha1.LifeCycleStatus) {
+		var resourceStatuses []riskifiedv1alpha1.ResourceStatus
+		for _, s := range statuses {
+			resourceStatuses = append(resourceStatuses, riskifiedv1alpha1.ResourceStatus{Name: "dr", Status: s})
+		}
+		Expect(handlers.RequiresRequeue(resourceStatuses)).To(Equal(expected))
+	},
+	Entry("initializing resource", true, riskifiedv1alpha1.Running, riskifiedv1alpha1.Initializing),
+	Entry("missing resource", true, riskifiedv1alpha1.Missing),
+	Entry("running resources", false, riskifiedv1alpha1.Running, riskifiedv1alpha1.Running),
+	Entry("ignored missing resource", false, riskifiedv1alpha1.IgnoredMissingDR),
+	Entry("no resources", false),
+)
@@ -0,0 +1,95 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/riskified/dynamic-environment/pkg/helpers"
+	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// LocateMatchingServiceHosts returns the (sorted) hosts of the Services in the provided namespace
+// whose selector selects the provided pod labels. With `serviceEntryHosts` the hosts of the
+// ServiceEntries whose workload selector selects them are included as well. Fails if there are no
+// such hosts.
+func LocateMatchingServiceHosts(ctx context.Context, c client.Reader, namespace string, ls labels.Set, serviceEntryHosts bool) (serviceHosts []string, err error) {
+	services := v1.ServiceList{}
+	var matchingServices []v1.Service
+	if err := c.List(ctx, &services, client.InNamespace(namespace)); err != nil {
+		return serviceHosts, fmt.Errorf("error fetching services list for namespace %s: %w", namespace, err)
+	}
+	for _, service := range services.Items {
+		var matcher labels.Set = service.Spec.Selector
+		selector, err := matcher.AsValidatedSelector()
+		if err != nil {
+			return serviceHosts, fmt.Errorf("error converting service selector (from: %v): %w", matcher, err)
+		}
+		if selector.Matches(ls) {
+			matchingServices = append(matchingServices, service)
+		}
+	}
+	var entryHosts []string
+	if serviceEntryHosts {
+		if entryHosts, err = locateMatchingServiceEntryHosts(ctx, c, namespace, ls); err != nil {
+			return serviceHosts, err
+		}
+	}
+
+	switch len(matchingServices) + len(entryHosts) {
+	case 0:
+		return serviceHosts, fmt.Errorf("couldn't find service with matching labels: (%v) in namespace: %s", ls, namespace)
+	default:
+		for _, sh := range matchingServices {
+			serviceHosts = append(serviceHosts, sh.Name)
+		}
+		serviceHosts = append(serviceHosts, entryHosts...)
+		// This is mainly to be able to test multiple services in Kuttl, but since I'm not expecting more than a few
+		// elements the effect is eligible.
+		sort.Strings(serviceHosts)
+		return serviceHosts, nil
+	}
+}
+
+// Returns the hosts of the ServiceEntries (in the provided namespace) whose workload selector selects
+// the provided labels.
+func locateMatchingServiceEntryHosts(ctx context.Context, c client.Reader, namespace string, ls labels.Set) ([]string, error) {
+	serviceEntries := istionetwork.ServiceEntryList{}
+	if err := c.List(ctx, &serviceEntries, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("error fetching service entries list for namespace %s: %w", namespace, err)
+	}
+	var hosts []string
+	for _, se := range serviceEntries.Items {
+		if se.Spec.WorkloadSelector == nil || len(se.Spec.WorkloadSelector.Labels) == 0 {
+			continue
+		}
+		var matcher labels.Set = se.Spec.WorkloadSelector.Labels
+		selector, err := matcher.AsValidatedSelector()
+		if err != nil {
+			return nil, fmt.Errorf("error converting service entry workload selector (from: %v): %w", matcher, err)
+		}
+		if selector.Matches(ls) {
+			hosts = helpers.UniqueStringSlice(append(hosts, se.Spec.Hosts...))
+		}
+	}
+	return hosts, nil
+}
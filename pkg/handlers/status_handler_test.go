@@ -17,9 +17,16 @@ limitations under the License.
 package handlers_test
 
 import (
+	"context"
+	"fmt"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"time"
 
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
@@ -27,6 +34,7 @@ import (
 )
 
 var _ = Describe("SyncStatusResources", func() {
+	missingSince := metav1.NewTime(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
 	defaultResources := []riskifiedv1alpha1.ResourceStatus{
 		{
 			Name:      "event1",
@@ -113,6 +121,95 @@ var _ = Describe("SyncStatusResources", func() {
 				},
 			},
 		),
+		Entry(
+			"when the same status is provided without the time the base went missing",
+			riskifiedv1alpha1.ResourceStatus{
+				Name:      "event1",
+				Namespace: "ns",
+				Status:    riskifiedv1alpha1.Initializing,
+			},
+			[]riskifiedv1alpha1.ResourceStatus{
+				{
+					Name:         "event1",
+					Namespace:    "ns",
+					Status:       riskifiedv1alpha1.Initializing,
+					MissingSince: &missingSince,
+				},
+			},
+			false,
+			[]riskifiedv1alpha1.ResourceStatus{
+				{
+					Name:         "event1",
+					Namespace:    "ns",
+					Status:       riskifiedv1alpha1.Initializing,
+					MissingSince: &missingSince,
+				},
+			},
+		),
+		Entry(
+			"when the same status is provided with the time the base went missing",
+			riskifiedv1alpha1.ResourceStatus{
+				Name:         "event1",
+				Namespace:    "ns",
+				Status:       riskifiedv1alpha1.Initializing,
+				MissingSince: &missingSince,
+			},
+			[]riskifiedv1alpha1.ResourceStatus{
+				{
+					Name:      "event1",
+					Namespace: "ns",
+					Status:    riskifiedv1alpha1.Initializing,
+				},
+			},
+			true,
+			[]riskifiedv1alpha1.ResourceStatus{
+				{
+					Name:         "event1",
+					Namespace:    "ns",
+					Status:       riskifiedv1alpha1.Initializing,
+					MissingSince: &missingSince,
+				},
+			},
+		),
+		Entry(
+			"when provided resource appears more than once",
+			riskifiedv1alpha1.ResourceStatus{
+				Name:      "event1",
+				Namespace: "ns",
+				Status:    riskifiedv1alpha1.Running,
+			},
+			[]riskifiedv1alpha1.ResourceStatus{
+				{Name: "event1", Namespace: "ns", Status: riskifiedv1alpha1.Unknown},
+				{Name: "event2", Namespace: "ns", Status: riskifiedv1alpha1.Unknown},
+				{Name: "event1", Namespace: "ns", Status: riskifiedv1alpha1.Unknown},
+			},
+			true,
+			[]riskifiedv1alpha1.ResourceStatus{
+				{Name: "event1", Namespace: "ns", Status: riskifiedv1alpha1.Running},
+				{Name: "event2", Namespace: "ns", Status: riskifiedv1alpha1.Unknown},
+			},
+		),
+		Entry(
+			"when the service host of an existing resource is recorded",
+			riskifiedv1alpha1.ResourceStatus{Name: "event1", Namespace: "ns", ServiceHost: "host", Status: riskifiedv1alpha1.Unknown},
+			defaultResources,
+			true,
+			[]riskifiedv1alpha1.ResourceStatus{
+				{Name: "event1", Namespace: "ns", ServiceHost: "host", Status: riskifiedv1alpha1.Unknown},
+				{Name: "event2", Namespace: "ns", Status: riskifiedv1alpha1.Unknown},
+			},
+		),
+		Entry(
+			"when the provided resource does not specify the recorded service host",
+			riskifiedv1alpha1.ResourceStatus{Name: "event1", Namespace: "ns", Status: riskifiedv1alpha1.Running},
+			[]riskifiedv1alpha1.ResourceStatus{
+				{Name: "event1", Namespace: "ns", ServiceHost: "host", Status: riskifiedv1alpha1.Unknown},
+			},
+			true,
+			[]riskifiedv1alpha1.ResourceStatus{
+				{Name: "event1", Namespace: "ns", ServiceHost: "host", Status: riskifiedv1alpha1.Running},
+			},
+		),
 		Entry(
 			"when current resources is empty",
 			riskifiedv1alpha1.ResourceStatus{
@@ -134,6 +231,48 @@ var _ = Describe("SyncStatusResources", func() {
 	// do something
 })
 
+var _ = Describe("AddDestinationRuleStatusEntry", func() {
+	It("keeps a single entry per destination rule across repeated calls", func() {
+		de := riskifiedv1alpha1.DynamicEnv{}
+		h := handlers.DynamicEnvStatusHandler{
+			Client:     &MockClient{},
+			Ctx:        context.Background(),
+			DynamicEnv: &de,
+		}
+		rs := riskifiedv1alpha1.ResourceStatus{Name: "dr", Namespace: "ns"}
+		for _, s := range []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Initializing, riskifiedv1alpha1.Initializing, riskifiedv1alpha1.Running} {
+			rs.Status = s
+			Expect(h.AddDestinationRuleStatusEntry("subset", rs)).To(Succeed())
+		}
+		Expect(de.Status.SubsetsStatus["subset"].DestinationRules).To(Equal([]riskifiedv1alpha1.ResourceStatus{
+			{Name: "dr", Namespace: "ns", Status: riskifiedv1alpha1.Running},
+		}))
+	})
+})
+
+var _ = Describe("SyncStatusResourceList", func() {
+	It("upserts all the statuses by name and namespace", func() {
+		current := []riskifiedv1alpha1.ResourceStatus{{Name: "dr1", Namespace: "ns", Status: riskifiedv1alpha1.Initializing}}
+		statuses := []riskifiedv1alpha1.ResourceStatus{
+			{Name: "dr1", Namespace: "ns", Status: riskifiedv1alpha1.Running},
+			{Name: "dr2", Namespace: "ns", Status: riskifiedv1alpha1.Running},
+			{Name: "dr2", Namespace: "ns", Status: riskifiedv1alpha1.Running},
+		}
+		modified, result := handlers.SyncStatusResourceList(statuses, current)
+		Expect(modified).To(BeTrue())
+		Expect(result).To(Equal(statuses[:2]))
+		modified, again := handlers.SyncStatusResourceList(statuses, result)
+		Expect(modified).To(BeFalse())
+		Expect(again).To(Equal(result))
+	})
+
+	It("is not modified without statuses", func() {
+		modified, result := handlers.SyncStatusResourceList(nil, nil)
+		Expect(modified).To(BeFalse())
+		Expect(result).To(BeEmpty())
+	})
+})
+
 var _ = Describe("SyncGlobalErrors", func() {
 
 	findErrorIndex := func(msg string, errors []riskifiedv1alpha1.StatusError) int {
@@ -373,3 +512,367 @@ var _ = Describe("SyncSubsetMessagesToStatus", func() {
 		})
 	})
 })
+
+var _ = Describe("SetCondition", func() {
+	readyCondition := metav1.Condition{
+		Type:   string(riskifiedv1alpha1.ConditionDestinationRulesReady),
+		Status: metav1.ConditionTrue,
+		Reason: "DestinationRulesReady",
+	}
+
+	It("adds a missing condition", func() {
+		var conditions []metav1.Condition
+		Expect(handlers.SetCondition(&conditions, readyCondition)).To(BeTrue())
+		Expect(conditions).To(HaveLen(1))
+		Expect(conditions[0].LastTransitionTime.IsZero()).To(BeFalse())
+	})
+
+	It("does not modify an identical condition", func() {
+		var conditions []metav1.Condition
+		handlers.SetCondition(&conditions, readyCondition)
+		Expect(handlers.SetCondition(&conditions, readyCondition)).To(BeFalse())
+		Expect(conditions).To(HaveLen(1))
+	})
+
+	It("updates the transition time only when the status changes", func() {
+		transitionTime := metav1.NewTime(time.Now().Add(-time.Hour))
+		existing := readyCondition
+		existing.LastTransitionTime = transitionTime
+		conditions := []metav1.Condition{existing}
+		updatedMessage := readyCondition
+		updatedMessage.Message = "new message"
+		Expect(handlers.SetCondition(&conditions, updatedMessage)).To(BeTrue())
+		Expect(conditions[0].LastTransitionTime).To(Equal(transitionTime))
+		Expect(conditions[0].Message).To(Equal("new message"))
+		notReady := readyCondition
+		notReady.Status = metav1.ConditionFalse
+		Expect(handlers.SetCondition(&conditions, notReady)).To(BeTrue())
+		Expect(conditions).To(HaveLen(1))
+		Expect(conditions[0].LastTransitionTime).NotTo(Equal(transitionTime))
+	})
+
+	It("finds conditions by type", func() {
+		conditions := []metav1.Condition{readyCondition}
+		Expect(handlers.GetCondition(conditions, readyCondition.Type)).To(Equal(&readyCondition))
+		Expect(handlers.GetCondition(conditions, string(riskifiedv1alpha1.ConditionReady))).To(BeNil())
+	})
+})
+
+var _ = Describe("SetGlobalState", func() {
+	mkHandler := func() handlers.DynamicEnvStatusHandler {
+		de := riskifiedv1alpha1.DynamicEnv{}
+		de.Generation = 3
+		return handlers.DynamicEnvStatusHandler{
+			Client:     &MockClient{},
+			Ctx:        context.Background(),
+			DynamicEnv: &de,
+		}
+	}
+
+	It("sets the ready condition according to the global state", func() {
+		h := mkHandler()
+		Expect(h.SetGlobalState(riskifiedv1alpha1.Degraded, 2, 1)).To(Succeed())
+		ready := handlers.GetCondition(h.DynamicEnv.Status.Conditions, string(riskifiedv1alpha1.ConditionReady))
+		Expect(ready).NotTo(BeNil())
+		Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+		Expect(ready.Reason).To(Equal("Degraded"))
+		Expect(ready.ObservedGeneration).To(Equal(int64(3)))
+	})
+
+	It("keeps the transition time while the ready status does not flip", func() {
+		h := mkHandler()
+		transitionTime := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+		h.DynamicEnv.Status.Conditions = []metav1.Condition{{
+			Type:               string(riskifiedv1alpha1.ConditionReady),
+			Status:             metav1.ConditionFalse,
+			Reason:             "Processing",
+			LastTransitionTime: transitionTime,
+		}}
+		Expect(h.SetGlobalState(riskifiedv1alpha1.Degraded, 2, 1)).To(Succeed())
+		Expect(h.SetGlobalState(riskifiedv1alpha1.Processing, 2, 0)).To(Succeed())
+		ready := handlers.GetCondition(h.DynamicEnv.Status.Conditions, string(riskifiedv1alpha1.ConditionReady))
+		Expect(ready.LastTransitionTime).To(Equal(transitionTime))
+
+		Expect(h.SetGlobalState(riskifiedv1alpha1.Ready, 2, 0)).To(Succeed())
+		ready = handlers.GetCondition(h.DynamicEnv.Status.Conditions, string(riskifiedv1alpha1.ConditionReady))
+		Expect(ready.Status).To(Equal(metav1.ConditionTrue))
+		Expect(ready.LastTransitionTime.After(transitionTime.Time)).To(BeTrue())
+	})
+})
+
+var _ = Describe("ComputeDynamicEnvPhase", func() {
+	DescribeTable(
+		"computes the phase from the combined statuses",
+		func(statuses []riskifiedv1alpha1.LifeCycleStatus, expected riskifiedv1alpha1.DynamicEnvPhase) {
+			Expect(handlers.ComputeDynamicEnvPhase(statuses)).To(Equal(expected))
+		},
+		Entry("no statuses", nil, riskifiedv1alpha1.PhaseProcessing),
+		Entry("all running", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.Running}, riskifiedv1alpha1.PhaseReady),
+		Entry("running and ignored missing", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.IgnoredMissingDR}, riskifiedv1alpha1.PhaseReady),
+		Entry("only ignored missing", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.IgnoredMissingDR}, riskifiedv1alpha1.PhaseReady),
+		Entry("running and initializing", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.Initializing}, riskifiedv1alpha1.PhaseProcessing),
+		Entry("initializing and ignored missing", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Initializing, riskifiedv1alpha1.IgnoredMissingDR}, riskifiedv1alpha1.PhaseProcessing),
+		Entry("running and missing", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.Missing}, riskifiedv1alpha1.PhaseMissing),
+		Entry("initializing and missing", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Initializing, riskifiedv1alpha1.Missing}, riskifiedv1alpha1.PhaseMissing),
+		Entry("ignored missing and missing", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.IgnoredMissingDR, riskifiedv1alpha1.Missing}, riskifiedv1alpha1.PhaseMissing),
+		Entry("all of them", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.Missing, riskifiedv1alpha1.Initializing, riskifiedv1alpha1.IgnoredMissingDR}, riskifiedv1alpha1.PhaseMissing),
+		Entry("failed takes precedence over missing", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Missing, riskifiedv1alpha1.Failed}, riskifiedv1alpha1.PhaseDegraded),
+		Entry("missing default subset is ready", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.MissingDefaultSubset}, riskifiedv1alpha1.PhaseReady),
+		Entry("opted out is ready", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.OptedOut}, riskifiedv1alpha1.PhaseReady),
+		Entry("excluded is ready", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.Excluded}, riskifiedv1alpha1.PhaseReady),
+		Entry("namespace not allowed is degraded", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.NamespaceNotAllowed}, riskifiedv1alpha1.PhaseDegraded),
+		Entry("conflicting is degraded", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.Conflicting}, riskifiedv1alpha1.PhaseDegraded),
+		Entry("terminating is processing", []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.Terminating}, riskifiedv1alpha1.PhaseProcessing),
+	)
+})
+
+var _ = Describe("SetPhase", func() {
+	It("updates the status only when the phase changes", func() {
+		updates := 0
+		mc := MockClient{
+			statusUpdateMethod: func(context.Context, client.Object, ...client.SubResourceUpdateOption) error {
+				updates++
+				return nil
+			},
+		}
+		h := handlers.DynamicEnvStatusHandler{Client: &mc, Ctx: context.Background(), DynamicEnv: &riskifiedv1alpha1.DynamicEnv{}}
+		Expect(h.SetPhase(riskifiedv1alpha1.PhaseReady)).To(Succeed())
+		Expect(h.SetPhase(riskifiedv1alpha1.PhaseReady)).To(Succeed())
+		Expect(h.DynamicEnv.Status.Phase).To(Equal(riskifiedv1alpha1.PhaseReady))
+		Expect(updates).To(Equal(1))
+	})
+})
+
+var _ = Describe("Status transitions", func() {
+	mkHandler := func(limit int) handlers.DynamicEnvStatusHandler {
+		return handlers.DynamicEnvStatusHandler{
+			Client:                 &MockClient{},
+			Ctx:                    context.Background(),
+			DynamicEnv:             &riskifiedv1alpha1.DynamicEnv{},
+			TransitionHistoryLimit: limit,
+		}
+	}
+	drStatus := func(status riskifiedv1alpha1.LifeCycleStatus) riskifiedv1alpha1.ResourceStatus {
+		return riskifiedv1alpha1.ResourceStatus{Name: "dr", Namespace: "ns", ServiceHost: "details", Status: status}
+	}
+	transitions := func(ts []riskifiedv1alpha1.StatusTransition) []string {
+		var result []string
+		for _, t := range ts {
+			Expect(t.At.IsZero()).To(BeFalse())
+			result = append(result, fmt.Sprintf("%s->%s", t.From, t.To))
+		}
+		return result
+	}
+
+	It("records the transitions of the life cycle statuses", func() {
+		h := mkHandler(5)
+		for _, s := range []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Initializing, riskifiedv1alpha1.Running, riskifiedv1alpha1.Running, riskifiedv1alpha1.Missing} {
+			Expect(h.AddDestinationRuleStatusEntry("subset", drStatus(s))).To(Succeed())
+		}
+		recorded := h.DynamicEnv.Status.SubsetsStatus["subset"].DestinationRules
+		Expect(recorded).To(HaveLen(1))
+		Expect(recorded[0].Status).To(Equal(riskifiedv1alpha1.Missing))
+		Expect(transitions(recorded[0].Transitions)).To(Equal([]string{"initializing->running", "running->missing"}))
+	})
+
+	It("keeps only the latest transitions", func() {
+		h := mkHandler(2)
+		for _, s := range []riskifiedv1alpha1.LifeCycleStatus{riskifiedv1alpha1.Running, riskifiedv1alpha1.Missing, riskifiedv1alpha1.Running, riskifiedv1alpha1.Missing} {
+			Expect(h.AddDestinationRuleStatusEntries("subset", []riskifiedv1alpha1.ResourceStatus{drStatus(s)})).To(Succeed())
+		}
+		recorded := h.DynamicEnv.Status.SubsetsStatus["subset"].DestinationRules
+		Expect(transitions(recorded[0].Transitions)).To(Equal([]string{"missing->running", "running->missing"}))
+	})
+
+	It("records the transitions of deployments and replaced statuses", func() {
+		h := mkHandler(5)
+		deployment := riskifiedv1alpha1.ResourceStatus{Name: "details", Namespace: "ns", Status: riskifiedv1alpha1.Initializing}
+		Expect(h.AddDeploymentStatusEntry("subset", deployment, riskifiedv1alpha1.SUBSET)).To(Succeed())
+		deployment.Status = riskifiedv1alpha1.Running
+		Expect(h.AddDeploymentStatusEntry("subset", deployment, riskifiedv1alpha1.SUBSET)).To(Succeed())
+		Expect(transitions(h.DynamicEnv.Status.SubsetsStatus["subset"].Deployment.Transitions)).To(Equal([]string{"initializing->running"}))
+
+		Expect(h.AddDeploymentStatusEntry("consumer", deployment, riskifiedv1alpha1.CONSUMER)).To(Succeed())
+		deployment.Status = riskifiedv1alpha1.Failed
+		Expect(h.AddDeploymentStatusEntry("consumer", deployment, riskifiedv1alpha1.CONSUMER)).To(Succeed())
+		Expect(transitions(h.DynamicEnv.Status.ConsumersStatus["consumer"].Transitions)).To(Equal([]string{"running->failed"}))
+
+		Expect(h.AddDestinationRuleStatusEntry("subset", drStatus(riskifiedv1alpha1.Running))).To(Succeed())
+		Expect(h.SetDestinationRuleStatuses("subset", []riskifiedv1alpha1.ResourceStatus{drStatus(riskifiedv1alpha1.Terminating)})).To(Succeed())
+		recorded := h.DynamicEnv.Status.SubsetsStatus["subset"].DestinationRules
+		Expect(transitions(recorded[0].Transitions)).To(Equal([]string{"running->terminating"}))
+	})
+
+	It("does not record transitions unless enabled", func() {
+		h := mkHandler(0)
+		Expect(h.AddDestinationRuleStatusEntry("subset", drStatus(riskifiedv1alpha1.Running))).To(Succeed())
+		Expect(h.AddDestinationRuleStatusEntry("subset", drStatus(riskifiedv1alpha1.Missing))).To(Succeed())
+		Expect(h.DynamicEnv.Status.SubsetsStatus["subset"].DestinationRules[0].Transitions).To(BeEmpty())
+	})
+})
+
+var _ = Describe("SetExpired", func() {
+	It("sets the expired phase and conditions once", func() {
+		updates := 0
+		mc := MockClient{
+			statusUpdateMethod: func(context.Context, client.Object, ...client.SubResourceUpdateOption) error {
+				updates++
+				return nil
+			},
+		}
+		de := &riskifiedv1alpha1.DynamicEnv{}
+		de.Status.Phase = riskifiedv1alpha1.PhaseReady
+		h := handlers.DynamicEnvStatusHandler{Client: &mc, Ctx: context.Background(), DynamicEnv: de}
+		expiredAt := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+		Expect(h.SetExpired(expiredAt)).To(Succeed())
+		Expect(h.SetExpired(expiredAt)).To(Succeed())
+		Expect(updates).To(Equal(1))
+		Expect(de.Status.Phase).To(Equal(riskifiedv1alpha1.PhaseExpired))
+		expired := handlers.GetCondition(de.Status.Conditions, string(riskifiedv1alpha1.ConditionExpired))
+		Expect(expired).NotTo(BeNil())
+		Expect(expired.Status).To(Equal(metav1.ConditionTrue))
+		Expect(expired.Message).To(ContainSubstring("2023-05-01T12:00:00Z"))
+		ready := handlers.GetCondition(de.Status.Conditions, string(riskifiedv1alpha1.ConditionReady))
+		Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+		Expect(ready.Reason).To(Equal("Expired"))
+
+		h.ClearExpired()
+		Expect(handlers.GetCondition(de.Status.Conditions, string(riskifiedv1alpha1.ConditionExpired))).To(BeNil())
+	})
+})
+
+var _ = Describe("Status update conflicts", func() {
+	It("re-fetches the dynamic environment and keeps the in-memory entries", func() {
+		de := riskifiedv1alpha1.DynamicEnv{}
+		de.Name = "de"
+		de.Namespace = "ns"
+		de.ResourceVersion = "1"
+		existing := riskifiedv1alpha1.ResourceStatus{Name: "dr1", Namespace: "ns", Status: riskifiedv1alpha1.Running}
+		de.Status.SubsetsStatus = map[string]riskifiedv1alpha1.SubsetStatus{
+			"subset": {DestinationRules: []riskifiedv1alpha1.ResourceStatus{existing}},
+		}
+		var written []*riskifiedv1alpha1.DynamicEnv
+		mc := MockClient{
+			getMethod: func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+				latest := o.(*riskifiedv1alpha1.DynamicEnv)
+				latest.Name = "de"
+				latest.Namespace = "ns"
+				latest.ResourceVersion = "2"
+				return nil
+			},
+			statusUpdateMethod: func(_ context.Context, o client.Object, _ ...client.SubResourceUpdateOption) error {
+				current := o.(*riskifiedv1alpha1.DynamicEnv)
+				written = append(written, current.DeepCopy())
+				if current.ResourceVersion == "1" {
+					return errors.NewConflict(schema.GroupResource{Resource: "dynamicenvs"}, current.Name, fmt.Errorf("the object has been modified"))
+				}
+				return nil
+			},
+		}
+		h := handlers.DynamicEnvStatusHandler{Client: &mc, Ctx: context.Background(), DynamicEnv: &de}
+		added := riskifiedv1alpha1.ResourceStatus{Name: "dr2", Namespace: "ns", Status: riskifiedv1alpha1.Initializing}
+		Expect(h.AddDestinationRuleStatusEntry("subset", added)).To(Succeed())
+		Expect(written).To(HaveLen(2))
+		last := written[1]
+		Expect(last.ResourceVersion).To(Equal("2"))
+		Expect(last.Status.SubsetsStatus["subset"].DestinationRules).To(Equal([]riskifiedv1alpha1.ResourceStatus{existing, added}))
+		Expect(de.ResourceVersion).To(Equal("2"))
+	})
+})
+
+var _ = Describe("Superseded generations", func() {
+	mkDynamicEnv := func(generation int64) *riskifiedv1alpha1.DynamicEnv {
+		de := &riskifiedv1alpha1.DynamicEnv{}
+		de.Name = "de"
+		de.Namespace = "ns"
+		de.Generation = generation
+		de.ResourceVersion = "1"
+		return de
+	}
+	mkClient := func(latestGeneration, observedGeneration int64, written *int) *MockClient {
+		return &MockClient{
+			getMethod: func(_ context.Context, _ types.NamespacedName, o client.Object, _ ...client.GetOption) error {
+				latest := o.(*riskifiedv1alpha1.DynamicEnv)
+				*latest = *mkDynamicEnv(latestGeneration)
+				latest.ResourceVersion = "2"
+				latest.Status.ObservedGeneration = observedGeneration
+				return nil
+			},
+			statusUpdateMethod: func(_ context.Context, o client.Object, _ ...client.SubResourceUpdateOption) error {
+				*written++
+				if o.GetResourceVersion() == "1" {
+					return errors.NewConflict(schema.GroupResource{Resource: "dynamicenvs"}, o.GetName(), fmt.Errorf("the object has been modified"))
+				}
+				return nil
+			},
+		}
+	}
+
+	It("records the observed generation with the status", func() {
+		written := 0
+		de := mkDynamicEnv(3)
+		de.ResourceVersion = "2"
+		h := handlers.DynamicEnvStatusHandler{Client: mkClient(3, 0, &written), Ctx: context.Background(), DynamicEnv: de}
+		Expect(h.SetPhase(riskifiedv1alpha1.PhaseReady)).To(Succeed())
+		Expect(de.Status.ObservedGeneration).To(Equal(int64(3)))
+	})
+
+	It("does not re-apply the status of a superseded generation on conflict", func() {
+		written := 0
+		de := mkDynamicEnv(3)
+		h := handlers.DynamicEnvStatusHandler{Client: mkClient(4, 0, &written), Ctx: context.Background(), DynamicEnv: de}
+		err := h.SetPhase(riskifiedv1alpha1.PhaseReady)
+		Expect(err).To(MatchError(handlers.SupersededGeneration{Generation: 3, Latest: 4}))
+		Expect(written).To(Equal(1))
+	})
+
+	DescribeTable(
+		"checking the generation",
+		func(latestGeneration, observedGeneration int64, superseded bool) {
+			written := 0
+			h := handlers.DynamicEnvStatusHandler{
+				Client:     mkClient(latestGeneration, observedGeneration, &written),
+				Ctx:        context.Background(),
+				DynamicEnv: mkDynamicEnv(3),
+			}
+			if superseded {
+				Expect(h.CheckGeneration()).To(BeAssignableToTypeOf(handlers.SupersededGeneration{}))
+			} else {
+				Expect(h.CheckGeneration()).To(Succeed())
+			}
+		},
+		Entry("current generation", int64(3), int64(2), false),
+		Entry("newer generation", int64(4), int64(3), true),
+		Entry("status written for a newer generation", int64(3), int64(4), true),
+	)
+})
+
+var _ = Describe("SetDestinationRuleStatuses", func() {
+	It("reports the rules being deleted and drops the ones that are gone", func() {
+		updates := 0
+		mc := MockClient{
+			statusUpdateMethod: func(context.Context, client.Object, ...client.SubResourceUpdateOption) error {
+				updates++
+				return nil
+			},
+		}
+		de := &riskifiedv1alpha1.DynamicEnv{}
+		de.Status.SubsetsStatus = map[string]riskifiedv1alpha1.SubsetStatus{
+			"subset": {DestinationRules: []riskifiedv1alpha1.ResourceStatus{
+				{Name: "dr1", Namespace: "ns", Status: riskifiedv1alpha1.Running},
+				{Name: "dr2", Namespace: "ns", Status: riskifiedv1alpha1.Running},
+			}},
+		}
+		h := handlers.DynamicEnvStatusHandler{Client: &mc, Ctx: context.Background(), DynamicEnv: de}
+		terminating := []riskifiedv1alpha1.ResourceStatus{{Name: "dr1", Namespace: "ns", Status: riskifiedv1alpha1.Terminating}}
+		Expect(h.SetDestinationRuleStatuses("subset", terminating)).To(Succeed())
+		Expect(de.Status.SubsetsStatus["subset"].DestinationRules).To(Equal(terminating))
+		Expect(h.SetDestinationRuleStatuses("subset", terminating)).To(Succeed())
+		Expect(updates).To(Equal(1))
+
+		// Cleared once the rule is gone
+		Expect(h.SetDestinationRuleStatuses("subset", nil)).To(Succeed())
+		Expect(de.Status.SubsetsStatus["subset"].DestinationRules).To(BeEmpty())
+		Expect(updates).To(Equal(2))
+	})
+})
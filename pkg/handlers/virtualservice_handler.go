@@ -27,6 +27,7 @@ import (
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
 	"github.com/riskified/dynamic-environment/pkg/helpers"
 	"github.com/riskified/dynamic-environment/pkg/watches"
+	"google.golang.org/protobuf/proto"
 	istioapi "istio.io/api/networking/v1alpha3"
 	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	"k8s.io/apimachinery/pkg/types"
@@ -42,16 +43,39 @@ type VirtualServiceHandler struct {
 	RoutePrefix    string
 	ServiceHosts   []string
 	DefaultVersion string
-	DynamicEnv     *riskifiedv1alpha1.DynamicEnv
-	StatusHandler  *DynamicEnvStatusHandler
-	Log            logr.Logger
-	Ctx            context.Context
+	// Default versions (subset names) for specific service hosts, overriding DefaultVersion (see
+	// `DestinationRuleHandler`).
+	DefaultVersionsByHost map[string]string
+	DynamicEnv            *riskifiedv1alpha1.DynamicEnv
+	StatusHandler         *DynamicEnvStatusHandler
+	// The names of the subsets to route to per service host (defaults to the unique version)
+	SubsetNames map[string]string
+	// The cluster domain used to fully qualify service hosts (defaults to `cluster.local`)
+	ClusterDomain string
+	// The percentage of the matching traffic routed to our subset, the rest is routed to the
+	// default version (0 or 100 route all the matching traffic to our subset)
+	Weight int32
+	// The maximum number of dynamic environments that may own (share) a single VirtualService
+	// (0 for no limit)
+	MaxAnnotationOwners int
+	// The key of the ownership annotations of this operator instance (defaults to
+	// `names.NamespacedNameAnnotation`, see `watches.Ownership`)
+	OwnerAnnotation string
+	// Only compute the changes (see `PlannedChanges`) without applying them (or modifying the status)
+	DryRun bool
+	Log    logr.Logger
+	Ctx    context.Context
 
 	activeHosts []string
+	// The changes collected in dry-run mode
+	planned []PlannedChange
 }
 
 // Fetches related Virtual Services and manipulates them accordingly.
 func (h *VirtualServiceHandler) Handle() error {
+	if h.DryRun {
+		h.Client, h.StatusHandler = enableDryRun(h.Client, h.StatusHandler, &h.planned)
+	}
 	for _, serviceHost := range h.ServiceHosts {
 		services, err := h.locateVirtualServicesByServiceHost(serviceHost)
 		if err != nil {
@@ -76,8 +100,12 @@ func (h *VirtualServiceHandler) Handle() error {
 	return nil
 }
 
+// PlannedChanges returns the writes that would have been done by `Handle` (in dry-run mode).
+func (h *VirtualServiceHandler) PlannedChanges() []PlannedChange {
+	return h.planned
+}
+
 func (h *VirtualServiceHandler) GetStatus() ([]riskifiedv1alpha1.ResourceStatus, error) {
-	var services []*istionetwork.VirtualService
 	var statuses []riskifiedv1alpha1.ResourceStatus
 	for _, serviceHost := range h.ServiceHosts {
 		result, err := h.locateVirtualServicesByServiceHost(serviceHost)
@@ -85,23 +113,18 @@ func (h *VirtualServiceHandler) GetStatus() ([]riskifiedv1alpha1.ResourceStatus,
 			h.Log.Error(err, "While running GetStatus in VirtualServiceHandler")
 			return []riskifiedv1alpha1.ResourceStatus{}, err
 		}
-		services = append(services, result...)
-	}
-	for _, service := range services {
-		s := h.getStatusForService(service)
-		statuses = append(statuses, s)
+		for _, service := range result {
+			s := h.getStatusForService(service)
+			s.ServiceHost = serviceHost
+			statuses = append(statuses, s)
+		}
 	}
 
 	return statuses, nil
 }
 
 func (h *VirtualServiceHandler) ApplyStatus(statuses []riskifiedv1alpha1.ResourceStatus) error {
-	for _, rs := range statuses {
-		if err := h.StatusHandler.AddVirtualServiceStatusEntry(h.UniqueName, rs); err != nil {
-			return err
-		}
-	}
-	return nil
+	return h.StatusHandler.AddVirtualServiceStatusEntries(h.UniqueName, statuses)
 }
 
 func (h *VirtualServiceHandler) GetSubset() string {
@@ -120,7 +143,7 @@ func (h *VirtualServiceHandler) locateVirtualServicesByServiceHost(serviceHost s
 	}
 	for idx, service := range virtualServices.Items {
 		for _, host := range service.Spec.Hosts {
-			if helpers.MatchNamespacedHost(serviceHost, h.Namespace, host, service.Namespace) {
+			if helpers.MatchNamespacedHost(serviceHost, h.Namespace, host, service.Namespace, h.ClusterDomain) {
 				useSelf, delegated := h.resolveVirtualServices(serviceHost, service)
 				if useSelf {
 					result = append(result, virtualServices.Items[idx])
@@ -191,13 +214,13 @@ func (h *VirtualServiceHandler) updateVirtualService(serviceHost string, service
 	prefix := h.RoutePrefix
 
 	// TODO: Might not be relevant in multiple services
-	if containsDynamicEnvRoutes(service.Spec.Http, prefix) {
+	if containsDynamicEnvRoutes(service.Spec.Http, prefix) && h.routesHaveWeight(serviceHost, service.Spec.Http) {
 		h.Log.Info("Skipping virtual service that already contains dynamic-environment routes", "virtual-service", service.Name)
 		return nil
 	}
 
 	// Add this service to status
-	newStatus := riskifiedv1alpha1.ResourceStatus{Name: service.Name, Namespace: service.Namespace}
+	newStatus := riskifiedv1alpha1.ResourceStatus{Name: service.Name, Namespace: service.Namespace, ServiceHost: serviceHost}
 	if err := h.StatusHandler.AddVirtualServiceStatusEntry(h.UniqueName, newStatus); err != nil {
 		h.Log.Error(err, "error updating state for virtual service")
 		return err
@@ -224,7 +247,14 @@ func (h *VirtualServiceHandler) updateVirtualService(serviceHost string, service
 	}
 
 	service.Spec.Http = newRoutes
-	watches.AddToAnnotation(owner, service)
+	ownership := watches.Ownership{Key: h.OwnerAnnotation}
+	if err := ownership.AddToAnnotationChecked(owner, service, h.MaxAnnotationOwners); err != nil {
+		msg := fmt.Sprintf("Not updating virtual service %s/%s: %s", service.Namespace, service.Name, err.Error())
+		if err := h.StatusHandler.AddGlobalVirtualServiceError(h.UniqueName, msg); err != nil {
+			h.Log.Error(err, "failed to write the following message to status: "+msg)
+		}
+		return err
+	}
 	if err := h.Update(h.Ctx, service); err != nil {
 		h.Log.Error(err, "Error updating VirtualService with our updated rules")
 		return err
@@ -257,14 +287,28 @@ func (h *VirtualServiceHandler) updateRouteForSubset(serviceHost string, route *
 	if len(newDestinations) == 0 {
 		return IgnoredMissing{}
 	}
+	var defaultDestination *istioapi.HTTPRouteDestination
+	if h.splitsTraffic() {
+		// The weights of a route must sum to 100, so we only split the first destination between
+		// our subset and the default version
+		defaultDestination = newDestinations[0].DeepCopy()
+		defaultDestination.Weight = 100 - h.Weight
+		newDestinations = newDestinations[:1]
+	}
 	for _, d := range newDestinations {
-		d.Destination.Subset = h.UniqueVersion
+		d.Destination.Subset = h.subsetName(serviceHost)
 		d.Weight = 0
+		if defaultDestination != nil {
+			d.Weight = h.Weight
+		}
 		if d.Headers == nil {
 			d.Headers = &istioapi.Headers{}
 		}
 		safeApplyResponseHeaders(d.Headers, "x-dynamic-env", h.UniqueName)
 	}
+	if defaultDestination != nil {
+		newDestinations = append(newDestinations, defaultDestination)
+	}
 	route.Route = newDestinations
 
 	if len(route.Match) == 0 {
@@ -292,12 +336,25 @@ func (h *VirtualServiceHandler) updateRouteForSubset(serviceHost string, route *
 			m.SourceLabels[k] = v
 		}
 	}
-	newRuleHash := helpers.AsSha256(route)
+	// The deterministic encoding keeps the name stable across reconciles (and renders, see
+	// `render.Render`), unlike formatting the route (which includes the addresses of its fields).
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(route)
+	if err != nil {
+		return fmt.Errorf("hashing route: %w", err)
+	}
+	newRuleHash := helpers.AsSha256(string(encoded))
 	route.Name = fmt.Sprintf("%s-%s", h.RoutePrefix, helpers.Shorten(newRuleHash, 10))
 
 	return nil
 }
 
+func (h *VirtualServiceHandler) subsetName(serviceHost string) string {
+	if name, ok := h.SubsetNames[serviceHost]; ok {
+		return name
+	}
+	return h.UniqueVersion
+}
+
 func containsDynamicEnvRoutes(routes []*istioapi.HTTPRoute, prefix string) bool {
 	for _, r := range routes {
 		if strings.HasPrefix(r.Name, prefix) {
@@ -307,13 +364,42 @@ func containsDynamicEnvRoutes(routes []*istioapi.HTTPRoute, prefix string) bool
 	return false
 }
 
+// Whether only part of the matching traffic should be routed to our subset (see `Weight`)
+func (h *VirtualServiceHandler) splitsTraffic() bool {
+	return h.Weight > 0 && h.Weight < 100
+}
+
+// Whether the destinations of our subset in our existing routes already have the configured
+// weight. Otherwise (e.g. the weight was modified) our routes should be rebuilt.
+func (h *VirtualServiceHandler) routesHaveWeight(serviceHost string, routes []*istioapi.HTTPRoute) bool {
+	var expected int32
+	if h.splitsTraffic() {
+		expected = h.Weight
+	}
+	for _, r := range routes {
+		if !strings.HasPrefix(r.Name, h.RoutePrefix) {
+			continue
+		}
+		for _, d := range r.Route {
+			if d.Destination != nil && d.Destination.Subset == h.subsetName(serviceHost) && d.Weight != expected {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (h *VirtualServiceHandler) defaultVersion(serviceHost string) string {
+	return helpers.ValueForHost(serviceHost, h.Namespace, h.ClusterDomain, h.DefaultVersion, h.DefaultVersionsByHost)
+}
+
 // A helper to check if any of the provided routes has the serviceHost and namespace configured in
 // our handler. The `inNamespace` parameter is the namespace to search if the `host` parameter is
 // not fully qualified (e.g. the namespace of the virtual service).
 func (h *VirtualServiceHandler) hasMatchingHostAndSubset(serviceHost string, routes []*istioapi.HTTPRouteDestination, inNamespace string) bool {
 	for _, route := range routes {
 		dest := route.Destination
-		if helpers.MatchNamespacedHost(serviceHost, h.Namespace, dest.Host, inNamespace) && dest.Subset == h.DefaultVersion {
+		if helpers.MatchNamespacedHost(serviceHost, h.Namespace, dest.Host, inNamespace, h.ClusterDomain) && dest.Subset == h.defaultVersion(serviceHost) {
 			return true
 		}
 	}
@@ -326,7 +412,7 @@ func (h *VirtualServiceHandler) filterDestinationByHostAndSubset(serviceHost str
 	var newDestinations []*istioapi.HTTPRouteDestination
 
 	for _, d := range destinations {
-		if helpers.MatchNamespacedHost(serviceHost, h.Namespace, d.Destination.Host, inNamespace) && d.Destination.Subset == h.DefaultVersion {
+		if helpers.MatchNamespacedHost(serviceHost, h.Namespace, d.Destination.Host, inNamespace, h.ClusterDomain) && d.Destination.Subset == h.defaultVersion(serviceHost) {
 			newDestinations = append(newDestinations, d)
 		}
 	}
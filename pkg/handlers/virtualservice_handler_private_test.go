@@ -26,6 +26,7 @@ import (
 	"fmt"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
 	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	ctrl "sigs.k8s.io/controller-runtime"
 
@@ -224,3 +225,70 @@ var _ = Describe("VirtualService with Delegates", func() {
 		),
 	)
 })
+
+var _ = Describe("Default version per service host in VirtualServices", func() {
+	routes := []*istioapi.HTTPRouteDestination{
+		{Destination: &istioapi.Destination{Host: "details", Subset: "stable"}},
+		{Destination: &istioapi.Destination{Host: "reviews", Subset: "production"}},
+	}
+	handler := VirtualServiceHandler{
+		Namespace:             "my-ns",
+		DefaultVersion:        "stable",
+		DefaultVersionsByHost: map[string]string{"reviews.my-ns": "production"},
+		Log:                   ctrl.Log,
+	}
+
+	It("matches the routes to the default subset of each host", func() {
+		Expect(handler.hasMatchingHostAndSubset("details", routes, "my-ns")).To(BeTrue())
+		Expect(handler.hasMatchingHostAndSubset("reviews", routes, "my-ns")).To(BeTrue())
+		Expect(handler.filterDestinationByHostAndSubset("reviews", routes, "my-ns")).To(Equal(routes[1:]))
+	})
+
+	It("does not match the global default version for mapped hosts", func() {
+		stableOnly := []*istioapi.HTTPRouteDestination{{Destination: &istioapi.Destination{Host: "reviews", Subset: "stable"}}}
+		Expect(handler.hasMatchingHostAndSubset("reviews", stableOnly, "my-ns")).To(BeFalse())
+	})
+})
+
+var _ = Describe("Splitting traffic between our subset and the default version", func() {
+	mkRoute := func() *istioapi.HTTPRoute {
+		return &istioapi.HTTPRoute{
+			Route: []*istioapi.HTTPRouteDestination{{Destination: &istioapi.Destination{Host: "details", Subset: "shared"}}},
+		}
+	}
+	match := riskifiedv1alpha1.IstioMatch{Headers: map[string]riskifiedv1alpha1.StringMatch{"end-user": {Exact: "jason"}}}
+	mkHandler := func(weight int32) VirtualServiceHandler {
+		return VirtualServiceHandler{
+			UniqueName:     "details-default-dynamicenv-sample",
+			UniqueVersion:  "default-dynamicenv-sample",
+			RoutePrefix:    "prefix",
+			Namespace:      "ns",
+			DefaultVersion: "shared",
+			Weight:         weight,
+			Log:            ctrl.Log,
+		}
+	}
+
+	It("routes all the matching traffic to our subset by default", func() {
+		route := mkRoute()
+		handler := mkHandler(100)
+		Expect(handler.updateRouteForSubset("details", route, match, "ns")).To(Succeed())
+		Expect(route.Route).To(HaveLen(1))
+		Expect(route.Route[0].Destination.Subset).To(Equal("default-dynamicenv-sample"))
+		Expect(route.Route[0].Weight).To(BeZero())
+	})
+
+	It("splits the matching traffic by the configured weight", func() {
+		route := mkRoute()
+		handler := mkHandler(10)
+		Expect(handler.updateRouteForSubset("details", route, match, "ns")).To(Succeed())
+		Expect(route.Route).To(HaveLen(2))
+		Expect(route.Route[0].Destination.Subset).To(Equal("default-dynamicenv-sample"))
+		Expect(route.Route[0].Weight).To(BeEquivalentTo(10))
+		Expect(route.Route[0].Headers.Response.Add).To(HaveKeyWithValue("x-dynamic-env", "details-default-dynamicenv-sample"))
+		Expect(route.Route[1].Destination.Subset).To(Equal("shared"))
+		Expect(route.Route[1].Weight).To(BeEquivalentTo(90))
+		Expect(route.Route[1].Headers).To(BeNil())
+		Expect(route.Match[0].Headers).To(HaveKey("end-user"))
+	})
+})
@@ -90,9 +90,10 @@ var _ = Describe("VirtualServiceHandler", func() {
 			handler.UniqueVersion = "unique-version"
 			expected := []riskifiedv1alpha1.ResourceStatus{
 				{
-					Name:      "service",
-					Namespace: "ns",
-					Status:    riskifiedv1alpha1.IgnoredMissingVS,
+					Name:        "service",
+					Namespace:   "ns",
+					ServiceHost: "my-service-host",
+					Status:      riskifiedv1alpha1.IgnoredMissingVS,
 				},
 			}
 			result, err := handler.GetStatus()
@@ -134,9 +135,10 @@ var _ = Describe("VirtualServiceHandler", func() {
 			handler.UniqueVersion = uniqueVersion
 			expected := []riskifiedv1alpha1.ResourceStatus{
 				{
-					Name:      "service",
-					Namespace: "ns",
-					Status:    riskifiedv1alpha1.Running,
+					Name:        "service",
+					Namespace:   "ns",
+					ServiceHost: "my-service-host",
+					Status:      riskifiedv1alpha1.Running,
 				},
 			}
 			result, err := handler.GetStatus()
@@ -144,4 +146,89 @@ var _ = Describe("VirtualServiceHandler", func() {
 			Expect(result).To(Equal(expected))
 		})
 	})
+
+	Context("Modifying the weight", func() {
+		const serviceHost = "details"
+		uniqueVersion := "unique-version"
+		prefix := helpers.CalculateVirtualServicePrefix(uniqueVersion, "details")
+		mkBaseVirtualService := func() *istionetwork.VirtualService {
+			vs := &istionetwork.VirtualService{}
+			vs.Name = "details"
+			vs.Namespace = "ns"
+			vs.Spec.Hosts = []string{serviceHost}
+			vs.Spec.Http = []*v1alpha3.HTTPRoute{{
+				Route: []*v1alpha3.HTTPRouteDestination{{Destination: &v1alpha3.Destination{Host: serviceHost, Subset: "shared"}}},
+			}}
+			return vs
+		}
+		// Handles the provided virtual service with the provided weight and returns it as updated
+		// (or nil if it was not updated)
+		handleWithWeight := func(vs *istionetwork.VirtualService, weight int32) *istionetwork.VirtualService {
+			var updated *istionetwork.VirtualService
+			mc := struct{ MockClient }{}
+			mc.listMethod = func(_ context.Context, o client.ObjectList, _ ...client.ListOption) error {
+				o.(*istionetwork.VirtualServiceList).Items = []*istionetwork.VirtualService{vs.DeepCopy()}
+				return nil
+			}
+			mc.updateMethod = func(_ context.Context, o client.Object, _ ...client.UpdateOption) error {
+				updated = o.(*istionetwork.VirtualService)
+				return nil
+			}
+			de := &riskifiedv1alpha1.DynamicEnv{}
+			de.Name = "de"
+			de.Namespace = "ns"
+			de.Spec.IstioMatches = []riskifiedv1alpha1.IstioMatch{
+				{Headers: map[string]riskifiedv1alpha1.StringMatch{"end-user": {Exact: "jason"}}},
+			}
+			handler := handlers.VirtualServiceHandler{
+				Client:         mc,
+				UniqueName:     "unique",
+				UniqueVersion:  uniqueVersion,
+				Namespace:      "ns",
+				RoutePrefix:    prefix,
+				ServiceHosts:   []string{serviceHost},
+				DefaultVersion: "shared",
+				Weight:         weight,
+				DynamicEnv:     de,
+				StatusHandler:  &handlers.DynamicEnvStatusHandler{Client: mc, Ctx: context.Background(), DynamicEnv: de},
+				Log:            ctrl.Log,
+				Ctx:            context.Background(),
+			}
+			Expect(handler.Handle()).To(Succeed())
+			return updated
+		}
+		ourWeights := func(vs *istionetwork.VirtualService) (weights []int32) {
+			for _, r := range vs.Spec.Http {
+				for _, d := range r.Route {
+					if d.Destination.Subset == uniqueVersion {
+						weights = append(weights, d.Weight)
+					}
+				}
+			}
+			return weights
+		}
+
+		It("rebuilds our routes with the modified weight", func() {
+			vs := handleWithWeight(mkBaseVirtualService(), 10)
+			Expect(vs).NotTo(BeNil())
+			Expect(ourWeights(vs)).To(Equal([]int32{10}))
+			vs = handleWithWeight(vs, 30)
+			Expect(vs).NotTo(BeNil())
+			Expect(vs.Spec.Http).To(HaveLen(2))
+			Expect(ourWeights(vs)).To(Equal([]int32{30}))
+			Expect(vs.Spec.Http[0].Route[1].Weight).To(BeEquivalentTo(70))
+			vs = handleWithWeight(vs, 100)
+			Expect(vs).NotTo(BeNil())
+			Expect(vs.Spec.Http).To(HaveLen(2))
+			Expect(ourWeights(vs)).To(Equal([]int32{0}))
+			Expect(vs.Spec.Http[0].Route).To(HaveLen(1))
+			Expect(vs.Spec.Http[1].Route[0].Destination.Subset).To(Equal("shared"))
+		})
+
+		It("does not update our routes if the weight is not modified", func() {
+			vs := handleWithWeight(mkBaseVirtualService(), 10)
+			Expect(vs).NotTo(BeNil())
+			Expect(handleWithWeight(vs, 10)).To(BeNil())
+		})
+	})
 })
@@ -0,0 +1,118 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The defaults of ReconcileHealth
+const (
+	DefaultWindow     = 5 * time.Minute
+	DefaultMinSamples = 10
+)
+
+// ReconcileHealth tracks the outcomes of the recent reconciles and reports the controller as not
+// ready when too many of them fail (e.g. base DestinationRules are broadly missing). Its `Check`
+// could be used as a controller-runtime readiness (or health) check.
+type ReconcileHealth struct {
+	// The maximum fraction (0-1) of failed reconciles within Window before the check fails
+	Threshold float64
+	// The period of the outcomes that are taken into account (defaults to DefaultWindow)
+	Window time.Duration
+	// The minimum number of reconciles within Window before the check may fail, so a couple of
+	// failures right after startup do not fail it (defaults to DefaultMinSamples)
+	MinSamples int
+
+	mu       sync.Mutex
+	outcomes []outcome
+	// Returns the current time (overridden in tests)
+	now func() time.Time
+}
+
+type outcome struct {
+	at     time.Time
+	failed bool
+}
+
+func NewReconcileHealth(threshold float64, window time.Duration) *ReconcileHealth {
+	return &ReconcileHealth{Threshold: threshold, Window: window}
+}
+
+// Record records the outcome of a single reconcile (failed if err is not nil).
+func (h *ReconcileHealth) Record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.currentTime()
+	h.prune(now)
+	h.outcomes = append(h.outcomes, outcome{at: now, failed: err != nil})
+}
+
+// ErrorRate returns the fraction of failed reconciles within the window, along with the number of
+// reconciles it's based on.
+func (h *ReconcileHealth) ErrorRate() (float64, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.prune(h.currentTime())
+	if len(h.outcomes) == 0 {
+		return 0, 0
+	}
+	failed := 0
+	for _, o := range h.outcomes {
+		if o.failed {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(h.outcomes)), len(h.outcomes)
+}
+
+// Check fails when the error rate within the window exceeds the threshold (see
+// `healthz.Checker`).
+func (h *ReconcileHealth) Check(_ *http.Request) error {
+	rate, samples := h.ErrorRate()
+	minSamples := h.MinSamples
+	if minSamples <= 0 {
+		minSamples = DefaultMinSamples
+	}
+	if samples < minSamples || rate <= h.Threshold {
+		return nil
+	}
+	return fmt.Errorf("%.0f%% of the last %d reconciles failed (threshold: %.0f%%)", rate*100, samples, h.Threshold*100)
+}
+
+// Drops the outcomes that are older than the window.
+func (h *ReconcileHealth) prune(now time.Time) {
+	window := h.Window
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	first := 0
+	for first < len(h.outcomes) && now.Sub(h.outcomes[first].at) > window {
+		first++
+	}
+	h.outcomes = h.outcomes[first:]
+}
+
+func (h *ReconcileHealth) currentTime() time.Time {
+	if h.now != nil {
+		return h.now()
+	}
+	return time.Now()
+}
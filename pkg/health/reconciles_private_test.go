@@ -0,0 +1,42 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reconcile outcomes window", func() {
+	It("only takes the reconciles within the window into account", func() {
+		now := time.Now()
+		h := &ReconcileHealth{Threshold: 0.5, Window: time.Minute, MinSamples: 1, now: func() time.Time { return now }}
+		for i := 0; i < 10; i++ {
+			h.Record(errors.New("failed"))
+		}
+		Expect(h.Check(nil)).NotTo(Succeed())
+		now = now.Add(2 * time.Minute)
+		h.Record(nil)
+		rate, samples := h.ErrorRate()
+		Expect(samples).To(Equal(1))
+		Expect(rate).To(BeZero())
+		Expect(h.Check(nil)).To(Succeed())
+	})
+})
@@ -0,0 +1,76 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/riskified/dynamic-environment/pkg/health"
+)
+
+var _ = Describe("ReconcileHealth", func() {
+	record := func(h *health.ReconcileHealth, succeeded, failed int) {
+		for i := 0; i < succeeded; i++ {
+			h.Record(nil)
+		}
+		for i := 0; i < failed; i++ {
+			h.Record(errors.New("failed"))
+		}
+	}
+
+	It("passes without any reconciles", func() {
+		h := health.NewReconcileHealth(0.5, time.Minute)
+		Expect(h.Check(nil)).To(Succeed())
+	})
+
+	It("passes while the error rate is within the threshold", func() {
+		h := health.NewReconcileHealth(0.5, time.Minute)
+		record(h, 5, 5)
+		rate, samples := h.ErrorRate()
+		Expect(rate).To(Equal(0.5))
+		Expect(samples).To(Equal(10))
+		Expect(h.Check(nil)).To(Succeed())
+	})
+
+	It("fails once the error rate exceeds the threshold", func() {
+		h := health.NewReconcileHealth(0.5, time.Minute)
+		record(h, 4, 6)
+		err := h.Check(nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("60% of the last 10 reconciles failed (threshold: 50%)"))
+	})
+
+	It("does not fail before enough reconciles were recorded", func() {
+		h := health.NewReconcileHealth(0.5, time.Minute)
+		h.MinSamples = 5
+		record(h, 0, 4)
+		Expect(h.Check(nil)).To(Succeed())
+		record(h, 0, 1)
+		Expect(h.Check(nil)).NotTo(Succeed())
+	})
+
+	It("recovers as reconciles succeed again", func() {
+		h := health.NewReconcileHealth(0.2, time.Minute)
+		record(h, 0, 10)
+		Expect(h.Check(nil)).NotTo(Succeed())
+		record(h, 40, 0)
+		Expect(h.Check(nil)).To(Succeed())
+	})
+})
@@ -17,12 +17,17 @@ limitations under the License.
 package helpers
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"strings"
 
+	"github.com/go-logr/logr"
 	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 )
 
 const (
@@ -30,6 +35,38 @@ const (
 	KeyValueHeaderConcatinator = "|"
 )
 
+type correlationIDKey struct{}
+
+// WithCorrelationID makes sure the provided context carries a correlation ID for the current
+// reconcile (reusing the controller-runtime reconcile ID if there is one). Returns the context
+// along with the ID.
+func WithCorrelationID(ctx context.Context) (context.Context, string) {
+	if id := CorrelationID(ctx); id != "" {
+		return ctx, id
+	}
+	id := string(uuid.NewUUID())
+	return context.WithValue(ctx, correlationIDKey{}, id), id
+}
+
+// CorrelationID returns the correlation ID of the current reconcile (or an empty string if there
+// is none).
+func CorrelationID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if id, ok := ctx.Value(correlationIDKey{}).(string); ok {
+		return id
+	}
+	return string(controller.ReconcileIDFromContext(ctx))
+}
+
+// CorrelatedLogger adds the correlation ID of the current reconcile (as `correlationID`) and the
+// owning DynamicEnv to the provided logger, so all the log lines of a single reconcile could be
+// grepped together.
+func CorrelatedLogger(ctx context.Context, log logr.Logger, owner types.NamespacedName) logr.Logger {
+	return log.WithValues("correlationID", CorrelationID(ctx), "owner", owner.String())
+}
+
 func IsStringSliceEqual(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -51,8 +88,21 @@ func StringSliceContains(s string, strings []string) bool {
 	return false
 }
 
+// StringSliceContainsFold is like StringSliceContains but ignores case (e.g. for hostnames, which are
+// case-insensitive). Use StringSliceContains for case-sensitive values such as label values.
+func StringSliceContainsFold(s string, slc []string) bool {
+	for _, item := range slc {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a new slice without any of the occurrences of the provided item (keeping the order of the
+// rest). The result is never nil, even if all the items were removed.
 func RemoveItemFromStringSlice(s string, slc []string) []string {
-	var result []string
+	result := []string{}
 	for _, item := range slc {
 		if s != item {
 			result = append(result, item)
@@ -61,6 +111,17 @@ func RemoveItemFromStringSlice(s string, slc []string) []string {
 	return result
 }
 
+// Removes duplicate items from the provided slice while keeping the order of first appearance.
+func UniqueStringSlice(slc []string) []string {
+	var result []string
+	for _, item := range slc {
+		if !StringSliceContains(item, result) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
 // Generates (somewhat) unique hash of a struct (or anything else). Depends on
 // the object's `String` method. Copied from blog post:
 // https://blog.8bitzen.com/posts/22-08-2019-how-to-hash-a-struct-in-go
@@ -81,15 +142,7 @@ func Shorten(msg string, length int) string {
 }
 
 func UniqueDynamicEnvName(de *riskifiedv1alpha1.DynamicEnv) string {
-	name := de.Name
-	ns := de.Namespace
-	if len(name) > 40 {
-		name = name[:40]
-	}
-	if len(ns) > 20 {
-		ns = ns[:20]
-	}
-	return fmt.Sprintf("%s-%s", ns, name)
+	return de.UniqueVersion()
 }
 
 // This is a temporary hack so we should not care about edge cases:
@@ -119,6 +172,21 @@ func HeadersContainsExactStringMatch(headers map[string]riskifiedv1alpha1.String
 	return false
 }
 
+// PickKeys returns the entries of the provided map with the provided keys (nil if none of them
+// exist).
+func PickKeys(m map[string]string, keys []string) map[string]string {
+	var result map[string]string
+	for _, k := range keys {
+		if v, ok := m[k]; ok {
+			if result == nil {
+				result = map[string]string{}
+			}
+			result[k] = v
+		}
+	}
+	return result
+}
+
 // Validate intersection between two slices is not empty/
 func CommonValueExists(l1, l2 []string) bool {
 	for _, s := range l2 {
@@ -17,6 +17,7 @@ limitations under the License.
 package helpers
 
 import (
+	"context"
 	"testing"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -65,4 +66,75 @@ var _ = Describe("Helpers Tests", func() {
 			Expect(got).To(Equal("first-header:value"))
 		})
 	})
+	Context("UniqueStringSlice", func() {
+		It("removes duplicates while keeping the original order", func() {
+			Expect(UniqueStringSlice([]string{"b", "a", "b", "c", "a"})).To(Equal([]string{"b", "a", "c"}))
+		})
+
+		It("returns nil for an empty slice", func() {
+			Expect(UniqueStringSlice(nil)).To(BeNil())
+		})
+	})
+
+	Context("RemoveItemFromStringSlice", func() {
+		It("removes all the occurrences while keeping the order", func() {
+			Expect(RemoveItemFromStringSlice("a", []string{"a", "b", "a", "c", "a"})).To(Equal([]string{"b", "c"}))
+		})
+
+		It("returns an empty (non-nil) slice when the only item is removed", func() {
+			result := RemoveItemFromStringSlice("a", []string{"a"})
+			Expect(result).NotTo(BeNil())
+			Expect(result).To(BeEmpty())
+		})
+
+		It("returns a new slice", func() {
+			original := []string{"a", "b"}
+			result := RemoveItemFromStringSlice("c", original)
+			result[0] = "changed"
+			Expect(original).To(Equal([]string{"a", "b"}))
+		})
+	})
+
+	Context("StringSliceContainsFold", func() {
+		DescribeTable("matches regardless of case",
+			func(s string, slc []string, expected bool) {
+				Expect(StringSliceContainsFold(s, slc)).To(Equal(expected))
+			},
+			Entry("exact match", "details", []string{"reviews", "details"}, true),
+			Entry("upper case item", "details", []string{"DETAILS"}, true),
+			Entry("mixed case search", "Details.NS.svc.cluster.local", []string{"details.ns.svc.cluster.local"}, true),
+			Entry("different value", "details", []string{"detail", "details2"}, false),
+			Entry("empty slice", "details", nil, false),
+		)
+		It("is case-sensitive in the exact variant", func() {
+			Expect(StringSliceContains("Details", []string{"details"})).To(BeFalse())
+		})
+	})
+
+	Context("PickKeys", func() {
+		It("returns only the requested existing keys", func() {
+			m := map[string]string{"team": "a", "cost-center": "b", "other": "c"}
+			Expect(PickKeys(m, []string{"team", "cost-center", "missing"})).To(Equal(map[string]string{"team": "a", "cost-center": "b"}))
+		})
+
+		It("returns nil if none of the keys exist", func() {
+			Expect(PickKeys(map[string]string{"other": "c"}, []string{"team"})).To(BeNil())
+			Expect(PickKeys(nil, []string{"team"})).To(BeNil())
+		})
+	})
+
+	Context("WithCorrelationID", func() {
+		It("generates an ID once and keeps it", func() {
+			ctx, id := WithCorrelationID(context.Background())
+			Expect(id).NotTo(BeEmpty())
+			_, sameID := WithCorrelationID(ctx)
+			Expect(sameID).To(Equal(id))
+			Expect(CorrelationID(ctx)).To(Equal(id))
+		})
+
+		It("returns an empty ID for contexts without one", func() {
+			Expect(CorrelationID(context.Background())).To(BeEmpty())
+			Expect(CorrelationID(nil)).To(BeEmpty()) // nolint:staticcheck
+		})
+	})
 })
@@ -18,18 +18,226 @@ package helpers
 
 import (
 	"fmt"
+	"net"
+	"strings"
 
 	"github.com/riskified/dynamic-environment/pkg/names"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // MatchNamespacedHost compares the provided `hostname` and `namespace` to the provided `matchHost`.
-// If `matchHost` is *not* fully qualified, it uses the `inNamespace` parameter to match against the
-// searched namespace.
-func MatchNamespacedHost(hostname, namespace, matchedHost, inNamespace string) bool {
-	shortNameEqual := hostname == matchedHost && namespace == inNamespace
-	fqdnEqual := fmt.Sprint(hostname, ".", namespace, ".svc.cluster.local") == matchedHost
-	return shortNameEqual || fqdnEqual
+// Both hosts are normalized to their FQDN form (using `namespace` and `inNamespace` respectively for
+// hosts that are not fully qualified) before comparing.
+func MatchNamespacedHost(hostname, namespace, matchedHost, inNamespace, clusterDomain string) bool {
+	return NormalizeHost(hostname, namespace, clusterDomain) == NormalizeHost(matchedHost, inNamespace, clusterDomain)
+}
+
+// MatchShortHostInNamespace is like MatchNamespacedHost, but resolves a short `matchedHost` (a bare
+// service name, see IsShortHost) relative to `namespace` (the one of `hostname`) instead of
+// `inNamespace`, for configs of a central namespace that are meant for the services of the
+// namespaces they are exported to. Note that Istio itself resolves them relative to `inNamespace`.
+func MatchShortHostInNamespace(hostname, namespace, matchedHost, inNamespace, clusterDomain string) bool {
+	if IsShortHost(matchedHost) {
+		inNamespace = namespace
+	}
+	return MatchNamespacedHost(hostname, namespace, matchedHost, inNamespace, clusterDomain)
+}
+
+// IsShortHost returns whether the provided host is a bare service name (e.g. `payments`), without
+// a namespace.
+func IsShortHost(host string) bool {
+	return host != "" && host != "*" && !strings.Contains(host, ".") && !IsIPHost(host)
+}
+
+// VersionLabelFor returns the version label key used by the provided service host: the label
+// configured for it in `labelsByHost` (keys could be in any form accepted by `NormalizeHost`) or
+// the `defaultLabel` if there is none.
+func VersionLabelFor(serviceHost, namespace, clusterDomain, defaultLabel string, labelsByHost map[string]string) string {
+	return ValueForHost(serviceHost, namespace, clusterDomain, defaultLabel, labelsByHost)
+}
+
+// ValueForHost returns the value configured for the provided service host in `valuesByHost` (keys
+// could be in any form accepted by `NormalizeHost`) or `defaultValue` if there is none.
+func ValueForHost(serviceHost, namespace, clusterDomain, defaultValue string, valuesByHost map[string]string) string {
+	normalized := NormalizeHost(serviceHost, namespace, clusterDomain)
+	for host, value := range valuesByHost {
+		if NormalizeHost(host, namespace, clusterDomain) == normalized {
+			return value
+		}
+	}
+	return defaultValue
+}
+
+// IsWildcardHost returns whether the provided host is a wildcard host (e.g. `*.ns.svc.cluster.local`).
+func IsWildcardHost(host string) bool {
+	return strings.HasPrefix(host, "*.")
+}
+
+// ValidateServiceHost checks that the provided service host is a valid DNS name (short or fully
+// qualified, optionally with a trailing dot), a wildcard host or an IP address. Hosts are compared regardless of
+// case, so upper case letters are allowed.
+func ValidateServiceHost(host string) error {
+	if strings.TrimSpace(host) == "" {
+		return fmt.Errorf("service host is empty")
+	}
+	if IsIPHost(host) {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "*."), "."))
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid service host %q: %s", host, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// MatchWildcardHost checks whether the provided `hostname` (in `namespace`) matches the provided
+// wildcard host (in `inNamespace`). Both are normalized to FQDN and the wildcard may only replace
+// the service name part, so a wildcard can't match hosts in other namespaces.
+func MatchWildcardHost(hostname, namespace, wildcardHost, inNamespace, clusterDomain string) bool {
+	if !IsWildcardHost(wildcardHost) {
+		return false
+	}
+	host := NormalizeHost(hostname, namespace, clusterDomain)
+	suffix := strings.TrimPrefix(NormalizeHost(wildcardHost, inNamespace, clusterDomain), "*")
+	if !strings.HasSuffix(host, suffix) {
+		return false
+	}
+	name := strings.TrimSuffix(host, suffix)
+	return len(name) > 0 && !strings.Contains(name, ".")
+}
+
+// NormalizeHost returns the FQDN form of the provided service host. Short names (`name`) are
+// qualified with the provided namespace, partially qualified names (`name.ns`, `name.ns.svc`) are
+// completed with the cluster domain. IP addresses are returned in their canonical form (without
+// brackets). Anything else is assumed to be fully qualified (or external) and returned as is. An
+// empty cluster domain defaults to `cluster.local`. Host names are case-insensitive, so they are
+// returned in lower case (which makes all the matching of hosts based on it case-insensitive).
+func NormalizeHost(host, namespace, clusterDomain string) string {
+	if ip := hostIP(host); ip != nil {
+		return ip.String()
+	}
+	host = strings.ToLower(host)
+	if clusterDomain == "" {
+		clusterDomain = names.DefaultClusterDomain
+	}
+	parts := strings.Split(host, ".")
+	switch {
+	case len(parts) == 1:
+		return fmt.Sprintf("%s.%s.svc.%s", host, namespace, clusterDomain)
+	case len(parts) == 2:
+		return fmt.Sprintf("%s.svc.%s", host, clusterDomain)
+	case len(parts) == 3 && parts[2] == "svc":
+		return fmt.Sprintf("%s.%s", host, clusterDomain)
+	}
+	return host
+}
+
+// ServiceForHost returns the Kubernetes Service (namespace and name) addressed by the provided
+// service host (in `namespace`), regardless of the cluster domain it uses (e.g. both `reviews` and
+// `reviews.ns.svc.cluster.local` address `ns/reviews`). Returns false for wildcard, IP and external
+// hosts.
+func ServiceForHost(host, namespace, clusterDomain string) (types.NamespacedName, bool) {
+	if IsWildcardHost(host) || IsIPHost(host) {
+		return types.NamespacedName{}, false
+	}
+	fqdn := strings.TrimSuffix(NormalizeHost(host, namespace, clusterDomain), ".")
+	parts := strings.Split(fqdn, ".")
+	if len(parts) < 4 || parts[2] != "svc" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: parts[1], Name: parts[0]}, true
+}
+
+// SameService returns whether the provided hosts (each in its namespace) address the same service:
+// the same Kubernetes Service regardless of their form and cluster domain (e.g. `a`, `a.ns` and
+// `a.ns.svc.cluster.local` in `ns`), or the same (case insensitive) host for the rest of them (e.g.
+// external and wildcard hosts).
+func SameService(hostA, nsA, hostB, nsB string) bool {
+	serviceA, okA := ServiceForHost(hostA, nsA, "")
+	serviceB, okB := ServiceForHost(hostB, nsB, "")
+	if okA || okB {
+		return okA && okB && serviceA == serviceB
+	}
+	normalizedA := strings.TrimSuffix(NormalizeHost(hostA, nsA, ""), ".")
+	normalizedB := strings.TrimSuffix(NormalizeHost(hostB, nsB, ""), ".")
+	return normalizedA == normalizedB
+}
+
+// UniqueServiceHosts removes the hosts (of the provided namespace) that address the same service as
+// a previous host (see SameService), keeping the order and the form of their first appearance.
+func UniqueServiceHosts(hosts []string, namespace string) []string {
+	var result []string
+	for _, host := range hosts {
+		duplicate := false
+		for _, kept := range result {
+			if SameService(host, namespace, kept, namespace) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			result = append(result, host)
+		}
+	}
+	return result
+}
+
+// ExportedTo returns whether an Istio config (e.g. a DestinationRule) of `inNamespace` with the
+// provided `exportTo` is visible to `namespace`: `*` exports it to all the namespaces, `.` to its
+// own namespace only and `~` to none of them. Without `exportTo` it's exported to all the
+// namespaces (the default of the mesh config).
+func ExportedTo(exportTo []string, inNamespace, namespace string) bool {
+	if len(exportTo) == 0 {
+		return true
+	}
+	for _, target := range exportTo {
+		switch target {
+		case "*":
+			return true
+		case ".":
+			if inNamespace == namespace {
+				return true
+			}
+		case "~":
+		default:
+			if target == namespace {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsIPHost returns whether the provided host is an IPv4 or an IPv6 address (optionally bracketed,
+// e.g. `[2001:db8::1]`).
+func IsIPHost(host string) bool {
+	return hostIP(host) != nil
+}
+
+// SanitizeHostForName returns a form of the provided host that could be part of a resource name:
+// IPv6 addresses are canonicalized (lower case, without brackets) with their colons replaced by
+// dashes (e.g. `2001-db8--1`, and `fd00--0` for `fd00::`). Other hosts are returned as is.
+func SanitizeHostForName(host string) string {
+	ip := hostIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	name := strings.ReplaceAll(ip.String(), ":", "-")
+	if strings.HasSuffix(name, "-") {
+		name += "0"
+	}
+	return name
+}
+
+// Parses the provided host as an IP address (stripping the brackets of IPv6 addresses), returning
+// nil if it's not one.
+func hostIP(host string) net.IP {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return net.ParseIP(host)
 }
 
 func MergeEnvVars(current []v1.EnvVar, overrides []v1.EnvVar) []v1.EnvVar {
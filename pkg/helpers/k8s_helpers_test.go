@@ -23,6 +23,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/riskified/dynamic-environment/pkg/helpers"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 var _ = Describe("Dynamic Environment Controller", func() {
@@ -60,5 +61,226 @@ var _ = Describe("Dynamic Environment Controller", func() {
 				Expect(helpers.EnvVarContains(r, notOverridden)).To(BeTrue(), "should keep original value")
 			})
 		})
+
+		Context("MatchNamespacedHost", func() {
+			DescribeTable(
+				"matching hosts in different forms",
+				func(hostname, namespace, matchedHost, inNamespace string, expected bool) {
+					Expect(helpers.MatchNamespacedHost(hostname, namespace, matchedHost, inNamespace, "")).To(Equal(expected))
+				},
+				Entry("bare names in the same namespace", "details", "ns", "details", "ns", true),
+				Entry("bare names in different namespaces", "details", "ns", "details", "other", false),
+				Entry("bare name and namespaced name", "details", "ns", "details.ns", "other", true),
+				Entry("bare name and FQDN", "details", "ns", "details.ns.svc.cluster.local", "other", true),
+				Entry("namespaced name and bare name", "details.shared", "ns", "details", "shared", true),
+				Entry("namespaced name and svc name", "details.shared", "ns", "details.shared.svc", "ns", true),
+				Entry("FQDN and bare name", "details.shared.svc.cluster.local", "ns", "details", "shared", true),
+				Entry("FQDN and bare name in another namespace", "details.shared.svc.cluster.local", "ns", "details", "ns", false),
+				Entry("FQDN and namespaced name", "details.shared.svc.cluster.local", "ns", "details.shared", "ns", true),
+				Entry("identical FQDNs", "details.ns.svc.cluster.local", "ns", "details.ns.svc.cluster.local", "other", true),
+				Entry("different services", "details", "ns", "reviews", "ns", false),
+				Entry("identical IPv6 hosts", "2001:db8::1", "ns", "2001:db8::1", "other", true),
+				Entry("bracketed and expanded IPv6 hosts", "[2001:DB8::1]", "ns", "2001:db8:0:0:0:0:0:1", "other", true),
+				Entry("different IPv6 hosts", "2001:db8::1", "ns", "2001:db8::2", "ns", false),
+				Entry("IPv4 hosts", "10.0.0.1", "ns", "10.0.0.1", "other", true),
+				Entry("mixed case and lower case names", "Details", "ns", "details", "ns", true),
+				Entry("mixed case FQDN and bare name", "Details.NS.svc.Cluster.Local", "other", "details", "ns", true),
+				Entry("mixed case external hosts", "HttpBin.org", "ns", "httpbin.org", "other", true),
+			)
+
+			It("normalizes hosts to lower case", func() {
+				Expect(helpers.NormalizeHost("Details.NS", "other", "")).To(Equal("details.ns.svc.cluster.local"))
+			})
+
+			It("does not qualify IPv6 hosts", func() {
+				Expect(helpers.NormalizeHost("[FD00::1]", "ns", "")).To(Equal("fd00::1"))
+			})
+
+			It("keeps FQDNs with custom cluster domain as is", func() {
+				Expect(helpers.NormalizeHost("details.ns.svc.mesh.internal", "other", "cluster.local")).To(Equal("details.ns.svc.mesh.internal"))
+			})
+
+			DescribeTable(
+				"matching hosts with a custom cluster domain",
+				func(hostname, namespace, matchedHost, inNamespace string, expected bool) {
+					Expect(helpers.MatchNamespacedHost(hostname, namespace, matchedHost, inNamespace, "mesh.internal")).To(Equal(expected))
+				},
+				Entry("bare name and FQDN", "details", "ns", "details.ns.svc.mesh.internal", "other", true),
+				Entry("FQDN and namespaced name", "details.ns.svc.mesh.internal", "other", "details.ns", "other", true),
+				Entry("bare name and default domain FQDN", "details", "ns", "details.ns.svc.cluster.local", "ns", false),
+			)
+
+			It("defaults to cluster.local if the cluster domain is not set", func() {
+				Expect(helpers.NormalizeHost("details", "ns", "")).To(Equal("details.ns.svc.cluster.local"))
+			})
+		})
+
+		Context("MatchWildcardHost", func() {
+			DescribeTable(
+				"matching hosts against wildcard hosts",
+				func(hostname, namespace, wildcardHost, inNamespace string, expected bool) {
+					Expect(helpers.MatchWildcardHost(hostname, namespace, wildcardHost, inNamespace, "")).To(Equal(expected))
+				},
+				Entry("FQDN host", "api.prod.svc.cluster.local", "ns", "*.prod.svc.cluster.local", "ns", true),
+				Entry("bare host in the wildcard namespace", "api", "prod", "*.prod.svc.cluster.local", "other", true),
+				Entry("namespaced wildcard", "api.prod", "ns", "*.prod", "ns", true),
+				Entry("host in another namespace", "api.staging.svc.cluster.local", "ns", "*.prod.svc.cluster.local", "ns", false),
+				Entry("namespace with a common prefix", "api.preprod.svc.cluster.local", "ns", "*.prod.svc.cluster.local", "ns", false),
+				Entry("non wildcard host", "api.prod.svc.cluster.local", "ns", "api.prod.svc.cluster.local", "ns", false),
+				Entry("mixed case host", "API.Prod.svc.cluster.local", "ns", "*.prod.svc.cluster.local", "ns", true),
+				Entry("multiple labels in place of the wildcard", "a.api.prod.svc.cluster.local", "ns", "*.prod.svc.cluster.local", "ns", false),
+			)
+		})
+
+		Context("ValidateServiceHost", func() {
+			DescribeTable(
+				"accepting well-formed service hosts",
+				func(host string) {
+					Expect(helpers.ValidateServiceHost(host)).To(Succeed())
+				},
+				Entry("short host", "details"),
+				Entry("FQDN host", "details.ns.svc.cluster.local"),
+				Entry("FQDN with a trailing dot", "api.example.com."),
+				Entry("wildcard host", "*.prod.svc.cluster.local"),
+				Entry("upper case host", "Details.NS"),
+				Entry("IPv4 host", "10.0.0.1"),
+				Entry("IPv6 host", "2001:db8::1"),
+				Entry("bracketed IPv6 host", "[2001:db8::1]"),
+			)
+
+			DescribeTable(
+				"rejecting empty and malformed service hosts",
+				func(host string) {
+					Expect(helpers.ValidateServiceHost(host)).NotTo(Succeed())
+				},
+				Entry("empty host", ""),
+				Entry("whitespace only host", "  "),
+				Entry("host with illegal characters", "details_v1.ns"),
+				Entry("empty label", "details..ns"),
+				Entry("host with a port", "details:8080"),
+				Entry("unbalanced brackets", "[2001:db8::1"),
+			)
+		})
+
+		Context("SanitizeHostForName", func() {
+			DescribeTable(
+				"sanitizing hosts for resource names",
+				func(host, expected string) {
+					Expect(helpers.SanitizeHostForName(host)).To(Equal(expected))
+				},
+				Entry("IPv6 host", "2001:db8::1", "2001-db8--1"),
+				Entry("bracketed upper case IPv6 host", "[2001:DB8::1]", "2001-db8--1"),
+				Entry("IPv6 host ending with a colon", "fd00::", "fd00--0"),
+				Entry("IPv4 host", "10.0.0.1", "10.0.0.1"),
+				Entry("DNS host", "details.ns", "details.ns"),
+			)
+		})
+
+		Context("ServiceForHost", func() {
+			It("resolves short and fully qualified hosts to the same service", func() {
+				expected := types.NamespacedName{Namespace: "ns", Name: "reviews"}
+				for _, host := range []string{"reviews", "reviews.ns", "Reviews.ns.svc", "reviews.ns.svc.cluster.local", "reviews.ns.svc.mesh.internal."} {
+					service, ok := helpers.ServiceForHost(host, "ns", "")
+					Expect(ok).To(BeTrue(), host)
+					Expect(service).To(Equal(expected), host)
+				}
+			})
+
+			It("does not resolve wildcard, IP and external hosts", func() {
+				for _, host := range []string{"*.ns.svc.cluster.local", "10.0.0.1", "2001:db8::1", "api.example.com"} {
+					_, ok := helpers.ServiceForHost(host, "ns", "")
+					Expect(ok).To(BeFalse(), host)
+				}
+			})
+		})
+
+		Context("MatchShortHostInNamespace", func() {
+			DescribeTable(
+				"matching the hosts of a config of another namespace",
+				func(hostname, matchedHost string, expected bool) {
+					Expect(helpers.MatchShortHostInNamespace(hostname, "prod", matchedHost, "mesh", "")).To(Equal(expected))
+				},
+				Entry("short host of the service", "payments", "payments", true),
+				Entry("short host of the service as FQDN", "payments.prod.svc.cluster.local", "payments", true),
+				Entry("short host of another service", "payments", "orders", false),
+				Entry("namespaced host of the service", "payments", "payments.prod", true),
+				Entry("namespaced host of the config namespace", "payments", "payments.mesh", false),
+				Entry("FQDN of the config namespace", "payments", "payments.mesh.svc.cluster.local", false),
+			)
+
+			It("resolves short hosts relative to the config namespace otherwise", func() {
+				Expect(helpers.MatchNamespacedHost("payments", "prod", "payments", "mesh", "")).To(BeFalse())
+				Expect(helpers.MatchNamespacedHost("payments", "mesh", "payments", "mesh", "")).To(BeTrue())
+			})
+
+			It("identifies short hosts", func() {
+				for _, host := range []string{"payments", "Payments"} {
+					Expect(helpers.IsShortHost(host)).To(BeTrue(), host)
+				}
+				for _, host := range []string{"", "*", "payments.prod", "*.prod.svc.cluster.local", "2001:db8::1", "10.0.0.1"} {
+					Expect(helpers.IsShortHost(host)).To(BeFalse(), host)
+				}
+			})
+		})
+
+		Context("SameService", func() {
+			DescribeTable(
+				"comparing the services of hosts",
+				func(hostA, nsA, hostB, nsB string, expected bool) {
+					Expect(helpers.SameService(hostA, nsA, hostB, nsB)).To(Equal(expected))
+					Expect(helpers.SameService(hostB, nsB, hostA, nsA)).To(Equal(expected))
+				},
+				Entry("short and namespaced", "a", "ns", "a.ns", "other", true),
+				Entry("short and svc", "a", "ns", "a.ns.svc", "ns", true),
+				Entry("short and FQDN", "a", "ns", "a.ns.svc.cluster.local", "ns", true),
+				Entry("namespaced and FQDN", "a.ns", "other", "a.ns.svc.cluster.local", "ns", true),
+				Entry("FQDN with a trailing dot", "a.ns.svc.cluster.local.", "ns", "a", "ns", true),
+				Entry("another cluster domain", "a.ns.svc.mesh.internal", "ns", "a", "ns", true),
+				Entry("different case", "A", "ns", "a.NS.svc.cluster.local", "ns", true),
+				Entry("short names in different namespaces", "a", "ns", "a", "other", false),
+				Entry("different services", "a", "ns", "b.ns.svc.cluster.local", "ns", false),
+				Entry("same external host", "api.example.com", "ns", "API.example.com.", "other", true),
+				Entry("different external hosts", "api.example.com", "ns", "web.example.com", "ns", false),
+				Entry("external and service hosts", "a.ns.svc.cluster.local", "ns", "a.example.com", "ns", false),
+				Entry("same wildcard host", "*.example.com", "ns", "*.example.com", "other", true),
+				Entry("same IP in different forms", "2001:db8::1", "ns", "[2001:db8:0:0:0:0:0:1]", "ns", true),
+			)
+
+			It("removes the duplicate forms of service hosts", func() {
+				hosts := []string{"a", "b.ns", "a.ns.svc.cluster.local", "B", "c.other", "c"}
+				Expect(helpers.UniqueServiceHosts(hosts, "ns")).To(Equal([]string{"a", "b.ns", "c.other", "c"}))
+			})
+		})
+
+		Context("ExportedTo", func() {
+			DescribeTable(
+				"checking the visibility of a config of another namespace",
+				func(exportTo []string, inNamespace string, expected bool) {
+					Expect(helpers.ExportedTo(exportTo, inNamespace, "ns")).To(Equal(expected))
+				},
+				Entry("no exportTo", nil, "gateway", true),
+				Entry("all namespaces", []string{"*"}, "gateway", true),
+				Entry("our namespace", []string{"other", "ns"}, "gateway", true),
+				Entry("other namespaces", []string{"other"}, "gateway", false),
+				Entry("own namespace of another namespace", []string{"."}, "gateway", false),
+				Entry("own namespace of our namespace", []string{"."}, "ns", true),
+				Entry("no namespaces", []string{"~"}, "gateway", false),
+			)
+		})
+
+		Context("VersionLabelFor", func() {
+			labelsByHost := map[string]string{"reviews.ns": "release"}
+			DescribeTable(
+				"selecting the version label of a service host",
+				func(serviceHost, namespace, expected string) {
+					Expect(helpers.VersionLabelFor(serviceHost, namespace, "", "version", labelsByHost)).To(Equal(expected))
+				},
+				Entry("mapped host", "reviews", "ns", "release"),
+				Entry("mapped host as FQDN", "reviews.ns.svc.cluster.local", "other", "release"),
+				Entry("unmapped host", "details", "ns", "version"),
+				Entry("mapped name in another namespace", "reviews", "other", "version"),
+				Entry("mapped host in mixed case", "Reviews.NS", "other", "release"),
+			)
+		})
 	})
 })
@@ -0,0 +1,94 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DestinationRuleMetrics holds the metrics about the outcomes of handling the overriding
+// DestinationRules. The counters are labeled by the namespace of the owning DynamicEnv, while the
+// per DynamicEnv gauges are also labeled by its name (see ForgetOwner).
+type DestinationRuleMetrics struct {
+	Created         *prometheus.CounterVec
+	Updated         *prometheus.CounterVec
+	IgnoredMissing  *prometheus.CounterVec
+	ReconcileErrors *prometheus.CounterVec
+	// The number of hosts with an overriding DestinationRule per subset of each DynamicEnv
+	ActiveHosts *prometheus.GaugeVec
+	// The number of DestinationRules owned by each DynamicEnv (according to the ownership
+	// annotation), e.g. to alert on leaked rules
+	OwnedDestinationRules *prometheus.GaugeVec
+	// The number of hosts ignored due to a missing base DestinationRule per DynamicEnv
+	IgnoredMissingHosts *prometheus.GaugeVec
+}
+
+func NewDestinationRuleMetrics() *DestinationRuleMetrics {
+	return &DestinationRuleMetrics{
+		Created: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dynamicenv_destinationrules_created_total",
+			Help: "Number of overriding destination rules created per namespace",
+		}, []string{"namespace"}),
+		Updated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dynamicenv_destinationrules_updated_total",
+			Help: "Number of overriding destination rules updated per namespace",
+		}, []string{"namespace"}),
+		IgnoredMissing: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dynamicenv_destinationrules_ignored_missing_total",
+			Help: "Number of service hosts skipped due to a missing base destination rule per namespace",
+		}, []string{"namespace"}),
+		ReconcileErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dynamicenv_destinationrules_reconcile_errors_total",
+			Help: "Number of failures handling destination rules per namespace",
+		}, []string{"namespace"}),
+		ActiveHosts: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dynamicenv_destinationrules_active_hosts",
+			Help: "Number of service hosts with an overriding destination rule per subset of each dynamic environment",
+		}, []string{"namespace", "name", "subset"}),
+		OwnedDestinationRules: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dynamicenv_owned_destinationrules",
+			Help: "Number of destination rules owned by each dynamic environment",
+		}, []string{"namespace", "name"}),
+		IgnoredMissingHosts: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dynamicenv_ignored_missing_hosts",
+			Help: "Number of service hosts ignored due to a missing base destination rule per dynamic environment",
+		}, []string{"namespace", "name"}),
+	}
+}
+
+// Register registers all the metrics with the provided registerer (e.g. the controller-runtime
+// metrics registry).
+func (m *DestinationRuleMetrics) Register(reg prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		m.Created, m.Updated, m.IgnoredMissing, m.ReconcileErrors, m.ActiveHosts, m.OwnedDestinationRules, m.IgnoredMissingHosts,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForgetOwner drops the gauges of the provided DynamicEnv (e.g. once it's deleted), so they are not
+// reported forever.
+func (m *DestinationRuleMetrics) ForgetOwner(owner types.NamespacedName) {
+	m.OwnedDestinationRules.DeleteLabelValues(owner.Namespace, owner.Name)
+	m.IgnoredMissingHosts.DeleteLabelValues(owner.Namespace, owner.Name)
+	m.ActiveHosts.DeletePartialMatch(prometheus.Labels{"namespace": owner.Namespace, "name": owner.Name})
+}
@@ -20,10 +20,21 @@ const (
 	DynamicEnvLabel             = "dynamic-env"
 	DefaultVersionLabel         = "version"
 	DefaultVersion              = "shared"
+	DefaultClusterDomain        = "cluster.local"
 	DeleteDeployments           = "DeleteDeployments"
 	DeleteDestinationRules      = "DeleteDestinationRules"
 	CleanupVirtualServices      = "CleanupVirtualServices"
 	VirtualServiceRoutePrefix   = "dynamic-environment"
+	SharedDestinationRulePrefix = "dynamic-environment-shared"
+	DestinationRuleFieldManager = "dynamic-environment"
+	// The default key of the annotation recording the dynamic environments owning a resource
+	NamespacedNameAnnotation = "riskified.com/dynamic-environment"
+	// The hash of the managed spec of the generated DestinationRules (used to detect drift)
+	DestinationRuleSpecHashAnnotation = "riskified.com/dynamic-environment-spec-hash"
+	// The `namespace/name` of the base DestinationRule a generated DestinationRule was derived from
+	DestinationRuleBaseAnnotation = "riskified.com/dynamic-environment-base"
+	// Base DestinationRules annotated with this key (set to "true") are never overridden
+	DefaultNoOverrideAnnotation = "riskified.com/no-dynamic-override"
 	MainServiceLabelKey         = "purpose"
 	MainServiceLabelValue       = "main"
 	DynamicEnvHeadersLabelKey   = "dynamic-env-headers"
@@ -31,4 +42,12 @@ const (
 	IstioSideCarName            = "istio-proxy"
 	IstioSideCarImage           = "auto"
 	IstioSideCarHeaderEnvName   = "EXACT_HEADERS_SERIALIZED"
+
+	// Event reasons
+	IgnoredMissingDestinationRuleReason = "IgnoredMissingDestinationRule"
+	ConflictingDestinationRuleReason    = "ConflictingDestinationRule"
+	MissingDefaultSubsetReason          = "MissingDefaultSubset"
+	NamespaceNotAllowedReason           = "NamespaceNotAllowed"
+	DestinationRuleNameCollisionReason  = "DestinationRuleNameCollision"
+	OptedOutDestinationRuleReason       = "OptedOutDestinationRule"
 )
@@ -0,0 +1,315 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package render computes the resources a DynamicEnv would generate without a cluster: the handlers
+// run in dry-run mode against an in-memory client seeded with the base resources (deployments,
+// services, DestinationRules and VirtualServices).
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"io"
+
+	"github.com/go-logr/logr"
+	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"github.com/riskified/dynamic-environment/pkg/handlers"
+	"github.com/riskified/dynamic-environment/pkg/helpers"
+	"github.com/riskified/dynamic-environment/pkg/names"
+	istionetwork "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// Scheme contains all the types that could be rendered (or provided as base resources).
+var Scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(Scheme))
+	utilruntime.Must(riskifiedv1alpha1.AddToScheme(Scheme))
+	utilruntime.Must(istionetwork.AddToScheme(Scheme))
+}
+
+// Options are the controller settings that affect the generated resources.
+type Options struct {
+	// The version label (defaults to `names.DefaultVersionLabel`)
+	VersionLabel string
+	// The default version (defaults to `names.DefaultVersion`, overridden by the subsets version)
+	DefaultVersion string
+	// Labels to remove from the overriding deployments
+	LabelsToRemove []string
+	// See `handlers.DestinationRuleHandler`
+	SharedDestinationRules bool
+	// The cluster domain used to fully qualify service hosts (defaults to `cluster.local`)
+	ClusterDomain string
+	Log           logr.Logger
+}
+
+// Render returns the resources the provided DynamicEnv would create or update given the provided
+// base resources. Resources that would be deleted are not included. Fails on the first error of
+// the handlers (e.g. a missing base deployment).
+func Render(de *riskifiedv1alpha1.DynamicEnv, objects []client.Object, opts Options) ([]client.Object, error) {
+	if opts.VersionLabel == "" {
+		opts.VersionLabel = names.DefaultVersionLabel
+	}
+	if opts.DefaultVersion == "" {
+		opts.DefaultVersion = names.DefaultVersion
+	}
+	if opts.Log.GetSink() == nil {
+		opts.Log = logr.Discard()
+	}
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(Scheme).WithObjects(objects...).Build()
+	uniqueVersion := helpers.UniqueDynamicEnvName(de)
+	owner := types.NamespacedName{Name: de.Name, Namespace: de.Namespace}
+	statusHandler := &handlers.DynamicEnvStatusHandler{Client: c, Ctx: ctx, DynamicEnv: de}
+
+	var planned []handlers.PlannedChange
+	subsets := []riskifiedv1alpha1.SubsetOrConsumer{}
+	all := []riskifiedv1alpha1.Subset{}
+	for _, s := range de.Spec.Subsets {
+		subsets, all = append(subsets, riskifiedv1alpha1.SUBSET), append(all, s)
+	}
+	for _, s := range de.Spec.Consumers {
+		subsets, all = append(subsets, riskifiedv1alpha1.CONSUMER), append(all, s)
+	}
+	for i, s := range all {
+		uniqueName := s.Name + "-" + uniqueVersion
+		defaultVersion := opts.DefaultVersion
+		if s.DefaultVersion != "" {
+			defaultVersion = s.DefaultVersion
+		}
+		baseDeployment := &appsv1.Deployment{}
+		if err := c.Get(ctx, types.NamespacedName{Name: s.Name, Namespace: s.Namespace}, baseDeployment); err != nil {
+			return nil, fmt.Errorf("couldn't find the deployment we need to override (name: %s, ns: %s): %w", s.Name, s.Namespace, err)
+		}
+		deploymentHandler := handlers.DeploymentHandler{
+			Client:         c,
+			UniqueName:     uniqueName,
+			UniqueVersion:  uniqueVersion,
+			Owner:          owner,
+			BaseDeployment: baseDeployment,
+			DeploymentType: subsets[i],
+			LabelsToRemove: opts.LabelsToRemove,
+			VersionLabel:   opts.VersionLabel,
+			StatusHandler:  statusHandler,
+			Matches:        de.Spec.IstioMatches,
+			Subset:         s,
+			DryRun:         true,
+			Log:            opts.Log,
+			Ctx:            ctx,
+		}
+		if err := deploymentHandler.Handle(); err != nil {
+			return nil, fmt.Errorf("rendering deployment of '%s': %w", uniqueName, err)
+		}
+		planned = append(planned, deploymentHandler.PlannedChanges()...)
+		if subsets[i] != riskifiedv1alpha1.SUBSET {
+			continue
+		}
+
+		serviceHosts, err := handlers.LocateMatchingServiceHosts(ctx, c, s.Namespace, baseDeployment.Spec.Template.ObjectMeta.Labels, false)
+		if err != nil {
+			return nil, fmt.Errorf("locating service hostname for deployment '%s': %w", baseDeployment.Name, err)
+		}
+		var trafficPolicy riskifiedv1alpha1.SubsetTrafficPolicy
+		if s.TrafficPolicy != nil {
+			trafficPolicy = *s.TrafficPolicy
+		}
+		destinationRuleHandler, err := handlers.NewDestinationRuleHandler(handlers.DestinationRuleHandler{
+			Client:                 c,
+			UniqueName:             uniqueName,
+			UniqueVersion:          uniqueVersion,
+			Namespace:              s.Namespace,
+			VersionLabel:           opts.VersionLabel,
+			DefaultVersion:         defaultVersion,
+			StatusHandler:          statusHandler,
+			ServiceHosts:           serviceHosts,
+			ExcludedHosts:          s.ExcludedHosts,
+			Owner:                  owner,
+			OwnerUID:               de.UID,
+			SharedDestinationRules: opts.SharedDestinationRules,
+			ClusterDomain:          opts.ClusterDomain,
+			ConnectionPool:         trafficPolicy.ConnectionPool,
+			LoadBalancer:           trafficPolicy.LoadBalancer,
+			TLS:                    trafficPolicy.TLS,
+			PortLevelSettings:      trafficPolicy.PortLevelSettings,
+			SubsetSelector:         s.SubsetSelector,
+			DryRun:                 true,
+			Log:                    opts.Log,
+			Ctx:                    ctx,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := destinationRuleHandler.Handle(); err != nil {
+			return nil, fmt.Errorf("rendering destination rules of '%s': %w", uniqueName, err)
+		}
+		planned = append(planned, destinationRuleHandler.PlannedChanges()...)
+
+		weight := int32(100)
+		if s.Weight != nil {
+			weight = *s.Weight
+		}
+		virtualServiceHandler := handlers.VirtualServiceHandler{
+			Client:         c,
+			UniqueName:     uniqueName,
+			UniqueVersion:  uniqueVersion,
+			RoutePrefix:    helpers.CalculateVirtualServicePrefix(uniqueVersion, s.Name),
+			Namespace:      s.Namespace,
+			ServiceHosts:   destinationRuleHandler.IncludedHosts(),
+			DefaultVersion: defaultVersion,
+			DynamicEnv:     de,
+			StatusHandler:  statusHandler,
+			SubsetNames:    destinationRuleHandler.GetSubsetNames(),
+			ClusterDomain:  opts.ClusterDomain,
+			Weight:         weight,
+			DryRun:         true,
+			Log:            opts.Log,
+			Ctx:            ctx,
+		}
+		if err := virtualServiceHandler.Handle(); err != nil {
+			return nil, fmt.Errorf("rendering virtual services of '%s': %w", uniqueName, err)
+		}
+		planned = append(planned, virtualServiceHandler.PlannedChanges()...)
+	}
+	return renderedObjects(planned)
+}
+
+// Returns the objects of the planned creates / updates (the latest version of each object), with
+// their type meta set and without server populated fields.
+func renderedObjects(planned []handlers.PlannedChange) ([]client.Object, error) {
+	var result []client.Object
+	index := make(map[string]int)
+	for _, change := range planned {
+		if change.Operation == handlers.PlannedDelete {
+			continue
+		}
+		obj := change.Object
+		gvk, err := apiutil.GVKForObject(obj, Scheme)
+		if err != nil {
+			return nil, err
+		}
+		obj.GetObjectKind().SetGroupVersionKind(gvk)
+		obj.SetResourceVersion("")
+		obj.SetManagedFields(nil)
+		key := gvk.String() + "/" + obj.GetNamespace() + "/" + obj.GetName()
+		if i, ok := index[key]; ok {
+			result[i] = obj
+			continue
+		}
+		index[key] = len(result)
+		result = append(result, obj)
+	}
+	return result, nil
+}
+
+// Decode decodes the (YAML or JSON, possibly multi document) objects of the provided reader.
+func Decode(r io.Reader) ([]client.Object, error) {
+	decoder := serializer.NewCodecFactory(Scheme).UniversalDeserializer()
+	reader := yaml.NewYAMLReader(bufio.NewReader(r))
+	var objects []client.Object
+	for {
+		doc, err := reader.Read()
+		if goerrors.Is(err, io.EOF) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isEmptyDocument(doc) {
+			continue
+		}
+		obj, _, err := decoder.Decode(doc, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("decoding object: %w", err)
+		}
+		o, ok := obj.(client.Object)
+		if !ok {
+			return nil, fmt.Errorf("unsupported object: %T", obj)
+		}
+		objects = append(objects, o)
+	}
+}
+
+// SplitDynamicEnv splits the provided (decoded) objects to the single DynamicEnv among them and the
+// base resources.
+func SplitDynamicEnv(objects []client.Object) (*riskifiedv1alpha1.DynamicEnv, []client.Object, error) {
+	var de *riskifiedv1alpha1.DynamicEnv
+	var base []client.Object
+	for _, obj := range objects {
+		d, ok := obj.(*riskifiedv1alpha1.DynamicEnv)
+		if !ok {
+			base = append(base, obj)
+			continue
+		}
+		if de != nil {
+			return nil, nil, fmt.Errorf("expected a single DynamicEnv, found both %s and %s", de.Name, d.Name)
+		}
+		de = d
+	}
+	if de == nil {
+		return nil, nil, fmt.Errorf("no DynamicEnv was provided")
+	}
+	return de, base, nil
+}
+
+// Encode writes the provided objects as a multi document YAML (or as a JSON list if asJSON is set).
+func Encode(w io.Writer, objects []client.Object, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(objects)
+	}
+	for i, obj := range objects {
+		out, err := sigsyaml.Marshal(obj)
+		if err != nil {
+			return fmt.Errorf("encoding %s: %w", obj.GetName(), err)
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the provided YAML document has no content (only blank and comment lines).
+func isEmptyDocument(doc []byte) bool {
+	for _, line := range bytes.Split(doc, []byte("\n")) {
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) > 0 && trimmed[0] != '#' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package render_test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	riskifiedv1alpha1 "github.com/riskified/dynamic-environment/api/v1alpha1"
+	"github.com/riskified/dynamic-environment/pkg/render"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Regenerate the golden files (go test ./pkg/render -update)
+var update = flag.Bool("update", false, "update the golden files")
+
+// Decodes the DynamicEnv and the base resources of the provided fixture
+func decodeFixture(path string) (*riskifiedv1alpha1.DynamicEnv, []client.Object) {
+	input, err := os.Open(path)
+	Expect(err).To(BeNil())
+	defer input.Close()
+	objects, err := render.Decode(input)
+	Expect(err).To(BeNil())
+	de, base, err := render.SplitDynamicEnv(objects)
+	Expect(err).To(BeNil())
+	return de, base
+}
+
+var _ = Describe("Render", func() {
+	It("renders the resources generated by a DynamicEnv", func() {
+		de, base := decodeFixture("fixtures/input.yaml")
+
+		rendered, err := render.Render(de, base, render.Options{})
+		Expect(err).To(BeNil())
+		var out bytes.Buffer
+		Expect(render.Encode(&out, rendered, false)).To(Succeed())
+
+		if *update {
+			Expect(os.WriteFile("fixtures/expected.yaml", out.Bytes(), 0644)).To(Succeed())
+		}
+		expected, err := os.ReadFile("fixtures/expected.yaml")
+		Expect(err).To(BeNil())
+		Expect(out.String()).To(Equal(string(expected)))
+	})
+
+	It("fails if the base deployment is missing", func() {
+		de, _ := decodeFixture("fixtures/input.yaml")
+
+		_, err := render.Render(de, nil, render.Options{})
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("couldn't find the deployment we need to override"))
+	})
+
+	It("requires a single dynamic environment", func() {
+		de, base := decodeFixture("fixtures/input.yaml")
+		_, _, err := render.SplitDynamicEnv(base)
+		Expect(err).To(MatchError("no DynamicEnv was provided"))
+		_, _, err = render.SplitDynamicEnv([]client.Object{de, de})
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("encodes the rendered resources as JSON", func() {
+		de, base := decodeFixture("fixtures/input.yaml")
+
+		rendered, err := render.Render(de, base, render.Options{})
+		Expect(err).To(BeNil())
+		var out bytes.Buffer
+		Expect(render.Encode(&out, rendered, true)).To(Succeed())
+		Expect(out.String()).To(HavePrefix("["))
+		Expect(out.String()).To(ContainSubstring(`"kind": "DestinationRule"`))
+	})
+})
@@ -18,108 +18,422 @@ package watches
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/riskified/dynamic-environment/pkg/helpers"
+	"github.com/riskified/dynamic-environment/pkg/names"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+// The default keys of the ownership annotations (see Ownership).
 const (
 	// NamespacedNameAnnotation is an annotation which indicates who the dynamic environment owner of this resource is.
 	// The format is `<namespace>/<name>` with comma-separated values if there is more than one dynamic environment
-	NamespacedNameAnnotation = "riskified.com/dynamic-environment"
+	NamespacedNameAnnotation = names.NamespacedNameAnnotation
+	// OwnerUIDsAnnotation records the UIDs of the dynamic environments listed in NamespacedNameAnnotation.
+	// The format is `<namespace>/<name>=<uid>` with comma-separated values (one per owner). It allows
+	// telling the original owner apart from a recreated dynamic environment with the same name.
+	OwnerUIDsAnnotation = NamespacedNameAnnotation + ownerUIDsSuffix
+	// SubsetOwnersAnnotation records the dynamic environment that added each of the subsets of a
+	// DestinationRule (subsets have no metadata of their own). The format is
+	// `<subset>=<namespace>/<name>` with comma-separated values (one per subset).
+	SubsetOwnersAnnotation = NamespacedNameAnnotation + subsetOwnersSuffix
 )
 
-type EnqueueRequestForAnnotation struct{}
+const (
+	ownerUIDsSuffix    = "-uids"
+	subsetOwnersSuffix = "-subsets"
+)
+
+var log = ctrl.Log.WithName("watches")
+
+// Ownership reads and writes the ownership annotations using the keys of an operator instance: Key
+// (the one of NamespacedNameAnnotation) and the UIDs and subset owners keys derived from it, so two
+// instances using different keys do not clobber each other's ownership annotations. The zero value
+// uses the default keys, like the functions of this package.
+type Ownership struct {
+	// The ownership annotation key (defaults to NamespacedNameAnnotation)
+	Key string
+}
+
+// NewOwnership returns the Ownership of the provided key, once it (and the keys derived from it)
+// are validated.
+func NewOwnership(key string) (Ownership, error) {
+	for _, k := range []string{key, key + ownerUIDsSuffix, key + subsetOwnersSuffix} {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return Ownership{}, fmt.Errorf("invalid annotation key %q: %s", k, strings.Join(errs, "; "))
+		}
+	}
+	return Ownership{Key: key}, nil
+}
+
+// NamespacedNameKey returns the key of the owners annotation (see NamespacedNameAnnotation).
+func (o Ownership) NamespacedNameKey() string {
+	if o.Key == "" {
+		return NamespacedNameAnnotation
+	}
+	return o.Key
+}
+
+// OwnerUIDsKey returns the key of the owner UIDs annotation (see OwnerUIDsAnnotation).
+func (o Ownership) OwnerUIDsKey() string {
+	return o.NamespacedNameKey() + ownerUIDsSuffix
+}
+
+// SubsetOwnersKey returns the key of the subset owners annotation (see SubsetOwnersAnnotation).
+func (o Ownership) SubsetOwnersKey() string {
+	return o.NamespacedNameKey() + subsetOwnersSuffix
+}
+
+// EnqueueRequestForAnnotation enqueues the dynamic environments listed in the ownership annotation
+// of the object. Only the annotation of this instance is parsed: the annotations of other operator
+// instances (using other keys) are ignored.
+type EnqueueRequestForAnnotation struct {
+	// The ownership annotation key (defaults to NamespacedNameAnnotation)
+	AnnotationKey string
+}
 
 var _ handler.EventHandler = &EnqueueRequestForAnnotation{}
 
 // Create is called in response to an add event.
 func (e *EnqueueRequestForAnnotation) Create(evt event.CreateEvent, q workqueue.RateLimitingInterface) {
-	addToQueue(evt.Object, q)
+	addToQueue(e.key(), evt.Object, q)
 }
 
-// Update is called in response to an update event.
+// Update is called in response to an update event. Enqueues each of the owners of both the old and
+// the new object once (the old object is skipped entirely when the annotation did not change).
 func (e *EnqueueRequestForAnnotation) Update(evt event.UpdateEvent, q workqueue.RateLimitingInterface) {
-	addToQueue(evt.ObjectNew, q)
-	addToQueue(evt.ObjectOld, q)
+	key := e.key()
+	if evt.ObjectOld == nil || evt.ObjectOld.GetAnnotations()[key] == evt.ObjectNew.GetAnnotations()[key] {
+		addToQueue(key, evt.ObjectNew, q)
+		return
+	}
+	owners := ownersOf(key, evt.ObjectNew)
+	for _, owner := range ownersOf(key, evt.ObjectOld) {
+		if !containsOwner(owners, owner) {
+			owners = append(owners, owner)
+		}
+	}
+	for _, owner := range owners {
+		q.Add(reconcile.Request{NamespacedName: owner})
+	}
 }
 
 // Delete is called in response to a delete event.
 func (e *EnqueueRequestForAnnotation) Delete(evt event.DeleteEvent, q workqueue.RateLimitingInterface) {
-	addToQueue(evt.Object, q)
+	addToQueue(e.key(), evt.Object, q)
 }
 
 // GenericFunc is called in response to a generic event.
 func (e *EnqueueRequestForAnnotation) Generic(evt event.GenericEvent, q workqueue.RateLimitingInterface) {
-	addToQueue(evt.Object, q)
+	addToQueue(e.key(), evt.Object, q)
 }
 
-// addToQueue converts annotations defined for NamespacedNameAnnotation as comma-separated list and add them to queue.
-func addToQueue(object client.Object, q workqueue.RateLimitingInterface) {
-	annotations := object.GetAnnotations()
-	if annotations != nil {
-		dynamicEnvs := strings.Split(annotations[NamespacedNameAnnotation], ",")
-		for _, env := range dynamicEnvs {
-			if env != "" {
-				values := strings.SplitN(env, "/", 2)
-				q.Add(reconcile.Request{NamespacedName: types.NamespacedName{
-					Name:      values[1],
-					Namespace: values[0],
-				}})
-			}
+func (e *EnqueueRequestForAnnotation) key() string {
+	return Ownership{Key: e.AnnotationKey}.NamespacedNameKey()
+}
+
+// addToQueue adds the owners defined in the provided annotation to queue.
+func addToQueue(key string, object client.Object, q workqueue.RateLimitingInterface) {
+	for _, owner := range ownersOf(key, object) {
+		q.Add(reconcile.Request{NamespacedName: owner})
+	}
+}
+
+// OwnersOf returns the dynamic environments listed in the NamespacedNameAnnotation of the provided
+// object. Malformed entries (e.g. missing the `/` separator) are skipped.
+func OwnersOf(object client.Object) []types.NamespacedName {
+	return Ownership{}.OwnersOf(object)
+}
+
+// OwnersOf is like the OwnersOf function, using the key of the Ownership.
+func (o Ownership) OwnersOf(object client.Object) []types.NamespacedName {
+	return ownersOf(o.NamespacedNameKey(), object)
+}
+
+// Returns the dynamic environments listed in the provided annotation of the object.
+func ownersOf(key string, object client.Object) []types.NamespacedName {
+	var owners []types.NamespacedName
+	for _, env := range splitAnnotation(object.GetAnnotations()[key]) {
+		values := strings.SplitN(env, "/", 2)
+		if len(values) != 2 || values[0] == "" || values[1] == "" {
+			log.Info("Skipping malformed dynamic environment annotation entry", "entry", env,
+				"object", client.ObjectKeyFromObject(object))
+			continue
+		}
+		owners = append(owners, types.NamespacedName{Namespace: values[0], Name: values[1]})
+	}
+	return owners
+}
+
+// FilterByOwner returns the objects from the provided list which are owned by the provided dynamic
+// environment (according to NamespacedNameAnnotation).
+func FilterByOwner[T client.Object](objects []T, owner types.NamespacedName) []T {
+	return FilterOwned(Ownership{}, objects, owner, "")
+}
+
+// splitAnnotation splits the comma-separated annotation value ignoring stray whitespace, empty
+// segments and duplicate entries (e.g. written by older versions). This is the single parser of the
+// annotation, so all readers and writers agree on its contents.
+func splitAnnotation(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" && !helpers.StringSliceContains(item, result) {
+			result = append(result, item)
 		}
 	}
+	return result
+}
+
+// TooManyOwners is returned by AddToAnnotationChecked when adding an owner would exceed the
+// configured maximum number of owners.
+type TooManyOwners struct {
+	Owner types.NamespacedName
+	Max   int
+}
+
+func (t TooManyOwners) Error() string {
+	return fmt.Sprintf("cannot add %s as owner: resource already has the maximum of %d dynamic environment owners", t.Owner, t.Max)
 }
 
 // AddToAnnotation appends the current Dynamic environment to `NamespacedNameAnnotation`
 func AddToAnnotation(owner types.NamespacedName, object client.Object) {
+	Ownership{}.AddToAnnotation(owner, object)
+}
+
+// AddToAnnotation is like the AddToAnnotation function, using the key of the Ownership.
+func (o Ownership) AddToAnnotation(owner types.NamespacedName, object client.Object) {
+	_ = o.AddToAnnotationChecked(owner, object, 0)
+}
+
+// AddToAnnotationChecked is like AddToAnnotation but refuses to add a new owner (returning
+// TooManyOwners) if the resource already has `maxOwners` owners. Owners that are already present
+// are always accepted. A non-positive `maxOwners` means there is no limit.
+func AddToAnnotationChecked(owner types.NamespacedName, object client.Object, maxOwners int) error {
+	return Ownership{}.AddToAnnotationChecked(owner, object, maxOwners)
+}
+
+// AddToAnnotationChecked is like the AddToAnnotationChecked function, using the key of the
+// Ownership.
+func (o Ownership) AddToAnnotationChecked(owner types.NamespacedName, object client.Object, maxOwners int) error {
+	key := o.NamespacedNameKey()
 	annotations := object.GetAnnotations()
 	if annotations == nil {
 		annotations = map[string]string{}
 	}
 
-	existingDynamicEnvs := strings.Split(annotations[NamespacedNameAnnotation], ",")
+	existingDynamicEnvs := splitAnnotation(annotations[key])
 	currentDynamicEnv := fmt.Sprintf("%s/%s", owner.Namespace, owner.Name)
 
-	if len(existingDynamicEnvs) == 1 && existingDynamicEnvs[0] == "" {
-		existingDynamicEnvs[0] = currentDynamicEnv
-	} else if !helpers.StringSliceContains(currentDynamicEnv, existingDynamicEnvs) {
+	if !helpers.StringSliceContains(currentDynamicEnv, existingDynamicEnvs) {
+		if maxOwners > 0 && len(existingDynamicEnvs) >= maxOwners {
+			return TooManyOwners{Owner: owner, Max: maxOwners}
+		}
 		existingDynamicEnvs = append(existingDynamicEnvs, currentDynamicEnv)
 	}
 
-	annotations[NamespacedNameAnnotation] = strings.Join(existingDynamicEnvs, ",")
+	annotations[key] = strings.Join(existingDynamicEnvs, ",")
 	object.SetAnnotations(annotations)
+	return nil
 }
 
-// RemoveFromAnnotation removes current Dynamic environment from `NamespacedNameAnnotation`
+// RemoveFromAnnotation removes current Dynamic environment from `NamespacedNameAnnotation`. The
+// annotation is deleted entirely once the last owner is removed.
 func RemoveFromAnnotation(owner types.NamespacedName, object client.Object) {
-	// Todo: Do we want to delete the annotation entirely if empty?
+	Ownership{}.RemoveFromAnnotation(owner, object)
+}
+
+// RemoveFromAnnotation is like the RemoveFromAnnotation function, using the keys of the Ownership.
+func (o Ownership) RemoveFromAnnotation(owner types.NamespacedName, object client.Object) {
+	key := o.NamespacedNameKey()
 	annotations := object.GetAnnotations()
-	if annotations == nil {
-		annotations = map[string]string{}
+	if _, ok := annotations[key]; !ok {
+		return
 	}
 
-	existingDynamicEnvs := strings.Split(annotations[NamespacedNameAnnotation], ",")
+	existingDynamicEnvs := splitAnnotation(annotations[key])
 	currentDynamicEnv := fmt.Sprintf("%s/%s", owner.Namespace, owner.Name)
 	existingDynamicEnvs = helpers.RemoveItemFromStringSlice(currentDynamicEnv, existingDynamicEnvs)
 
-	annotations[NamespacedNameAnnotation] = strings.Join(existingDynamicEnvs, ",")
+	if len(existingDynamicEnvs) == 0 {
+		delete(annotations, key)
+	} else {
+		annotations[key] = strings.Join(existingDynamicEnvs, ",")
+	}
 	object.SetAnnotations(annotations)
+	o.setOwnerUID(owner, "", object)
 }
 
 // ContainsAnnotations checks whether the requested annotation already exists.
 func ContainsAnnotation(searchItem types.NamespacedName, object client.Object) bool {
+	return Ownership{}.ContainsAnnotation(searchItem, object)
+}
+
+// ContainsAnnotation is like the ContainsAnnotation function, using the key of the Ownership.
+func (o Ownership) ContainsAnnotation(searchItem types.NamespacedName, object client.Object) bool {
+	return containsOwner(o.OwnersOf(object), searchItem)
+}
+
+// ContainsOwner is like ContainsAnnotation but also verifies the identity of the owner: if a UID is
+// recorded for the owner (see OwnerUIDsAnnotation) it must match the provided one. Owners without a
+// recorded UID (e.g. annotated by older versions) and an empty `uid` are matched by name only.
+func ContainsOwner(owner types.NamespacedName, uid types.UID, object client.Object) bool {
+	return Ownership{}.ContainsOwner(owner, uid, object)
+}
+
+// ContainsOwner is like the ContainsOwner function, using the keys of the Ownership.
+func (o Ownership) ContainsOwner(owner types.NamespacedName, uid types.UID, object client.Object) bool {
+	if !o.ContainsAnnotation(owner, object) {
+		return false
+	}
+	recorded, ok := o.OwnerUID(owner, object)
+	return !ok || uid == "" || recorded == uid
+}
+
+// FilterByOwnerUID is like FilterByOwner but also verifies the identity of the owner (see
+// ContainsOwner).
+func FilterByOwnerUID[T client.Object](objects []T, owner types.NamespacedName, uid types.UID) []T {
+	return FilterOwned(Ownership{}, objects, owner, uid)
+}
+
+// FilterOwned is like FilterByOwnerUID, using the keys of the provided Ownership.
+func FilterOwned[T client.Object](o Ownership, objects []T, owner types.NamespacedName, uid types.UID) []T {
+	var result []T
+	for _, object := range objects {
+		if o.ContainsOwner(owner, uid, object) {
+			result = append(result, object)
+		}
+	}
+	return result
+}
+
+// AddOwnerUID records the UID of the provided owner in OwnerUIDsAnnotation (replacing the previously
+// recorded one, if any). Does nothing if `uid` is empty.
+func AddOwnerUID(owner types.NamespacedName, uid types.UID, object client.Object) {
+	Ownership{}.AddOwnerUID(owner, uid, object)
+}
+
+// AddOwnerUID is like the AddOwnerUID function, using the keys of the Ownership.
+func (o Ownership) AddOwnerUID(owner types.NamespacedName, uid types.UID, object client.Object) {
+	if uid != "" {
+		o.setOwnerUID(owner, uid, object)
+	}
+}
+
+// OwnerUID returns the UID recorded for the provided owner (see OwnerUIDsAnnotation).
+func OwnerUID(owner types.NamespacedName, object client.Object) (types.UID, bool) {
+	return Ownership{}.OwnerUID(owner, object)
+}
+
+// OwnerUID is like the OwnerUID function, using the keys of the Ownership.
+func (o Ownership) OwnerUID(owner types.NamespacedName, object client.Object) (types.UID, bool) {
+	prefix := fmt.Sprintf("%s/%s=", owner.Namespace, owner.Name)
+	for _, entry := range splitAnnotation(object.GetAnnotations()[o.OwnerUIDsKey()]) {
+		if strings.HasPrefix(entry, prefix) {
+			return types.UID(strings.TrimPrefix(entry, prefix)), true
+		}
+	}
+	return "", false
+}
+
+// Replaces the UID recorded for the provided owner (removing it if `uid` is empty). The annotation is
+// deleted entirely once the last UID is removed.
+func (o Ownership) setOwnerUID(owner types.NamespacedName, uid types.UID, object client.Object) {
+	key := o.OwnerUIDsKey()
 	annotations := object.GetAnnotations()
+	if _, ok := annotations[key]; !ok && uid == "" {
+		return
+	}
 	if annotations == nil {
-		return false
+		annotations = map[string]string{}
+	}
+	prefix := fmt.Sprintf("%s/%s=", owner.Namespace, owner.Name)
+	var entries []string
+	for _, entry := range splitAnnotation(annotations[key]) {
+		if !strings.HasPrefix(entry, prefix) {
+			entries = append(entries, entry)
+		}
+	}
+	if uid != "" {
+		entries = append(entries, prefix+string(uid))
+	}
+	if len(entries) == 0 {
+		delete(annotations, key)
+	} else {
+		annotations[key] = strings.Join(entries, ",")
+	}
+	object.SetAnnotations(annotations)
+}
+
+// SubsetOwners returns the owner of each subset according to SubsetOwnersAnnotation (malformed
+// entries are skipped).
+func SubsetOwners(object client.Object) map[string]types.NamespacedName {
+	return Ownership{}.SubsetOwners(object)
+}
+
+// SubsetOwners is like the SubsetOwners function, using the keys of the Ownership.
+func (o Ownership) SubsetOwners(object client.Object) map[string]types.NamespacedName {
+	result := map[string]types.NamespacedName{}
+	for _, entry := range splitAnnotation(object.GetAnnotations()[o.SubsetOwnersKey()]) {
+		subset, owner, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		namespace, name, ok := strings.Cut(owner, "/")
+		if !ok || subset == "" || namespace == "" || name == "" {
+			continue
+		}
+		result[subset] = types.NamespacedName{Namespace: namespace, Name: name}
+	}
+	return result
+}
+
+// SetSubsetOwners replaces SubsetOwnersAnnotation with the provided owners per subset. The annotation
+// is deleted if there are none.
+func SetSubsetOwners(object client.Object, owners map[string]types.NamespacedName) {
+	Ownership{}.SetSubsetOwners(object, owners)
+}
+
+// SetSubsetOwners is like the SetSubsetOwners function, using the keys of the Ownership.
+func (o Ownership) SetSubsetOwners(object client.Object, owners map[string]types.NamespacedName) {
+	key := o.SubsetOwnersKey()
+	annotations := object.GetAnnotations()
+	if len(owners) == 0 {
+		if _, ok := annotations[key]; ok {
+			delete(annotations, key)
+			object.SetAnnotations(annotations)
+		}
+		return
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	subsets := make([]string, 0, len(owners))
+	for subset := range owners {
+		subsets = append(subsets, subset)
+	}
+	sort.Strings(subsets)
+	entries := make([]string, 0, len(subsets))
+	for _, subset := range subsets {
+		entries = append(entries, fmt.Sprintf("%s=%s/%s", subset, owners[subset].Namespace, owners[subset].Name))
+	}
+	annotations[key] = strings.Join(entries, ",")
+	object.SetAnnotations(annotations)
+}
+
+func containsOwner(owners []types.NamespacedName, owner types.NamespacedName) bool {
+	for _, o := range owners {
+		if o == owner {
+			return true
+		}
 	}
-	existingAnnotations := strings.Split(annotations[NamespacedNameAnnotation], ",")
-	searchFor := fmt.Sprintf("%s/%s", searchItem.Namespace, searchItem.Name)
-	return helpers.StringSliceContains(searchFor, existingAnnotations)
+	return false
 }
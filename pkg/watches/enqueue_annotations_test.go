@@ -0,0 +1,427 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watches_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/riskified/dynamic-environment/pkg/names"
+	"github.com/riskified/dynamic-environment/pkg/watches"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func withAnnotation(value string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "deployment",
+			Namespace:   "ns",
+			Annotations: map[string]string{watches.NamespacedNameAnnotation: value},
+		},
+	}
+}
+
+func drainQueue(q workqueue.RateLimitingInterface) []reconcile.Request {
+	var result []reconcile.Request
+	for q.Len() > 0 {
+		item, _ := q.Get()
+		result = append(result, item.(reconcile.Request))
+		q.Done(item)
+	}
+	return result
+}
+
+var _ = Describe("EnqueueRequestForAnnotation", func() {
+	DescribeTable(
+		"skips malformed annotation entries",
+		func(value string, expected []types.NamespacedName) {
+			q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+			defer q.ShutDown()
+			handler := watches.EnqueueRequestForAnnotation{}
+			handler.Create(event.CreateEvent{Object: withAnnotation(value)}, q)
+			var result []types.NamespacedName
+			for _, r := range drainQueue(q) {
+				result = append(result, r.NamespacedName)
+			}
+			Expect(result).To(ConsistOf(expected))
+		},
+		Entry("valid entries", "ns1/de1,ns2/de2",
+			[]types.NamespacedName{{Namespace: "ns1", Name: "de1"}, {Namespace: "ns2", Name: "de2"}}),
+		Entry("entry missing the slash", "ns1/de1,broken",
+			[]types.NamespacedName{{Namespace: "ns1", Name: "de1"}}),
+		Entry("entries with empty parts", "/de1,ns2/,ns3/de3",
+			[]types.NamespacedName{{Namespace: "ns3", Name: "de3"}}),
+		Entry("whitespace and empty segments", " ns1/de1 ,, ",
+			[]types.NamespacedName{{Namespace: "ns1", Name: "de1"}}),
+		Entry("empty annotation", "", nil),
+	)
+})
+
+// Records the added items (the real queue dedups identical items, hiding double enqueueing)
+type recordingQueue struct {
+	workqueue.RateLimitingInterface
+	added []reconcile.Request
+}
+
+func (q *recordingQueue) Add(item interface{}) {
+	q.added = append(q.added, item.(reconcile.Request))
+}
+
+var _ = Describe("EnqueueRequestForAnnotation Update", func() {
+	update := func(oldValue, newValue string) []reconcile.Request {
+		q := &recordingQueue{}
+		handler := watches.EnqueueRequestForAnnotation{}
+		handler.Update(event.UpdateEvent{ObjectOld: withAnnotation(oldValue), ObjectNew: withAnnotation(newValue)}, q)
+		return q.added
+	}
+
+	It("enqueues a single request if the annotation did not change", func() {
+		Expect(update("ns1/de1", "ns1/de1")).To(Equal([]reconcile.Request{
+			{NamespacedName: types.NamespacedName{Namespace: "ns1", Name: "de1"}},
+		}))
+	})
+
+	It("enqueues the union of the old and new owners once", func() {
+		Expect(update("ns1/de1,ns2/de2", "ns2/de2,ns3/de3")).To(ConsistOf(
+			reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns1", Name: "de1"}},
+			reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns2", Name: "de2"}},
+			reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "ns3", Name: "de3"}},
+		))
+	})
+})
+
+var _ = Describe("EnqueueRequestForAnnotation of an instance", func() {
+	foreign := func() *appsv1.Deployment {
+		return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "deployment", Namespace: "ns", Annotations: map[string]string{
+			"tenant.example.com/owners": "ns1/de1",
+		}}}
+	}
+
+	It("does not enqueue the owners in a foreign annotation", func() {
+		q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		defer q.ShutDown()
+		handler := watches.EnqueueRequestForAnnotation{}
+		handler.Create(event.CreateEvent{Object: foreign()}, q)
+		handler.Update(event.UpdateEvent{ObjectOld: withAnnotation("ns2/de2"), ObjectNew: foreign()}, q)
+		Expect(drainQueue(q)).To(Equal([]reconcile.Request{
+			{NamespacedName: types.NamespacedName{Namespace: "ns2", Name: "de2"}},
+		}))
+	})
+
+	It("enqueues only the owners in its own annotation", func() {
+		q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		defer q.ShutDown()
+		d := foreign()
+		d.Annotations[watches.NamespacedNameAnnotation] = "ns2/de2"
+		handler := watches.EnqueueRequestForAnnotation{AnnotationKey: "tenant.example.com/owners"}
+		handler.Delete(event.DeleteEvent{Object: d}, q)
+		Expect(drainQueue(q)).To(Equal([]reconcile.Request{
+			{NamespacedName: types.NamespacedName{Namespace: "ns1", Name: "de1"}},
+		}))
+	})
+})
+
+var _ = Describe("Annotation manipulation", func() {
+	owner := types.NamespacedName{Namespace: "ns1", Name: "de1"}
+
+	It("ignores stray whitespace and empty segments when adding", func() {
+		d := withAnnotation(" ns2/de2 ,,")
+		watches.AddToAnnotation(owner, d)
+		Expect(d.GetAnnotations()[watches.NamespacedNameAnnotation]).To(Equal("ns2/de2,ns1/de1"))
+	})
+
+	It("does not add an existing owner twice", func() {
+		d := withAnnotation("ns1/de1 ")
+		watches.AddToAnnotation(owner, d)
+		Expect(d.GetAnnotations()[watches.NamespacedNameAnnotation]).To(Equal("ns1/de1"))
+	})
+
+	It("ignores stray whitespace when removing", func() {
+		d := withAnnotation("ns2/de2, ns1/de1")
+		watches.RemoveFromAnnotation(owner, d)
+		Expect(d.GetAnnotations()[watches.NamespacedNameAnnotation]).To(Equal("ns2/de2"))
+	})
+
+	It("deletes the annotation when removing the only owner", func() {
+		d := withAnnotation("ns1/de1")
+		d.Annotations["other"] = "value"
+		watches.RemoveFromAnnotation(owner, d)
+		Expect(d.GetAnnotations()).NotTo(HaveKey(watches.NamespacedNameAnnotation))
+		Expect(d.GetAnnotations()).To(HaveKeyWithValue("other", "value"))
+	})
+
+	It("keeps the other owners when removing one of several", func() {
+		d := withAnnotation("ns1/de1,ns2/de2,ns3/de3")
+		watches.RemoveFromAnnotation(owner, d)
+		Expect(d.GetAnnotations()[watches.NamespacedNameAnnotation]).To(Equal("ns2/de2,ns3/de3"))
+	})
+
+	It("does not add the annotation when removing from an object without it", func() {
+		d := withAnnotation("")
+		delete(d.Annotations, watches.NamespacedNameAnnotation)
+		watches.RemoveFromAnnotation(owner, d)
+		Expect(d.GetAnnotations()).NotTo(HaveKey(watches.NamespacedNameAnnotation))
+	})
+
+	DescribeTable(
+		"finds owners in loosely formatted annotations",
+		func(value string) {
+			Expect(watches.ContainsAnnotation(owner, withAnnotation(value))).To(BeTrue())
+		},
+		Entry("surrounded by whitespace", "ns2/de2, ns1/de1 "),
+		Entry("trailing comma", "ns1/de1,"),
+		Entry("empty segments in between", "ns2/de2,,ns1/de1"),
+		Entry("whitespace only segments", "ns2/de2, ,ns1/de1"),
+		Entry("duplicate entries", "ns1/de1,ns2/de2, ns1/de1"),
+	)
+
+	It("does not find owners missing from loosely formatted annotations", func() {
+		Expect(watches.ContainsAnnotation(owner, withAnnotation(" , ns2/de2,"))).To(BeFalse())
+	})
+
+	It("returns each owner once", func() {
+		Expect(watches.OwnersOf(withAnnotation("ns1/de1, ns2/de2,ns1/de1,"))).To(Equal([]types.NamespacedName{
+			{Namespace: "ns1", Name: "de1"},
+			{Namespace: "ns2", Name: "de2"},
+		}))
+	})
+
+	It("normalizes the annotation when adding", func() {
+		d := withAnnotation("ns2/de2,ns2/de2, ,")
+		watches.AddToAnnotation(owner, d)
+		Expect(d.GetAnnotations()[watches.NamespacedNameAnnotation]).To(Equal("ns2/de2,ns1/de1"))
+	})
+
+	It("does not count duplicate entries towards the maximum owners", func() {
+		d := withAnnotation("ns2/de2,ns2/de2")
+		Expect(watches.AddToAnnotationChecked(owner, d, 2)).To(Succeed())
+		Expect(d.GetAnnotations()[watches.NamespacedNameAnnotation]).To(Equal("ns2/de2,ns1/de1"))
+	})
+
+	It("removes duplicate entries of the removed owner", func() {
+		d := withAnnotation("ns1/de1,ns2/de2,ns1/de1")
+		watches.RemoveFromAnnotation(owner, d)
+		Expect(d.GetAnnotations()[watches.NamespacedNameAnnotation]).To(Equal("ns2/de2"))
+		Expect(watches.ContainsAnnotation(owner, d)).To(BeFalse())
+	})
+
+	It("refuses to add an owner beyond the maximum and keeps the existing owners", func() {
+		d := withAnnotation("ns2/de2,ns3/de3")
+		err := watches.AddToAnnotationChecked(owner, d, 2)
+		Expect(err).To(MatchError(watches.TooManyOwners{Owner: owner, Max: 2}))
+		Expect(d.GetAnnotations()[watches.NamespacedNameAnnotation]).To(Equal("ns2/de2,ns3/de3"))
+	})
+
+	It("accepts an existing owner even when the maximum is reached", func() {
+		d := withAnnotation("ns2/de2,ns1/de1")
+		Expect(watches.AddToAnnotationChecked(owner, d, 2)).To(Succeed())
+		Expect(d.GetAnnotations()[watches.NamespacedNameAnnotation]).To(Equal("ns2/de2,ns1/de1"))
+	})
+
+	It("does not limit the owners when the maximum is not set", func() {
+		d := withAnnotation("ns2/de2,ns3/de3")
+		Expect(watches.AddToAnnotationChecked(owner, d, 0)).To(Succeed())
+		Expect(d.GetAnnotations()[watches.NamespacedNameAnnotation]).To(Equal("ns2/de2,ns3/de3,ns1/de1"))
+	})
+})
+
+var _ = Describe("OwnersOf", func() {
+	It("parses all the owners", func() {
+		Expect(watches.OwnersOf(withAnnotation("ns1/de1, ns2/de2"))).To(Equal([]types.NamespacedName{
+			{Namespace: "ns1", Name: "de1"},
+			{Namespace: "ns2", Name: "de2"},
+		}))
+	})
+
+	It("skips malformed owners", func() {
+		Expect(watches.OwnersOf(withAnnotation("broken,ns1/de1,/de2"))).To(Equal([]types.NamespacedName{
+			{Namespace: "ns1", Name: "de1"},
+		}))
+	})
+
+	It("returns nothing for objects without annotations", func() {
+		Expect(watches.OwnersOf(&appsv1.Deployment{})).To(BeEmpty())
+	})
+})
+
+var _ = Describe("FilterByOwner", func() {
+	It("returns only the objects owned by the provided owner", func() {
+		owned := withAnnotation("ns2/de2,ns1/de1")
+		notOwned := withAnnotation("ns2/de2")
+		malformed := withAnnotation("ns1de1")
+		result := watches.FilterByOwner([]*appsv1.Deployment{owned, notOwned, malformed}, types.NamespacedName{Namespace: "ns1", Name: "de1"})
+		Expect(result).To(Equal([]*appsv1.Deployment{owned}))
+	})
+})
+
+var _ = Describe("Owner UIDs", func() {
+	owner := types.NamespacedName{Namespace: "ns1", Name: "de1"}
+
+	It("records the UID of each owner", func() {
+		d := withAnnotation("ns1/de1,ns2/de2")
+		watches.AddOwnerUID(owner, "uid1", d)
+		watches.AddOwnerUID(types.NamespacedName{Namespace: "ns2", Name: "de2"}, "uid2", d)
+		Expect(d.GetAnnotations()[watches.OwnerUIDsAnnotation]).To(Equal("ns1/de1=uid1,ns2/de2=uid2"))
+		uid, ok := watches.OwnerUID(owner, d)
+		Expect(ok).To(BeTrue())
+		Expect(uid).To(BeEquivalentTo("uid1"))
+	})
+
+	It("replaces the UID of a recreated owner", func() {
+		d := withAnnotation("ns1/de1")
+		watches.AddOwnerUID(owner, "old", d)
+		watches.AddOwnerUID(owner, "new", d)
+		Expect(d.GetAnnotations()[watches.OwnerUIDsAnnotation]).To(Equal("ns1/de1=new"))
+	})
+
+	It("does not record empty UIDs", func() {
+		d := withAnnotation("ns1/de1")
+		watches.AddOwnerUID(owner, "", d)
+		Expect(d.GetAnnotations()).NotTo(HaveKey(watches.OwnerUIDsAnnotation))
+	})
+
+	It("removes the UID along with the owner", func() {
+		d := withAnnotation("ns1/de1,ns2/de2")
+		watches.AddOwnerUID(owner, "uid1", d)
+		watches.AddOwnerUID(types.NamespacedName{Namespace: "ns2", Name: "de2"}, "uid2", d)
+		watches.RemoveFromAnnotation(owner, d)
+		Expect(d.GetAnnotations()[watches.OwnerUIDsAnnotation]).To(Equal("ns2/de2=uid2"))
+		watches.RemoveFromAnnotation(types.NamespacedName{Namespace: "ns2", Name: "de2"}, d)
+		Expect(d.GetAnnotations()).NotTo(HaveKey(watches.OwnerUIDsAnnotation))
+	})
+
+	It("rejects an owner with the same name but a different UID", func() {
+		d := withAnnotation("ns1/de1")
+		watches.AddOwnerUID(owner, "old", d)
+		Expect(watches.ContainsOwner(owner, "new", d)).To(BeFalse())
+		Expect(watches.ContainsOwner(owner, "old", d)).To(BeTrue())
+		Expect(watches.ContainsAnnotation(owner, d)).To(BeTrue())
+	})
+
+	It("matches owners without a recorded UID by name", func() {
+		d := withAnnotation("ns1/de1")
+		Expect(watches.ContainsOwner(owner, "uid1", d)).To(BeTrue())
+		Expect(watches.ContainsOwner(types.NamespacedName{Namespace: "ns2", Name: "de2"}, "uid1", d)).To(BeFalse())
+	})
+
+	It("filters the objects of the owner with the provided UID", func() {
+		owned := withAnnotation("ns1/de1")
+		watches.AddOwnerUID(owner, "uid1", owned)
+		stale := withAnnotation("ns1/de1")
+		watches.AddOwnerUID(owner, "old", stale)
+		result := watches.FilterByOwnerUID([]*appsv1.Deployment{owned, stale}, owner, "uid1")
+		Expect(result).To(Equal([]*appsv1.Deployment{owned}))
+	})
+})
+
+var _ = Describe("Subset owners", func() {
+	owner := types.NamespacedName{Namespace: "ns1", Name: "de1"}
+	other := types.NamespacedName{Namespace: "ns2", Name: "de2"}
+
+	It("records the owner of each subset in a stable order", func() {
+		d := &appsv1.Deployment{}
+		watches.SetSubsetOwners(d, map[string]types.NamespacedName{"second": other, "first": owner})
+		Expect(d.GetAnnotations()[watches.SubsetOwnersAnnotation]).To(Equal("first=ns1/de1,second=ns2/de2"))
+		Expect(watches.SubsetOwners(d)).To(Equal(map[string]types.NamespacedName{"first": owner, "second": other}))
+	})
+
+	It("skips malformed entries", func() {
+		d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			watches.SubsetOwnersAnnotation: "first=ns1/de1,second,=ns2/de2,third=de3, fourth=ns4/de4",
+		}}}
+		Expect(watches.SubsetOwners(d)).To(Equal(map[string]types.NamespacedName{
+			"first":  owner,
+			"fourth": {Namespace: "ns4", Name: "de4"},
+		}))
+	})
+
+	It("deletes the annotation once there are no subset owners", func() {
+		d := &appsv1.Deployment{}
+		watches.SetSubsetOwners(d, map[string]types.NamespacedName{"first": owner})
+		watches.SetSubsetOwners(d, nil)
+		Expect(d.GetAnnotations()).NotTo(HaveKey(watches.SubsetOwnersAnnotation))
+	})
+})
+
+var _ = Describe("Configured annotation keys", func() {
+	owner := types.NamespacedName{Namespace: "ns1", Name: "de1"}
+	other := types.NamespacedName{Namespace: "ns2", Name: "de2"}
+
+	It("derives the UIDs annotation from the configured key", func() {
+		o, err := watches.NewOwnership("example.com/owners")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(o.NamespacedNameKey()).To(Equal("example.com/owners"))
+		Expect(o.OwnerUIDsKey()).To(Equal("example.com/owners-uids"))
+		Expect(o.SubsetOwnersKey()).To(Equal("example.com/owners-subsets"))
+	})
+
+	It("defaults to the default keys", func() {
+		o := watches.Ownership{}
+		Expect(o.NamespacedNameKey()).To(Equal(names.NamespacedNameAnnotation))
+		Expect(o.OwnerUIDsKey()).To(Equal(watches.OwnerUIDsAnnotation))
+		Expect(o.SubsetOwnersKey()).To(Equal(watches.SubsetOwnersAnnotation))
+	})
+
+	It("rejects invalid keys", func() {
+		_, err := watches.NewOwnership("not a key")
+		Expect(err).To(HaveOccurred())
+		_, err = watches.NewOwnership("")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("keeps the owners of each key independent", func() {
+		d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "deployment", Namespace: "ns"}}
+		first := watches.Ownership{Key: "first.example.com/owners"}
+		second := watches.Ownership{Key: "second.example.com/owners"}
+		first.AddToAnnotation(owner, d)
+		first.AddOwnerUID(owner, "uid1", d)
+		Expect(second.ContainsAnnotation(owner, d)).To(BeFalse())
+		second.AddToAnnotation(other, d)
+		second.RemoveFromAnnotation(owner, d)
+
+		Expect(d.GetAnnotations()).To(Equal(map[string]string{
+			"first.example.com/owners":      "ns1/de1",
+			"first.example.com/owners-uids": "ns1/de1=uid1",
+			"second.example.com/owners":     "ns2/de2",
+		}))
+		Expect(second.OwnersOf(d)).To(Equal([]types.NamespacedName{other}))
+		Expect(first.OwnersOf(d)).To(Equal([]types.NamespacedName{owner}))
+		Expect(first.ContainsOwner(owner, "uid1", d)).To(BeTrue())
+		Expect(watches.OwnersOf(d)).To(BeEmpty())
+	})
+
+	It("enqueues only the owners of the configured key", func() {
+		d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "deployment", Namespace: "ns", Annotations: map[string]string{
+			"first.example.com/owners":  "ns1/de1",
+			"second.example.com/owners": "ns2/de2",
+		}}}
+		for key, expected := range map[string]types.NamespacedName{
+			"first.example.com/owners":  owner,
+			"second.example.com/owners": other,
+		} {
+			q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+			handler := watches.EnqueueRequestForAnnotation{AnnotationKey: key}
+			handler.Create(event.CreateEvent{Object: d}, q)
+			Expect(drainQueue(q)).To(Equal([]reconcile.Request{{NamespacedName: expected}}))
+			q.ShutDown()
+		}
+	})
+})
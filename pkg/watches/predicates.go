@@ -0,0 +1,56 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watches
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// OwnedResourceChangedPredicate filters update events of owned resources (e.g. DestinationRules,
+// Deployments) to the ones that are meaningful to the owning DynamicEnv: the spec was changed (the
+// generation was bumped) or the owners in NamespacedNameAnnotation were changed. Status and other
+// metadata updates are dropped (including changes to the ownership annotations of other operator
+// instances). Create, Delete and Generic events always pass.
+//
+// Use it alongside EnqueueRequestForAnnotation when building the controller:
+//
+//	Watches(&source.Kind{Type: &appsv1.Deployment{}}, &watches.EnqueueRequestForAnnotation{},
+//		builder.WithPredicates(watches.OwnedResourceChangedPredicate{}))
+type OwnedResourceChangedPredicate struct {
+	predicate.Funcs
+	// The ownership annotation key (defaults to NamespacedNameAnnotation)
+	AnnotationKey string
+}
+
+var _ predicate.Predicate = OwnedResourceChangedPredicate{}
+
+// Update implements the default UpdateEvent filter for owned resources.
+func (p OwnedResourceChangedPredicate) Update(e event.UpdateEvent) bool {
+	if e.ObjectOld == nil || e.ObjectNew == nil {
+		return false
+	}
+	key := Ownership{Key: p.AnnotationKey}.NamespacedNameKey()
+	if e.ObjectOld.GetAnnotations()[key] != e.ObjectNew.GetAnnotations()[key] {
+		return true
+	}
+	if e.ObjectNew.GetGeneration() == 0 {
+		// The resource does not track generations, we can only tell whether anything was changed.
+		return e.ObjectOld.GetResourceVersion() != e.ObjectNew.GetResourceVersion()
+	}
+	return e.ObjectOld.GetGeneration() != e.ObjectNew.GetGeneration()
+}
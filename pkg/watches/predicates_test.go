@@ -0,0 +1,66 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watches_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/riskified/dynamic-environment/pkg/watches"
+	appsv1 "k8s.io/api/apps/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+var _ = Describe("OwnedResourceChangedPredicate", func() {
+	mkDeployment := func(generation int64, resourceVersion, owners string) *appsv1.Deployment {
+		d := withAnnotation(owners)
+		d.Generation = generation
+		d.ResourceVersion = resourceVersion
+		return d
+	}
+
+	DescribeTable(
+		"filters update events",
+		func(old, new *appsv1.Deployment, expected bool) {
+			p := watches.OwnedResourceChangedPredicate{}
+			Expect(p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: new})).To(Equal(expected))
+		},
+		Entry("status or metadata only update",
+			mkDeployment(1, "100", "ns/de"), mkDeployment(1, "101", "ns/de"), false),
+		Entry("spec update",
+			mkDeployment(1, "100", "ns/de"), mkDeployment(2, "101", "ns/de"), true),
+		Entry("owners update",
+			mkDeployment(1, "100", "ns/de"), mkDeployment(1, "101", "ns/de,ns/other"), true),
+		Entry("update of a resource without generation",
+			mkDeployment(0, "100", "ns/de"), mkDeployment(0, "101", "ns/de"), true),
+		Entry("resync of a resource without generation",
+			mkDeployment(0, "100", "ns/de"), mkDeployment(0, "100", "ns/de"), false),
+	)
+
+	It("ignores changes to the ownership annotation of another instance", func() {
+		p := watches.OwnedResourceChangedPredicate{AnnotationKey: "tenant.example.com/owners"}
+		old, new := mkDeployment(1, "100", "ns/de"), mkDeployment(1, "101", "ns/de,ns/other")
+		Expect(p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: new})).To(BeFalse())
+		new.Annotations["tenant.example.com/owners"] = "ns/tenant"
+		Expect(p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: new})).To(BeTrue())
+	})
+
+	It("passes create and delete events", func() {
+		p := watches.OwnedResourceChangedPredicate{}
+		Expect(p.Create(event.CreateEvent{Object: mkDeployment(1, "1", "ns/de")})).To(BeTrue())
+		Expect(p.Delete(event.DeleteEvent{Object: mkDeployment(1, "1", "ns/de")})).To(BeTrue())
+	})
+})
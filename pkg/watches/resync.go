@@ -0,0 +1,110 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watches
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// DefaultResyncPeriod is the default interval between relists of the annotated resources.
+const DefaultResyncPeriod = 10 * time.Minute
+
+// AnnotationResync periodically relists the annotated resources and emits a generic event for each
+// of them. Combined with `EnqueueRequestForAnnotation` (see `Source`) this re-enqueues all the
+// dynamic environments referenced by existing annotations, so state whose watch events were lost
+// is eventually reconciled. It should be added to the manager (it implements `manager.Runnable`).
+type AnnotationResync struct {
+	// The ownership annotation key (defaults to NamespacedNameAnnotation)
+	AnnotationKey string
+
+	client client.Reader
+	period time.Duration
+	// Creates an empty list for each of the kinds to relist
+	newLists []func() client.ObjectList
+	events   chan event.GenericEvent
+}
+
+// NewAnnotationResync creates a resync of the kinds created by `newLists` every `period` (falls
+// back to DefaultResyncPeriod if not positive). The reader should not be backed by the informer
+// cache (e.g. the API reader of the manager): relisting the cache only re-enqueues the owners of
+// the cached resources, which misses the resources whose watch events were lost.
+func NewAnnotationResync(c client.Reader, period time.Duration, newLists ...func() client.ObjectList) *AnnotationResync {
+	if period <= 0 {
+		period = DefaultResyncPeriod
+	}
+	return &AnnotationResync{
+		client:   c,
+		period:   period,
+		newLists: newLists,
+		events:   make(chan event.GenericEvent),
+	}
+}
+
+// Source returns the source of the resync events (to be watched with `EnqueueRequestForAnnotation`).
+func (r *AnnotationResync) Source() source.Source {
+	return &source.Channel{Source: r.events}
+}
+
+// Start relists the resources every period until the context is done.
+func (r *AnnotationResync) Start(ctx context.Context) error {
+	ticker := time.NewTicker(r.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.Resync(ctx); err != nil {
+				log.Error(err, "Resyncing annotated resources")
+			}
+		}
+	}
+}
+
+// Resync lists all the resources of the configured kinds once and emits an event for each resource
+// that has owners. Blocks until the events are consumed (or the context is done).
+func (r *AnnotationResync) Resync(ctx context.Context) error {
+	for _, newList := range r.newLists {
+		list := newList()
+		if err := r.client.List(ctx, list); err != nil {
+			return fmt.Errorf("listing %T for resync: %w", list, err)
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return fmt.Errorf("extracting %T items for resync: %w", list, err)
+		}
+		for _, item := range items {
+			obj, ok := item.(client.Object)
+			if !ok || len(Ownership{Key: r.AnnotationKey}.OwnersOf(obj)) == 0 {
+				continue
+			}
+			select {
+			case r.events <- event.GenericEvent{Object: obj}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watches_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/riskified/dynamic-environment/pkg/watches"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var _ = Describe("AnnotationResync", func() {
+	newDeploymentList := func() client.ObjectList { return &appsv1.DeploymentList{} }
+	mkClient := func() client.Client {
+		owned := withAnnotation("ns/first,other/second")
+		unowned := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "unowned", Namespace: "ns"}}
+		return fake.NewClientBuilder().WithObjects(owned, unowned).Build()
+	}
+	events := func(r *watches.AnnotationResync) <-chan event.GenericEvent {
+		return r.Source().(*source.Channel).Source
+	}
+
+	It("enqueues the owners of all the annotated resources", func() {
+		resync := watches.NewAnnotationResync(mkClient(), time.Hour, newDeploymentList)
+		done := make(chan error)
+		go func() { done <- resync.Resync(context.Background()) }()
+
+		q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		defer q.ShutDown()
+		handler := watches.EnqueueRequestForAnnotation{}
+		var err error
+	loop:
+		for {
+			select {
+			case evt := <-events(resync):
+				handler.Generic(evt, q)
+			case err = <-done:
+				break loop
+			}
+		}
+		Expect(err).To(BeNil())
+		var owners []types.NamespacedName
+		for _, r := range drainQueue(q) {
+			owners = append(owners, r.NamespacedName)
+		}
+		Expect(owners).To(ConsistOf(
+			types.NamespacedName{Namespace: "ns", Name: "first"},
+			types.NamespacedName{Namespace: "other", Name: "second"},
+		))
+	})
+
+	It("resyncs periodically until stopped", func() {
+		resync := watches.NewAnnotationResync(mkClient(), 10*time.Millisecond, newDeploymentList)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- resync.Start(ctx) }()
+		for i := 0; i < 2; i++ {
+			Eventually(events(resync)).Should(Receive(HaveField("Object.GetName()", "deployment")))
+		}
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+})
@@ -0,0 +1,155 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watches
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// ReconcileTriggerPath is the path of the debug endpoint triggering reconciles (see
+// `ReconcileTrigger.Handler`).
+const ReconcileTriggerPath = "/debug/reconcile"
+
+// DefaultTriggerTimeout is the default time the debug endpoint waits for the triggered reconcile.
+const DefaultTriggerTimeout = 30 * time.Second
+
+// StatusFunc returns the (JSON serializable) status of the provided dynamic environment.
+type StatusFunc func(ctx context.Context, key types.NamespacedName) (interface{}, error)
+
+// ReconcileTrigger enqueues reconciles of specific dynamic environments on demand (e.g. for
+// debugging, without waiting for events). Its `Source` should be watched with
+// `handler.EnqueueRequestForObject` and the reconciler should report the completed reconciles with
+// `Done`.
+type ReconcileTrigger struct {
+	events chan event.GenericEvent
+
+	mu      sync.Mutex
+	waiters map[types.NamespacedName][]chan struct{}
+}
+
+func NewReconcileTrigger() *ReconcileTrigger {
+	return &ReconcileTrigger{
+		events:  make(chan event.GenericEvent),
+		waiters: map[types.NamespacedName][]chan struct{}{},
+	}
+}
+
+// Source returns the source of the triggered events.
+func (t *ReconcileTrigger) Source() source.Source {
+	return &source.Channel{Source: t.events}
+}
+
+// Trigger enqueues a reconcile of the provided dynamic environment. The returned channel is closed
+// once the next reconcile of it is done. Blocks until the event is consumed (or the context is
+// done).
+func (t *ReconcileTrigger) Trigger(ctx context.Context, key types.NamespacedName) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	t.mu.Lock()
+	t.waiters[key] = append(t.waiters[key], done)
+	t.mu.Unlock()
+	object := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+	select {
+	case t.events <- event.GenericEvent{Object: object}:
+		return done, nil
+	case <-ctx.Done():
+		t.removeWaiter(key, done)
+		return nil, fmt.Errorf("enqueueing reconcile of %s: %w", key, ctx.Err())
+	}
+}
+
+// Done reports that a reconcile of the provided dynamic environment is done.
+func (t *ReconcileTrigger) Done(key types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, done := range t.waiters[key] {
+		close(done)
+	}
+	delete(t.waiters, key)
+}
+
+func (t *ReconcileTrigger) removeWaiter(key types.NamespacedName, done chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var remaining []chan struct{}
+	for _, w := range t.waiters[key] {
+		if w != done {
+			remaining = append(remaining, w)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(t.waiters, key)
+	} else {
+		t.waiters[key] = remaining
+	}
+}
+
+// Handler returns the debug endpoint triggering reconciles: a POST with the `dynamicenv` query
+// parameter (`<namespace>/<name>`) enqueues a reconcile of it and waits (up to `timeout`, defaults
+// to DefaultTriggerTimeout) for it to complete. Responds with the resulting status (or with the
+// current one and 202 Accepted if the reconcile did not complete in time).
+func (t *ReconcileTrigger) Handler(status StatusFunc, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		timeout = DefaultTriggerTimeout
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		param := r.URL.Query().Get("dynamicenv")
+		namespace, name, ok := strings.Cut(param, "/")
+		if !ok || namespace == "" || name == "" {
+			http.Error(w, fmt.Sprintf("expected dynamicenv=<namespace>/<name>, got %q", param), http.StatusBadRequest)
+			return
+		}
+		key := types.NamespacedName{Namespace: namespace, Name: name}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		done, err := t.Trigger(ctx, key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		code := http.StatusOK
+		select {
+		case <-done:
+		case <-ctx.Done():
+			code = http.StatusAccepted
+		}
+		result, err := status(r.Context(), key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("reading the status of %s: %s", key, err), http.StatusInternalServerError)
+			return
+		}
+		log.Info("Triggered reconcile", "owner", key, "completed", code == http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(result)
+	})
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2023 Riskified Ltd
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watches_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/riskified/dynamic-environment/pkg/watches"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var _ = Describe("ReconcileTrigger", func() {
+	key := types.NamespacedName{Namespace: "ns", Name: "de"}
+	status := func(_ context.Context, key types.NamespacedName) (interface{}, error) {
+		return map[string]string{"state": "ready", "name": key.String()}, nil
+	}
+
+	// Enqueues the triggered events like the controller would, optionally reporting the reconciles as
+	// done.
+	consume := func(trigger *watches.ReconcileTrigger, q workqueue.RateLimitingInterface, reconcile bool) context.CancelFunc {
+		ctx, cancel := context.WithCancel(context.Background())
+		events := trigger.Source().(*source.Channel).Source
+		go func() {
+			for {
+				select {
+				case evt := <-events:
+					(&handler.EnqueueRequestForObject{}).Generic(evt, q)
+					if reconcile {
+						trigger.Done(types.NamespacedName{Namespace: evt.Object.GetNamespace(), Name: evt.Object.GetName()})
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return cancel
+	}
+	post := func(h http.Handler, query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, watches.ReconcileTriggerPath+query, nil))
+		return rec
+	}
+
+	It("enqueues the requested dynamic environment and responds with its status", func() {
+		trigger := watches.NewReconcileTrigger()
+		q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		defer q.ShutDown()
+		defer consume(trigger, q, true)()
+
+		rec := post(trigger.Handler(status, time.Second), "?dynamicenv=ns/de")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(MatchJSON(`{"state": "ready", "name": "ns/de"}`))
+		Expect(drainQueue(q)).To(Equal([]reconcile.Request{{NamespacedName: key}}))
+	})
+
+	It("responds with the current status if the reconcile did not complete in time", func() {
+		trigger := watches.NewReconcileTrigger()
+		q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		defer q.ShutDown()
+		defer consume(trigger, q, false)()
+
+		rec := post(trigger.Handler(status, 50*time.Millisecond), "?dynamicenv=ns/de")
+		Expect(rec.Code).To(Equal(http.StatusAccepted))
+		Expect(rec.Body.String()).To(MatchJSON(`{"state": "ready", "name": "ns/de"}`))
+		Expect(drainQueue(q)).To(Equal([]reconcile.Request{{NamespacedName: key}}))
+	})
+
+	It("fails if the controller does not consume the trigger", func() {
+		trigger := watches.NewReconcileTrigger()
+		rec := post(trigger.Handler(status, 50*time.Millisecond), "?dynamicenv=ns/de")
+		Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	DescribeTable(
+		"rejects malformed requests",
+		func(method, query string, code int) {
+			trigger := watches.NewReconcileTrigger()
+			rec := httptest.NewRecorder()
+			trigger.Handler(status, time.Second).ServeHTTP(rec, httptest.NewRequest(method, watches.ReconcileTriggerPath+query, nil))
+			Expect(rec.Code).To(Equal(code))
+		},
+		Entry("GET request", http.MethodGet, "?dynamicenv=ns/de", http.StatusMethodNotAllowed),
+		Entry("missing dynamic environment", http.MethodPost, "", http.StatusBadRequest),
+		Entry("missing namespace", http.MethodPost, "?dynamicenv=de", http.StatusBadRequest),
+		Entry("empty name", http.MethodPost, "?dynamicenv=ns/", http.StatusBadRequest),
+	)
+
+	It("fails if the status could not be read", func() {
+		trigger := watches.NewReconcileTrigger()
+		q := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		defer q.ShutDown()
+		defer consume(trigger, q, true)()
+		failing := func(context.Context, types.NamespacedName) (interface{}, error) {
+			return nil, fmt.Errorf("not found")
+		}
+		rec := post(trigger.Handler(failing, time.Second), "?dynamicenv=ns/de")
+		Expect(rec.Code).To(Equal(http.StatusInternalServerError))
+		Expect(rec.Body.String()).To(ContainSubstring("reading the status of ns/de: not found"))
+	})
+
+	It("releases the waiters of a dynamic environment once its reconcile is done", func() {
+		trigger := watches.NewReconcileTrigger()
+		events := trigger.Source().(*source.Channel).Source
+		go func() { <-events }()
+		done, err := trigger.Trigger(context.Background(), key)
+		Expect(err).To(BeNil())
+		trigger.Done(types.NamespacedName{Namespace: "ns", Name: "other"})
+		Consistently(done).ShouldNot(BeClosed())
+		trigger.Done(key)
+		Eventually(done).Should(BeClosed())
+	})
+})